@@ -1,16 +1,22 @@
 package config
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"flag"
 	"fmt"
 	"github.com/emvi/logbuch"
-	"github.com/gorilla/securecookie"
 	"github.com/jinzhu/configor"
 	"github.com/muety/broilerplate/models"
 	"gorm.io/gorm"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
+	"time"
 )
 
 const (
@@ -22,6 +28,9 @@ const (
 
 	ErrUnauthorized        = "401 unauthorized"
 	ErrBadRequest          = "400 bad request"
+	ErrForbidden           = "403 forbidden"
+	ErrNotFound            = "404 not found"
+	ErrConflict            = "409 conflict"
 	ErrInternalServerError = "500 internal server error"
 
 	SimpleDateFormat     = "2006-01-02"
@@ -29,6 +38,15 @@ const (
 
 	MailProviderSmtp      = "smtp"
 	MailProviderMailWhale = "mailwhale"
+
+	ThrottleStoreMemory = "memory"
+	ThrottleStoreDb     = "db"
+
+	ClientCertMappingFingerprint = "fingerprint"
+	ClientCertMappingSubject     = "subject"
+	ClientCertMappingEmail       = "email"
+
+	ErrTooManyRequests = "429 too many requests"
 )
 
 var emailProviders = []string{
@@ -41,17 +59,111 @@ var cFlag = flag.String("config", defaultConfigPath, "config file location")
 var env string
 
 type appConfig struct {
+	Name              string `yaml:"name" default:"Broilerplate" env:"BROILERPLATE_APP_NAME"`
 	AvatarURLTemplate string `yaml:"avatar_url_template" default:"https://avatars.dicebear.com/api/pixel-art-neutral/{username_hash}.svg"`
 }
 
 type securityConfig struct {
 	AllowSignup   bool `yaml:"allow_signup" default:"true" env:"BROILERPLATE_ALLOW_SIGNUP"`
 	ExposeMetrics bool `yaml:"expose_metrics" default:"false" env:"BROILERPLATE_EXPOSE_METRICS"`
+	// time for which invitations can be used to sign up, also while open registration is disabled
+	InvitationTtlSec int `yaml:"invitation_ttl_sec" default:"604800" env:"BROILERPLATE_INVITATION_TTL_SEC"`
+	// time for which password reset links can be used
+	PasswordResetTtlSec int `yaml:"password_reset_ttl_sec" default:"3600" env:"BROILERPLATE_PASSWORD_RESET_TTL_SEC"`
+	// whether users can log in through a link mailed to their verified e-mail address instead of entering their password
+	MagicLinkLogin  bool `yaml:"magic_link_login" default:"false" env:"BROILERPLATE_MAGIC_LINK_LOGIN"`
+	MagicLinkTtlSec int  `yaml:"magic_link_ttl_sec" default:"900" env:"BROILERPLATE_MAGIC_LINK_TTL_SEC"`
+	// time after which accounts are actually deleted when their owners asked for it, logging in again in the meantime cancels the deletion
+	AccountDeletionGraceSec int `yaml:"account_deletion_grace_sec" default:"0" env:"BROILERPLATE_ACCOUNT_DELETION_GRACE_SEC"`
+	// time for which audit log entries are kept, 0 to keep them forever
+	AuditRetentionDays int `yaml:"audit_retention_days" default:"365" env:"BROILERPLATE_AUDIT_RETENTION_DAYS"`
+	// whether users have to confirm their e-mail address before being able to log in
+	RequireEmailVerification bool `yaml:"require_email_verification" default:"false" env:"BROILERPLATE_REQUIRE_EMAIL_VERIFICATION"`
 	// this is actually a pepper (https://en.wikipedia.org/wiki/Pepper_(cryptography))
-	PasswordSalt    string                     `yaml:"password_salt" default:"" env:"BROILERPLATE_PASSWORD_SALT"`
-	InsecureCookies bool                       `yaml:"insecure_cookies" default:"false" env:"BROILERPLATE_INSECURE_COOKIES"`
-	CookieMaxAgeSec int                        `yaml:"cookie_max_age" default:"172800" env:"BROILERPLATE_COOKIE_MAX_AGE"`
-	SecureCookie    *securecookie.SecureCookie `yaml:"-"`
+	PasswordSalt    string `yaml:"password_salt" default:"" env:"BROILERPLATE_PASSWORD_SALT"`
+	InsecureCookies bool   `yaml:"insecure_cookies" default:"false" env:"BROILERPLATE_INSECURE_COOKIES"`
+	CookieMaxAgeSec int    `yaml:"cookie_max_age" default:"172800" env:"BROILERPLATE_COOKIE_MAX_AGE"`
+	CookieHashKey   string `yaml:"cookie_hash_key" default:"" env:"BROILERPLATE_COOKIE_HASH_KEY"`
+	CookieBlockKey  string `yaml:"cookie_block_key" default:"" env:"BROILERPLATE_COOKIE_BLOCK_KEY"`
+	CookieKeysFile  string `yaml:"cookie_keys_file" default:"" env:"BROILERPLATE_COOKIE_KEYS_FILE"`
+	// time for which retired cookie keys are still accepted for decoding after a key rotation
+	CookieKeyGraceSec int            `yaml:"cookie_key_grace_sec" default:"172800" env:"BROILERPLATE_COOKIE_KEY_GRACE_SEC"`
+	SecureCookie      *CookieKeyRing `yaml:"-"`
+	// key to encrypt secrets at rest (e.g. totp secrets) with
+	EncryptionKey      string `yaml:"encryption_key" default:"" env:"BROILERPLATE_ENCRYPTION_KEY"`
+	EncryptionKeyBytes []byte `yaml:"-"`
+	TotpIssuer         string `yaml:"totp_issuer" default:"Broilerplate" env:"BROILERPLATE_TOTP_ISSUER"`
+	// openid connect identity providers to offer single sign-on with
+	Oidc []OidcProviderConfig `yaml:"oidc"`
+	// directory to check passwords against in addition to local accounts
+	Ldap LdapConfig `yaml:"ldap"`
+	// protection against password guessing and mail flooding
+	Throttle ThrottleConfig `yaml:"throttle"`
+	// lets third-party apps act on behalf of users via oauth 2.0
+	OAuthServer OAuthServerConfig `yaml:"oauth_server"`
+}
+
+type ThrottleConfig struct {
+	Enabled bool `default:"true" env:"BROILERPLATE_THROTTLE_ENABLED"`
+	// where to keep track of failed attempts, one of ['memory', 'db'] (the latter is required when running multiple instances)
+	Store string `default:"memory" env:"BROILERPLATE_THROTTLE_STORE"`
+	// number of failures per client ip or username that are tolerated before delays start to apply
+	FreeAttempts int `yaml:"free_attempts" default:"3" env:"BROILERPLATE_THROTTLE_FREE_ATTEMPTS"`
+	// initial delay, which doubles with every further failure
+	BaseDelaySec int `yaml:"base_delay_sec" default:"1" env:"BROILERPLATE_THROTTLE_BASE_DELAY_SEC"`
+	MaxDelaySec  int `yaml:"max_delay_sec" default:"300" env:"BROILERPLATE_THROTTLE_MAX_DELAY_SEC"`
+	// number of failed logins after which an account is locked and its owner is notified
+	LockoutThreshold   int `yaml:"lockout_threshold" default:"10" env:"BROILERPLATE_THROTTLE_LOCKOUT_THRESHOLD"`
+	LockoutDurationSec int `yaml:"lockout_duration_sec" default:"900" env:"BROILERPLATE_THROTTLE_LOCKOUT_DURATION_SEC"`
+	// time without any failure after which counters are reset
+	WindowSec int `yaml:"window_sec" default:"3600" env:"BROILERPLATE_THROTTLE_WINDOW_SEC"`
+}
+
+type OAuthServerConfig struct {
+	Enabled            bool `default:"false" env:"BROILERPLATE_OAUTH_SERVER_ENABLED"`
+	AccessTokenTtlSec  int  `yaml:"access_token_ttl_sec" default:"3600" env:"BROILERPLATE_OAUTH_SERVER_ACCESS_TOKEN_TTL_SEC"`
+	RefreshTokenTtlSec int  `yaml:"refresh_token_ttl_sec" default:"2592000" env:"BROILERPLATE_OAUTH_SERVER_REFRESH_TOKEN_TTL_SEC"`
+}
+
+type OidcProviderConfig struct {
+	Name          string   `yaml:"name"` // used in urls, e.g. /login/oidc/{name}
+	DisplayName   string   `yaml:"display_name"`
+	Issuer        string   `yaml:"issuer"`
+	ClientId      string   `yaml:"client_id"`
+	ClientSecret  string   `yaml:"client_secret"`
+	Scopes        []string `yaml:"scopes"`
+	UsernameClaim string   `yaml:"username_claim"`
+	EmailClaim    string   `yaml:"email_claim"`
+	GroupsClaim   string   `yaml:"groups_claim"`
+	// members of this group are granted admin rights, leave blank to not manage admin rights via sso
+	AdminGroup string `yaml:"admin_group"`
+	// create accounts for unknown users even if registration is disabled, i.e. trust everyone the identity provider lets in
+	AutoProvision bool `yaml:"auto_provision"`
+}
+
+type LdapConfig struct {
+	Enabled bool   `default:"false" env:"BROILERPLATE_LDAP_ENABLED"`
+	Url     string `env:"BROILERPLATE_LDAP_URL"` // e.g. ldaps://ldap.example.org:636 or ldap://ldap.example.org:389
+	// upgrade plain ldap:// connections using starttls
+	StartTls bool `yaml:"start_tls" default:"false" env:"BROILERPLATE_LDAP_START_TLS"`
+	// pem file with the certificate authority to verify the directory server with, leave blank to use the system's ones
+	CaCertPath         string         `yaml:"ca_cert_path" env:"BROILERPLATE_LDAP_CA_CERT_PATH"`
+	InsecureSkipVerify bool           `yaml:"insecure_skip_verify" default:"false" env:"BROILERPLATE_LDAP_INSECURE_SKIP_VERIFY"`
+	CaCertPool         *x509.CertPool `yaml:"-"`
+	// service account to search for users with, leave blank to search anonymously
+	BindDn       string `yaml:"bind_dn" env:"BROILERPLATE_LDAP_BIND_DN"`
+	BindPassword string `yaml:"bind_password" env:"BROILERPLATE_LDAP_BIND_PASSWORD"`
+	BaseDn       string `yaml:"base_dn" env:"BROILERPLATE_LDAP_BASE_DN"`
+	// {username} is replaced with the (escaped) name entered on the login page
+	UserFilter        string `yaml:"user_filter" default:"(&(objectClass=person)(uid={username}))" env:"BROILERPLATE_LDAP_USER_FILTER"`
+	UsernameAttribute string `yaml:"username_attribute" default:"uid" env:"BROILERPLATE_LDAP_USERNAME_ATTRIBUTE"`
+	EmailAttribute    string `yaml:"email_attribute" default:"mail" env:"BROILERPLATE_LDAP_EMAIL_ATTRIBUTE"`
+	GroupAttribute    string `yaml:"group_attribute" default:"memberOf" env:"BROILERPLATE_LDAP_GROUP_ATTRIBUTE"`
+	// dn of the group whose members are granted admin rights, leave blank to not manage admin rights via ldap
+	AdminGroup string `yaml:"admin_group" env:"BROILERPLATE_LDAP_ADMIN_GROUP"`
+	TimeoutSec int    `yaml:"timeout_sec" default:"10" env:"BROILERPLATE_LDAP_TIMEOUT_SEC"`
+	// create accounts for directory users even if registration is disabled
+	AutoProvision bool `yaml:"auto_provision" default:"false" env:"BROILERPLATE_LDAP_AUTO_PROVISION"`
 }
 
 type dbConfig struct {
@@ -78,6 +190,19 @@ type serverConfig struct {
 	PublicUrl    string `yaml:"public_url" default:"http://localhost:3000" env:"BROILERPLATE_PUBLIC_URL"`
 	TlsCertPath  string `yaml:"tls_cert_path" default:"" env:"BROILERPLATE_TLS_CERT_PATH"`
 	TlsKeyPath   string `yaml:"tls_key_path" default:"" env:"BROILERPLATE_TLS_KEY_PATH"`
+	// pem bundle of the certificate authorities to verify client certificates with, which are then requested, but not required
+	TlsClientCaPath string `yaml:"tls_client_ca_path" default:"" env:"BROILERPLATE_TLS_CLIENT_CA_PATH"`
+	// how verified client certificates map to users besides registered fingerprints, one of ['fingerprint', 'subject', 'email']
+	ClientCertMapping string         `yaml:"client_cert_mapping" default:"fingerprint" env:"BROILERPLATE_CLIENT_CERT_MAPPING"`
+	ClientCaPool      *x509.CertPool `yaml:"-"`
+	// cidrs (or single addresses) of reverse proxies to take the client ip from forwarding headers or proxy protocol headers of
+	TrustedProxies   []string     `yaml:"trusted_proxies" env:"BROILERPLATE_TRUSTED_PROXIES"`
+	ProxyProtocol    bool         `yaml:"proxy_protocol" default:"false" env:"BROILERPLATE_PROXY_PROTOCOL"`
+	TrustedProxyNets []*net.IPNet `yaml:"-"`
+	// time to wait for in-flight requests and background work (e.g. sending mails) on shutdown, before cutting them off
+	ShutdownTimeoutSec int `yaml:"shutdown_timeout_sec" default:"30" env:"BROILERPLATE_SHUTDOWN_TIMEOUT_SEC"`
+	// time to keep serving after reporting not to be ready on shutdown, to let load balancers take the instance out of rotation first
+	ShutdownDelaySec int `yaml:"shutdown_delay_sec" default:"0" env:"BROILERPLATE_SHUTDOWN_DELAY_SEC"`
 }
 
 type mailConfig struct {
@@ -117,6 +242,17 @@ func (c *Config) CreateCookie(name, value, path string) *http.Cookie {
 	return c.createCookie(name, value, path, c.Security.CookieMaxAgeSec)
 }
 
+func (c *Config) CreateCookieWithMaxAge(name, value, path string, maxAge int) *http.Cookie {
+	return c.createCookie(name, value, path, maxAge)
+}
+
+// CreateLaxCookieWithMaxAge creates a cookie that is also sent along with cross-site top-level navigations, e.g. when being redirected back from an identity provider
+func (c *Config) CreateLaxCookieWithMaxAge(name, value, path string, maxAge int) *http.Cookie {
+	cookie := c.createCookie(name, value, path, maxAge)
+	cookie.SameSite = http.SameSiteLaxMode
+	return cookie
+}
+
 func (c *Config) GetClearCookie(name, path string) *http.Cookie {
 	return c.createCookie(name, "", path, -1)
 }
@@ -141,6 +277,20 @@ func (c *Config) UseTLS() bool {
 	return c.Server.TlsCertPath != "" && c.Server.TlsKeyPath != ""
 }
 
+func (c *Config) UseClientCerts() bool {
+	return c.UseTLS() && c.Server.ClientCaPool != nil
+}
+
+// GetTLSConfig returns the server's tls settings, which include verifying client certificates if a client ca is configured
+func (c *serverConfig) GetTLSConfig() *tls.Config {
+	tlsConfig := &tls.Config{}
+	if c.ClientCaPool != nil {
+		tlsConfig.ClientCAs = c.ClientCaPool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tlsConfig
+}
+
 func (c *Config) GetMigrationFunc(dbDialect string) models.MigrationFunc {
 	switch dbDialect {
 	default:
@@ -151,11 +301,124 @@ func (c *Config) GetMigrationFunc(dbDialect string) models.MigrationFunc {
 			if err := db.AutoMigrate(&models.KeyStringValue{}); err != nil && !c.Db.AutoMigrateFailSilently {
 				return err
 			}
+			if err := db.AutoMigrate(&models.Session{}); err != nil && !c.Db.AutoMigrateFailSilently {
+				return err
+			}
+			if err := db.AutoMigrate(&models.RecoveryCode{}); err != nil && !c.Db.AutoMigrateFailSilently {
+				return err
+			}
+			if err := db.AutoMigrate(&models.WebauthnCredential{}); err != nil && !c.Db.AutoMigrateFailSilently {
+				return err
+			}
+			if err := db.AutoMigrate(&models.WebauthnSession{}); err != nil && !c.Db.AutoMigrateFailSilently {
+				return err
+			}
+			if err := db.AutoMigrate(&models.OidcIdentity{}); err != nil && !c.Db.AutoMigrateFailSilently {
+				return err
+			}
+			if err := db.AutoMigrate(&models.ApiToken{}); err != nil && !c.Db.AutoMigrateFailSilently {
+				return err
+			}
+			if err := db.AutoMigrate(&models.EmailVerification{}); err != nil && !c.Db.AutoMigrateFailSilently {
+				return err
+			}
+			if err := db.AutoMigrate(&models.MagicLink{}); err != nil && !c.Db.AutoMigrateFailSilently {
+				return err
+			}
+			if err := db.AutoMigrate(&models.ClientCertificate{}); err != nil && !c.Db.AutoMigrateFailSilently {
+				return err
+			}
+			if err := db.AutoMigrate(&models.OAuthClient{}); err != nil && !c.Db.AutoMigrateFailSilently {
+				return err
+			}
+			if err := db.AutoMigrate(&models.OAuthGrant{}); err != nil && !c.Db.AutoMigrateFailSilently {
+				return err
+			}
+			if err := db.AutoMigrate(&models.OAuthAuthorizationCode{}); err != nil && !c.Db.AutoMigrateFailSilently {
+				return err
+			}
+			if err := db.AutoMigrate(&models.OAuthToken{}); err != nil && !c.Db.AutoMigrateFailSilently {
+				return err
+			}
+			if err := db.AutoMigrate(&models.KnownDevice{}); err != nil && !c.Db.AutoMigrateFailSilently {
+				return err
+			}
+			if err := db.AutoMigrate(&models.AuditEvent{}); err != nil && !c.Db.AutoMigrateFailSilently {
+				return err
+			}
+			if err := db.AutoMigrate(&models.Invitation{}); err != nil && !c.Db.AutoMigrateFailSilently {
+				return err
+			}
+			if err := db.AutoMigrate(&models.ThrottleEntry{}); err != nil && !c.Db.AutoMigrateFailSilently {
+				return err
+			}
+			if err := db.AutoMigrate(&models.Permission{}); err != nil && !c.Db.AutoMigrateFailSilently {
+				return err
+			}
+			if err := db.AutoMigrate(&models.Role{}); err != nil && !c.Db.AutoMigrateFailSilently {
+				return err
+			}
+			if err := db.AutoMigrate(&models.UserRole{}); err != nil && !c.Db.AutoMigrateFailSilently {
+				return err
+			}
+			if err := db.AutoMigrate(&models.Organization{}); err != nil && !c.Db.AutoMigrateFailSilently {
+				return err
+			}
+			if err := db.AutoMigrate(&models.Membership{}); err != nil && !c.Db.AutoMigrateFailSilently {
+				return err
+			}
+			if err := db.AutoMigrate(&models.OrganizationInvitation{}); err != nil && !c.Db.AutoMigrateFailSilently {
+				return err
+			}
 			return nil
 		}
 	}
 }
 
+func (c *securityConfig) HasStaticCookieKeys() bool {
+	return c.CookieHashKey != "" && c.CookieBlockKey != ""
+}
+
+func (c *securityConfig) GetCookieKeyGracePeriod() time.Duration {
+	return time.Duration(c.CookieKeyGraceSec) * time.Second
+}
+
+func (c *securityConfig) GetInvitationTtl() time.Duration {
+	return time.Duration(c.InvitationTtlSec) * time.Second
+}
+
+func (c *securityConfig) GetPasswordResetTtl() time.Duration {
+	return time.Duration(c.PasswordResetTtlSec) * time.Second
+}
+
+func (c *securityConfig) GetMagicLinkTtl() time.Duration {
+	return time.Duration(c.MagicLinkTtlSec) * time.Second
+}
+
+func (c *securityConfig) GetAuditRetention() time.Duration {
+	return time.Duration(c.AuditRetentionDays) * 24 * time.Hour
+}
+
+func (c *securityConfig) GetAccountDeletionGracePeriod() time.Duration {
+	return time.Duration(c.AccountDeletionGraceSec) * time.Second
+}
+
+func (c *ThrottleConfig) GetBaseDelay() time.Duration {
+	return time.Duration(c.BaseDelaySec) * time.Second
+}
+
+func (c *ThrottleConfig) GetMaxDelay() time.Duration {
+	return time.Duration(c.MaxDelaySec) * time.Second
+}
+
+func (c *ThrottleConfig) GetLockoutDuration() time.Duration {
+	return time.Duration(c.LockoutDurationSec) * time.Second
+}
+
+func (c *ThrottleConfig) GetWindow() time.Duration {
+	return time.Duration(c.WindowSec) * time.Second
+}
+
 func (c *dbConfig) IsSQLite() bool {
 	return c.Dialect == "sqlite3"
 }
@@ -168,10 +431,94 @@ func (c *dbConfig) IsPostgres() bool {
 	return c.Dialect == "postgres"
 }
 
+func (c *securityConfig) GetOidcProvider(name string) *OidcProviderConfig {
+	for i := range c.Oidc {
+		if c.Oidc[i].Name == name {
+			return &c.Oidc[i]
+		}
+	}
+	return nil
+}
+
+func (c *OAuthServerConfig) GetAccessTokenTtl() time.Duration {
+	return time.Duration(c.AccessTokenTtlSec) * time.Second
+}
+
+func (c *OAuthServerConfig) GetRefreshTokenTtl() time.Duration {
+	return time.Duration(c.RefreshTokenTtlSec) * time.Second
+}
+
+func (c *LdapConfig) GetTimeout() time.Duration {
+	return time.Duration(c.TimeoutSec) * time.Second
+}
+
+// GetTLSConfig returns the settings to verify the directory server with, both for ldaps:// and starttls
+func (c *LdapConfig) GetTLSConfig() *tls.Config {
+	tlsConfig := &tls.Config{
+		RootCAs:            c.CaCertPool,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if u, err := url.Parse(c.Url); err == nil {
+		tlsConfig.ServerName = u.Hostname()
+	}
+	return tlsConfig
+}
+
+func (c *OidcProviderConfig) GetScopes() []string {
+	if len(c.Scopes) == 0 {
+		return []string{"openid", "profile", "email"}
+	}
+	return c.Scopes
+}
+
+func (c *OidcProviderConfig) GetDisplayName() string {
+	if c.DisplayName == "" {
+		return c.Name
+	}
+	return c.DisplayName
+}
+
+func (c *serverConfig) GetShutdownTimeout() time.Duration {
+	return time.Duration(c.ShutdownTimeoutSec) * time.Second
+}
+
+func (c *serverConfig) GetShutdownDelay() time.Duration {
+	return time.Duration(c.ShutdownDelaySec) * time.Second
+}
+
+// IsTrustedProxy tells whether the given peer is a reverse proxy, whose forwarding headers can be relied on
+func (c *serverConfig) IsTrustedProxy(ip net.IP) bool {
+	for _, n := range c.TrustedProxyNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 func (c *serverConfig) GetPublicUrl() string {
 	return strings.TrimSuffix(c.PublicUrl, "/")
 }
 
+// GetOrigin returns scheme, host and port of the public url, e.g. to be checked against the origin of webauthn requests
+func (c *serverConfig) GetOrigin() string {
+	u, err := url.Parse(c.PublicUrl)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%s://%s", u.Scheme, u.Host)
+}
+
+// GetHostname returns the host name of the public url, which is used as webauthn relying party id
+func (c *serverConfig) GetHostname() string {
+	u, err := url.Parse(c.PublicUrl)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
 func (c *SMTPMailConfig) ConnStr() string {
 	return fmt.Sprintf("%s:%d", c.Host, c.Port)
 }
@@ -209,6 +556,24 @@ func findString(needle string, haystack []string, defaultVal string) string {
 	return defaultVal
 }
 
+func decodeCookieKey(hashKey, blockKey string) (*models.CookieKey, error) {
+	hashKeyBytes, err := base64.StdEncoding.DecodeString(hashKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(hashKeyBytes) != 32 && len(hashKeyBytes) != 64 {
+		return nil, fmt.Errorf("hash key must be 32 or 64 bytes long, got %d", len(hashKeyBytes))
+	}
+	blockKeyBytes, err := base64.StdEncoding.DecodeString(blockKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(blockKeyBytes) != 16 && len(blockKeyBytes) != 24 && len(blockKeyBytes) != 32 {
+		return nil, fmt.Errorf("block key must be 16, 24 or 32 bytes long, got %d", len(blockKeyBytes))
+	}
+	return &models.CookieKey{HashKey: hashKeyBytes, BlockKey: blockKeyBytes, CreatedAt: time.Now()}, nil
+}
+
 func Set(config *Config) {
 	cfg = config
 }
@@ -229,10 +594,7 @@ func Load(version string) *Config {
 	env = config.Env
 	config.Version = strings.TrimSpace(version)
 	config.Db.Dialect = resolveDbDialect(config.Db.Type)
-	config.Security.SecureCookie = securecookie.New(
-		securecookie.GenerateRandomKey(64),
-		securecookie.GenerateRandomKey(32),
-	)
+	config.Security.SecureCookie = NewCookieKeyRing()
 
 	if strings.HasSuffix(config.Server.BasePath, "/") {
 		config.Server.BasePath = config.Server.BasePath[:len(config.Server.BasePath)-1]
@@ -249,6 +611,126 @@ func Load(version string) *Config {
 		logbuch.Warn("with sqlite, only a single connection is supported") // otherwise 'PRAGMA foreign_keys=ON' would somehow have to be set for every connection in the pool
 		config.Db.MaxConn = 1
 	}
+	if config.Security.Throttle.Store != ThrottleStoreMemory && config.Security.Throttle.Store != ThrottleStoreDb {
+		logbuch.Fatal("invalid throttle store '%s'", config.Security.Throttle.Store)
+	}
+
+	if config.Security.RequireEmailVerification && !config.Mail.Enabled {
+		logbuch.Warn("e-mail verification can't be required while mailing is disabled, ignoring require_email_verification")
+		config.Security.RequireEmailVerification = false
+	}
+	if config.Security.MagicLinkLogin && !config.Mail.Enabled {
+		logbuch.Warn("login links can't be sent while mailing is disabled, ignoring magic_link_login")
+		config.Security.MagicLinkLogin = false
+	}
+	if (config.Security.CookieHashKey == "") != (config.Security.CookieBlockKey == "") {
+		logbuch.Fatal("either both or none of cookie_hash_key and cookie_block_key must be set")
+	}
+	for i, p := range config.Security.Oidc {
+		if p.Name == "" || p.Issuer == "" || p.ClientId == "" {
+			logbuch.Fatal("oidc provider #%d is missing one of name, issuer or client_id", i+1)
+		}
+		if url.PathEscape(p.Name) != p.Name {
+			logbuch.Fatal("oidc provider name '%s' must be url-safe", p.Name)
+		}
+		if config.Security.GetOidcProvider(p.Name) != &config.Security.Oidc[i] {
+			logbuch.Fatal("duplicate oidc provider name '%s'", p.Name)
+		}
+		// configor doesn't apply defaults to slice elements
+		if p.UsernameClaim == "" {
+			config.Security.Oidc[i].UsernameClaim = "preferred_username"
+		}
+		if p.EmailClaim == "" {
+			config.Security.Oidc[i].EmailClaim = "email"
+		}
+		if p.GroupsClaim == "" {
+			config.Security.Oidc[i].GroupsClaim = "groups"
+		}
+	}
+	if config.Server.TlsClientCaPath != "" {
+		if !config.UseTLS() {
+			logbuch.Fatal("tls_client_ca_path requires tls_cert_path and tls_key_path to be set")
+		}
+		pem, err := ioutil.ReadFile(config.Server.TlsClientCaPath)
+		if err != nil {
+			logbuch.Fatal("failed to read client ca certificates: %v", err)
+		}
+		config.Server.ClientCaPool = x509.NewCertPool()
+		if !config.Server.ClientCaPool.AppendCertsFromPEM(pem) {
+			logbuch.Fatal("no valid certificates found in %s", config.Server.TlsClientCaPath)
+		}
+	}
+	switch config.Server.ClientCertMapping {
+	case ClientCertMappingFingerprint, ClientCertMappingSubject, ClientCertMappingEmail:
+	default:
+		logbuch.Fatal("invalid client_cert_mapping '%s'", config.Server.ClientCertMapping)
+	}
+	if config.Server.ShutdownTimeoutSec <= 0 || config.Server.ShutdownDelaySec < 0 {
+		logbuch.Fatal("shutdown_timeout_sec must be positive and shutdown_delay_sec must not be negative")
+	}
+	for _, p := range config.Server.TrustedProxies {
+		// single addresses are accepted as well, for convenience
+		if !strings.Contains(p, "/") {
+			if ip := net.ParseIP(p); ip != nil && ip.To4() != nil {
+				p += "/32"
+			} else {
+				p += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(p)
+		if err != nil {
+			logbuch.Fatal("invalid trusted proxy '%s'", p)
+		}
+		config.Server.TrustedProxyNets = append(config.Server.TrustedProxyNets, ipNet)
+	}
+	if config.Server.ProxyProtocol && len(config.Server.TrustedProxyNets) == 0 && config.Server.ListenSocket == "" {
+		logbuch.Fatal("proxy_protocol requires trusted_proxies to be set")
+	}
+	if oauthConfig := config.Security.OAuthServer; oauthConfig.Enabled && (oauthConfig.AccessTokenTtlSec <= 0 || oauthConfig.RefreshTokenTtlSec <= 0) {
+		logbuch.Fatal("oauth server token lifetimes must be positive")
+	}
+	if ldapConfig := &config.Security.Ldap; ldapConfig.Enabled {
+		u, err := url.Parse(ldapConfig.Url)
+		if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") {
+			logbuch.Fatal("ldap url must start with ldap:// or ldaps://")
+		}
+		if u.Scheme == "ldaps" && ldapConfig.StartTls {
+			logbuch.Fatal("ldap start_tls can't be used with ldaps:// urls")
+		}
+		if ldapConfig.BaseDn == "" {
+			logbuch.Fatal("ldap base_dn is required")
+		}
+		if !strings.Contains(ldapConfig.UserFilter, "{username}") {
+			logbuch.Fatal("ldap user_filter must contain the {username} placeholder")
+		}
+		if ldapConfig.CaCertPath != "" {
+			pem, err := ioutil.ReadFile(ldapConfig.CaCertPath)
+			if err != nil {
+				logbuch.Fatal("failed to read ldap ca certificate: %v", err)
+			}
+			ldapConfig.CaCertPool = x509.NewCertPool()
+			if !ldapConfig.CaCertPool.AppendCertsFromPEM(pem) {
+				logbuch.Fatal("no valid certificates found in %s", ldapConfig.CaCertPath)
+			}
+		}
+		if ldapConfig.InsecureSkipVerify {
+			logbuch.Warn("not verifying the ldap server's certificate, this is insecure")
+		}
+	}
+	if config.Security.HasStaticCookieKeys() {
+		key, err := decodeCookieKey(config.Security.CookieHashKey, config.Security.CookieBlockKey)
+		if err != nil {
+			logbuch.Fatal("invalid cookie keys: %v", err)
+		}
+		config.Security.SecureCookie.SetKeys([]*models.CookieKey{key})
+	}
+	if config.Security.EncryptionKey != "" {
+		key, err := base64.StdEncoding.DecodeString(config.Security.EncryptionKey)
+		if err != nil || len(key) != 32 {
+			logbuch.Fatal("encryption_key must be a base64-encoded 32 bytes key")
+		}
+		config.Security.EncryptionKeyBytes = key
+	}
 	if config.Mail.Provider != "" && findString(config.Mail.Provider, emailProviders, "") == "" {
 		logbuch.Fatal("unknown mail provider '%s'", config.Mail.Provider)
 	}
@@ -0,0 +1,55 @@
+package config
+
+import (
+	"errors"
+	"github.com/gorilla/securecookie"
+	"github.com/muety/broilerplate/models"
+	"sync"
+	"time"
+)
+
+// CookieKeyRing holds the secure cookie codecs currently in use. New cookies are always signed with the first (most recent)
+// key pair, while all remaining pairs are only used to decode cookies that were issued before the latest key rotation.
+type CookieKeyRing struct {
+	codecs []securecookie.Codec
+	mutex  sync.RWMutex
+}
+
+func NewCookieKeyRing() *CookieKeyRing {
+	return &CookieKeyRing{codecs: []securecookie.Codec{}}
+}
+
+func (r *CookieKeyRing) SetKeys(keys []*models.CookieKey) {
+	codecs := make([]securecookie.Codec, len(keys))
+	for i, k := range keys {
+		codecs[i] = securecookie.New(k.HashKey, k.BlockKey)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.codecs = codecs
+}
+
+func (r *CookieKeyRing) Encode(name string, value interface{}) (string, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if len(r.codecs) == 0 {
+		return "", errors.New("no cookie keys available")
+	}
+	return r.codecs[0].Encode(name, value)
+}
+
+func (r *CookieKeyRing) Decode(name, value string, dst interface{}) error {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return securecookie.DecodeMulti(name, value, dst, r.codecs...)
+}
+
+// GenerateCookieKey creates a new random key pair with a 64 bytes hash key (HMAC-SHA512) and a 32 bytes block key (AES-256)
+func GenerateCookieKey() *models.CookieKey {
+	return &models.CookieKey{
+		HashKey:   securecookie.GenerateRandomKey(64),
+		BlockKey:  securecookie.GenerateRandomKey(32),
+		CreatedAt: time.Now(),
+	}
+}
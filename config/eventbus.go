@@ -1,6 +1,10 @@
 package config
 
-import "github.com/leandro-lugaresi/hub"
+import (
+	"context"
+	"github.com/leandro-lugaresi/hub"
+	"sync"
+)
 
 type ApplicationEvent struct {
 	Type    string
@@ -10,13 +14,18 @@ type ApplicationEvent struct {
 const (
 	TopicUser            = "user.*"
 	EventUserUpdate      = "user.update"
+	EventUserDelete      = "user.delete"
 	EventHeartbeatCreate = "heartbeat.create"
+	EventAuditRecord     = "audit.record"
 	FieldPayload         = "payload"
 	FieldUser            = "user"
 	FieldUserId          = "user.id"
 )
 
-var eventHub *hub.Hub
+var (
+	eventHub    *hub.Hub
+	subscribers sync.WaitGroup
+)
 
 func init() {
 	eventHub = hub.New()
@@ -25,3 +34,33 @@ func init() {
 func EventBus() *hub.Hub {
 	return eventHub
 }
+
+// HandleEvents calls the handler for every message of a blocking subscription, one after another, until the event bus is closed
+func HandleEvents(sub hub.Subscription, handler func(hub.Message)) {
+	subscribers.Add(1)
+	go func() {
+		defer subscribers.Done()
+		for m := range sub.Receiver {
+			handler(m)
+		}
+	}()
+}
+
+// CloseEventBus ends all subscriptions and waits for the messages already received to be handled. It must only be called once nobody is
+// publishing anymore, i.e. after all background jobs have completed. As subscriptions are blocking, every message published up to then has been received.
+func CloseEventBus(ctx context.Context) error {
+	eventHub.Close()
+
+	finished := make(chan struct{})
+	go func() {
+		subscribers.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
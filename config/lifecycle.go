@@ -0,0 +1,99 @@
+package config
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// unlike a sync.WaitGroup, jobs may be started at any time, even while already waiting for others to complete
+	backgroundJobs     int
+	backgroundJobsLock sync.Mutex
+	backgroundJobsIdle = sync.NewCond(&backgroundJobsLock)
+	ready              int32
+)
+
+// BeginBackgroundJob marks the start of work that should be completed before shutting down, the returned function marks its end
+func BeginBackgroundJob() func() {
+	backgroundJobsLock.Lock()
+	backgroundJobs++
+	backgroundJobsLock.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			backgroundJobsLock.Lock()
+			defer backgroundJobsLock.Unlock()
+			if backgroundJobs--; backgroundJobs == 0 {
+				backgroundJobsIdle.Broadcast()
+			}
+		})
+	}
+}
+
+// RunInBackground runs fire-and-forget work (e.g. sending a mail) asynchronously, while making sure it is not cut off on shutdown
+func RunInBackground(fn func()) {
+	done := BeginBackgroundJob()
+	go func() {
+		defer done()
+		fn()
+	}()
+}
+
+// RunPeriodically calls fn every interval until the context is done, shutting down waits for the loop to end, i.e. for a run in progress to complete
+func RunPeriodically(ctx context.Context, interval time.Duration, fn func()) {
+	done := BeginBackgroundJob()
+	go func() {
+		defer done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				// both might be ready at the same time
+				if ctx.Err() != nil {
+					return
+				}
+				fn()
+			}
+		}
+	}()
+}
+
+// WaitForBackgroundJobs blocks until all background jobs have completed or the context is done, periodic jobs have to be stopped before
+func WaitForBackgroundJobs(ctx context.Context) error {
+	finished := make(chan struct{})
+	go func() {
+		backgroundJobsLock.Lock()
+		for backgroundJobs > 0 {
+			backgroundJobsIdle.Wait()
+		}
+		backgroundJobsLock.Unlock()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SetReady tells whether the application accepts new requests, it is set to false as soon as it starts draining on shutdown
+func SetReady(value bool) {
+	var v int32
+	if value {
+		v = 1
+	}
+	atomic.StoreInt32(&ready, v)
+}
+
+func IsReady() bool {
+	return atomic.LoadInt32(&ready) == 1
+}
@@ -1,11 +1,25 @@
 package config
 
 const (
-	IndexTemplate         = "index.tpl.html"
-	DashboardTemplate     = "dashboard.tpl.html"
-	LoginTemplate         = "login.tpl.html"
-	ImprintTemplate       = "imprint.tpl.html"
-	SignupTemplate        = "signup.tpl.html"
-	SetPasswordTemplate   = "set-password.tpl.html"
-	ResetPasswordTemplate = "reset-password.tpl.html"
+	IndexTemplate             = "index.tpl.html"
+	DashboardTemplate         = "dashboard.tpl.html"
+	LoginTemplate             = "login.tpl.html"
+	Login2faTemplate          = "login-2fa.tpl.html"
+	LoginMagicTemplate        = "login-magic.tpl.html"
+	TotpTemplate              = "totp.tpl.html"
+	ApiTokensTemplate         = "api-tokens.tpl.html"
+	AdminInvitationsTemplate  = "admin-invitations.tpl.html"
+	AdminUsersTemplate        = "admin-users.tpl.html"
+	AdminAuditTemplate        = "admin-audit.tpl.html"
+	AdminClientCertsTemplate  = "admin-client-certificates.tpl.html"
+	AdminOAuthClientsTemplate = "admin-oauth-clients.tpl.html"
+	OAuthAuthorizeTemplate    = "oauth-authorize.tpl.html"
+	OAuthAppsTemplate         = "oauth-apps.tpl.html"
+	OrganizationsTemplate     = "organizations.tpl.html"
+	SettingsTemplate          = "settings.tpl.html"
+	ImprintTemplate           = "imprint.tpl.html"
+	ErrorTemplate             = "error.tpl.html"
+	SignupTemplate            = "signup.tpl.html"
+	SetPasswordTemplate       = "set-password.tpl.html"
+	ResetPasswordTemplate     = "reset-password.tpl.html"
 )
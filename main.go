@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"embed"
 	_ "embed"
 	"github.com/emvi/logbuch"
@@ -10,11 +11,13 @@ import (
 	conf "github.com/muety/broilerplate/config"
 	"github.com/muety/broilerplate/middlewares"
 	"github.com/muety/broilerplate/migrations"
+	"github.com/muety/broilerplate/models"
 	"github.com/muety/broilerplate/repositories"
 	"github.com/muety/broilerplate/routes"
 	"github.com/muety/broilerplate/routes/api"
 	"github.com/muety/broilerplate/services"
 	"github.com/muety/broilerplate/services/mail"
+	"github.com/muety/broilerplate/utils"
 	fsutils "github.com/muety/broilerplate/utils/fs"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
@@ -23,7 +26,10 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -41,14 +47,53 @@ var (
 )
 
 var (
-	userRepository     repositories.IUserRepository
-	keyValueRepository repositories.IKeyValueRepository
+	userRepository            repositories.IUserRepository
+	keyValueRepository        repositories.IKeyValueRepository
+	sessionRepository         repositories.ISessionRepository
+	recoveryCodeRepository    repositories.IRecoveryCodeRepository
+	webauthnRepository        repositories.IWebauthnCredentialRepository
+	webauthnSessionRepository repositories.IWebauthnSessionRepository
+	oidcIdentityRepository    repositories.IOidcIdentityRepository
+	apiTokenRepository        repositories.IApiTokenRepository
+	verificationRepository    repositories.IEmailVerificationRepository
+	magicLinkRepository       repositories.IMagicLinkRepository
+	clientCertRepository      repositories.IClientCertificateRepository
+	oauthClientRepository     repositories.IOAuthClientRepository
+	oauthGrantRepository      repositories.IOAuthGrantRepository
+	oauthCodeRepository       repositories.IOAuthAuthorizationCodeRepository
+	oauthTokenRepository      repositories.IOAuthTokenRepository
+	knownDeviceRepository     repositories.IKnownDeviceRepository
+	auditEventRepository      repositories.IAuditEventRepository
+	invitationRepository      repositories.IInvitationRepository
+	throttleRepository        repositories.IThrottleRepository
+	roleRepository            repositories.IRoleRepository
+	organizationRepository    repositories.IOrganizationRepository
+	membershipRepository      repositories.IMembershipRepository
+	orgInvitationRepository   repositories.IOrganizationInvitationRepository
 )
 
 var (
-	userService     services.IUserService
-	mailService     services.IMailService
-	keyValueService services.IKeyValueService
+	userService              services.IUserService
+	mailService              services.IMailService
+	keyValueService          services.IKeyValueService
+	cookieKeyService         services.ICookieKeyService
+	sessionService           services.ISessionService
+	totpService              services.ITotpService
+	webauthnService          services.IWebauthnService
+	oidcService              services.IOidcService
+	apiTokenService          services.IApiTokenService
+	verifyService            services.IEmailVerificationService
+	magicLinkService         services.IMagicLinkService
+	clientCertificateService services.IClientCertificateService
+	oauthService             services.IOAuthService
+	knownDeviceService       services.IKnownDeviceService
+	auditService             services.IAuditService
+	invitationService        services.IInvitationService
+	throttleService          services.IThrottleService
+	roleService              services.IRoleService
+	organizationService      services.IOrganizationService
+	dataExportService        services.IDataExportService
+	authenticator            services.IAuthenticator
 )
 
 // @title Broilerplate API
@@ -116,23 +161,103 @@ func main() {
 	// Repositories
 	userRepository = repositories.NewUserRepository(db)
 	keyValueRepository = repositories.NewKeyValueRepository(db)
+	sessionRepository = repositories.NewSessionRepository(db)
+	recoveryCodeRepository = repositories.NewRecoveryCodeRepository(db)
+	webauthnRepository = repositories.NewWebauthnCredentialRepository(db)
+	webauthnSessionRepository = repositories.NewWebauthnSessionRepository(db)
+	oidcIdentityRepository = repositories.NewOidcIdentityRepository(db)
+	apiTokenRepository = repositories.NewApiTokenRepository(db)
+	verificationRepository = repositories.NewEmailVerificationRepository(db)
+	magicLinkRepository = repositories.NewMagicLinkRepository(db)
+	clientCertRepository = repositories.NewClientCertificateRepository(db)
+	oauthClientRepository = repositories.NewOAuthClientRepository(db)
+	oauthGrantRepository = repositories.NewOAuthGrantRepository(db)
+	oauthCodeRepository = repositories.NewOAuthAuthorizationCodeRepository(db)
+	oauthTokenRepository = repositories.NewOAuthTokenRepository(db)
+	knownDeviceRepository = repositories.NewKnownDeviceRepository(db)
+	auditEventRepository = repositories.NewAuditEventRepository(db)
+	invitationRepository = repositories.NewInvitationRepository(db)
+	roleRepository = repositories.NewRoleRepository(db)
+	organizationRepository = repositories.NewOrganizationRepository(db)
+	membershipRepository = repositories.NewMembershipRepository(db)
+	orgInvitationRepository = repositories.NewOrganizationInvitationRepository(db)
+	if config.Security.Throttle.Store == conf.ThrottleStoreDb {
+		throttleRepository = repositories.NewThrottleRepository(db)
+	} else {
+		throttleRepository = repositories.NewInMemoryThrottleRepository()
+	}
 
 	// Services
 	mailService = mail.NewMailService()
-	userService = services.NewUserService(mailService, userRepository)
 	keyValueService = services.NewKeyValueService(keyValueRepository)
+	auditService = services.NewAuditService(keyValueService, auditEventRepository)
+	userService = services.NewUserService(mailService, keyValueService, userRepository)
+	cookieKeyService = services.NewCookieKeyService(keyValueService)
+	sessionService = services.NewSessionService(sessionRepository)
+	totpService = services.NewTotpService(userService, keyValueService, recoveryCodeRepository)
+	webauthnService = services.NewWebauthnService(userService, webauthnRepository, webauthnSessionRepository)
+	roleService = services.NewRoleService(userService, roleRepository)
+	oidcService = services.NewOidcService(userService, roleService, oidcIdentityRepository)
+	apiTokenService = services.NewApiTokenService(apiTokenRepository)
+	verifyService = services.NewEmailVerificationService(userService, mailService, verificationRepository)
+	magicLinkService = services.NewMagicLinkService(userService, mailService, keyValueService, magicLinkRepository)
+	knownDeviceService = services.NewKnownDeviceService(mailService, knownDeviceRepository)
+	clientCertificateService = services.NewClientCertificateService(userService, clientCertRepository)
+	oauthService = services.NewOAuthService(roleService, oauthClientRepository, oauthGrantRepository, oauthCodeRepository, oauthTokenRepository)
+	invitationService = services.NewInvitationService(mailService, invitationRepository)
+	throttleService = services.NewThrottleService(userService, mailService, throttleRepository)
+	organizationService = services.NewOrganizationService(userService, mailService, organizationRepository, membershipRepository, orgInvitationRepository)
+	dataExportService = services.NewDataExportService(sessionService, apiTokenService, webauthnService, roleService, organizationService, auditService, knownDeviceService, clientCertificateService, oauthService)
+
+	if config.Security.Ldap.Enabled {
+		authenticator = services.NewAuthenticatorChain(services.NewLocalAuthenticator(userService), services.NewLdapAuthenticator(userService, roleService))
+	} else {
+		authenticator = services.NewLocalAuthenticator(userService)
+	}
+
+	// Periodic jobs run until shutting down
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	defer stopJobs()
+
+	// Load persistent cookie keys
+	if err := cookieKeyService.Load(); err != nil {
+		logbuch.Fatal("failed to load cookie keys – %v", err)
+	}
+	cookieKeyService.ScheduleReload(jobsCtx, 1*time.Minute)
+
+	// Make sure permissions introduced by newer versions are known and granted to admins
+	if err := roleService.EnsureDefaults(); err != nil {
+		logbuch.Fatal("failed to seed roles – %v", err)
+	}
 
-	routes.Init()
+	// Periodically clean up expired sessions
+	sessionService.ScheduleCleanup(jobsCtx, 1*time.Hour)
+	verifyService.ScheduleCleanup(jobsCtx, 1*time.Hour)
+	magicLinkService.ScheduleCleanup(jobsCtx, 1*time.Hour)
+	webauthnService.ScheduleCleanup(jobsCtx, 1*time.Hour)
+	oauthService.ScheduleCleanup(jobsCtx, 1*time.Hour)
+	knownDeviceService.ScheduleCleanup(jobsCtx, 24*time.Hour)
+	auditService.ScheduleCleanup(jobsCtx, 24*time.Hour)
+	throttleService.ScheduleCleanup(jobsCtx, 10*time.Minute)
+	organizationService.ScheduleCleanup(jobsCtx, 1*time.Hour)
+	userService.ScheduleCleanup(jobsCtx, 1*time.Hour)
+
+	routes.Init(roleService, organizationService)
 
 	// API Handlers
 	healthApiHandler := api.NewHealthApiHandler(db)
-	metricsHandler := api.NewMetricsHandler(userService, keyValueService)
+	metricsHandler := api.NewMetricsHandler(userService, sessionService, apiTokenService, keyValueService, roleService, clientCertificateService, oauthService)
+	adminApiHandler := api.NewAdminApiHandler(userService, sessionService, apiTokenService, totpService, cookieKeyService, invitationService, roleService, clientCertificateService, oauthService, organizationService)
 
 	// MVC Handlers
 	homeHandler := routes.NewHomeHandler(keyValueService)
-	dashboardHandler := routes.NewDashboardHandler(userService)
-	loginHandler := routes.NewLoginHandler(userService, mailService)
+	dashboardHandler := routes.NewDashboardHandler(userService, sessionService, totpService, webauthnService, apiTokenService, roleService, clientCertificateService, oauthService)
+	loginHandler := routes.NewLoginHandler(userService, sessionService, totpService, webauthnService, oidcService, apiTokenService, mailService, verifyService, invitationService, throttleService, roleService, magicLinkService, knownDeviceService, authenticator, clientCertificateService, oauthService)
+	settingsHandler := routes.NewSettingsHandler(userService, sessionService, apiTokenService, verifyService, organizationService, dataExportService, clientCertificateService, oauthService)
+	adminHandler := routes.NewAdminHandler(userService, sessionService, apiTokenService, invitationService, roleService, mailService, auditService, clientCertificateService, oauthService, organizationService)
 	imprintHandler := routes.NewImprintHandler(keyValueService)
+	organizationHandler := routes.NewOrganizationHandler(userService, sessionService, apiTokenService, organizationService, clientCertificateService, oauthService)
+	oauthHandler := routes.NewOAuthHandler(userService, sessionService, apiTokenService, clientCertificateService, oauthService)
 
 	// Setup Routers
 	router := mux.NewRouter()
@@ -148,21 +273,35 @@ func main() {
 	})(router.NotFoundHandler)
 
 	// Globally used middlewares
+	router.Use(middlewares.NewClientIpMiddleware())
 	router.Use(middlewares.NewPrincipalMiddleware())
 	router.Use(middlewares.NewLoggingMiddleware(logbuch.Info, []string{"/assets", "/api/health"}))
 	router.Use(handlers.RecoveryHandler())
 
+	csrfSecret, err := keyValueService.GetOrCreateSecret(models.CsrfKeyKey, 32)
+	if err != nil {
+		logbuch.Fatal("failed to load csrf secret – %v", err)
+	}
+	csrfMiddleware := middlewares.NewCsrfMiddleware(csrfSecret).WithFailureHandler(http.HandlerFunc(routes.CsrfFailureHandler))
+
 	rootRouter.Use(middlewares.NewSecurityMiddleware())
+	rootRouter.Use(csrfMiddleware.Handler)
+	apiRouter.Use(csrfMiddleware.Handler)
 
 	// Route registrations
 	homeHandler.RegisterRoutes(rootRouter)
 	dashboardHandler.RegisterRoutes(rootRouter)
+	settingsHandler.RegisterRoutes(rootRouter)
 	loginHandler.RegisterRoutes(rootRouter)
 	imprintHandler.RegisterRoutes(rootRouter)
+	adminHandler.RegisterRoutes(rootRouter)
+	organizationHandler.RegisterRoutes(rootRouter)
+	oauthHandler.RegisterRoutes(rootRouter)
 
 	// API route registrations
 	healthApiHandler.RegisterRoutes(apiRouter)
 	metricsHandler.RegisterRoutes(apiRouter)
+	adminApiHandler.RegisterRoutes(apiRouter)
 
 	// Static Routes
 	// https://github.com/golang/go/issues/43431
@@ -182,11 +321,12 @@ func main() {
 		middlewares.NewFileTypeFilterMiddleware([]string{".go"})(staticFileServer),
 	)
 
-	// Listen HTTP
-	listen(router)
+	// Listen HTTP, until asked to shut down
+	listen(router, stopJobs)
 }
 
-func listen(handler http.Handler) {
+// listen serves requests until receiving a termination signal, then shuts down gracefully, i.e. completes in-flight requests and background work
+func listen(handler http.Handler, stopJobs context.CancelFunc) {
 	var s4, s6, sSocket *http.Server
 
 	// IPv4
@@ -228,10 +368,19 @@ func listen(handler http.Handler) {
 	}
 
 	if config.UseTLS() {
+		for _, s := range []*http.Server{s4, s6, sSocket} {
+			if s != nil {
+				s.TLSConfig = config.Server.GetTLSConfig()
+			}
+		}
+		if config.UseClientCerts() {
+			logbuch.Info("--> Accepting client certificates issued by %s", config.Server.TlsClientCaPath)
+		}
+
 		if s4 != nil {
 			logbuch.Info("--> Listening for HTTPS on %s... ✅", s4.Addr)
 			go func() {
-				if err := s4.ListenAndServeTLS(config.Server.TlsCertPath, config.Server.TlsKeyPath); err != nil {
+				if err := s4.ServeTLS(listenTcp(s4.Addr), config.Server.TlsCertPath, config.Server.TlsKeyPath); err != nil && err != http.ErrServerClosed {
 					logbuch.Fatal(err.Error())
 				}
 			}()
@@ -239,7 +388,7 @@ func listen(handler http.Handler) {
 		if s6 != nil {
 			logbuch.Info("--> Listening for HTTPS on %s... ✅", s6.Addr)
 			go func() {
-				if err := s6.ListenAndServeTLS(config.Server.TlsCertPath, config.Server.TlsKeyPath); err != nil {
+				if err := s6.ServeTLS(listenTcp(s6.Addr), config.Server.TlsCertPath, config.Server.TlsKeyPath); err != nil && err != http.ErrServerClosed {
 					logbuch.Fatal(err.Error())
 				}
 			}()
@@ -251,7 +400,8 @@ func listen(handler http.Handler) {
 				if err != nil {
 					logbuch.Fatal(err.Error())
 				}
-				if err := sSocket.ServeTLS(unixListener, config.Server.TlsCertPath, config.Server.TlsKeyPath); err != nil {
+				unixListener = withProxyProtocol(unixListener)
+				if err := sSocket.ServeTLS(unixListener, config.Server.TlsCertPath, config.Server.TlsKeyPath); err != nil && err != http.ErrServerClosed {
 					logbuch.Fatal(err.Error())
 				}
 			}()
@@ -260,7 +410,7 @@ func listen(handler http.Handler) {
 		if s4 != nil {
 			logbuch.Info("--> Listening for HTTP on %s... ✅", s4.Addr)
 			go func() {
-				if err := s4.ListenAndServe(); err != nil {
+				if err := s4.Serve(listenTcp(s4.Addr)); err != nil && err != http.ErrServerClosed {
 					logbuch.Fatal(err.Error())
 				}
 			}()
@@ -268,7 +418,7 @@ func listen(handler http.Handler) {
 		if s6 != nil {
 			logbuch.Info("--> Listening for HTTP on %s... ✅", s6.Addr)
 			go func() {
-				if err := s6.ListenAndServe(); err != nil {
+				if err := s6.Serve(listenTcp(s6.Addr)); err != nil && err != http.ErrServerClosed {
 					logbuch.Fatal(err.Error())
 				}
 			}()
@@ -280,12 +430,70 @@ func listen(handler http.Handler) {
 				if err != nil {
 					logbuch.Fatal(err.Error())
 				}
-				if err := sSocket.Serve(unixListener); err != nil {
+				unixListener = withProxyProtocol(unixListener)
+				if err := sSocket.Serve(unixListener); err != nil && err != http.ErrServerClosed {
 					logbuch.Fatal(err.Error())
 				}
 			}()
 		}
 	}
 
-	<-make(chan interface{}, 1)
+	conf.SetReady(true)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+
+	logbuch.Info("--> Received %v, shutting down... 👋", sig)
+	conf.SetReady(false)
+	time.Sleep(config.Server.GetShutdownDelay())
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.Server.GetShutdownTimeout())
+	defer cancel()
+
+	// stop accepting connections and wait for in-flight requests to complete, closing the unix listener also removes the socket file
+	var wg sync.WaitGroup
+	for _, s := range []*http.Server{s4, s6, sSocket} {
+		if s == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(s *http.Server) {
+			defer wg.Done()
+			if err := s.Shutdown(ctx); err != nil {
+				logbuch.Warn("failed to gracefully shut down server – %v", err)
+			}
+		}(s)
+	}
+	wg.Wait()
+
+	// with no more requests coming in and periodic jobs stopped, nobody but running background jobs publishes events anymore,
+	// so once they are done, every event has been received by its subscriber and the event bus can be drained
+	stopJobs()
+	if err := conf.WaitForBackgroundJobs(ctx); err != nil {
+		logbuch.Warn("failed to wait for background jobs to finish – %v", err)
+	}
+	if err := conf.CloseEventBus(ctx); err != nil {
+		logbuch.Warn("failed to wait for events to be handled – %v", err)
+	}
+	logbuch.Info("--> Shut down, closing database connections")
+}
+
+func listenTcp(addr string) net.Listener {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		logbuch.Fatal(err.Error())
+	}
+	return withProxyProtocol(listener)
+}
+
+// withProxyProtocol makes the listener expect proxy protocol headers from trusted proxies, if enabled, while peers on the unix socket are always trusted
+func withProxyProtocol(listener net.Listener) net.Listener {
+	if !config.Server.ProxyProtocol {
+		return listener
+	}
+	return utils.NewProxyProtocolListener(listener, func(addr net.Addr) bool {
+		tcpAddr, ok := addr.(*net.TCPAddr)
+		return !ok || config.Server.IsTrustedProxy(tcpAddr.IP)
+	}, time.Duration(config.Server.TimeoutSec)*time.Second)
 }
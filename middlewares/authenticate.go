@@ -17,21 +17,39 @@ const (
 )
 
 var (
-	errEmptyKey = fmt.Errorf("the api_key is empty")
+	errEmptyKey          = fmt.Errorf("the api_key is empty")
+	errNoClientCert      = fmt.Errorf("no verified client certificate")
+	errInsufficientScope = fmt.Errorf("the api token lacks the required scopes")
+	errDeletionScheduled = fmt.Errorf("the account is about to be deleted")
 )
 
+// scopedToken is implemented by both api tokens and oauth access tokens
+type scopedToken interface {
+	HasScope(string) bool
+}
+
 type AuthenticateMiddleware struct {
 	config           *conf.Config
 	userSrvc         services.IUserService
+	sessionSrvc      services.ISessionService
+	apiTokenSrvc     services.IApiTokenService
+	clientCertSrvc   services.IClientCertificateService
+	oauthSrvc        services.IOAuthService
 	optionalForPaths []string
-	redirectTarget   string // optional
+	redirectTarget   string   // optional
+	requiredScopes   []string // api and oauth tokens are only accepted if they have all of these, and not at all if empty
 }
 
-func NewAuthenticateMiddleware(userService services.IUserService) *AuthenticateMiddleware {
+func NewAuthenticateMiddleware(userService services.IUserService, sessionService services.ISessionService, apiTokenService services.IApiTokenService, clientCertificateService services.IClientCertificateService, oauthService services.IOAuthService) *AuthenticateMiddleware {
 	return &AuthenticateMiddleware{
 		config:           conf.Get(),
 		userSrvc:         userService,
+		sessionSrvc:      sessionService,
+		apiTokenSrvc:     apiTokenService,
+		clientCertSrvc:   clientCertificateService,
+		oauthSrvc:        oauthService,
 		optionalForPaths: []string{},
+		requiredScopes:   []string{},
 	}
 }
 
@@ -45,6 +63,11 @@ func (m *AuthenticateMiddleware) WithRedirectTarget(path string) *AuthenticateMi
 	return m
 }
 
+func (m *AuthenticateMiddleware) WithRequiredScopes(scopes ...string) *AuthenticateMiddleware {
+	m.requiredScopes = scopes
+	return m
+}
+
 func (m *AuthenticateMiddleware) Handler(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		m.ServeHTTP(w, r, h.ServeHTTP)
@@ -56,9 +79,12 @@ func (m *AuthenticateMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Reques
 	user, err := m.tryGetUserByCookie(r)
 
 	if err != nil {
-		user, err = m.tryGetUserByApiKeyHeader(r)
+		user, err = m.tryGetUserByClientCert(r)
 	}
 	if err != nil {
+		user, err = m.tryGetUserByApiKeyHeader(r)
+	}
+	if err != nil && err != errInsufficientScope {
 		user, err = m.tryGetUserByApiKeyQuery(r)
 	}
 
@@ -68,7 +94,10 @@ func (m *AuthenticateMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Reques
 			return
 		}
 
-		if m.redirectTarget == "" {
+		if err == errInsufficientScope && m.redirectTarget == "" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(conf.ErrForbidden))
+		} else if m.redirectTarget == "" {
 			w.WriteHeader(http.StatusUnauthorized)
 			w.Write([]byte(conf.ErrUnauthorized))
 		} else {
@@ -92,47 +121,115 @@ func (m *AuthenticateMiddleware) isOptional(requestPath string) bool {
 }
 
 func (m *AuthenticateMiddleware) tryGetUserByApiKeyHeader(r *http.Request) (*models.User, error) {
-	key, err := utils.ExtractBearerAuth(r)
-	if err != nil {
-		return nil, err
+	// third-party apps send their access tokens as is (rfc 6750), not base64-encoded like api keys
+	if token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); strings.HasPrefix(token, models.OAuthAccessTokenPrefix) {
+		return m.getUserByKey(strings.TrimSpace(token))
 	}
 
-	var user *models.User
-	userKey := strings.TrimSpace(key)
-	user, err = m.userSrvc.GetUserByKey(userKey)
+	key, err := utils.ExtractBearerAuth(r)
 	if err != nil {
 		return nil, err
 	}
-	return user, nil
+
+	return m.getUserByKey(strings.TrimSpace(key))
 }
 
 func (m *AuthenticateMiddleware) tryGetUserByApiKeyQuery(r *http.Request) (*models.User, error) {
 	key := r.URL.Query().Get(queryApiKey)
-	var user *models.User
 	userKey := strings.TrimSpace(key)
 	if userKey == "" {
 		return nil, errEmptyKey
 	}
-	user, err := m.userSrvc.GetUserByKey(userKey)
+	return m.getUserByKey(userKey)
+}
+
+// getUserByKey resolves either a scoped api token, an oauth access token issued to a third-party app or a user's (unrestricted) api key
+func (m *AuthenticateMiddleware) getUserByKey(key string) (*models.User, error) {
+	var user *models.User
+	var err error
+
+	switch {
+	case strings.HasPrefix(key, models.ApiTokenPrefix):
+		token, err := m.apiTokenSrvc.GetValidByToken(key)
+		if err != nil {
+			return nil, err
+		}
+		if !m.hasRequiredScopes(token) {
+			return nil, errInsufficientScope
+		}
+		if user, err = m.userSrvc.GetUserById(token.UserID); err != nil {
+			return nil, err
+		}
+	case strings.HasPrefix(key, models.OAuthAccessTokenPrefix):
+		token, err := m.oauthSrvc.GetValidByAccessToken(key)
+		if err != nil {
+			return nil, err
+		}
+		if !m.hasRequiredScopes(token) {
+			return nil, errInsufficientScope
+		}
+		if user, err = m.userSrvc.GetUserById(token.Grant.UserID); err != nil {
+			return nil, err
+		}
+	default:
+		if user, err = m.userSrvc.GetUserByKey(key); err != nil {
+			return nil, err
+		}
+	}
+
+	// unlike logging in, using the api does not cancel a scheduled deletion
+	if user.IsDeletionScheduled() {
+		return nil, errDeletionScheduled
+	}
+	return user, nil
+}
+
+func (m *AuthenticateMiddleware) hasRequiredScopes(token scopedToken) bool {
+	if len(m.requiredScopes) == 0 {
+		return false
+	}
+	for _, s := range m.requiredScopes {
+		if !token.HasScope(s) {
+			return false
+		}
+	}
+	return true
+}
+
+// tryGetUserByClientCert relies on the tls handshake to have verified the certificate against the client ca, it is only mapped to its owner here
+func (m *AuthenticateMiddleware) tryGetUserByClientCert(r *http.Request) (*models.User, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil, errNoClientCert
+	}
+
+	user, err := m.clientCertSrvc.GetUserByCertificate(r.TLS.VerifiedChains[0][0])
 	if err != nil {
 		return nil, err
 	}
+	if user.IsDeletionScheduled() {
+		return nil, errDeletionScheduled
+	}
 	return user, nil
 }
 
 func (m *AuthenticateMiddleware) tryGetUserByCookie(r *http.Request) (*models.User, error) {
-	username, err := utils.ExtractCookieAuth(r, m.config)
+	sessionId, err := utils.ExtractCookieAuth(r, m.config)
 	if err != nil {
 		return nil, err
 	}
 
-	user, err := m.userSrvc.GetUserById(*username)
+	// no need to check password here, as securecookie decoding will fail anyway,
+	// if cookie is not properly signed, but the session must still exist server-side,
+	// i.e. must not have been revoked or expired
+	session, err := m.sessionSrvc.GetValidById(*sessionId)
 	if err != nil {
 		return nil, err
 	}
 
-	// no need to check password here, as securecookie decoding will fail anyway,
-	// if cookie is not properly signed
+	user, err := m.userSrvc.GetUserById(session.UserID)
+	if err != nil {
+		return nil, err
+	}
 
 	return user, nil
 }
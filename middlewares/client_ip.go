@@ -0,0 +1,120 @@
+package middlewares
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+
+	conf "github.com/muety/broilerplate/config"
+)
+
+const keyClientIp = "client_ip"
+
+// ClientIpMiddleware resolves the client's ip once per request, so that logging, rate limiting, sessions and the audit log all agree on it.
+// Forwarding headers are only taken into account if the immediate peer is a trusted proxy. They are evaluated from right to left, skipping
+// further trusted proxies, as all entries left of the first untrusted hop could have been made up by the client.
+type ClientIpMiddleware struct {
+	config  *conf.Config
+	handler http.Handler
+}
+
+func NewClientIpMiddleware() func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return &ClientIpMiddleware{
+			config:  conf.Get(),
+			handler: h,
+		}
+	}
+}
+
+func (m *ClientIpMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithValue(r.Context(), keyClientIp, resolveClientIp(r, m.config))
+	m.handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// ReadUserIP returns the client ip as resolved by ClientIpMiddleware
+func ReadUserIP(r *http.Request) string {
+	if ip := r.Context().Value(keyClientIp); ip != nil {
+		return ip.(string)
+	}
+	return resolveClientIp(r, conf.Get())
+}
+
+func resolveClientIp(r *http.Request, config *conf.Config) string {
+	remote := r.RemoteAddr
+	// strip the ephemeral client port, as the address is also used to recognize clients across requests
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+
+	// peers on the unix socket are local processes, most likely a reverse proxy, unless a proxy protocol header already told the actual client
+	remoteIp := net.ParseIP(remote)
+	if remoteIp == nil && !isUnixSocket(r) || remoteIp != nil && !config.Server.IsTrustedProxy(remoteIp) {
+		return remote
+	}
+
+	var hops []string
+	if forwarded := r.Header.Values("Forwarded"); len(forwarded) > 0 {
+		hops = parseForwardedFor(forwarded)
+	} else if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		hops = strings.Split(strings.Join(xff, ","), ",")
+	} else if xri := r.Header.Get("X-Real-Ip"); xri != "" {
+		hops = []string{xri}
+	}
+
+	var client string
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := parseForwardedNode(hops[i])
+		if ip == nil {
+			// obfuscated or unknown hops (e.g. "for=unknown") end the chain of trust
+			break
+		}
+		client = ip.String()
+		if !config.Server.IsTrustedProxy(ip) {
+			break
+		}
+	}
+
+	if client == "" {
+		return remote
+	}
+	return client
+}
+
+// parseForwardedFor extracts the for parameters of all elements of rfc 7239 forwarded headers, in order, with an empty string for elements lacking one
+func parseForwardedFor(headers []string) []string {
+	hops := make([]string, 0)
+	for _, h := range headers {
+		for _, element := range strings.Split(h, ",") {
+			var node string
+			for _, pair := range strings.Split(element, ";") {
+				if kv := strings.SplitN(strings.TrimSpace(pair), "=", 2); len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+					node = kv[1]
+				}
+			}
+			hops = append(hops, node)
+		}
+	}
+	return hops
+}
+
+// parseForwardedNode parses addresses like 192.0.2.43, "192.0.2.43:47011" or "[2001:db8:cafe::17]:4711", returning nil for anything else
+func parseForwardedNode(node string) net.IP {
+	node = strings.Trim(strings.TrimSpace(node), `"`)
+	if strings.HasPrefix(node, "[") {
+		if end := strings.Index(node, "]"); end > 0 {
+			return net.ParseIP(node[1:end])
+		}
+		return nil
+	}
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		node = host
+	}
+	return net.ParseIP(node)
+}
+
+func isUnixSocket(r *http.Request) bool {
+	addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return ok && addr.Network() == "unix"
+}
@@ -0,0 +1,165 @@
+package middlewares
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"strings"
+
+	conf "github.com/muety/broilerplate/config"
+	"github.com/muety/broilerplate/models"
+	"github.com/muety/broilerplate/utils"
+)
+
+const (
+	keyCsrfToken = "csrf_token"
+
+	CsrfFormField       = "csrf_token"
+	CsrfHeaderName      = "X-CSRF-Token"
+	RequestedWithHeader = "X-Requested-With"
+)
+
+// endpoints, which are called by third-party apps and never rely on cookies
+var csrfExemptPaths = []string{"/oauth/token", "/oauth/introspect"}
+
+var csrfSafeMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+}
+
+// CsrfMiddleware implements synchronizer tokens to protect state-changing requests against cross-site request forgery.
+// Tokens are derived from the user's session, or, for anonymous visitors (e.g. on the login form), from a random
+// value in a separate cookie. Thus, they don't need to be stored server-side, but still can't be obtained by other sites.
+type CsrfMiddleware struct {
+	config         *conf.Config
+	secret         []byte
+	failureHandler http.Handler
+	handler        http.Handler
+}
+
+func NewCsrfMiddleware(secret []byte) *CsrfMiddleware {
+	return &CsrfMiddleware{
+		config: conf.Get(),
+		secret: secret,
+		failureHandler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(conf.ErrForbidden))
+		}),
+	}
+}
+
+func (m *CsrfMiddleware) WithFailureHandler(handler http.Handler) *CsrfMiddleware {
+	m.failureHandler = handler
+	return m
+}
+
+func (m *CsrfMiddleware) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.ServeHTTP(w, r, h)
+	})
+}
+
+func (m *CsrfMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	binding := m.getBinding(r)
+	if binding == "" {
+		random, err := utils.RandomBytes(32)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(conf.ErrInternalServerError))
+			return
+		}
+		binding = base64.RawURLEncoding.EncodeToString(random)
+		http.SetCookie(w, m.config.CreateCookie(models.CsrfCookieKey, binding, "/"))
+	}
+
+	token := m.computeToken(binding)
+	r = r.WithContext(context.WithValue(r.Context(), keyCsrfToken, token))
+
+	if csrfSafeMethods[r.Method] || m.isExempt(r) {
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	provided := r.Header.Get(CsrfHeaderName)
+	if provided == "" {
+		provided = r.PostFormValue(CsrfFormField)
+	}
+	if subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+		m.failureHandler.ServeHTTP(w, r)
+		return
+	}
+
+	// handlers decode forms strictly, so they must not see the token
+	r.PostForm.Del(CsrfFormField)
+	r.Form.Del(CsrfFormField)
+
+	next.ServeHTTP(w, r)
+}
+
+// getBinding returns the value the token is bound to, i.e. the session id for logged in users and the anonymous csrf cookie otherwise
+func (m *CsrfMiddleware) getBinding(r *http.Request) string {
+	if sessionId, err := utils.ExtractCookieAuth(r, m.config); err == nil && *sessionId != "" {
+		return "session:" + *sessionId
+	}
+	if cookie, err := r.Cookie(models.CsrfCookieKey); err == nil && cookie.Value != "" {
+		return cookie.Value
+	}
+	return ""
+}
+
+func (m *CsrfMiddleware) computeToken(binding string) string {
+	mac := hmac.New(sha256.New, m.secret)
+	mac.Write([]byte(binding))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// isExempt returns whether the request is an api call that authenticates via api key or token, which browsers never attach automatically,
+// or a call to one of the oauth token endpoints, which apps authenticate to with their client credentials. Api calls carrying a session
+// cookie are not exempt, as those would authenticate a forged request with a made-up key on behalf of the victim. The same goes for client
+// certificates, unless the request proves not to be a cross-site one, see isNonBrowserRequest.
+func (m *CsrfMiddleware) isExempt(r *http.Request) bool {
+	basePath := strings.TrimSuffix(m.config.Server.BasePath, "/")
+	for _, p := range csrfExemptPaths {
+		if r.URL.Path == basePath+p {
+			return true
+		}
+	}
+
+	apiPrefix := basePath + "/api/"
+	if !strings.HasPrefix(r.URL.Path, apiPrefix) {
+		return false
+	}
+	if _, err := r.Cookie(models.AuthCookieKey); err == nil {
+		return false
+	}
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		return isNonBrowserRequest(r)
+	}
+	return r.Header.Get("Authorization") != "" || r.URL.Query().Get(queryApiKey) != ""
+}
+
+// isNonBrowserRequest tells whether the request carries a custom header, which other sites' forms can't set and scripts only could after a
+// cors preflight, that we never answer. Browsers, which state where a request originates from, must additionally report it as same-origin.
+func isNonBrowserRequest(r *http.Request) bool {
+	if r.Header.Get(RequestedWithHeader) == "" {
+		return false
+	}
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "", "same-origin", "none":
+		return true
+	default:
+		return false
+	}
+}
+
+func GetCsrfToken(r *http.Request) string {
+	if token := r.Context().Value(keyCsrfToken); token != nil {
+		return token.(string)
+	}
+	return ""
+}
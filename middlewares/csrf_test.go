@@ -0,0 +1,84 @@
+package middlewares
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	conf "github.com/muety/broilerplate/config"
+	"github.com/muety/broilerplate/models"
+)
+
+func setupCsrfMiddleware(t *testing.T) (*CsrfMiddleware, *conf.Config) {
+	cfg := &conf.Config{}
+	cfg.Security.SecureCookie = conf.NewCookieKeyRing()
+	cfg.Security.SecureCookie.SetKeys([]*models.CookieKey{conf.GenerateCookieKey()})
+	conf.Set(cfg)
+	return NewCsrfMiddleware([]byte("secret")), cfg
+}
+
+func serveCsrf(m *CsrfMiddleware, r *http.Request) int {
+	rec := httptest.NewRecorder()
+	m.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})).ServeHTTP(rec, r)
+	return rec.Code
+}
+
+func TestCsrfMiddleware_ClientCertificates(t *testing.T) {
+	m, cfg := setupCsrfMiddleware(t)
+
+	sessionCookie, err := cfg.Security.SecureCookie.Encode(models.AuthCookieKey, "session-id")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		headers      map[string]string
+		withCookie   bool
+		expectStatus int
+	}{
+		{"machine client", map[string]string{RequestedWithHeader: "client"}, false, http.StatusNoContent},
+		{"machine client reported as same-origin", map[string]string{RequestedWithHeader: "client", "Sec-Fetch-Site": "same-origin"}, false, http.StatusNoContent},
+		{"cross-site form", nil, false, http.StatusForbidden},
+		{"cross-site form with api key", map[string]string{"Authorization": "Basic Zm9v"}, false, http.StatusForbidden},
+		{"cross-site script", map[string]string{RequestedWithHeader: "client", "Sec-Fetch-Site": "cross-site"}, false, http.StatusForbidden},
+		{"browser session", map[string]string{RequestedWithHeader: "client"}, true, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/api/admin/cookie-keys/rotate", nil)
+			r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{}}}
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			if tt.withCookie {
+				r.AddCookie(&http.Cookie{Name: models.AuthCookieKey, Value: sessionCookie})
+			}
+
+			if status := serveCsrf(m, r); status != tt.expectStatus {
+				t.Errorf("expected status %d, got %d", tt.expectStatus, status)
+			}
+		})
+	}
+}
+
+func TestCsrfMiddleware_ApiKeys(t *testing.T) {
+	m, _ := setupCsrfMiddleware(t)
+
+	r := httptest.NewRequest(http.MethodPost, "/api/admin/cookie-keys/rotate", nil)
+	r.Header.Set("Authorization", "Basic Zm9v")
+	if status := serveCsrf(m, r); status != http.StatusNoContent {
+		t.Errorf("expected api key requests to be exempt, got status %d", status)
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/settings", nil)
+	r.Header.Set("Authorization", "Basic Zm9v")
+	if status := serveCsrf(m, r); status != http.StatusForbidden {
+		t.Errorf("expected non-api requests to require a token, got status %d", status)
+	}
+}
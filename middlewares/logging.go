@@ -49,22 +49,11 @@ func (lg *LoggingMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		r.URL.String(),
 		duration,
 		ww.BytesWritten(),
-		readUserIP(r),
+		ReadUserIP(r),
 		readUserID(r),
 	)
 }
 
-func readUserIP(r *http.Request) string {
-	ip := r.Header.Get("X-Real-Ip")
-	if ip == "" {
-		ip = r.Header.Get("X-Forwarded-For")
-	}
-	if ip == "" {
-		ip = r.RemoteAddr
-	}
-	return ip
-}
-
 func readUserID(r *http.Request) string {
 	if user := GetPrincipal(r); user != nil {
 		return user.ID
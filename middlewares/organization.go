@@ -0,0 +1,35 @@
+package middlewares
+
+import (
+	"net/http"
+
+	"github.com/emvi/logbuch"
+	"github.com/muety/broilerplate/services"
+)
+
+// OrganizationMiddleware resolves the organization the principal is currently acting in and stores their membership
+// next to the principal, see GetMembership and GetOrganization. It must be preceded by AuthenticateMiddleware.
+type OrganizationMiddleware struct {
+	organizationSrvc services.IOrganizationService
+}
+
+func NewOrganizationMiddleware(organizationService services.IOrganizationService) *OrganizationMiddleware {
+	return &OrganizationMiddleware{organizationSrvc: organizationService}
+}
+
+func (m *OrganizationMiddleware) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.ServeHTTP(w, r, h.ServeHTTP)
+	})
+}
+
+func (m *OrganizationMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	if user := GetPrincipal(r); user != nil {
+		membership, err := m.organizationSrvc.GetActive(user)
+		if err != nil {
+			logbuch.Error("failed to resolve active organization of user %s – %v", user.ID, err)
+		}
+		SetMembership(r, membership)
+	}
+	next(w, r)
+}
@@ -0,0 +1,61 @@
+package middlewares
+
+import (
+	"net/http"
+
+	conf "github.com/muety/broilerplate/config"
+	"github.com/muety/broilerplate/services"
+)
+
+// PermissionMiddleware only lets requests pass whose principal holds all of the given permissions, it must be preceded by AuthenticateMiddleware
+type PermissionMiddleware struct {
+	roleSrvc       services.IRoleService
+	permissions    []string
+	redirectTarget string // optional
+}
+
+func NewPermissionMiddleware(roleService services.IRoleService, permissions ...string) *PermissionMiddleware {
+	return &PermissionMiddleware{
+		roleSrvc:    roleService,
+		permissions: permissions,
+	}
+}
+
+// RequirePermission is a shorthand for NewPermissionMiddleware(roleService, permissions...).Handler
+func RequirePermission(roleService services.IRoleService, permissions ...string) func(http.Handler) http.Handler {
+	return NewPermissionMiddleware(roleService, permissions...).Handler
+}
+
+func (m *PermissionMiddleware) WithRedirectTarget(path string) *PermissionMiddleware {
+	m.redirectTarget = path
+	return m
+}
+
+func (m *PermissionMiddleware) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.ServeHTTP(w, r, h.ServeHTTP)
+	})
+}
+
+func (m *PermissionMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	user := GetPrincipal(r)
+	if user == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(conf.ErrUnauthorized))
+		return
+	}
+
+	for _, p := range m.permissions {
+		if !m.roleSrvc.HasPermission(user, p) {
+			if m.redirectTarget != "" {
+				http.Redirect(w, r, m.redirectTarget, http.StatusFound)
+			} else {
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte(conf.ErrForbidden))
+			}
+			return
+		}
+	}
+
+	next(w, r)
+}
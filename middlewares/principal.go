@@ -9,7 +9,8 @@ import (
 const keyPrincipal = "principal"
 
 type PrincipalContainer struct {
-	principal *models.User
+	principal  *models.User
+	membership *models.Membership // of the principal within the active organization, if any
 }
 
 func (c *PrincipalContainer) SetPrincipal(user *models.User) {
@@ -20,6 +21,14 @@ func (c *PrincipalContainer) GetPrincipal() *models.User {
 	return c.principal
 }
 
+func (c *PrincipalContainer) SetMembership(membership *models.Membership) {
+	c.membership = membership
+}
+
+func (c *PrincipalContainer) GetMembership() *models.Membership {
+	return c.membership
+}
+
 // This middleware is a bit of a dirty workaround to the fact that a http.Request's context
 // does not allow to pass values from an inner to an outer middleware. Calling WithContext() on a
 // request shallow-copies the whole request itself and therefore, in a chain of handler1(handler2()),
@@ -62,3 +71,46 @@ func GetPrincipal(r *http.Request) *models.User {
 	}
 	return nil
 }
+
+func SetMembership(r *http.Request, membership *models.Membership) {
+	if p := r.Context().Value(keyPrincipal); p != nil {
+		p.(*PrincipalContainer).SetMembership(membership)
+	}
+}
+
+// GetMembership returns the principal's membership in the organization they are currently acting in
+func GetMembership(r *http.Request) *models.Membership {
+	if p := r.Context().Value(keyPrincipal); p != nil {
+		return p.(*PrincipalContainer).GetMembership()
+	}
+	return nil
+}
+
+// GetOrganization returns the organization the principal is currently acting in
+func GetOrganization(r *http.Request) *models.Organization {
+	if m := GetMembership(r); m != nil {
+		return m.Organization
+	}
+	return nil
+}
+
+// GetOrganizationId returns the id of the organization the principal is currently acting in, or an empty string, which
+// tenant-scoped repositories refuse, if they aren't acting in any
+func GetOrganizationId(r *http.Request) string {
+	if m := GetMembership(r); m != nil {
+		return m.OrganizationID
+	}
+	return ""
+}
+
+// GetAuditOrigin describes the request as the origin of an audited action, with the principal as actor, if authenticated
+func GetAuditOrigin(r *http.Request) *models.AuditOrigin {
+	origin := &models.AuditOrigin{
+		IP:        ReadUserIP(r),
+		UserAgent: r.UserAgent(),
+	}
+	if user := GetPrincipal(r); user != nil {
+		origin.ActorID = user.ID
+	}
+	return origin
+}
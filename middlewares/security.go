@@ -2,6 +2,8 @@ package middlewares
 
 import (
 	"net/http"
+	"net/url"
+	"strings"
 )
 
 var securityHeaders = map[string]string{
@@ -30,3 +32,20 @@ func (f *SecurityMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	f.handler.ServeHTTP(w, r)
 }
+
+// AllowFormAction extends a response's content security policy to let forms (and the redirects following their submission) target the given uri's origin
+func AllowFormAction(w http.ResponseWriter, uri string) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return
+	}
+	source := u.Scheme + ":"
+	if u.Host != "" {
+		source = u.Scheme + "://" + u.Host
+	}
+	if strings.ContainsAny(source, " ;,'") {
+		return
+	}
+	policy := w.Header().Get("Content-Security-Policy")
+	w.Header().Set("Content-Security-Policy", strings.Replace(policy, "form-action 'self'", "form-action 'self' "+source, 1))
+}
@@ -0,0 +1,46 @@
+package migrations
+
+import (
+	"github.com/emvi/logbuch"
+	"github.com/muety/broilerplate/config"
+	"github.com/muety/broilerplate/models"
+	"github.com/muety/broilerplate/repositories"
+	"github.com/muety/broilerplate/services"
+	"gorm.io/gorm"
+)
+
+// maps the former is_admin flag to the built-in admin role, which is seeded along with all permissions
+func init() {
+	const name = "20261018-assign_admin_role"
+
+	f := migrationFunc{
+		name: name,
+		f: func(db *gorm.DB, cfg *config.Config) error {
+			if hasRun(name, db) {
+				return nil
+			}
+
+			roleRepository := repositories.NewRoleRepository(db)
+			if err := services.NewRoleService(nil, roleRepository).EnsureDefaults(); err != nil {
+				return err
+			}
+
+			var admins []*models.User
+			if err := db.Where("is_admin = ?", true).Find(&admins).Error; err != nil {
+				return err
+			}
+
+			for _, u := range admins {
+				if err := roleRepository.Assign(u.ID, models.RoleAdmin); err != nil {
+					return err
+				}
+			}
+
+			logbuch.Info("assigned admin role to %d existing admins", len(admins))
+			setHasRun(name, db)
+			return nil
+		},
+	}
+
+	registerPostMigration(f)
+}
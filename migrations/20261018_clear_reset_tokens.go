@@ -0,0 +1,35 @@
+package migrations
+
+import (
+	"github.com/emvi/logbuch"
+	"github.com/muety/broilerplate/config"
+	"github.com/muety/broilerplate/models"
+	"gorm.io/gorm"
+)
+
+// invalidates pending password reset tokens, which used to be stored in plain text and without expiry
+func init() {
+	const name = "20261018-clear_reset_tokens"
+
+	f := migrationFunc{
+		name: name,
+		f: func(db *gorm.DB, cfg *config.Config) error {
+			if hasRun(name, db) {
+				return nil
+			}
+
+			result := db.Model(&models.User{}).
+				Where("reset_token != '' AND reset_token_created_at IS NULL").
+				Update("reset_token", "")
+			if err := result.Error; err != nil {
+				return err
+			}
+
+			logbuch.Info("invalidated %d legacy password reset tokens", result.RowsAffected)
+			setHasRun(name, db)
+			return nil
+		},
+	}
+
+	registerPostMigration(f)
+}
@@ -0,0 +1,59 @@
+package migrations
+
+import (
+	"github.com/emvi/logbuch"
+	"github.com/muety/broilerplate/config"
+	"github.com/muety/broilerplate/models"
+	"github.com/muety/broilerplate/repositories"
+	"github.com/muety/broilerplate/services"
+	"github.com/muety/broilerplate/utils"
+	"gorm.io/gorm"
+)
+
+// replaces plain text api keys by their keyed hash, while keeping existing keys valid
+func init() {
+	const name = "20261018-hash_api_keys"
+	const prefixLength = 8
+
+	f := migrationFunc{
+		name: name,
+		f: func(db *gorm.DB, cfg *config.Config) error {
+			if hasRun(name, db) {
+				return nil
+			}
+
+			hashKey, err := services.NewKeyValueService(repositories.NewKeyValueRepository(db)).GetOrCreateSecret(models.ApiKeyHashKeyKey, 32)
+			if err != nil {
+				return err
+			}
+
+			var users []*models.User
+			if err := db.Where("api_key_prefix = '' OR api_key_prefix IS NULL").Find(&users).Error; err != nil {
+				return err
+			}
+
+			tx := db.Begin()
+			for _, u := range users {
+				if len(u.ApiKey) < prefixLength {
+					continue
+				}
+				if err := tx.Model(u).Updates(map[string]interface{}{
+					"api_key":        utils.HashHmac(u.ApiKey, string(hashKey)),
+					"api_key_prefix": u.ApiKey[:prefixLength],
+				}).Error; err != nil {
+					tx.Rollback()
+					return err
+				}
+			}
+			if err := tx.Commit().Error; err != nil {
+				return err
+			}
+
+			logbuch.Info("hashed api keys of %d users", len(users))
+			setHasRun(name, db)
+			return nil
+		},
+	}
+
+	registerPostMigration(f)
+}
@@ -0,0 +1,35 @@
+package migrations
+
+import (
+	"github.com/emvi/logbuch"
+	"github.com/muety/broilerplate/config"
+	"github.com/muety/broilerplate/models"
+	"gorm.io/gorm"
+)
+
+// addresses of accounts created before e-mail verification was introduced are considered confirmed, to not lock anyone out
+func init() {
+	const name = "20261018-mark_existing_emails_verified"
+
+	f := migrationFunc{
+		name: name,
+		f: func(db *gorm.DB, cfg *config.Config) error {
+			if hasRun(name, db) {
+				return nil
+			}
+
+			result := db.Model(&models.User{}).
+				Where("email IS NOT NULL AND email != ''").
+				Update("email_verified", true)
+			if result.Error != nil {
+				return result.Error
+			}
+
+			logbuch.Info("marked e-mail addresses of %d existing users as verified", result.RowsAffected)
+			setHasRun(name, db)
+			return nil
+		},
+	}
+
+	registerPostMigration(f)
+}
@@ -0,0 +1,89 @@
+package models
+
+import (
+	"strings"
+	"time"
+)
+
+// ApiTokenPrefix is prepended to every generated token to tell tokens apart from legacy api keys
+const ApiTokenPrefix = "bp_"
+
+const (
+	ScopeMetricsRead = "metrics:read"
+	ScopeUsersAdmin  = "users:admin"
+	ScopeSystemAdmin = "system:admin"
+)
+
+// ApiTokenScopes lists all scopes available to tokens
+var ApiTokenScopes = []string{ScopeMetricsRead, ScopeUsersAdmin, ScopeSystemAdmin}
+
+// apiTokenScopePermissions maps admin scopes to the permission a user needs to grant them
+var apiTokenScopePermissions = map[string]string{
+	ScopeUsersAdmin:  PermissionUsersManage,
+	ScopeSystemAdmin: PermissionSystemManage,
+}
+
+type ApiToken struct {
+	ID         string      `json:"id" gorm:"primary_key"`
+	User       *User       `json:"-" gorm:"not null; constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	UserID     string      `json:"-" gorm:"not null; index:idx_api_token_user"`
+	Name       string      `json:"name" gorm:"size:64"`
+	Prefix     string      `json:"prefix" gorm:"size:16"` // first few characters of the plain token to help users identify it
+	TokenHash  string      `json:"-" gorm:"unique; size:64"`
+	Scopes     string      `json:"scopes"` // comma-separated
+	CreatedAt  CustomTime  `json:"created_at" gorm:"type:timestamp; default:CURRENT_TIMESTAMP" swaggertype:"string" format:"date" example:"2006-01-02 15:04:05.000"`
+	ExpiresAt  *CustomTime `json:"expires_at" gorm:"type:timestamp" swaggertype:"string" format:"date" example:"2006-01-02 15:04:05.000"`
+	LastUsedAt *CustomTime `json:"last_used_at" gorm:"type:timestamp" swaggertype:"string" format:"date" example:"2006-01-02 15:04:05.000"`
+}
+
+type ApiTokenCreateRequest struct {
+	Name          string   `schema:"name"`
+	Scopes        []string `schema:"scopes"`
+	ExpiresInDays int      `schema:"expires_in_days"` // zero meaning no expiry
+}
+
+func (t *ApiToken) GetScopes() []string {
+	if t.Scopes == "" {
+		return []string{}
+	}
+	return strings.Split(t.Scopes, ",")
+}
+
+func (t *ApiToken) HasScope(scope string) bool {
+	for _, s := range t.GetScopes() {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *ApiToken) IsExpired() bool {
+	return t.ExpiresAt != nil && time.Now().After(t.ExpiresAt.T())
+}
+
+func (r *ApiTokenCreateRequest) IsValid() bool {
+	if len(r.Name) < 1 || len(r.Name) > 64 || len(r.Scopes) == 0 || r.ExpiresInDays < 0 {
+		return false
+	}
+	for _, s := range r.Scopes {
+		if !ValidateScope(s) {
+			return false
+		}
+	}
+	return true
+}
+
+func ValidateScope(scope string) bool {
+	for _, s := range ApiTokenScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// ScopePermission returns the permission required to grant the given scope, or an empty string, if anyone may grant it
+func ScopePermission(scope string) string {
+	return apiTokenScopePermissions[scope]
+}
@@ -0,0 +1,147 @@
+package models
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+const AuditEventPageSize = 50
+
+const (
+	AuditLoginSuccess          = "login.success"
+	AuditLoginFailure          = "login.failure"
+	AuditLogout                = "logout"
+	AuditPasswordChange        = "password.change"
+	AuditPasswordResetRequest  = "password.reset_request"
+	AuditApiKeyReset           = "api_key.reset"
+	AuditTotpDisable           = "totp.disable"
+	AuditRoleAssign            = "role.assign"
+	AuditRoleUnassign          = "role.unassign"
+	AuditUserDelete            = "user.delete"
+	AuditUserDeletionScheduled = "user.deletion_scheduled"
+	AuditUserDeletionCancelled = "user.deletion_cancelled"
+	AuditClientCertRegister    = "client_cert.register"
+	AuditClientCertRevoke      = "client_cert.revoke"
+	AuditOAuthClientRegister   = "oauth_client.register"
+	AuditOAuthClientDelete     = "oauth_client.delete"
+	AuditOAuthAuthorize        = "oauth.authorize"
+	AuditOAuthRevoke           = "oauth.revoke"
+)
+
+// AuditActions lists all recorded actions, e.g. to filter the audit log by
+var AuditActions = []string{
+	AuditLoginSuccess,
+	AuditLoginFailure,
+	AuditLogout,
+	AuditPasswordChange,
+	AuditPasswordResetRequest,
+	AuditApiKeyReset,
+	AuditTotpDisable,
+	AuditRoleAssign,
+	AuditRoleUnassign,
+	AuditUserDelete,
+	AuditUserDeletionScheduled,
+	AuditUserDeletionCancelled,
+	AuditClientCertRegister,
+	AuditClientCertRevoke,
+	AuditOAuthClientRegister,
+	AuditOAuthClientDelete,
+	AuditOAuthAuthorize,
+	AuditOAuthRevoke,
+}
+
+// AuditOrigin tells who triggered an action from where, it is nil for actions taken by the system itself
+type AuditOrigin struct {
+	ActorID   string
+	IP        string
+	UserAgent string
+}
+
+// AuditEvent is an entry of the audit log, entries are chained by their hashes to reveal later modifications
+type AuditEvent struct {
+	ID        uint       `json:"id" gorm:"primary_key"`
+	CreatedAt CustomTime `json:"created_at" gorm:"type:timestamp; default:CURRENT_TIMESTAMP; index:idx_audit_event_created" swaggertype:"string" format:"date" example:"2006-01-02 15:04:05.000"`
+	Action    string     `json:"action" gorm:"size:64; index:idx_audit_event_action"`
+	ActorID   string     `json:"actor_id" gorm:"index:idx_audit_event_actor"` // deliberately no foreign keys, as entries have to outlive deleted users
+	TargetID  string     `json:"target_id" gorm:"index:idx_audit_event_target"`
+	IP        string     `json:"ip"`
+	UserAgent string     `json:"user_agent"`
+	Details   string     `json:"details"`
+	PrevHash  string     `json:"prev_hash" gorm:"size:64; uniqueIndex:idx_audit_event_prev_hash"` // unique, so that concurrent writers can't fork the chain
+	Hash      string     `json:"hash" gorm:"size:64"`
+}
+
+// AuditEventQuery describes a single page of the filtered audit log
+type AuditEventQuery struct {
+	Action string `schema:"action"`
+	UserID string `schema:"user"` // matches both actor and target
+	Since  string `schema:"since"`
+	Until  string `schema:"until"`
+	Page   int    `schema:"page"`
+}
+
+func NewAuditEvent(action string, origin *AuditOrigin, targetId, details string) *AuditEvent {
+	event := &AuditEvent{
+		CreatedAt: CustomTime(time.Now().Truncate(time.Second)),
+		Action:    action,
+		TargetID:  targetId,
+		Details:   details,
+	}
+	if origin != nil {
+		event.ActorID = origin.ActorID
+		event.IP = origin.IP
+		event.UserAgent = origin.UserAgent
+	}
+	return event
+}
+
+// Payload returns the content covered by the entry's hash, timestamps are only included to the second, as not all databases store them more precisely
+func (e *AuditEvent) Payload() string {
+	return strings.Join([]string{
+		e.PrevHash,
+		strconv.FormatInt(e.CreatedAt.T().Unix(), 10),
+		e.Action,
+		e.ActorID,
+		e.TargetID,
+		e.IP,
+		e.UserAgent,
+		e.Details,
+	}, "\x00")
+}
+
+func (q *AuditEventQuery) Normalize() *AuditEventQuery {
+	q.UserID = strings.TrimSpace(q.UserID)
+	if q.Page < 1 {
+		q.Page = 1
+	}
+	return q
+}
+
+func (q *AuditEventQuery) Offset() int {
+	return (q.Page - 1) * AuditEventPageSize
+}
+
+// SinceTime returns the beginning of the day given as lower bound, if any
+func (q *AuditEventQuery) SinceTime() *time.Time {
+	if t, err := time.ParseInLocation("2006-01-02", q.Since, time.Local); err == nil {
+		return &t
+	}
+	return nil
+}
+
+// UntilTime returns the end of the day given as upper bound, if any
+func (q *AuditEventQuery) UntilTime() *time.Time {
+	if t, err := time.ParseInLocation("2006-01-02", q.Until, time.Local); err == nil {
+		t = t.AddDate(0, 0, 1)
+		return &t
+	}
+	return nil
+}
+
+// AuditChainStatus is the outcome of verifying the audit log's hash chain
+type AuditChainStatus struct {
+	Checked  int
+	Intact   bool
+	BrokenAt uint // id of the first entry which was altered or whose predecessor is missing
+}
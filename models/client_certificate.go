@@ -0,0 +1,44 @@
+package models
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"regexp"
+	"strings"
+)
+
+var fingerprintRegex = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// ClientCertificate is a tls client certificate, which an admin registered for a (usually non-human) user to authenticate with
+type ClientCertificate struct {
+	Fingerprint string      `json:"fingerprint" gorm:"primary_key; size:64"` // hex-encoded sha-256 of the der-encoded certificate
+	User        *User       `json:"-" gorm:"not null; constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	UserID      string      `json:"user_id" gorm:"not null; index:idx_client_certificate_user"`
+	Name        string      `json:"name" gorm:"size:64"`
+	CreatedAt   CustomTime  `json:"created_at" gorm:"type:timestamp; default:CURRENT_TIMESTAMP" swaggertype:"string" format:"date" example:"2006-01-02 15:04:05.000"`
+	LastUsedAt  *CustomTime `json:"last_used_at" gorm:"type:timestamp" swaggertype:"string" format:"date" example:"2006-01-02 15:04:05.000"`
+}
+
+type ClientCertificateCreateRequest struct {
+	UserID      string `schema:"user_id"`
+	Name        string `schema:"name"`
+	Fingerprint string `schema:"fingerprint"`
+}
+
+// CertificateFingerprint computes the sha-256 fingerprint of a certificate, as also shown by e.g. openssl x509 -fingerprint -sha256
+func CertificateFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// NormalizeFingerprint accepts fingerprints with colons, spaces and in either case, as different tools print them
+func NormalizeFingerprint(fingerprint string) (string, bool) {
+	normalized := strings.ToLower(strings.NewReplacer(":", "", " ", "").Replace(strings.TrimSpace(fingerprint)))
+	return normalized, fingerprintRegex.MatchString(normalized)
+}
+
+func (r *ClientCertificateCreateRequest) IsValid() bool {
+	_, ok := NormalizeFingerprint(r.Fingerprint)
+	return ok && r.UserID != "" && len(r.Name) <= 64
+}
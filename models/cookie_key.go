@@ -0,0 +1,22 @@
+package models
+
+import (
+	"time"
+)
+
+// CookieKey is a pair of keys used to sign (hash key) and encrypt (block key) secure cookies
+type CookieKey struct {
+	HashKey   []byte     `json:"hash_key"`
+	BlockKey  []byte     `json:"block_key"`
+	CreatedAt time.Time  `json:"created_at"`
+	RetiredAt *time.Time `json:"retired_at,omitempty"`
+}
+
+func (k *CookieKey) IsRetired() bool {
+	return k.RetiredAt != nil
+}
+
+// IsExpired returns whether the key was retired longer than the given grace period ago and can be discarded
+func (k *CookieKey) IsExpired(gracePeriod time.Duration) bool {
+	return k.IsRetired() && time.Since(*k.RetiredAt) > gracePeriod
+}
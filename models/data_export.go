@@ -0,0 +1,49 @@
+package models
+
+// UserDataExport bundles everything stored about a user, as handed out to them on request, while secrets like password hashes or keys are never included
+type UserDataExport struct {
+	ExportedAt  CustomTime            `json:"exported_at"`
+	User        *UserExport           `json:"user"`
+	Roles       []string              `json:"roles"`
+	Memberships []*Membership         `json:"memberships"`
+	Sessions    []*Session            `json:"sessions"`
+	ApiTokens   []*ApiToken           `json:"api_tokens"`
+	Passkeys    []*WebauthnCredential `json:"passkeys"`
+	ClientCerts []*ClientCertificate  `json:"client_certificates"`
+	OAuthGrants []*OAuthGrant         `json:"authorized_apps"`
+	Devices     []*KnownDevice        `json:"devices"`
+	AuditEvents []*AuditEvent         `json:"audit_events"`
+}
+
+// UserExport is the non-secret part of a user's data
+type UserExport struct {
+	ID                  string      `json:"id"`
+	Email               string      `json:"email"`
+	EmailVerified       bool        `json:"email_verified"`
+	PendingEmail        string      `json:"pending_email,omitempty"`
+	Location            string      `json:"location"`
+	ApiKeyPrefix        string      `json:"api_key_prefix"`
+	TotpEnabled         bool        `json:"totp_enabled"`
+	ReportsWeekly       bool        `json:"reports_weekly"`
+	NotifyNewLogins     bool        `json:"notify_new_logins"`
+	CreatedAt           CustomTime  `json:"created_at"`
+	LastLoggedInAt      CustomTime  `json:"last_logged_in_at"`
+	DeletionScheduledAt *CustomTime `json:"deletion_scheduled_at,omitempty"`
+}
+
+func NewUserExport(u *User) *UserExport {
+	return &UserExport{
+		ID:                  u.ID,
+		Email:               u.Email,
+		EmailVerified:       u.EmailVerified,
+		PendingEmail:        u.PendingEmail,
+		Location:            u.Location,
+		ApiKeyPrefix:        u.ApiKeyPrefix,
+		TotpEnabled:         u.TotpEnabled,
+		ReportsWeekly:       u.ReportsWeekly,
+		NotifyNewLogins:     u.NotifyNewLogins,
+		CreatedAt:           u.CreatedAt,
+		LastLoggedInAt:      u.LastLoggedInAt,
+		DeletionScheduledAt: u.DeletionScheduledAt,
+	}
+}
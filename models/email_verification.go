@@ -0,0 +1,17 @@
+package models
+
+import "time"
+
+// EmailVerification is a pending confirmation of an e-mail address, either after signup or after changing the address
+type EmailVerification struct {
+	TokenHash string     `gorm:"primary_key; size:64"`
+	User      *User      `gorm:"not null; constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	UserID    string     `gorm:"not null; index:idx_email_verification_user"`
+	Email     string     `gorm:"size:255"`
+	CreatedAt CustomTime `gorm:"type:timestamp; default:CURRENT_TIMESTAMP" swaggertype:"string" format:"date" example:"2006-01-02 15:04:05.000"`
+	ExpiresAt CustomTime `gorm:"type:timestamp" swaggertype:"string" format:"date" example:"2006-01-02 15:04:05.000"`
+}
+
+func (v *EmailVerification) IsExpired() bool {
+	return time.Now().After(v.ExpiresAt.T())
+}
@@ -0,0 +1,42 @@
+package models
+
+import "time"
+
+// Invitation allows the invited person to sign up once, even if open registration is disabled
+type Invitation struct {
+	ID         string      `json:"id" gorm:"primary_key"`
+	TokenHash  string      `json:"-" gorm:"unique; not null; size:64"`
+	Email      string      `json:"email" gorm:"size:255"`
+	Inviter    *User       `json:"-" gorm:"not null; constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	InviterID  string      `json:"inviter_id" gorm:"not null; index:idx_invitation_inviter"`
+	CreatedAt  CustomTime  `json:"created_at" gorm:"type:timestamp; default:CURRENT_TIMESTAMP" swaggertype:"string" format:"date" example:"2006-01-02 15:04:05.000"`
+	ExpiresAt  CustomTime  `json:"expires_at" gorm:"type:timestamp" swaggertype:"string" format:"date" example:"2006-01-02 15:04:05.000"`
+	ConsumedAt *CustomTime `json:"consumed_at" gorm:"type:timestamp" swaggertype:"string" format:"date" example:"2006-01-02 15:04:05.000"`
+	ConsumedBy string      `json:"consumed_by"`
+}
+
+type InvitationCreateRequest struct {
+	Email string `json:"email" schema:"email"`
+}
+
+// InvitationCreateResponse is only returned once upon creation, as the plain token isn't stored
+type InvitationCreateResponse struct {
+	Invitation *Invitation `json:"invitation"`
+	Link       string      `json:"link"`
+}
+
+func (i *Invitation) IsExpired() bool {
+	return time.Now().After(i.ExpiresAt.T())
+}
+
+func (i *Invitation) IsConsumed() bool {
+	return i.ConsumedAt != nil
+}
+
+func (i *Invitation) IsPending() bool {
+	return !i.IsConsumed() && !i.IsExpired()
+}
+
+func (r *InvitationCreateRequest) IsValid() bool {
+	return r.Email != "" && ValidateEmail(r.Email)
+}
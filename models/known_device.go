@@ -0,0 +1,17 @@
+package models
+
+import "time"
+
+// KnownDeviceRetention is how long a device is remembered after it was last used to log in
+const KnownDeviceRetention = 180 * 24 * time.Hour
+
+// KnownDevice is a combination of client and ip address a user has logged in from before, used to tell about sign-ins from new ones
+type KnownDevice struct {
+	ID         uint       `json:"-" gorm:"primary_key"`
+	User       *User      `json:"-" gorm:"not null; constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	UserID     string     `json:"-" gorm:"not null; index:idx_known_device_user"`
+	Client     string     `json:"client"` // parsed from the user agent, as the raw one changes with every browser update
+	IP         string     `json:"ip"`
+	CreatedAt  CustomTime `json:"created_at" gorm:"type:timestamp; default:CURRENT_TIMESTAMP" swaggertype:"string" format:"date" example:"2006-01-02 15:04:05.000"`
+	LastSeenAt CustomTime `json:"last_seen_at" gorm:"type:timestamp; default:CURRENT_TIMESTAMP; index:idx_known_device_last_seen" swaggertype:"string" format:"date" example:"2006-01-02 15:04:05.000"`
+}
@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+// MagicLink is a single-use login link, which was mailed to a user's verified e-mail address
+type MagicLink struct {
+	TokenHash string     `gorm:"primary_key; size:64"`
+	User      *User      `gorm:"not null; constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	UserID    string     `gorm:"not null; index:idx_magic_link_user"`
+	CreatedAt CustomTime `gorm:"type:timestamp; default:CURRENT_TIMESTAMP" swaggertype:"string" format:"date" example:"2006-01-02 15:04:05.000"`
+	ExpiresAt CustomTime `gorm:"type:timestamp" swaggertype:"string" format:"date" example:"2006-01-02 15:04:05.000"`
+}
+
+func (l *MagicLink) IsExpired() bool {
+	return time.Now().After(l.ExpiresAt.T())
+}
@@ -0,0 +1,269 @@
+package models
+
+import (
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// prefixes of tokens issued to third-party apps, to tell them apart from api tokens and legacy api keys
+const (
+	OAuthAccessTokenPrefix  = "bpa_"
+	OAuthRefreshTokenPrefix = "bpr_"
+)
+
+// OAuthCodeTtl is the time within which an app has to exchange an authorization code for tokens
+const OAuthCodeTtl = 10 * time.Minute
+
+const OAuthCodeChallengeS256 = "S256"
+
+// error codes as defined by rfc 6749
+const (
+	OAuthErrInvalidRequest          = "invalid_request"
+	OAuthErrInvalidClient           = "invalid_client"
+	OAuthErrInvalidGrant            = "invalid_grant"
+	OAuthErrInvalidScope            = "invalid_scope"
+	OAuthErrAccessDenied            = "access_denied"
+	OAuthErrUnsupportedGrantType    = "unsupported_grant_type"
+	OAuthErrUnsupportedResponseType = "unsupported_response_type"
+	OAuthErrServerError             = "server_error"
+)
+
+// OAuthClient is a third-party app registered by an admin, which users can authorize to access the api on their behalf
+type OAuthClient struct {
+	ID           string     `json:"id" gorm:"primary_key; size:32"` // the client_id
+	Name         string     `json:"name" gorm:"size:64"`
+	RedirectUris string     `json:"redirect_uris"`    // newline-separated
+	Scopes       string     `json:"scopes"`           // comma-separated, the most the app may ask for
+	SecretHash   string     `json:"-" gorm:"size:64"` // empty for public clients (e.g. native or single-page apps), which rely on pkce alone
+	CreatedAt    CustomTime `json:"created_at" gorm:"type:timestamp; default:CURRENT_TIMESTAMP" swaggertype:"string" format:"date" example:"2006-01-02 15:04:05.000"`
+}
+
+// OAuthGrant is a user's consent for an app to access their account, revoking it also invalidates all of the app's tokens
+type OAuthGrant struct {
+	ID         string       `json:"id" gorm:"primary_key"`
+	User       *User        `json:"-" gorm:"not null; constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	UserID     string       `json:"-" gorm:"not null; uniqueIndex:idx_oauth_grant_user_client"`
+	Client     *OAuthClient `json:"client" gorm:"not null; constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	ClientID   string       `json:"-" gorm:"not null; size:32; uniqueIndex:idx_oauth_grant_user_client"`
+	Scopes     string       `json:"scopes"` // comma-separated
+	CreatedAt  CustomTime   `json:"created_at" gorm:"type:timestamp; default:CURRENT_TIMESTAMP" swaggertype:"string" format:"date" example:"2006-01-02 15:04:05.000"`
+	LastUsedAt *CustomTime  `json:"last_used_at" gorm:"type:timestamp" swaggertype:"string" format:"date" example:"2006-01-02 15:04:05.000"`
+}
+
+// OAuthAuthorizationCode is issued after consent and can be exchanged for tokens once, only its hash is stored
+type OAuthAuthorizationCode struct {
+	CodeHash      string      `gorm:"primary_key; size:64"`
+	Grant         *OAuthGrant `gorm:"not null; constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	GrantID       string      `gorm:"not null"`
+	RedirectUri   string
+	Scopes        string     // comma-separated
+	CodeChallenge string     `gorm:"size:64"`
+	ExpiresAt     CustomTime `gorm:"type:timestamp; index:idx_oauth_code_expires"`
+}
+
+// OAuthToken is a pair of access and refresh token, of which only the hashes are stored
+type OAuthToken struct {
+	ID               string      `gorm:"primary_key"`
+	Grant            *OAuthGrant `gorm:"not null; constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	GrantID          string      `gorm:"not null; index:idx_oauth_token_grant"`
+	AccessTokenHash  string      `gorm:"unique; size:64"`
+	RefreshTokenHash string      `gorm:"unique; size:64"`
+	Scopes           string      // comma-separated
+	CreatedAt        CustomTime  `gorm:"type:timestamp; default:CURRENT_TIMESTAMP"`
+	AccessExpiresAt  CustomTime  `gorm:"type:timestamp"`
+	RefreshExpiresAt CustomTime  `gorm:"type:timestamp; index:idx_oauth_token_refresh_expires"`
+}
+
+type OAuthClientCreateRequest struct {
+	Name         string   `schema:"name"`
+	RedirectUris string   `schema:"redirect_uris"` // one per line
+	Scopes       []string `schema:"scopes"`
+	Confidential bool     `schema:"confidential"`
+}
+
+// OAuthAuthorizeRequest holds the parameters an app sends the user's browser to the authorization endpoint with
+type OAuthAuthorizeRequest struct {
+	ResponseType        string `schema:"response_type"`
+	ClientID            string `schema:"client_id"`
+	RedirectUri         string `schema:"redirect_uri"`
+	Scope               string `schema:"scope"` // space-separated
+	State               string `schema:"state"`
+	CodeChallenge       string `schema:"code_challenge"`
+	CodeChallengeMethod string `schema:"code_challenge_method"`
+}
+
+type OAuthTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+}
+
+// OAuthIntrospection is the response to a token introspection request as of rfc 7662, all but active are omitted for inactive tokens
+type OAuthIntrospection struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Username  string `json:"username,omitempty"`
+	Subject   string `json:"sub,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+}
+
+// OAuthError is an error to be reported to the app, as opposed to internal errors
+type OAuthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func NewOAuthError(code, description string) *OAuthError {
+	return &OAuthError{Code: code, Description: description}
+}
+
+func (e *OAuthError) Error() string {
+	return e.Code + ": " + e.Description
+}
+
+func (c *OAuthClient) GetRedirectUris() []string {
+	return splitNonEmpty(c.RedirectUris, "\n")
+}
+
+// HasRedirectUri compares uris exactly, as recommended by the oauth 2.0 security best current practice
+func (c *OAuthClient) HasRedirectUri(uri string) bool {
+	for _, u := range c.GetRedirectUris() {
+		if u == uri {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *OAuthClient) GetScopes() []string {
+	return splitNonEmpty(c.Scopes, ",")
+}
+
+func (c *OAuthClient) HasScope(scope string) bool {
+	return containsString(c.GetScopes(), scope)
+}
+
+// ResolveRedirectUri falls back to the only registered uri if the app didn't specify one, as permitted by rfc 6749
+func (c *OAuthClient) ResolveRedirectUri(uri string) (string, bool) {
+	if uri == "" {
+		if uris := c.GetRedirectUris(); len(uris) == 1 {
+			return uris[0], true
+		}
+		return "", false
+	}
+	return uri, c.HasRedirectUri(uri)
+}
+
+func (c *OAuthClient) IsConfidential() bool {
+	return c.SecretHash != ""
+}
+
+func (g *OAuthGrant) GetScopes() []string {
+	return splitNonEmpty(g.Scopes, ",")
+}
+
+func (g *OAuthGrant) HasScope(scope string) bool {
+	return containsString(g.GetScopes(), scope)
+}
+
+func (t *OAuthToken) GetScopes() []string {
+	return splitNonEmpty(t.Scopes, ",")
+}
+
+func (t *OAuthToken) HasScope(scope string) bool {
+	return containsString(t.GetScopes(), scope)
+}
+
+func (t *OAuthToken) IsAccessExpired() bool {
+	return time.Now().After(t.AccessExpiresAt.T())
+}
+
+func (t *OAuthToken) IsRefreshExpired() bool {
+	return time.Now().After(t.RefreshExpiresAt.T())
+}
+
+func (c *OAuthAuthorizationCode) IsExpired() bool {
+	return time.Now().After(c.ExpiresAt.T())
+}
+
+func (c *OAuthAuthorizationCode) GetScopes() []string {
+	return splitNonEmpty(c.Scopes, ",")
+}
+
+func (r *OAuthClientCreateRequest) GetRedirectUris() []string {
+	uris := []string{}
+	for _, u := range strings.Split(r.RedirectUris, "\n") {
+		if u = strings.TrimSpace(u); u != "" {
+			uris = append(uris, u)
+		}
+	}
+	return uris
+}
+
+func (r *OAuthClientCreateRequest) IsValid() bool {
+	if len(r.Name) < 1 || len(r.Name) > 64 || len(r.Scopes) == 0 || len(r.GetRedirectUris()) == 0 {
+		return false
+	}
+	for _, s := range r.Scopes {
+		if !ValidateScope(s) {
+			return false
+		}
+	}
+	for _, u := range r.GetRedirectUris() {
+		if !ValidateRedirectUri(u) {
+			return false
+		}
+	}
+	return true
+}
+
+// GetScopes returns the requested scopes, which the scope parameter lists separated by spaces
+func (r *OAuthAuthorizeRequest) GetScopes() []string {
+	return strings.Fields(r.Scope)
+}
+
+// ValidateRedirectUri accepts absolute uris without fragment, plain http only for loopback addresses used by native apps (rfc 8252)
+func ValidateRedirectUri(uri string) bool {
+	u, err := url.Parse(uri)
+	if err != nil || !u.IsAbs() || u.Fragment != "" || strings.ContainsAny(uri, " \t") {
+		return false
+	}
+	switch u.Scheme {
+	case "https":
+		return u.Host != ""
+	case "http":
+		if u.Hostname() == "localhost" {
+			return true
+		}
+		ip := net.ParseIP(u.Hostname())
+		return ip != nil && ip.IsLoopback()
+	case "javascript", "data", "file":
+		return false
+	default:
+		// private-use schemes of native apps, e.g. com.example.app:/callback
+		return strings.Contains(u.Scheme, ".")
+	}
+}
+
+func splitNonEmpty(s, sep string) []string {
+	if s == "" {
+		return []string{}
+	}
+	return strings.Split(s, sep)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
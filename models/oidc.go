@@ -0,0 +1,25 @@
+package models
+
+import "time"
+
+// OidcIdentity links a user to the subject identifier of an external openid connect identity provider
+type OidcIdentity struct {
+	ProviderName string     `gorm:"primary_key; size:255"`
+	Subject      string     `gorm:"primary_key; size:255"`
+	User         *User      `gorm:"not null; constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	UserID       string     `gorm:"not null; index:idx_oidc_identity_user"`
+	CreatedAt    CustomTime `gorm:"type:timestamp; default:CURRENT_TIMESTAMP" swaggertype:"string" format:"date" example:"2006-01-02 15:04:05.000"`
+}
+
+// OidcState holds the state of an ongoing authorization code flow and is kept in a short-lived cookie
+type OidcState struct {
+	Provider     string
+	State        string
+	Nonce        string
+	CodeVerifier string
+	ExpiresAt    time.Time
+}
+
+func (s *OidcState) IsExpired() bool {
+	return time.Now().After(s.ExpiresAt)
+}
@@ -0,0 +1,98 @@
+package models
+
+import (
+	"strings"
+	"time"
+)
+
+const (
+	OrgRoleOwner  = "owner"
+	OrgRoleAdmin  = "admin"
+	OrgRoleMember = "member"
+)
+
+// OrgRoles lists the roles a member can hold within an organization, ordered by decreasing privileges
+var OrgRoles = []string{OrgRoleOwner, OrgRoleAdmin, OrgRoleMember}
+
+type Organization struct {
+	ID        string     `json:"id" gorm:"primary_key"`
+	Name      string     `json:"name" gorm:"size:64"`
+	CreatedAt CustomTime `json:"created_at" gorm:"type:timestamp; default:CURRENT_TIMESTAMP" swaggertype:"string" format:"date" example:"2006-01-02 15:04:05.000"`
+}
+
+// Membership links a user to an organization with an organization-specific role
+type Membership struct {
+	Organization   *Organization `json:"organization,omitempty" gorm:"not null; constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	OrganizationID string        `json:"organization_id" gorm:"primary_key"`
+	User           *User         `json:"-" gorm:"not null; constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	UserID         string        `json:"user_id" gorm:"primary_key; index:idx_membership_user"`
+	Role           string        `json:"role" gorm:"size:16"`
+	CreatedAt      CustomTime    `json:"created_at" gorm:"type:timestamp; default:CURRENT_TIMESTAMP" swaggertype:"string" format:"date" example:"2006-01-02 15:04:05.000"`
+}
+
+// OrganizationInvitation allows an existing user to join an organization once, unlike Invitation, which is about signing up
+type OrganizationInvitation struct {
+	ID             string        `json:"id" gorm:"primary_key"`
+	Organization   *Organization `json:"-" gorm:"not null; constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	OrganizationID string        `json:"organization_id" gorm:"not null; index:idx_org_invitation_org"`
+	TokenHash      string        `json:"-" gorm:"unique; not null; size:64"`
+	Email          string        `json:"email" gorm:"size:255"`
+	Role           string        `json:"role" gorm:"size:16"`
+	Inviter        *User         `json:"-" gorm:"not null; constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	InviterID      string        `json:"inviter_id" gorm:"not null"`
+	CreatedAt      CustomTime    `json:"created_at" gorm:"type:timestamp; default:CURRENT_TIMESTAMP" swaggertype:"string" format:"date" example:"2006-01-02 15:04:05.000"`
+	ExpiresAt      CustomTime    `json:"expires_at" gorm:"type:timestamp" swaggertype:"string" format:"date" example:"2006-01-02 15:04:05.000"`
+}
+
+type OrganizationCreateRequest struct {
+	Name string `schema:"name"`
+}
+
+type OrganizationInviteRequest struct {
+	Email string `schema:"email"`
+	Role  string `schema:"role"`
+}
+
+type MembershipUpdateRequest struct {
+	UserID string `schema:"user_id"`
+	Role   string `schema:"role"`
+}
+
+func (m *Membership) IsOwner() bool {
+	return m.Role == OrgRoleOwner
+}
+
+// CanManage tells whether the member may invite, remove and change the roles of other members
+func (m *Membership) CanManage() bool {
+	return m.Role == OrgRoleOwner || m.Role == OrgRoleAdmin
+}
+
+func (i *OrganizationInvitation) IsExpired() bool {
+	return time.Now().After(i.ExpiresAt.T())
+}
+
+func (r *OrganizationCreateRequest) IsValid() bool {
+	return ValidateOrganizationName(r.Name)
+}
+
+func (r *OrganizationInviteRequest) IsValid() bool {
+	return r.Email != "" && ValidateEmail(r.Email) && ValidateOrgRole(r.Role)
+}
+
+func (r *MembershipUpdateRequest) IsValid() bool {
+	return r.UserID != "" && ValidateOrgRole(r.Role)
+}
+
+func ValidateOrganizationName(name string) bool {
+	name = strings.TrimSpace(name)
+	return len(name) >= 1 && len(name) <= 64
+}
+
+func ValidateOrgRole(role string) bool {
+	for _, r := range OrgRoles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
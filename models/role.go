@@ -0,0 +1,78 @@
+package models
+
+import "regexp"
+
+// RoleAdmin is the built-in role, which always holds every permission and is mirrored to User.IsAdmin
+const RoleAdmin = "admin"
+
+const (
+	PermissionUsersManage       = "users.manage"
+	PermissionInvitationsManage = "invitations.manage"
+	PermissionRolesManage       = "roles.manage"
+	PermissionSystemManage      = "system.manage"
+	PermissionMetricsView       = "metrics.view"
+	PermissionAuditView         = "audit.view"
+)
+
+// Permissions lists all permissions known to the application, they are seeded into the database on startup
+var Permissions = map[string]string{
+	PermissionUsersManage:       "View and manage user accounts",
+	PermissionInvitationsManage: "Invite new users",
+	PermissionRolesManage:       "Manage roles and assign them to users",
+	PermissionSystemManage:      "Manage system-wide settings, e.g. rotate cookie keys",
+	PermissionMetricsView:       "View instance-wide metrics",
+	PermissionAuditView:         "View and export the audit log",
+}
+
+var roleNameRegex = regexp.MustCompile(`^[a-z0-9_\-]{1,64}$`)
+
+type Permission struct {
+	Name        string `json:"name" gorm:"primary_key; size:64"`
+	Description string `json:"description"`
+}
+
+type Role struct {
+	Name        string        `json:"name" gorm:"primary_key; size:64"`
+	Description string        `json:"description"`
+	Permissions []*Permission `json:"permissions" gorm:"many2many:role_permissions; constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+}
+
+// UserRole assigns a role to a user, a user holds the union of all their roles' permissions
+type UserRole struct {
+	User     *User  `json:"-" gorm:"not null; constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	UserID   string `json:"user_id" gorm:"primary_key"`
+	Role     *Role  `json:"-" gorm:"foreignKey:RoleName; references:Name; constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	RoleName string `json:"role_name" gorm:"primary_key; size:64"`
+}
+
+type RoleSaveRequest struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
+}
+
+func (r *Role) HasPermission(permission string) bool {
+	for _, p := range r.Permissions {
+		if p.Name == permission {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *RoleSaveRequest) IsValid() bool {
+	if !roleNameRegex.MatchString(r.Name) || len(r.Description) > 255 {
+		return false
+	}
+	for _, p := range r.Permissions {
+		if !ValidatePermission(p) {
+			return false
+		}
+	}
+	return true
+}
+
+func ValidatePermission(permission string) bool {
+	_, ok := Permissions[permission]
+	return ok
+}
@@ -0,0 +1,18 @@
+package models
+
+import "time"
+
+type Session struct {
+	ID         string     `json:"id" gorm:"primary_key"`
+	User       *User      `json:"-" gorm:"not null; constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	UserID     string     `json:"user_id" gorm:"not null; index:idx_session_user"`
+	CreatedAt  CustomTime `json:"created_at" gorm:"type:timestamp; default:CURRENT_TIMESTAMP" swaggertype:"string" format:"date" example:"2006-01-02 15:04:05.000"`
+	LastSeenAt CustomTime `json:"last_seen_at" gorm:"type:timestamp; default:CURRENT_TIMESTAMP" swaggertype:"string" format:"date" example:"2006-01-02 15:04:05.000"`
+	IpAddress  string     `json:"ip_address" gorm:"size:64"`
+	UserAgent  string     `json:"user_agent" gorm:"size:255"`
+}
+
+// IsExpired returns whether the session was not used within the given maximum age (zero meaning no expiry)
+func (s *Session) IsExpired(maxAge time.Duration) bool {
+	return maxAge > 0 && time.Since(s.LastSeenAt.T()) > maxAge
+}
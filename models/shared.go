@@ -12,9 +12,21 @@ import (
 )
 
 const (
-	UserKey       = "user"
-	ImprintKey    = "imprint"
-	AuthCookieKey = "broilerplate_auth"
+	UserKey               = "user"
+	ImprintKey            = "imprint"
+	CookieKeysKey         = "cookie_keys"
+	EncryptionKeyKey      = "encryption_key"
+	RecoveryCodeKeyKey    = "recovery_code_key"
+	ApiKeyHashKeyKey      = "api_key_hash_key"
+	MagicLinkKeyKey       = "magic_link_key"
+	AuditKeyKey           = "audit_key"
+	CsrfKeyKey            = "csrf_key"
+	AuthCookieKey         = "broilerplate_auth"
+	SecondFactorCookieKey = "broilerplate_2fa"
+	WebauthnCookieKey     = "broilerplate_webauthn"
+	OidcCookieKey         = "broilerplate_oidc"
+	CsrfCookieKey         = "broilerplate_csrf"
+	ReturnToCookieKey     = "broilerplate_return_to"
 )
 
 type MigrationFunc func(db *gorm.DB) error
@@ -0,0 +1,30 @@
+package models
+
+import "time"
+
+const (
+	ThrottleKeyLoginIp    = "login_ip"
+	ThrottleKeyLoginUser  = "login_user"
+	ThrottleKeyResetIp    = "reset_ip"
+	ThrottleKeyResetEmail = "reset_email"
+)
+
+// ThrottleEntry keeps track of recent failed attempts for a client ip, username, etc.
+type ThrottleEntry struct {
+	Key           string     `gorm:"primary_key; size:255"` // e.g. login_user:alice
+	Failures      int        `gorm:"not null; default:0"`
+	LastFailureAt CustomTime `gorm:"type:timestamp; index:idx_throttle_last_failure"`
+	BlockedUntil  CustomTime `gorm:"type:timestamp"`
+}
+
+func ThrottleKey(kind, value string) string {
+	return kind + ":" + value
+}
+
+func (e *ThrottleEntry) IsBlocked() bool {
+	return time.Now().Before(e.BlockedUntil.T())
+}
+
+func (e *ThrottleEntry) RetryAfter() time.Duration {
+	return time.Until(e.BlockedUntil.T())
+}
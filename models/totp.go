@@ -0,0 +1,25 @@
+package models
+
+import "time"
+
+// RecoveryCode is a one-time code to log in with in place of a totp code, e.g. when having lost access to the authenticator device
+type RecoveryCode struct {
+	ID       uint   `gorm:"primary_key"`
+	User     *User  `json:"-" gorm:"not null; constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	UserID   string `gorm:"not null; index:idx_recovery_code_user"`
+	CodeHash string `gorm:"not null; size:64"`
+}
+
+type TotpCodeRequest struct {
+	Code string `schema:"code"`
+}
+
+// PendingLogin is stored in a short-lived cookie after successful password authentication, while the second factor is still outstanding
+type PendingLogin struct {
+	UserID    string
+	ExpiresAt time.Time
+}
+
+func (p *PendingLogin) IsExpired() bool {
+	return time.Now().After(p.ExpiresAt)
+}
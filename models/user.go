@@ -8,20 +8,46 @@ import (
 	"time"
 )
 
+const UserListPageSize = 25
+
+// UserSortColumns maps the sort keys accepted from the admin panel to database columns
+var UserSortColumns = map[string]string{
+	"id":         "id",
+	"email":      "email",
+	"created":    "created_at",
+	"last_login": "last_logged_in_at",
+}
+
 func init() {
 	mailRegex = regexp.MustCompile(MailPattern)
 }
 
 type User struct {
-	ID             string     `json:"id" gorm:"primary_key"`
-	ApiKey         string     `json:"api_key" gorm:"unique"`
-	Email          string     `json:"email" gorm:"index:idx_user_email; size:255"`
-	Location       string     `json:"location"`
-	Password       string     `json:"-"`
-	CreatedAt      CustomTime `gorm:"type:timestamp; default:CURRENT_TIMESTAMP" swaggertype:"string" format:"date" example:"2006-01-02 15:04:05.000"`
-	LastLoggedInAt CustomTime `gorm:"type:timestamp; default:CURRENT_TIMESTAMP" swaggertype:"string" format:"date" example:"2006-01-02 15:04:05.000"`
-	IsAdmin        bool       `json:"-" gorm:"default:false; type:bool"`
-	ResetToken     string     `json:"-"`
+	ID                  string      `json:"id" gorm:"primary_key"`
+	ApiKey              string      `json:"-" gorm:"unique"` // keyed hash of the actual api key, which is only shown once
+	ApiKeyPrefix        string      `json:"api_key_prefix"`
+	Email               string      `json:"email" gorm:"index:idx_user_email; size:255"`
+	Location            string      `json:"location"`
+	Password            string      `json:"-"`
+	CreatedAt           CustomTime  `gorm:"type:timestamp; default:CURRENT_TIMESTAMP" swaggertype:"string" format:"date" example:"2006-01-02 15:04:05.000"`
+	LastLoggedInAt      CustomTime  `gorm:"type:timestamp; default:CURRENT_TIMESTAMP" swaggertype:"string" format:"date" example:"2006-01-02 15:04:05.000"`
+	IsAdmin             bool        `json:"-" gorm:"default:false; type:bool"` // mirrors whether the admin role is assigned, authorization checks use permissions instead
+	ResetToken          string      `json:"-"`                                 // hash of the latest password reset token, issuing a new one invalidates it
+	ResetTokenCreatedAt *CustomTime `json:"-" gorm:"type:timestamp" swaggertype:"string" format:"date" example:"2006-01-02 15:04:05.000"`
+	EmailVerified       bool        `json:"email_verified" gorm:"default:false; type:bool"`
+	PendingEmail        string      `json:"-" gorm:"size:255"` // new address awaiting confirmation, replaces email once verified
+	LdapDn              string      `json:"-"`                 // set for users provisioned from the directory, whose passwords are checked against it
+	// encrypted totp secret, set as soon as 2fa enrollment was started, while only effective if enabled
+	TotpSecret      string `json:"-"`
+	TotpEnabled     bool   `json:"-" gorm:"default:false; type:bool"`
+	TotpLastCounter int64  `json:"-"`
+	// organization the user last switched to, only effective as long as the user is still a member
+	ActiveOrganizationID string `json:"-"`
+	// notification preferences
+	ReportsWeekly   bool `json:"-" gorm:"default:false; type:bool"`
+	NotifyNewLogins bool `json:"-" gorm:"default:true; type:bool"` // mail about logins from unknown devices
+	// set while the account is about to be deleted on its owner's request
+	DeletionScheduledAt *CustomTime `json:"-" gorm:"type:timestamp" swaggertype:"string" format:"date" example:"2006-01-02 15:04:05.000"`
 }
 
 type Login struct {
@@ -35,6 +61,7 @@ type Signup struct {
 	Password       string `schema:"password"`
 	PasswordRepeat string `schema:"password_repeat"`
 	Location       string `schema:"location"`
+	InviteToken    string `schema:"invite_token"`
 }
 
 type SetPasswordRequest struct {
@@ -47,6 +74,14 @@ type ResetPasswordRequest struct {
 	Email string `schema:"email"`
 }
 
+type MagicLinkRequest struct {
+	Email string `schema:"email"`
+}
+
+type MagicLinkLogin struct {
+	Token string `schema:"token"`
+}
+
 type CredentialsReset struct {
 	PasswordOld    string `schema:"password_old"`
 	PasswordNew    string `schema:"password_new"`
@@ -54,9 +89,22 @@ type CredentialsReset struct {
 }
 
 type UserDataUpdate struct {
-	Email         string `schema:"email"`
-	Location      string `schema:"location"`
-	ReportsWeekly bool   `schema:"reports_weekly"`
+	Email           string `schema:"email"`
+	Location        string `schema:"location"`
+	ReportsWeekly   bool   `schema:"reports_weekly"`
+	NotifyNewLogins bool   `schema:"notify_new_logins"`
+}
+
+// UserListQuery describes a single page of the searchable and sortable user list in the admin panel
+type UserListQuery struct {
+	Search   string `schema:"q"`
+	SortBy   string `schema:"sort"`
+	SortDesc bool   `schema:"desc"`
+	Page     int    `schema:"page"`
+}
+
+type AccountDeleteRequest struct {
+	Password string `schema:"password"`
 }
 
 type TimeByUser struct {
@@ -92,6 +140,14 @@ func (u *User) AvatarURL(urlTemplate string) string {
 	return urlTemplate
 }
 
+func (u *User) IsLdapUser() bool {
+	return u.LdapDn != ""
+}
+
+func (u *User) IsDeletionScheduled() bool {
+	return u.DeletionScheduledAt != nil
+}
+
 func (c *CredentialsReset) IsValid() bool {
 	return ValidatePassword(c.PasswordNew) &&
 		c.PasswordNew == c.PasswordRepeat
@@ -110,7 +166,23 @@ func (s *Signup) IsValid() bool {
 }
 
 func (r *UserDataUpdate) IsValid() bool {
-	return ValidateEmail(r.Email) && ValidateTimezone(r.Location)
+	return ValidateEmail(r.Email) && r.Location != "" && ValidateTimezone(r.Location)
+}
+
+// Normalize falls back to defaults for missing or unsupported parameters, so the query can safely be passed on to the database
+func (q *UserListQuery) Normalize() *UserListQuery {
+	q.Search = strings.TrimSpace(q.Search)
+	if _, ok := UserSortColumns[q.SortBy]; !ok {
+		q.SortBy = "id"
+	}
+	if q.Page < 1 {
+		q.Page = 1
+	}
+	return q
+}
+
+func (q *UserListQuery) Offset() int {
+	return (q.Page - 1) * UserListPageSize
 }
 
 func ValidateUsername(username string) bool {
@@ -0,0 +1,23 @@
+package view
+
+import "github.com/muety/broilerplate/models"
+
+type ApiTokensViewModel struct {
+	User      *models.User
+	Tokens    []*models.ApiToken
+	Scopes    []string
+	NewToken  string
+	Success   string
+	Error     string
+	CsrfToken string
+}
+
+func (s *ApiTokensViewModel) WithSuccess(m string) *ApiTokensViewModel {
+	s.Success = m
+	return s
+}
+
+func (s *ApiTokensViewModel) WithError(m string) *ApiTokensViewModel {
+	s.Error = m
+	return s
+}
@@ -0,0 +1,71 @@
+package view
+
+import (
+	"fmt"
+	"github.com/muety/broilerplate/models"
+	"net/url"
+	"strconv"
+)
+
+type AdminAuditViewModel struct {
+	User      *models.User
+	Events    []*models.AuditEvent
+	Query     *models.AuditEventQuery
+	Total     int64
+	Actions   []string
+	Chain     *models.AuditChainStatus
+	Success   string
+	Error     string
+	CsrfToken string
+}
+
+func (s *AdminAuditViewModel) WithSuccess(m string) *AdminAuditViewModel {
+	s.Success = m
+	return s
+}
+
+func (s *AdminAuditViewModel) WithError(m string) *AdminAuditViewModel {
+	s.Error = m
+	return s
+}
+
+func (s *AdminAuditViewModel) Pages() int {
+	return int((s.Total + models.AuditEventPageSize - 1) / models.AuditEventPageSize)
+}
+
+func (s *AdminAuditViewModel) HasPrev() bool {
+	return s.Query.Page > 1
+}
+
+func (s *AdminAuditViewModel) HasNext() bool {
+	return s.Query.Page < s.Pages()
+}
+
+// PageLink returns the relative link to another page of the log, retaining all filters
+func (s *AdminAuditViewModel) PageLink(page int) string {
+	params := s.filterParams()
+	params.Set("page", strconv.Itoa(page))
+	return fmt.Sprintf("admin/audit?%s", params.Encode())
+}
+
+// ExportLink returns the relative link to download all events matching the current filters
+func (s *AdminAuditViewModel) ExportLink() string {
+	return fmt.Sprintf("admin/audit/export?%s", s.filterParams().Encode())
+}
+
+func (s *AdminAuditViewModel) filterParams() url.Values {
+	params := url.Values{}
+	if s.Query.Action != "" {
+		params.Set("action", s.Query.Action)
+	}
+	if s.Query.UserID != "" {
+		params.Set("user", s.Query.UserID)
+	}
+	if s.Query.Since != "" {
+		params.Set("since", s.Query.Since)
+	}
+	if s.Query.Until != "" {
+		params.Set("until", s.Query.Until)
+	}
+	return params
+}
@@ -0,0 +1,24 @@
+package view
+
+import "github.com/muety/broilerplate/models"
+
+type AdminClientCertificatesViewModel struct {
+	User         *models.User
+	Certificates []*models.ClientCertificate
+	Enabled      bool   // whether the server actually asks clients for certificates
+	Mapping      string // how certificates without registered fingerprint map to users
+	PresetUserID string
+	Success      string
+	Error        string
+	CsrfToken    string
+}
+
+func (s *AdminClientCertificatesViewModel) WithSuccess(m string) *AdminClientCertificatesViewModel {
+	s.Success = m
+	return s
+}
+
+func (s *AdminClientCertificatesViewModel) WithError(m string) *AdminClientCertificatesViewModel {
+	s.Error = m
+	return s
+}
@@ -3,10 +3,15 @@ package view
 import "github.com/muety/broilerplate/models"
 
 type DashboardViewModel struct {
-	User      *models.User
-	AvatarURL string
-	Success   string
-	Error     string
+	User             *models.User
+	AvatarURL        string
+	Sessions         []*models.Session
+	CurrentSessionId string
+	Passkeys         []*models.WebauthnCredential
+	OAuthEnabled     bool // whether third-party apps can be authorized
+	Success          string
+	Error            string
+	CsrfToken        string
 }
 
 func (s *DashboardViewModel) WithSuccess(m string) *DashboardViewModel {
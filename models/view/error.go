@@ -0,0 +1,12 @@
+package view
+
+type ErrorViewModel struct {
+	Success   string
+	Error     string
+	CsrfToken string
+}
+
+func (s *ErrorViewModel) WithError(m string) *ErrorViewModel {
+	s.Error = m
+	return s
+}
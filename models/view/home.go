@@ -1,8 +1,9 @@
 package view
 
 type HomeViewModel struct {
-	Success string
-	Error   string
+	Success   string
+	Error     string
+	CsrfToken string
 }
 
 func (s *HomeViewModel) WithSuccess(m string) *HomeViewModel {
@@ -1,9 +1,10 @@
 package view
 
 type ImprintViewModel struct {
-	HtmlText string
-	Success  string
-	Error    string
+	HtmlText  string
+	Success   string
+	Error     string
+	CsrfToken string
 }
 
 func (s *ImprintViewModel) WithSuccess(m string) *ImprintViewModel {
@@ -0,0 +1,23 @@
+package view
+
+import "github.com/muety/broilerplate/models"
+
+type InvitationsViewModel struct {
+	User        *models.User
+	Invitations []*models.Invitation
+	MailEnabled bool
+	NewLink     string
+	Success     string
+	Error       string
+	CsrfToken   string
+}
+
+func (s *InvitationsViewModel) WithSuccess(m string) *InvitationsViewModel {
+	s.Success = m
+	return s
+}
+
+func (s *InvitationsViewModel) WithError(m string) *InvitationsViewModel {
+	s.Error = m
+	return s
+}
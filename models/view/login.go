@@ -1,9 +1,16 @@
 package view
 
+import "github.com/muety/broilerplate/config"
+
 type LoginViewModel struct {
-	Success    string
-	Error      string
-	TotalUsers int
+	Success       string
+	Error         string
+	TotalUsers    int
+	OidcProviders []*config.OidcProviderConfig
+	MagicLink     bool
+	InviteToken   string
+	InviteEmail   string
+	CsrfToken     string
 }
 
 type SetPasswordViewModel struct {
@@ -11,6 +18,22 @@ type SetPasswordViewModel struct {
 	Token string
 }
 
+type MagicLinkLoginViewModel struct {
+	LoginViewModel
+	Token string
+}
+
+type Login2faViewModel struct {
+	LoginViewModel
+	TotpEnabled bool
+	HasPasskeys bool
+}
+
+func (s *Login2faViewModel) WithError(m string) *Login2faViewModel {
+	s.Error = m
+	return s
+}
+
 func (s *LoginViewModel) WithSuccess(m string) *LoginViewModel {
 	s.Success = m
 	return s
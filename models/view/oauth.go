@@ -0,0 +1,54 @@
+package view
+
+import "github.com/muety/broilerplate/models"
+
+type OAuthAuthorizeViewModel struct {
+	User        *models.User
+	Client      *models.OAuthClient
+	Request     *models.OAuthAuthorizeRequest
+	Scopes      []string
+	RedirectUri string
+	Success     string
+	Error       string
+	CsrfToken   string
+}
+
+type OAuthAppsViewModel struct {
+	User      *models.User
+	Grants    []*models.OAuthGrant
+	Success   string
+	Error     string
+	CsrfToken string
+}
+
+func (s *OAuthAppsViewModel) WithSuccess(m string) *OAuthAppsViewModel {
+	s.Success = m
+	return s
+}
+
+func (s *OAuthAppsViewModel) WithError(m string) *OAuthAppsViewModel {
+	s.Error = m
+	return s
+}
+
+type AdminOAuthClientsViewModel struct {
+	User      *models.User
+	Clients   []*models.OAuthClient
+	Scopes    []string
+	Enabled   bool // whether the authorization server is turned on
+	NewClient *models.OAuthClient
+	NewSecret string
+	Success   string
+	Error     string
+	CsrfToken string
+}
+
+func (s *AdminOAuthClientsViewModel) WithSuccess(m string) *AdminOAuthClientsViewModel {
+	s.Success = m
+	return s
+}
+
+func (s *AdminOAuthClientsViewModel) WithError(m string) *AdminOAuthClientsViewModel {
+	s.Error = m
+	return s
+}
@@ -0,0 +1,29 @@
+package view
+
+import "github.com/muety/broilerplate/models"
+
+type OrganizationsViewModel struct {
+	User        *models.User
+	Memberships []*models.Membership
+	Active      *models.Membership
+	Members     []*models.Membership
+	Invitations []*models.OrganizationInvitation
+	Roles       []string
+	MailEnabled bool
+	NewLink     string
+	JoinToken   string
+	Join        *models.OrganizationInvitation // pending invitation to be confirmed by the user
+	Success     string
+	Error       string
+	CsrfToken   string
+}
+
+func (s *OrganizationsViewModel) WithSuccess(m string) *OrganizationsViewModel {
+	s.Success = m
+	return s
+}
+
+func (s *OrganizationsViewModel) WithError(m string) *OrganizationsViewModel {
+	s.Error = m
+	return s
+}
@@ -0,0 +1,26 @@
+package view
+
+import (
+	"github.com/muety/broilerplate/models"
+	"time"
+)
+
+type SettingsViewModel struct {
+	User        *models.User
+	NewApiKey   string
+	MailEnabled bool
+	DeletionAt  time.Time // zero if accounts are deleted right away
+	Success     string
+	Error       string
+	CsrfToken   string
+}
+
+func (s *SettingsViewModel) WithSuccess(m string) *SettingsViewModel {
+	s.Success = m
+	return s
+}
+
+func (s *SettingsViewModel) WithError(m string) *SettingsViewModel {
+	s.Error = m
+	return s
+}
@@ -0,0 +1,26 @@
+package view
+
+import (
+	"github.com/muety/broilerplate/models"
+	"html/template"
+)
+
+type TotpViewModel struct {
+	User          *models.User
+	QrCode        template.URL
+	KeyUri        string
+	RecoveryCodes []string
+	Success       string
+	Error         string
+	CsrfToken     string
+}
+
+func (s *TotpViewModel) WithSuccess(m string) *TotpViewModel {
+	s.Success = m
+	return s
+}
+
+func (s *TotpViewModel) WithError(m string) *TotpViewModel {
+	s.Error = m
+	return s
+}
@@ -0,0 +1,63 @@
+package view
+
+import (
+	"fmt"
+	"github.com/muety/broilerplate/models"
+	"net/url"
+	"strconv"
+)
+
+type AdminUsersViewModel struct {
+	User           *models.User
+	Users          []*models.User
+	Query          *models.UserListQuery
+	Total          int64
+	CanManageRoles bool
+	MailEnabled    bool
+	Success        string
+	Error          string
+	CsrfToken      string
+}
+
+func (s *AdminUsersViewModel) WithSuccess(m string) *AdminUsersViewModel {
+	s.Success = m
+	return s
+}
+
+func (s *AdminUsersViewModel) WithError(m string) *AdminUsersViewModel {
+	s.Error = m
+	return s
+}
+
+func (s *AdminUsersViewModel) Pages() int {
+	return int((s.Total + models.UserListPageSize - 1) / models.UserListPageSize)
+}
+
+func (s *AdminUsersViewModel) HasPrev() bool {
+	return s.Query.Page > 1
+}
+
+func (s *AdminUsersViewModel) HasNext() bool {
+	return s.Query.Page < s.Pages()
+}
+
+// PageLink returns the relative link to another page of the list, retaining search and sorting
+func (s *AdminUsersViewModel) PageLink(page int) string {
+	return s.link(s.Query.SortBy, s.Query.SortDesc, page)
+}
+
+// SortLink returns the relative link to the first page sorted by the given key, toggling the direction if already sorted by it
+func (s *AdminUsersViewModel) SortLink(key string) string {
+	return s.link(key, key == s.Query.SortBy && !s.Query.SortDesc, 1)
+}
+
+func (s *AdminUsersViewModel) link(sortBy string, desc bool, page int) string {
+	params := url.Values{}
+	if s.Query.Search != "" {
+		params.Set("q", s.Query.Search)
+	}
+	params.Set("sort", sortBy)
+	params.Set("desc", strconv.FormatBool(desc))
+	params.Set("page", strconv.Itoa(page))
+	return fmt.Sprintf("admin/users?%s", params.Encode())
+}
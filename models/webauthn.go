@@ -0,0 +1,107 @@
+package models
+
+import "time"
+
+const (
+	WebauthnPurposeRegister     = "register"
+	WebauthnPurposeLogin        = "login"
+	WebauthnPurposeSecondFactor = "2fa"
+)
+
+// COSE algorithm identifiers (https://www.iana.org/assignments/cose/cose.xhtml#algorithms)
+const (
+	CoseAlgES256 = -7
+	CoseAlgRS256 = -257
+)
+
+type WebauthnCredential struct {
+	ID         string     `json:"id" gorm:"primary_key; size:255"` // base64url-encoded credential id
+	User       *User      `json:"-" gorm:"not null; constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	UserID     string     `json:"-" gorm:"not null; index:idx_webauthn_credential_user"`
+	Name       string     `json:"name"`
+	PublicKey  []byte     `json:"-"` // der-encoded subject public key info
+	Algorithm  int        `json:"-"`
+	SignCount  uint32     `json:"-"`
+	CreatedAt  CustomTime `json:"created_at" gorm:"type:timestamp; default:CURRENT_TIMESTAMP" swaggertype:"string" format:"date" example:"2006-01-02 15:04:05.000"`
+	LastUsedAt CustomTime `json:"last_used_at" gorm:"type:timestamp; default:CURRENT_TIMESTAMP" swaggertype:"string" format:"date" example:"2006-01-02 15:04:05.000"`
+}
+
+// WebauthnSession holds the state of an ongoing registration or authentication ceremony, it is kept server-side and only referenced by its id from a short-lived cookie.
+// It lives in the database, so that ceremonies can be finished on any instance, but only once.
+type WebauthnSession struct {
+	ID        string     `gorm:"primary_key; size:64"`
+	Challenge string     `gorm:"size:64"`
+	UserID    string     `gorm:"size:255"` // empty for passwordless logins, where the user is not known up front
+	Purpose   string     `gorm:"size:16"`
+	ExpiresAt CustomTime `gorm:"type:timestamp; index:idx_webauthn_session_expires" swaggertype:"string" format:"date" example:"2006-01-02 15:04:05.000"`
+}
+
+func (s *WebauthnSession) IsExpired() bool {
+	return time.Now().After(s.ExpiresAt.T())
+}
+
+// WebauthnRegistration is what the client sends after navigator.credentials.create(), all binary values base64url-encoded
+type WebauthnRegistration struct {
+	ID                 string `json:"id"`
+	ClientDataJSON     string `json:"client_data_json"`
+	AuthenticatorData  string `json:"authenticator_data"`
+	PublicKey          string `json:"public_key"`
+	PublicKeyAlgorithm int    `json:"public_key_algorithm"`
+	Name               string `json:"name"`
+}
+
+// WebauthnAssertion is what the client sends after navigator.credentials.get(), all binary values base64url-encoded
+type WebauthnAssertion struct {
+	ID                string `json:"id"`
+	ClientDataJSON    string `json:"client_data_json"`
+	AuthenticatorData string `json:"authenticator_data"`
+	Signature         string `json:"signature"`
+	UserHandle        string `json:"user_handle"`
+}
+
+type WebauthnClientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// WebauthnOptions contains the subset of PublicKeyCredentialCreationOptions and PublicKeyCredentialRequestOptions used by us
+type WebauthnOptions struct {
+	Challenge              string                          `json:"challenge"`
+	Timeout                int                             `json:"timeout"`
+	RpId                   string                          `json:"rpId,omitempty"`
+	Rp                     *WebauthnRpEntity               `json:"rp,omitempty"`
+	User                   *WebauthnUserEntity             `json:"user,omitempty"`
+	PubKeyCredParams       []WebauthnCredentialParameters  `json:"pubKeyCredParams,omitempty"`
+	AllowCredentials       []WebauthnCredentialDescriptor  `json:"allowCredentials,omitempty"`
+	ExcludeCredentials     []WebauthnCredentialDescriptor  `json:"excludeCredentials,omitempty"`
+	AuthenticatorSelection *WebauthnAuthenticatorSelection `json:"authenticatorSelection,omitempty"`
+	UserVerification       string                          `json:"userVerification,omitempty"`
+	Attestation            string                          `json:"attestation,omitempty"`
+}
+
+type WebauthnRpEntity struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type WebauthnUserEntity struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+type WebauthnCredentialParameters struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+type WebauthnCredentialDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+type WebauthnAuthenticatorSelection struct {
+	ResidentKey      string `json:"residentKey"`
+	UserVerification string `json:"userVerification"`
+}
@@ -0,0 +1,72 @@
+package repositories
+
+import (
+	"errors"
+	"github.com/muety/broilerplate/models"
+	"gorm.io/gorm"
+)
+
+type ApiTokenRepository struct {
+	db *gorm.DB
+}
+
+func NewApiTokenRepository(db *gorm.DB) *ApiTokenRepository {
+	return &ApiTokenRepository{db: db}
+}
+
+func (r *ApiTokenRepository) GetById(tokenId string) (*models.ApiToken, error) {
+	if tokenId == "" {
+		return nil, errors.New("invalid input")
+	}
+	t := &models.ApiToken{}
+	if err := r.db.Where(&models.ApiToken{ID: tokenId}).First(t).Error; err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (r *ApiTokenRepository) GetByHash(tokenHash string) (*models.ApiToken, error) {
+	if tokenHash == "" {
+		return nil, errors.New("invalid input")
+	}
+	t := &models.ApiToken{}
+	if err := r.db.Where(&models.ApiToken{TokenHash: tokenHash}).First(t).Error; err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (r *ApiTokenRepository) GetByUser(userId string) ([]*models.ApiToken, error) {
+	var tokens []*models.ApiToken
+	if err := r.db.
+		Where(&models.ApiToken{UserID: userId}).
+		Order("created_at desc").
+		Find(&tokens).Error; err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func (r *ApiTokenRepository) Insert(token *models.ApiToken) (*models.ApiToken, error) {
+	if err := r.db.Create(token).Error; err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func (r *ApiTokenRepository) UpdateLastUsed(token *models.ApiToken) (*models.ApiToken, error) {
+	if err := r.db.Model(token).Update("last_used_at", token.LastUsedAt).Error; err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func (r *ApiTokenRepository) Delete(token *models.ApiToken) error {
+	return r.db.Delete(token).Error
+}
+
+func (r *ApiTokenRepository) DeleteByUser(userId string) error {
+	return r.db.
+		Where("user_id = ?", userId).
+		Delete(&models.ApiToken{}).Error
+}
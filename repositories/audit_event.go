@@ -0,0 +1,124 @@
+package repositories
+
+import (
+	"errors"
+	"github.com/muety/broilerplate/models"
+	"gorm.io/gorm"
+	"time"
+)
+
+type AuditEventRepository struct {
+	db *gorm.DB
+}
+
+func NewAuditEventRepository(db *gorm.DB) *AuditEventRepository {
+	return &AuditEventRepository{db: db}
+}
+
+func (r *AuditEventRepository) GetLatest() (*models.AuditEvent, error) {
+	e := &models.AuditEvent{}
+	if err := r.db.Order("id desc").First(e).Error; err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// GetAfter returns up to limit events following the given id in chronological order
+func (r *AuditEventRepository) GetAfter(id uint, limit int) ([]*models.AuditEvent, error) {
+	var events []*models.AuditEvent
+	if err := r.db.
+		Where("id > ?", id).
+		Order("id asc").
+		Limit(limit).
+		Find(&events).Error; err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+func (r *AuditEventRepository) GetByUser(userId string) ([]*models.AuditEvent, error) {
+	var events []*models.AuditEvent
+	if err := r.db.
+		Where("actor_id = ? or target_id = ?", userId, userId).
+		Order("id asc").
+		Find(&events).Error; err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// Search returns a single page of events matching the query's filters, newest first, along with the total number of matches.
+// Only events whose actor or target is a member of the given organization are considered.
+func (r *AuditEventRepository) Search(orgId string, query *models.AuditEventQuery) ([]*models.AuditEvent, int64, error) {
+	q := r.filter(orgId, query)
+
+	var count int64
+	if err := q.Count(&count).Error; err != nil {
+		return nil, 0, err
+	}
+
+	var events []*models.AuditEvent
+	if err := q.
+		Order("id desc").
+		Offset(query.Offset()).
+		Limit(models.AuditEventPageSize).
+		Find(&events).Error; err != nil {
+		return nil, 0, err
+	}
+	return events, count, nil
+}
+
+// GetAllByQuery returns all of the organization's events matching the query's filters in chronological order, regardless of its page
+func (r *AuditEventRepository) GetAllByQuery(orgId string, query *models.AuditEventQuery) ([]*models.AuditEvent, error) {
+	var events []*models.AuditEvent
+	if err := r.filter(orgId, query).
+		Order("id asc").
+		Find(&events).Error; err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// Append makes the event reference the latest one's hash and lets seal compute its own one, before inserting it within the same transaction.
+// Inserting fails if another writer appended to the same predecessor in the meantime, as previous hashes are unique.
+func (r *AuditEventRepository) Append(event *models.AuditEvent, seal func(*models.AuditEvent) error) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		latest := &models.AuditEvent{}
+		if err := tx.Order("id desc").First(latest).Error; err == nil {
+			event.PrevHash = latest.Hash
+		} else if errors.Is(err, gorm.ErrRecordNotFound) {
+			event.PrevHash = ""
+		} else {
+			return err
+		}
+
+		if err := seal(event); err != nil {
+			return err
+		}
+		return tx.Create(event).Error
+	})
+}
+
+func (r *AuditEventRepository) DeleteByCreatedBefore(t time.Time) (int64, error) {
+	result := r.db.
+		Where("created_at < ?", t.Local()).
+		Delete(&models.AuditEvent{})
+	return result.RowsAffected, result.Error
+}
+
+func (r *AuditEventRepository) filter(orgId string, query *models.AuditEventQuery) *gorm.DB {
+	q := r.db.Model(&models.AuditEvent{}).Scopes(MemberScope(orgId, "actor_id", "target_id"))
+	if query.Action != "" {
+		q = q.Where("action = ?", query.Action)
+	}
+	if query.UserID != "" {
+		q = q.Where("actor_id = ? or target_id = ?", query.UserID, query.UserID)
+	}
+	if since := query.SinceTime(); since != nil {
+		q = q.Where("created_at >= ?", since.Local())
+	}
+	if until := query.UntilTime(); until != nil {
+		q = q.Where("created_at < ?", until.Local())
+	}
+	return q
+}
@@ -0,0 +1,81 @@
+package repositories
+
+import (
+	"errors"
+	"github.com/muety/broilerplate/models"
+	"gorm.io/gorm"
+)
+
+type ClientCertificateRepository struct {
+	db *gorm.DB
+}
+
+func NewClientCertificateRepository(db *gorm.DB) *ClientCertificateRepository {
+	return &ClientCertificateRepository{db: db}
+}
+
+// GetByOrganization returns the certificates of all members of the given organization
+func (r *ClientCertificateRepository) GetByOrganization(orgId string) ([]*models.ClientCertificate, error) {
+	var certificates []*models.ClientCertificate
+	if err := r.db.
+		Scopes(MemberScope(orgId, "user_id")).
+		Order("user_id asc, created_at desc").
+		Find(&certificates).Error; err != nil {
+		return nil, err
+	}
+	return certificates, nil
+}
+
+func (r *ClientCertificateRepository) GetByFingerprint(fingerprint string) (*models.ClientCertificate, error) {
+	if fingerprint == "" {
+		return nil, errors.New("invalid input")
+	}
+	c := &models.ClientCertificate{}
+	if err := r.db.Where(&models.ClientCertificate{Fingerprint: fingerprint}).First(c).Error; err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (r *ClientCertificateRepository) GetByOrganizationAndFingerprint(orgId, fingerprint string) (*models.ClientCertificate, error) {
+	if fingerprint == "" {
+		return nil, errors.New("invalid input")
+	}
+	c := &models.ClientCertificate{}
+	if err := r.db.
+		Scopes(MemberScope(orgId, "user_id")).
+		Where(&models.ClientCertificate{Fingerprint: fingerprint}).
+		First(c).Error; err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (r *ClientCertificateRepository) GetByUser(userId string) ([]*models.ClientCertificate, error) {
+	var certificates []*models.ClientCertificate
+	if err := r.db.
+		Where(&models.ClientCertificate{UserID: userId}).
+		Order("created_at desc").
+		Find(&certificates).Error; err != nil {
+		return nil, err
+	}
+	return certificates, nil
+}
+
+func (r *ClientCertificateRepository) Insert(certificate *models.ClientCertificate) (*models.ClientCertificate, error) {
+	if err := r.db.Create(certificate).Error; err != nil {
+		return nil, err
+	}
+	return certificate, nil
+}
+
+func (r *ClientCertificateRepository) UpdateLastUsed(certificate *models.ClientCertificate) (*models.ClientCertificate, error) {
+	if err := r.db.Model(certificate).Update("last_used_at", certificate.LastUsedAt).Error; err != nil {
+		return nil, err
+	}
+	return certificate, nil
+}
+
+func (r *ClientCertificateRepository) Delete(certificate *models.ClientCertificate) error {
+	return r.db.Delete(certificate).Error
+}
@@ -0,0 +1,58 @@
+package repositories
+
+import (
+	"errors"
+	"github.com/muety/broilerplate/models"
+	"gorm.io/gorm"
+	"time"
+)
+
+type EmailVerificationRepository struct {
+	db *gorm.DB
+}
+
+func NewEmailVerificationRepository(db *gorm.DB) *EmailVerificationRepository {
+	return &EmailVerificationRepository{db: db}
+}
+
+func (r *EmailVerificationRepository) GetByHash(tokenHash string) (*models.EmailVerification, error) {
+	if tokenHash == "" {
+		return nil, errors.New("invalid input")
+	}
+	v := &models.EmailVerification{}
+	if err := r.db.Where(&models.EmailVerification{TokenHash: tokenHash}).First(v).Error; err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (r *EmailVerificationRepository) GetLatestByUser(userId string) (*models.EmailVerification, error) {
+	v := &models.EmailVerification{}
+	if err := r.db.
+		Where(&models.EmailVerification{UserID: userId}).
+		Order("created_at desc").
+		First(v).Error; err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (r *EmailVerificationRepository) Insert(verification *models.EmailVerification) (*models.EmailVerification, error) {
+	if err := r.db.Create(verification).Error; err != nil {
+		return nil, err
+	}
+	return verification, nil
+}
+
+func (r *EmailVerificationRepository) DeleteByUser(userId string) error {
+	return r.db.
+		Where("user_id = ?", userId).
+		Delete(&models.EmailVerification{}).Error
+}
+
+func (r *EmailVerificationRepository) DeleteByExpiresBefore(t time.Time) (int64, error) {
+	result := r.db.
+		Where("expires_at < ?", t.Local()).
+		Delete(&models.EmailVerification{})
+	return result.RowsAffected, result.Error
+}
@@ -0,0 +1,72 @@
+package repositories
+
+import (
+	"errors"
+	"github.com/muety/broilerplate/models"
+	"gorm.io/gorm"
+	"time"
+)
+
+type InvitationRepository struct {
+	db *gorm.DB
+}
+
+func NewInvitationRepository(db *gorm.DB) *InvitationRepository {
+	return &InvitationRepository{db: db}
+}
+
+func (r *InvitationRepository) GetAll() ([]*models.Invitation, error) {
+	var invitations []*models.Invitation
+	if err := r.db.
+		Order("created_at desc").
+		Find(&invitations).Error; err != nil {
+		return nil, err
+	}
+	return invitations, nil
+}
+
+func (r *InvitationRepository) GetById(id string) (*models.Invitation, error) {
+	if id == "" {
+		return nil, errors.New("invalid input")
+	}
+	invitation := &models.Invitation{}
+	if err := r.db.Where(&models.Invitation{ID: id}).First(invitation).Error; err != nil {
+		return nil, err
+	}
+	return invitation, nil
+}
+
+func (r *InvitationRepository) GetByHash(tokenHash string) (*models.Invitation, error) {
+	if tokenHash == "" {
+		return nil, errors.New("invalid input")
+	}
+	invitation := &models.Invitation{}
+	if err := r.db.Where(&models.Invitation{TokenHash: tokenHash}).First(invitation).Error; err != nil {
+		return nil, err
+	}
+	return invitation, nil
+}
+
+func (r *InvitationRepository) Insert(invitation *models.Invitation) (*models.Invitation, error) {
+	if err := r.db.Create(invitation).Error; err != nil {
+		return nil, err
+	}
+	return invitation, nil
+}
+
+// MarkConsumed atomically consumes the invitation, returning false if it had already been used before
+func (r *InvitationRepository) MarkConsumed(id, userId string, at time.Time) (bool, error) {
+	result := r.db.Model(&models.Invitation{}).
+		Where("id = ? AND consumed_at IS NULL", id).
+		Updates(map[string]interface{}{
+			"consumed_at": at.Local(),
+			"consumed_by": userId,
+		})
+	return result.RowsAffected == 1, result.Error
+}
+
+func (r *InvitationRepository) Delete(id string) error {
+	return r.db.
+		Where("id = ?", id).
+		Delete(&models.Invitation{}).Error
+}
@@ -50,6 +50,15 @@ func (r *KeyValueRepository) PutString(kv *models.KeyStringValue) error {
 	return nil
 }
 
+// InsertString only creates the entry if no value is stored under its key, yet, otherwise, the existing one is left untouched
+func (r *KeyValueRepository) InsertString(kv *models.KeyStringValue) error {
+	return r.db.
+		Clauses(clause.OnConflict{
+			DoNothing: true,
+		}).
+		Create(kv).Error
+}
+
 func (r *KeyValueRepository) DeleteString(key string) error {
 	result := r.db.
 		Delete(&models.KeyStringValue{}, &models.KeyStringValue{Key: key})
@@ -0,0 +1,46 @@
+package repositories
+
+import (
+	"github.com/muety/broilerplate/models"
+	"gorm.io/gorm"
+	"time"
+)
+
+type KnownDeviceRepository struct {
+	db *gorm.DB
+}
+
+func NewKnownDeviceRepository(db *gorm.DB) *KnownDeviceRepository {
+	return &KnownDeviceRepository{db: db}
+}
+
+func (r *KnownDeviceRepository) GetByUser(userId string) ([]*models.KnownDevice, error) {
+	var devices []*models.KnownDevice
+	if err := r.db.
+		Where(&models.KnownDevice{UserID: userId}).
+		Order("last_seen_at desc").
+		Find(&devices).Error; err != nil {
+		return nil, err
+	}
+	return devices, nil
+}
+
+func (r *KnownDeviceRepository) Insert(device *models.KnownDevice) (*models.KnownDevice, error) {
+	if err := r.db.Create(device).Error; err != nil {
+		return nil, err
+	}
+	return device, nil
+}
+
+func (r *KnownDeviceRepository) Touch(device *models.KnownDevice) error {
+	return r.db.
+		Model(device).
+		Update("last_seen_at", device.LastSeenAt).Error
+}
+
+func (r *KnownDeviceRepository) DeleteByLastSeenBefore(t time.Time) (int64, error) {
+	result := r.db.
+		Where("last_seen_at < ?", t.Local()).
+		Delete(&models.KnownDevice{})
+	return result.RowsAffected, result.Error
+}
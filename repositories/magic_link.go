@@ -0,0 +1,55 @@
+package repositories
+
+import (
+	"errors"
+	"github.com/muety/broilerplate/models"
+	"gorm.io/gorm"
+	"time"
+)
+
+type MagicLinkRepository struct {
+	db *gorm.DB
+}
+
+func NewMagicLinkRepository(db *gorm.DB) *MagicLinkRepository {
+	return &MagicLinkRepository{db: db}
+}
+
+func (r *MagicLinkRepository) GetByHash(tokenHash string) (*models.MagicLink, error) {
+	if tokenHash == "" {
+		return nil, errors.New("invalid input")
+	}
+	l := &models.MagicLink{}
+	if err := r.db.Where(&models.MagicLink{TokenHash: tokenHash}).First(l).Error; err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (r *MagicLinkRepository) Insert(link *models.MagicLink) (*models.MagicLink, error) {
+	if err := r.db.Create(link).Error; err != nil {
+		return nil, err
+	}
+	return link, nil
+}
+
+// DeleteByHash returns the number of deleted links, which is zero if the link was consumed by someone else in the meantime
+func (r *MagicLinkRepository) DeleteByHash(tokenHash string) (int64, error) {
+	result := r.db.
+		Where("token_hash = ?", tokenHash).
+		Delete(&models.MagicLink{})
+	return result.RowsAffected, result.Error
+}
+
+func (r *MagicLinkRepository) DeleteByUser(userId string) error {
+	return r.db.
+		Where("user_id = ?", userId).
+		Delete(&models.MagicLink{}).Error
+}
+
+func (r *MagicLinkRepository) DeleteByExpiresBefore(t time.Time) (int64, error) {
+	result := r.db.
+		Where("expires_at < ?", t.Local()).
+		Delete(&models.MagicLink{})
+	return result.RowsAffected, result.Error
+}
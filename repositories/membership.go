@@ -0,0 +1,85 @@
+package repositories
+
+import (
+	"github.com/muety/broilerplate/models"
+	"gorm.io/gorm"
+)
+
+type MembershipRepository struct {
+	db *gorm.DB
+}
+
+func NewMembershipRepository(db *gorm.DB) *MembershipRepository {
+	return &MembershipRepository{db: db}
+}
+
+// GetByUser returns all memberships of the user across organizations, which is needed to let them choose one
+func (r *MembershipRepository) GetByUser(userId string) ([]*models.Membership, error) {
+	var memberships []*models.Membership
+	if err := r.db.
+		Preload("Organization").
+		Where(&models.Membership{UserID: userId}).
+		Order("created_at asc").
+		Find(&memberships).Error; err != nil {
+		return nil, err
+	}
+	return memberships, nil
+}
+
+func (r *MembershipRepository) GetByOrganization(orgId string) ([]*models.Membership, error) {
+	var memberships []*models.Membership
+	if err := r.db.
+		Scopes(TenantScope(orgId)).
+		Preload("User").
+		Order("created_at asc").
+		Find(&memberships).Error; err != nil {
+		return nil, err
+	}
+	return memberships, nil
+}
+
+func (r *MembershipRepository) Get(orgId, userId string) (*models.Membership, error) {
+	membership := &models.Membership{}
+	if err := r.db.
+		Scopes(TenantScope(orgId)).
+		Preload("Organization").
+		Where(&models.Membership{UserID: userId}).
+		First(membership).Error; err != nil {
+		return nil, err
+	}
+	return membership, nil
+}
+
+func (r *MembershipRepository) CountByRole(orgId, role string) (int64, error) {
+	var count int64
+	if err := r.db.
+		Model(&models.Membership{}).
+		Scopes(TenantScope(orgId)).
+		Where(&models.Membership{Role: role}).
+		Count(&count).Error; err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func (r *MembershipRepository) Insert(membership *models.Membership) (*models.Membership, error) {
+	if err := r.db.Omit("Organization", "User").Create(membership).Error; err != nil {
+		return nil, err
+	}
+	return membership, nil
+}
+
+func (r *MembershipRepository) UpdateRole(orgId, userId, role string) error {
+	return r.db.
+		Model(&models.Membership{}).
+		Scopes(TenantScope(orgId)).
+		Where("user_id = ?", userId).
+		Update("role", role).Error
+}
+
+func (r *MembershipRepository) Delete(orgId, userId string) error {
+	return r.db.
+		Scopes(TenantScope(orgId)).
+		Where("user_id = ?", userId).
+		Delete(&models.Membership{}).Error
+}
@@ -0,0 +1,50 @@
+package repositories
+
+import (
+	"errors"
+	"github.com/muety/broilerplate/models"
+	"gorm.io/gorm"
+	"time"
+)
+
+type OAuthAuthorizationCodeRepository struct {
+	db *gorm.DB
+}
+
+func NewOAuthAuthorizationCodeRepository(db *gorm.DB) *OAuthAuthorizationCodeRepository {
+	return &OAuthAuthorizationCodeRepository{db: db}
+}
+
+func (r *OAuthAuthorizationCodeRepository) GetByHash(codeHash string) (*models.OAuthAuthorizationCode, error) {
+	if codeHash == "" {
+		return nil, errors.New("invalid input")
+	}
+	c := &models.OAuthAuthorizationCode{}
+	if err := r.db.
+		Preload("Grant").
+		Where(&models.OAuthAuthorizationCode{CodeHash: codeHash}).
+		First(c).Error; err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (r *OAuthAuthorizationCodeRepository) Insert(code *models.OAuthAuthorizationCode) (*models.OAuthAuthorizationCode, error) {
+	if err := r.db.Create(code).Error; err != nil {
+		return nil, err
+	}
+	return code, nil
+}
+
+// Delete returns the number of deleted rows, which is zero if another request has consumed the code in the meantime
+func (r *OAuthAuthorizationCodeRepository) Delete(code *models.OAuthAuthorizationCode) (int64, error) {
+	result := r.db.Delete(code)
+	return result.RowsAffected, result.Error
+}
+
+func (r *OAuthAuthorizationCodeRepository) DeleteByExpiresBefore(t time.Time) (int64, error) {
+	result := r.db.
+		Where("expires_at < ?", t.Local()).
+		Delete(&models.OAuthAuthorizationCode{})
+	return result.RowsAffected, result.Error
+}
@@ -0,0 +1,47 @@
+package repositories
+
+import (
+	"errors"
+	"github.com/muety/broilerplate/models"
+	"gorm.io/gorm"
+)
+
+type OAuthClientRepository struct {
+	db *gorm.DB
+}
+
+func NewOAuthClientRepository(db *gorm.DB) *OAuthClientRepository {
+	return &OAuthClientRepository{db: db}
+}
+
+func (r *OAuthClientRepository) GetAll() ([]*models.OAuthClient, error) {
+	var clients []*models.OAuthClient
+	if err := r.db.
+		Order("name asc").
+		Find(&clients).Error; err != nil {
+		return nil, err
+	}
+	return clients, nil
+}
+
+func (r *OAuthClientRepository) GetById(clientId string) (*models.OAuthClient, error) {
+	if clientId == "" {
+		return nil, errors.New("invalid input")
+	}
+	c := &models.OAuthClient{}
+	if err := r.db.Where(&models.OAuthClient{ID: clientId}).First(c).Error; err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (r *OAuthClientRepository) Insert(client *models.OAuthClient) (*models.OAuthClient, error) {
+	if err := r.db.Create(client).Error; err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+func (r *OAuthClientRepository) Delete(client *models.OAuthClient) error {
+	return r.db.Delete(client).Error
+}
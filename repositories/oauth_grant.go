@@ -0,0 +1,80 @@
+package repositories
+
+import (
+	"errors"
+	"github.com/muety/broilerplate/models"
+	"gorm.io/gorm"
+)
+
+type OAuthGrantRepository struct {
+	db *gorm.DB
+}
+
+func NewOAuthGrantRepository(db *gorm.DB) *OAuthGrantRepository {
+	return &OAuthGrantRepository{db: db}
+}
+
+func (r *OAuthGrantRepository) GetById(grantId string) (*models.OAuthGrant, error) {
+	if grantId == "" {
+		return nil, errors.New("invalid input")
+	}
+	g := &models.OAuthGrant{}
+	if err := r.db.
+		Preload("Client").
+		Where(&models.OAuthGrant{ID: grantId}).
+		First(g).Error; err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+func (r *OAuthGrantRepository) GetByUserAndClient(userId, clientId string) (*models.OAuthGrant, error) {
+	if userId == "" || clientId == "" {
+		return nil, errors.New("invalid input")
+	}
+	g := &models.OAuthGrant{}
+	if err := r.db.
+		Preload("Client").
+		Where(&models.OAuthGrant{UserID: userId, ClientID: clientId}).
+		First(g).Error; err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+func (r *OAuthGrantRepository) GetByUser(userId string) ([]*models.OAuthGrant, error) {
+	var grants []*models.OAuthGrant
+	if err := r.db.
+		Preload("Client").
+		Where(&models.OAuthGrant{UserID: userId}).
+		Order("created_at desc").
+		Find(&grants).Error; err != nil {
+		return nil, err
+	}
+	return grants, nil
+}
+
+func (r *OAuthGrantRepository) Insert(grant *models.OAuthGrant) (*models.OAuthGrant, error) {
+	if err := r.db.Create(grant).Error; err != nil {
+		return nil, err
+	}
+	return grant, nil
+}
+
+func (r *OAuthGrantRepository) UpdateScopes(grant *models.OAuthGrant) (*models.OAuthGrant, error) {
+	if err := r.db.Model(grant).Update("scopes", grant.Scopes).Error; err != nil {
+		return nil, err
+	}
+	return grant, nil
+}
+
+func (r *OAuthGrantRepository) UpdateLastUsed(grant *models.OAuthGrant) (*models.OAuthGrant, error) {
+	if err := r.db.Model(grant).Update("last_used_at", grant.LastUsedAt).Error; err != nil {
+		return nil, err
+	}
+	return grant, nil
+}
+
+func (r *OAuthGrantRepository) Delete(grant *models.OAuthGrant) error {
+	return r.db.Delete(grant).Error
+}
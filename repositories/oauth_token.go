@@ -0,0 +1,64 @@
+package repositories
+
+import (
+	"errors"
+	"github.com/muety/broilerplate/models"
+	"gorm.io/gorm"
+	"time"
+)
+
+type OAuthTokenRepository struct {
+	db *gorm.DB
+}
+
+func NewOAuthTokenRepository(db *gorm.DB) *OAuthTokenRepository {
+	return &OAuthTokenRepository{db: db}
+}
+
+func (r *OAuthTokenRepository) GetByAccessHash(tokenHash string) (*models.OAuthToken, error) {
+	if tokenHash == "" {
+		return nil, errors.New("invalid input")
+	}
+	t := &models.OAuthToken{}
+	if err := r.db.
+		Preload("Grant").
+		Where(&models.OAuthToken{AccessTokenHash: tokenHash}).
+		First(t).Error; err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (r *OAuthTokenRepository) GetByRefreshHash(tokenHash string) (*models.OAuthToken, error) {
+	if tokenHash == "" {
+		return nil, errors.New("invalid input")
+	}
+	t := &models.OAuthToken{}
+	if err := r.db.
+		Preload("Grant").
+		Where(&models.OAuthToken{RefreshTokenHash: tokenHash}).
+		First(t).Error; err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (r *OAuthTokenRepository) Insert(token *models.OAuthToken) (*models.OAuthToken, error) {
+	if err := r.db.Create(token).Error; err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// Delete returns the number of deleted rows, which is zero if another request has used the refresh token in the meantime
+func (r *OAuthTokenRepository) Delete(token *models.OAuthToken) (int64, error) {
+	result := r.db.Delete(token)
+	return result.RowsAffected, result.Error
+}
+
+func (r *OAuthTokenRepository) DeleteByRefreshExpiresBefore(t time.Time) (int64, error) {
+	result := r.db.
+		Where("refresh_expires_at < ?", t.Local()).
+		Delete(&models.OAuthToken{})
+	return result.RowsAffected, result.Error
+}
@@ -0,0 +1,41 @@
+package repositories
+
+import (
+	"github.com/muety/broilerplate/models"
+	"gorm.io/gorm"
+)
+
+type OidcIdentityRepository struct {
+	db *gorm.DB
+}
+
+func NewOidcIdentityRepository(db *gorm.DB) *OidcIdentityRepository {
+	return &OidcIdentityRepository{db: db}
+}
+
+func (r *OidcIdentityRepository) GetBySubject(providerName, subject string) (*models.OidcIdentity, error) {
+	identity := &models.OidcIdentity{}
+	if err := r.db.
+		Where(&models.OidcIdentity{ProviderName: providerName, Subject: subject}).
+		First(identity).Error; err != nil {
+		return nil, err
+	}
+	return identity, nil
+}
+
+func (r *OidcIdentityRepository) GetByUser(userId string) ([]*models.OidcIdentity, error) {
+	var identities []*models.OidcIdentity
+	if err := r.db.
+		Where(&models.OidcIdentity{UserID: userId}).
+		Find(&identities).Error; err != nil {
+		return nil, err
+	}
+	return identities, nil
+}
+
+func (r *OidcIdentityRepository) Insert(identity *models.OidcIdentity) (*models.OidcIdentity, error) {
+	if err := r.db.Create(identity).Error; err != nil {
+		return nil, err
+	}
+	return identity, nil
+}
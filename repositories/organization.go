@@ -0,0 +1,62 @@
+package repositories
+
+import (
+	"errors"
+	"github.com/muety/broilerplate/models"
+	"gorm.io/gorm"
+)
+
+type OrganizationRepository struct {
+	db *gorm.DB
+}
+
+func NewOrganizationRepository(db *gorm.DB) *OrganizationRepository {
+	return &OrganizationRepository{db: db}
+}
+
+func (r *OrganizationRepository) GetById(id string) (*models.Organization, error) {
+	if id == "" {
+		return nil, errors.New("invalid input")
+	}
+	org := &models.Organization{}
+	if err := r.db.Where(&models.Organization{ID: id}).First(org).Error; err != nil {
+		return nil, err
+	}
+	return org, nil
+}
+
+// Insert creates the organization along with its first membership
+func (r *OrganizationRepository) Insert(org *models.Organization, owner *models.Membership) (*models.Organization, error) {
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(org).Error; err != nil {
+			return err
+		}
+		owner.OrganizationID = org.ID
+		return tx.Omit("Organization", "User").Create(owner).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return org, nil
+}
+
+func (r *OrganizationRepository) Update(org *models.Organization) (*models.Organization, error) {
+	if err := r.db.Model(org).Update("name", org.Name).Error; err != nil {
+		return nil, err
+	}
+	return org, nil
+}
+
+func (r *OrganizationRepository) Delete(id string) error {
+	return r.db.
+		Where("id = ?", id).
+		Delete(&models.Organization{}).Error
+}
+
+// DeleteOrphaned removes all organizations without any members, it is the only operation spanning across tenants
+func (r *OrganizationRepository) DeleteOrphaned() (int64, error) {
+	result := r.db.
+		Where("id not in (?)", r.db.Model(&models.Membership{}).Select("organization_id")).
+		Delete(&models.Organization{})
+	return result.RowsAffected, result.Error
+}
@@ -0,0 +1,65 @@
+package repositories
+
+import (
+	"errors"
+	"github.com/muety/broilerplate/models"
+	"gorm.io/gorm"
+	"time"
+)
+
+type OrganizationInvitationRepository struct {
+	db *gorm.DB
+}
+
+func NewOrganizationInvitationRepository(db *gorm.DB) *OrganizationInvitationRepository {
+	return &OrganizationInvitationRepository{db: db}
+}
+
+func (r *OrganizationInvitationRepository) GetByOrganization(orgId string) ([]*models.OrganizationInvitation, error) {
+	var invitations []*models.OrganizationInvitation
+	if err := r.db.
+		Scopes(TenantScope(orgId)).
+		Order("created_at desc").
+		Find(&invitations).Error; err != nil {
+		return nil, err
+	}
+	return invitations, nil
+}
+
+// GetByHash is the only lookup across organizations, as the invitee doesn't belong to the organization yet
+func (r *OrganizationInvitationRepository) GetByHash(tokenHash string) (*models.OrganizationInvitation, error) {
+	if tokenHash == "" {
+		return nil, errors.New("invalid input")
+	}
+	invitation := &models.OrganizationInvitation{}
+	if err := r.db.
+		Preload("Organization").
+		Where(&models.OrganizationInvitation{TokenHash: tokenHash}).
+		First(invitation).Error; err != nil {
+		return nil, err
+	}
+	return invitation, nil
+}
+
+func (r *OrganizationInvitationRepository) Insert(invitation *models.OrganizationInvitation) (*models.OrganizationInvitation, error) {
+	if err := r.db.Omit("Organization", "Inviter").Create(invitation).Error; err != nil {
+		return nil, err
+	}
+	return invitation, nil
+}
+
+// Delete removes the invitation, returning false if it didn't exist (anymore) within the organization
+func (r *OrganizationInvitationRepository) Delete(orgId, id string) (bool, error) {
+	result := r.db.
+		Scopes(TenantScope(orgId)).
+		Where("id = ?", id).
+		Delete(&models.OrganizationInvitation{})
+	return result.RowsAffected == 1, result.Error
+}
+
+func (r *OrganizationInvitationRepository) DeleteByExpiresBefore(t time.Time) (int64, error) {
+	result := r.db.
+		Where("expires_at < ?", t.Local()).
+		Delete(&models.OrganizationInvitation{})
+	return result.RowsAffected, result.Error
+}
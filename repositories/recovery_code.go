@@ -0,0 +1,42 @@
+package repositories
+
+import (
+	"github.com/muety/broilerplate/models"
+	"gorm.io/gorm"
+)
+
+type RecoveryCodeRepository struct {
+	db *gorm.DB
+}
+
+func NewRecoveryCodeRepository(db *gorm.DB) *RecoveryCodeRepository {
+	return &RecoveryCodeRepository{db: db}
+}
+
+func (r *RecoveryCodeRepository) GetByUser(userId string) ([]*models.RecoveryCode, error) {
+	var codes []*models.RecoveryCode
+	if err := r.db.
+		Where(&models.RecoveryCode{UserID: userId}).
+		Find(&codes).Error; err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func (r *RecoveryCodeRepository) InsertBatch(codes []*models.RecoveryCode) error {
+	return r.db.Create(&codes).Error
+}
+
+// DeleteByUserAndHash removes the matching code, if still present, the number of affected rows tells whether the caller was the one to consume it
+func (r *RecoveryCodeRepository) DeleteByUserAndHash(userId, codeHash string) (int64, error) {
+	result := r.db.
+		Where("user_id = ? AND code_hash = ?", userId, codeHash).
+		Delete(&models.RecoveryCode{})
+	return result.RowsAffected, result.Error
+}
+
+func (r *RecoveryCodeRepository) DeleteByUser(userId string) error {
+	return r.db.
+		Where("user_id = ?", userId).
+		Delete(&models.RecoveryCode{}).Error
+}
@@ -9,20 +9,207 @@ type IKeyValueRepository interface {
 	GetAll() ([]*models.KeyStringValue, error)
 	GetString(string) (*models.KeyStringValue, error)
 	PutString(*models.KeyStringValue) error
+	InsertString(*models.KeyStringValue) error
 	DeleteString(string) error
 }
 
+type IRecoveryCodeRepository interface {
+	GetByUser(string) ([]*models.RecoveryCode, error)
+	InsertBatch([]*models.RecoveryCode) error
+	DeleteByUserAndHash(string, string) (int64, error)
+	DeleteByUser(string) error
+}
+
+type ISessionRepository interface {
+	GetById(string) (*models.Session, error)
+	GetByUser(string) ([]*models.Session, error)
+	Insert(*models.Session) (*models.Session, error)
+	UpdateLastSeen(*models.Session) (*models.Session, error)
+	Delete(*models.Session) error
+	DeleteByUser(string) error
+	DeleteByLastSeenBefore(time.Time) (int64, error)
+}
+
+type IWebauthnCredentialRepository interface {
+	GetById(string) (*models.WebauthnCredential, error)
+	GetByUser(string) ([]*models.WebauthnCredential, error)
+	CountByUser(string) (int64, error)
+	Insert(*models.WebauthnCredential) (*models.WebauthnCredential, error)
+	UpdateUsage(*models.WebauthnCredential) (*models.WebauthnCredential, error)
+	Delete(*models.WebauthnCredential) error
+}
+
+type IWebauthnSessionRepository interface {
+	GetById(string) (*models.WebauthnSession, error)
+	Insert(*models.WebauthnSession) (*models.WebauthnSession, error)
+	Delete(string) (int64, error)
+	DeleteByExpiresBefore(time.Time) (int64, error)
+}
+
+type IApiTokenRepository interface {
+	GetById(string) (*models.ApiToken, error)
+	GetByHash(string) (*models.ApiToken, error)
+	GetByUser(string) ([]*models.ApiToken, error)
+	Insert(*models.ApiToken) (*models.ApiToken, error)
+	UpdateLastUsed(*models.ApiToken) (*models.ApiToken, error)
+	Delete(*models.ApiToken) error
+	DeleteByUser(string) error
+}
+
+type IEmailVerificationRepository interface {
+	GetByHash(string) (*models.EmailVerification, error)
+	GetLatestByUser(string) (*models.EmailVerification, error)
+	Insert(*models.EmailVerification) (*models.EmailVerification, error)
+	DeleteByUser(string) error
+	DeleteByExpiresBefore(time.Time) (int64, error)
+}
+
+type IAuditEventRepository interface {
+	GetLatest() (*models.AuditEvent, error)
+	GetAfter(uint, int) ([]*models.AuditEvent, error)
+	GetByUser(string) ([]*models.AuditEvent, error)
+	Search(string, *models.AuditEventQuery) ([]*models.AuditEvent, int64, error)
+	GetAllByQuery(string, *models.AuditEventQuery) ([]*models.AuditEvent, error)
+	Append(*models.AuditEvent, func(*models.AuditEvent) error) error
+	DeleteByCreatedBefore(time.Time) (int64, error)
+}
+
+type IMagicLinkRepository interface {
+	GetByHash(string) (*models.MagicLink, error)
+	Insert(*models.MagicLink) (*models.MagicLink, error)
+	DeleteByHash(string) (int64, error)
+	DeleteByUser(string) error
+	DeleteByExpiresBefore(time.Time) (int64, error)
+}
+
+type IKnownDeviceRepository interface {
+	GetByUser(string) ([]*models.KnownDevice, error)
+	Insert(*models.KnownDevice) (*models.KnownDevice, error)
+	Touch(*models.KnownDevice) error
+	DeleteByLastSeenBefore(time.Time) (int64, error)
+}
+
+type IClientCertificateRepository interface {
+	GetByOrganization(string) ([]*models.ClientCertificate, error)
+	GetByFingerprint(string) (*models.ClientCertificate, error)
+	GetByOrganizationAndFingerprint(string, string) (*models.ClientCertificate, error)
+	GetByUser(string) ([]*models.ClientCertificate, error)
+	Insert(*models.ClientCertificate) (*models.ClientCertificate, error)
+	UpdateLastUsed(*models.ClientCertificate) (*models.ClientCertificate, error)
+	Delete(*models.ClientCertificate) error
+}
+
+type IOAuthClientRepository interface {
+	GetAll() ([]*models.OAuthClient, error)
+	GetById(string) (*models.OAuthClient, error)
+	Insert(*models.OAuthClient) (*models.OAuthClient, error)
+	Delete(*models.OAuthClient) error
+}
+
+type IOAuthGrantRepository interface {
+	GetById(string) (*models.OAuthGrant, error)
+	GetByUserAndClient(string, string) (*models.OAuthGrant, error)
+	GetByUser(string) ([]*models.OAuthGrant, error)
+	Insert(*models.OAuthGrant) (*models.OAuthGrant, error)
+	UpdateScopes(*models.OAuthGrant) (*models.OAuthGrant, error)
+	UpdateLastUsed(*models.OAuthGrant) (*models.OAuthGrant, error)
+	Delete(*models.OAuthGrant) error
+}
+
+type IOAuthAuthorizationCodeRepository interface {
+	GetByHash(string) (*models.OAuthAuthorizationCode, error)
+	Insert(*models.OAuthAuthorizationCode) (*models.OAuthAuthorizationCode, error)
+	Delete(*models.OAuthAuthorizationCode) (int64, error)
+	DeleteByExpiresBefore(time.Time) (int64, error)
+}
+
+type IOAuthTokenRepository interface {
+	GetByAccessHash(string) (*models.OAuthToken, error)
+	GetByRefreshHash(string) (*models.OAuthToken, error)
+	Insert(*models.OAuthToken) (*models.OAuthToken, error)
+	Delete(*models.OAuthToken) (int64, error)
+	DeleteByRefreshExpiresBefore(time.Time) (int64, error)
+}
+
+type IInvitationRepository interface {
+	GetAll() ([]*models.Invitation, error)
+	GetById(string) (*models.Invitation, error)
+	GetByHash(string) (*models.Invitation, error)
+	Insert(*models.Invitation) (*models.Invitation, error)
+	MarkConsumed(string, string, time.Time) (bool, error)
+	Delete(string) error
+}
+
+type IThrottleRepository interface {
+	Get(string) (*models.ThrottleEntry, error)
+	Upsert(*models.ThrottleEntry) error
+	Delete(string) error
+	DeleteByLastFailureBefore(time.Time) (int64, error)
+}
+
+type IOidcIdentityRepository interface {
+	GetBySubject(string, string) (*models.OidcIdentity, error)
+	GetByUser(string) ([]*models.OidcIdentity, error)
+	Insert(*models.OidcIdentity) (*models.OidcIdentity, error)
+}
+
+type IRoleRepository interface {
+	GetAll() ([]*models.Role, error)
+	GetByName(string) (*models.Role, error)
+	GetByUser(string) ([]*models.Role, error)
+	GetPermissions() ([]*models.Permission, error)
+	UpsertPermission(*models.Permission) error
+	Upsert(*models.Role) (*models.Role, error)
+	Delete(string) error
+	Assign(string, string) error
+	Unassign(string, string) error
+	CountUsers(string) (int64, error)
+}
+
+type IOrganizationRepository interface {
+	GetById(string) (*models.Organization, error)
+	Insert(*models.Organization, *models.Membership) (*models.Organization, error)
+	Update(*models.Organization) (*models.Organization, error)
+	Delete(string) error
+	DeleteOrphaned() (int64, error)
+}
+
+// IMembershipRepository is tenant-scoped, i.e. all methods except GetByUser operate within a single organization only
+type IMembershipRepository interface {
+	GetByUser(string) ([]*models.Membership, error)
+	GetByOrganization(string) ([]*models.Membership, error)
+	Get(string, string) (*models.Membership, error)
+	CountByRole(string, string) (int64, error)
+	Insert(*models.Membership) (*models.Membership, error)
+	UpdateRole(string, string, string) error
+	Delete(string, string) error
+}
+
+// IOrganizationInvitationRepository is tenant-scoped, except for looking up an invitation by its token
+type IOrganizationInvitationRepository interface {
+	GetByOrganization(string) ([]*models.OrganizationInvitation, error)
+	GetByHash(string) (*models.OrganizationInvitation, error)
+	Insert(*models.OrganizationInvitation) (*models.OrganizationInvitation, error)
+	Delete(string, string) (bool, error)
+	DeleteByExpiresBefore(time.Time) (int64, error)
+}
+
 type IUserRepository interface {
 	GetById(string) (*models.User, error)
+	GetByOrganizationAndId(string, string) (*models.User, error)
 	GetByIds([]string) ([]*models.User, error)
 	GetByApiKey(string) (*models.User, error)
 	GetByEmail(string) (*models.User, error)
 	GetByResetToken(string) (*models.User, error)
 	GetAll() ([]*models.User, error)
+	Search(string, *models.UserListQuery) ([]*models.User, int64, error)
 	GetByLoggedInAfter(time.Time) ([]*models.User, error)
+	GetByDeletionScheduledBefore(time.Time) ([]*models.User, error)
 	Count() (int64, error)
 	InsertOrGet(*models.User) (*models.User, bool, error)
 	Update(*models.User) (*models.User, error)
 	UpdateField(*models.User, string, interface{}) (*models.User, error)
+	AdvanceTotpCounter(string, int64) (int64, error)
+	ClearResetTokensCreatedBefore(time.Time) (int64, error)
 	Delete(*models.User) error
 }
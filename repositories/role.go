@@ -0,0 +1,119 @@
+package repositories
+
+import (
+	"errors"
+	"github.com/muety/broilerplate/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type RoleRepository struct {
+	db *gorm.DB
+}
+
+func NewRoleRepository(db *gorm.DB) *RoleRepository {
+	return &RoleRepository{db: db}
+}
+
+func (r *RoleRepository) GetAll() ([]*models.Role, error) {
+	var roles []*models.Role
+	if err := r.db.
+		Preload("Permissions").
+		Order("name asc").
+		Find(&roles).Error; err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+func (r *RoleRepository) GetByName(name string) (*models.Role, error) {
+	if name == "" {
+		return nil, errors.New("invalid input")
+	}
+	role := &models.Role{}
+	if err := r.db.
+		Preload("Permissions").
+		Where(&models.Role{Name: name}).
+		First(role).Error; err != nil {
+		return nil, err
+	}
+	return role, nil
+}
+
+func (r *RoleRepository) GetByUser(userId string) ([]*models.Role, error) {
+	var roles []*models.Role
+	if err := r.db.
+		Preload("Permissions").
+		Joins("INNER JOIN user_roles ON user_roles.role_name = roles.name").
+		Where("user_roles.user_id = ?", userId).
+		Order("roles.name asc").
+		Find(&roles).Error; err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+func (r *RoleRepository) GetPermissions() ([]*models.Permission, error) {
+	var permissions []*models.Permission
+	if err := r.db.
+		Order("name asc").
+		Find(&permissions).Error; err != nil {
+		return nil, err
+	}
+	return permissions, nil
+}
+
+func (r *RoleRepository) UpsertPermission(permission *models.Permission) error {
+	return r.db.
+		Clauses(clause.OnConflict{UpdateAll: true}).
+		Create(permission).Error
+}
+
+// Upsert creates or updates the role and replaces its set of permissions
+func (r *RoleRepository) Upsert(role *models.Role) (*models.Role, error) {
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.
+			Omit("Permissions").
+			Clauses(clause.OnConflict{UpdateAll: true}).
+			Create(role).Error; err != nil {
+			return err
+		}
+		return tx.Model(role).Association("Permissions").Replace(role.Permissions)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return role, nil
+}
+
+func (r *RoleRepository) Delete(name string) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("role_name = ?", name).Delete(&models.UserRole{}).Error; err != nil {
+			return err
+		}
+		return tx.Select("Permissions").Delete(&models.Role{Name: name}).Error
+	})
+}
+
+func (r *RoleRepository) Assign(userId, roleName string) error {
+	return r.db.
+		Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&models.UserRole{UserID: userId, RoleName: roleName}).Error
+}
+
+func (r *RoleRepository) Unassign(userId, roleName string) error {
+	return r.db.
+		Where("user_id = ? AND role_name = ?", userId, roleName).
+		Delete(&models.UserRole{}).Error
+}
+
+func (r *RoleRepository) CountUsers(roleName string) (int64, error) {
+	var count int64
+	if err := r.db.
+		Model(&models.UserRole{}).
+		Where("role_name = ?", roleName).
+		Count(&count).Error; err != nil {
+		return 0, err
+	}
+	return count, nil
+}
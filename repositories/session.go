@@ -0,0 +1,69 @@
+package repositories
+
+import (
+	"errors"
+	"github.com/muety/broilerplate/models"
+	"gorm.io/gorm"
+	"time"
+)
+
+type SessionRepository struct {
+	db *gorm.DB
+}
+
+func NewSessionRepository(db *gorm.DB) *SessionRepository {
+	return &SessionRepository{db: db}
+}
+
+func (r *SessionRepository) GetById(sessionId string) (*models.Session, error) {
+	if sessionId == "" {
+		return nil, errors.New("invalid input")
+	}
+	s := &models.Session{}
+	if err := r.db.Where(&models.Session{ID: sessionId}).First(s).Error; err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (r *SessionRepository) GetByUser(userId string) ([]*models.Session, error) {
+	var sessions []*models.Session
+	if err := r.db.
+		Where(&models.Session{UserID: userId}).
+		Order("last_seen_at desc").
+		Find(&sessions).Error; err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func (r *SessionRepository) Insert(session *models.Session) (*models.Session, error) {
+	if err := r.db.Create(session).Error; err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+func (r *SessionRepository) UpdateLastSeen(session *models.Session) (*models.Session, error) {
+	if err := r.db.Model(session).Update("last_seen_at", session.LastSeenAt).Error; err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+func (r *SessionRepository) Delete(session *models.Session) error {
+	return r.db.Delete(session).Error
+}
+
+func (r *SessionRepository) DeleteByUser(userId string) error {
+	return r.db.
+		Where("user_id = ?", userId).
+		Delete(&models.Session{}).Error
+}
+
+func (r *SessionRepository) DeleteByLastSeenBefore(t time.Time) (int64, error) {
+	result := r.db.
+		Where("last_seen_at < ?", t.Local()).
+		Delete(&models.Session{})
+	return result.RowsAffected, result.Error
+}
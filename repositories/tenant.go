@@ -0,0 +1,44 @@
+package repositories
+
+import (
+	"errors"
+	"github.com/muety/broilerplate/models"
+	"gorm.io/gorm"
+)
+
+var ErrMissingTenant = errors.New("missing tenant")
+
+// TenantScope restricts a query to rows belonging to the given organization. Repositories of organization-owned data
+// apply it to every read and write, so records can never be accessed through another organization's id. Without an
+// organization, the query fails instead of silently spanning all tenants.
+func TenantScope(orgId string) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		if orgId == "" {
+			db.AddError(ErrMissingTenant)
+			return db
+		}
+		return db.Where("organization_id = ?", orgId)
+	}
+}
+
+// MemberScope is the counterpart of TenantScope for user-owned data, as one account may be a member of several
+// organizations. It restricts a query to rows whose given user id column (or any of them) refers to a member of the
+// organization, and fails without one just like TenantScope does. Only lookups made on behalf of a user, who has not
+// been authenticated yet (logins, tokens, ...), or of the user themselves go without it.
+func MemberScope(orgId string, columns ...string) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		if orgId == "" {
+			db.AddError(ErrMissingTenant)
+			return db
+		}
+		members := db.Session(&gorm.Session{NewDB: true}).
+			Model(&models.Membership{}).
+			Select("user_id").
+			Where("organization_id = ?", orgId)
+		q := db.Session(&gorm.Session{NewDB: true})
+		for _, column := range columns {
+			q = q.Or(column+" IN (?)", members)
+		}
+		return db.Where(q)
+	}
+}
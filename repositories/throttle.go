@@ -0,0 +1,46 @@
+package repositories
+
+import (
+	"errors"
+	"github.com/muety/broilerplate/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"time"
+)
+
+// ThrottleRepository keeps throttle state in the database, so it is shared between multiple instances
+type ThrottleRepository struct {
+	db *gorm.DB
+}
+
+func NewThrottleRepository(db *gorm.DB) *ThrottleRepository {
+	return &ThrottleRepository{db: db}
+}
+
+func (r *ThrottleRepository) Get(key string) (*models.ThrottleEntry, error) {
+	if key == "" {
+		return nil, errors.New("invalid input")
+	}
+	entry := &models.ThrottleEntry{}
+	if err := r.db.Where(&models.ThrottleEntry{Key: key}).First(entry).Error; err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+func (r *ThrottleRepository) Upsert(entry *models.ThrottleEntry) error {
+	return r.db.
+		Clauses(clause.OnConflict{UpdateAll: true}).
+		Create(entry).Error
+}
+
+func (r *ThrottleRepository) Delete(key string) error {
+	return r.db.Delete(&models.ThrottleEntry{Key: key}).Error
+}
+
+func (r *ThrottleRepository) DeleteByLastFailureBefore(t time.Time) (int64, error) {
+	result := r.db.
+		Where("last_failure_at < ? AND blocked_until < ?", t.Local(), time.Now().Local()).
+		Delete(&models.ThrottleEntry{})
+	return result.RowsAffected, result.Error
+}
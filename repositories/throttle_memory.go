@@ -0,0 +1,47 @@
+package repositories
+
+import (
+	"errors"
+	"github.com/muety/broilerplate/models"
+	"github.com/patrickmn/go-cache"
+	"time"
+)
+
+// InMemoryThrottleRepository keeps throttle state in memory, which is sufficient for single-instance deployments
+type InMemoryThrottleRepository struct {
+	cache *cache.Cache
+}
+
+func NewInMemoryThrottleRepository() *InMemoryThrottleRepository {
+	return &InMemoryThrottleRepository{cache: cache.New(cache.NoExpiration, 0)}
+}
+
+func (r *InMemoryThrottleRepository) Get(key string) (*models.ThrottleEntry, error) {
+	if item, ok := r.cache.Get(key); ok {
+		entry := item.(models.ThrottleEntry)
+		return &entry, nil
+	}
+	return nil, errors.New("record not found")
+}
+
+func (r *InMemoryThrottleRepository) Upsert(entry *models.ThrottleEntry) error {
+	r.cache.Set(entry.Key, *entry, cache.NoExpiration)
+	return nil
+}
+
+func (r *InMemoryThrottleRepository) Delete(key string) error {
+	r.cache.Delete(key)
+	return nil
+}
+
+func (r *InMemoryThrottleRepository) DeleteByLastFailureBefore(t time.Time) (int64, error) {
+	var n int64
+	for key, item := range r.cache.Items() {
+		entry := item.Object.(models.ThrottleEntry)
+		if entry.LastFailureAt.T().Before(t) && !entry.IsBlocked() {
+			r.cache.Delete(key)
+			n++
+		}
+	}
+	return n, nil
+}
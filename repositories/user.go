@@ -4,6 +4,8 @@ import (
 	"errors"
 	"github.com/muety/broilerplate/models"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"strings"
 	"time"
 )
 
@@ -23,6 +25,18 @@ func (r *UserRepository) GetById(userId string) (*models.User, error) {
 	return u, nil
 }
 
+// GetByOrganizationAndId looks up a user only if they are a member of the given organization
+func (r *UserRepository) GetByOrganizationAndId(orgId, userId string) (*models.User, error) {
+	u := &models.User{}
+	if err := r.db.
+		Scopes(MemberScope(orgId, "id")).
+		Where(&models.User{ID: userId}).
+		First(u).Error; err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
 func (r *UserRepository) GetByIds(userIds []string) ([]*models.User, error) {
 	var users []*models.User
 	if err := r.db.
@@ -77,6 +91,31 @@ func (r *UserRepository) GetAll() ([]*models.User, error) {
 	return users, nil
 }
 
+// Search returns a single page of the organization's members whose id or e-mail address contain the query's search term, along with the total number of matches
+func (r *UserRepository) Search(orgId string, query *models.UserListQuery) ([]*models.User, int64, error) {
+	q := r.db.Model(&models.User{}).Scopes(MemberScope(orgId, "id"))
+	if query.Search != "" {
+		term := "%" + strings.ToLower(query.Search) + "%"
+		q = q.Where("lower(id) like ? or lower(email) like ?", term, term)
+	}
+
+	var count int64
+	if err := q.Count(&count).Error; err != nil {
+		return nil, 0, err
+	}
+
+	var users []*models.User
+	if err := q.
+		Order(clause.OrderByColumn{Column: clause.Column{Name: models.UserSortColumns[query.SortBy]}, Desc: query.SortDesc}).
+		Order("id asc").
+		Offset(query.Offset()).
+		Limit(models.UserListPageSize).
+		Find(&users).Error; err != nil {
+		return nil, 0, err
+	}
+	return users, count, nil
+}
+
 func (r *UserRepository) GetByLoggedInAfter(t time.Time) ([]*models.User, error) {
 	var users []*models.User
 	if err := r.db.
@@ -87,6 +126,16 @@ func (r *UserRepository) GetByLoggedInAfter(t time.Time) ([]*models.User, error)
 	return users, nil
 }
 
+func (r *UserRepository) GetByDeletionScheduledBefore(t time.Time) ([]*models.User, error) {
+	var users []*models.User
+	if err := r.db.
+		Where("deletion_scheduled_at <= ?", t.Local()).
+		Find(&users).Error; err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
 func (r *UserRepository) Count() (int64, error) {
 	var count int64
 	if err := r.db.
@@ -112,12 +161,25 @@ func (r *UserRepository) InsertOrGet(user *models.User) (*models.User, bool, err
 
 func (r *UserRepository) Update(user *models.User) (*models.User, error) {
 	updateMap := map[string]interface{}{
-		"api_key":           user.ApiKey,
-		"password":          user.Password,
-		"email":             user.Email,
-		"last_logged_in_at": user.LastLoggedInAt,
-		"reset_token":       user.ResetToken,
-		"location":          user.Location,
+		"api_key":                user.ApiKey,
+		"api_key_prefix":         user.ApiKeyPrefix,
+		"password":               user.Password,
+		"email":                  user.Email,
+		"email_verified":         user.EmailVerified,
+		"pending_email":          user.PendingEmail,
+		"ldap_dn":                user.LdapDn,
+		"last_logged_in_at":      user.LastLoggedInAt,
+		"reset_token":            user.ResetToken,
+		"reset_token_created_at": user.ResetTokenCreatedAt,
+		"location":               user.Location,
+		"is_admin":               user.IsAdmin,
+		"totp_secret":            user.TotpSecret,
+		"totp_enabled":           user.TotpEnabled,
+		"totp_last_counter":      user.TotpLastCounter,
+		"active_organization_id": user.ActiveOrganizationID,
+		"reports_weekly":         user.ReportsWeekly,
+		"notify_new_logins":      user.NotifyNewLogins,
+		"deletion_scheduled_at":  user.DeletionScheduledAt,
 	}
 
 	result := r.db.Model(user).Updates(updateMap)
@@ -141,6 +203,22 @@ func (r *UserRepository) UpdateField(user *models.User, key string, value interf
 	return user, nil
 }
 
+// AdvanceTotpCounter only ever moves the last used time step forward, the number of affected rows tells whether the caller was the one to use it
+func (r *UserRepository) AdvanceTotpCounter(userId string, counter int64) (int64, error) {
+	result := r.db.Model(&models.User{}).
+		Where("id = ? AND COALESCE(totp_last_counter, 0) < ?", userId, counter).
+		Update("totp_last_counter", counter)
+	return result.RowsAffected, result.Error
+}
+
+// ClearResetTokensCreatedBefore invalidates all password reset tokens issued before the given time
+func (r *UserRepository) ClearResetTokensCreatedBefore(t time.Time) (int64, error) {
+	result := r.db.Model(&models.User{}).
+		Where("reset_token != '' AND (reset_token_created_at IS NULL OR reset_token_created_at < ?)", t.Local()).
+		Updates(map[string]interface{}{"reset_token": "", "reset_token_created_at": nil})
+	return result.RowsAffected, result.Error
+}
+
 func (r *UserRepository) Delete(user *models.User) error {
 	return r.db.Delete(user).Error
 }
@@ -0,0 +1,111 @@
+package repositories
+
+import (
+	"errors"
+	"github.com/muety/broilerplate/models"
+	"gorm.io/gorm"
+	"time"
+)
+
+type WebauthnCredentialRepository struct {
+	db *gorm.DB
+}
+
+func NewWebauthnCredentialRepository(db *gorm.DB) *WebauthnCredentialRepository {
+	return &WebauthnCredentialRepository{db: db}
+}
+
+func (r *WebauthnCredentialRepository) GetById(id string) (*models.WebauthnCredential, error) {
+	if id == "" {
+		return nil, errors.New("invalid input")
+	}
+	c := &models.WebauthnCredential{}
+	if err := r.db.Where(&models.WebauthnCredential{ID: id}).First(c).Error; err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (r *WebauthnCredentialRepository) GetByUser(userId string) ([]*models.WebauthnCredential, error) {
+	var credentials []*models.WebauthnCredential
+	if err := r.db.
+		Where(&models.WebauthnCredential{UserID: userId}).
+		Order("created_at asc").
+		Find(&credentials).Error; err != nil {
+		return nil, err
+	}
+	return credentials, nil
+}
+
+func (r *WebauthnCredentialRepository) CountByUser(userId string) (int64, error) {
+	var count int64
+	if err := r.db.
+		Model(&models.WebauthnCredential{}).
+		Where(&models.WebauthnCredential{UserID: userId}).
+		Count(&count).Error; err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func (r *WebauthnCredentialRepository) Insert(credential *models.WebauthnCredential) (*models.WebauthnCredential, error) {
+	if err := r.db.Create(credential).Error; err != nil {
+		return nil, err
+	}
+	return credential, nil
+}
+
+func (r *WebauthnCredentialRepository) UpdateUsage(credential *models.WebauthnCredential) (*models.WebauthnCredential, error) {
+	if err := r.db.Model(credential).Updates(map[string]interface{}{
+		"sign_count":   credential.SignCount,
+		"last_used_at": credential.LastUsedAt,
+	}).Error; err != nil {
+		return nil, err
+	}
+	return credential, nil
+}
+
+func (r *WebauthnCredentialRepository) Delete(credential *models.WebauthnCredential) error {
+	return r.db.Delete(credential).Error
+}
+
+type WebauthnSessionRepository struct {
+	db *gorm.DB
+}
+
+func NewWebauthnSessionRepository(db *gorm.DB) *WebauthnSessionRepository {
+	return &WebauthnSessionRepository{db: db}
+}
+
+func (r *WebauthnSessionRepository) GetById(id string) (*models.WebauthnSession, error) {
+	if id == "" {
+		return nil, errors.New("invalid input")
+	}
+	s := &models.WebauthnSession{}
+	if err := r.db.Where(&models.WebauthnSession{ID: id}).First(s).Error; err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (r *WebauthnSessionRepository) Insert(session *models.WebauthnSession) (*models.WebauthnSession, error) {
+	if err := r.db.Create(session).Error; err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// Delete returns the number of deleted sessions, which is zero if the ceremony was finished by someone else in the meantime
+func (r *WebauthnSessionRepository) Delete(id string) (int64, error) {
+	result := r.db.
+		Where("id = ?", id).
+		Delete(&models.WebauthnSession{})
+	return result.RowsAffected, result.Error
+}
+
+func (r *WebauthnSessionRepository) DeleteByExpiresBefore(t time.Time) (int64, error) {
+	result := r.db.
+		Where("expires_at < ?", t.Local()).
+		Delete(&models.WebauthnSession{})
+	return result.RowsAffected, result.Error
+}
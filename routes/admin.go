@@ -0,0 +1,656 @@
+package routes
+
+import (
+	"fmt"
+	"github.com/emvi/logbuch"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/schema"
+	conf "github.com/muety/broilerplate/config"
+	"github.com/muety/broilerplate/middlewares"
+	"github.com/muety/broilerplate/models"
+	"github.com/muety/broilerplate/models/view"
+	"github.com/muety/broilerplate/services"
+	"github.com/muety/broilerplate/utils"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+type AdminHandler struct {
+	config           *conf.Config
+	userSrvc         services.IUserService
+	sessionSrvc      services.ISessionService
+	apiTokenSrvc     services.IApiTokenService
+	clientCertSrvc   services.IClientCertificateService
+	oauthSrvc        services.IOAuthService
+	invitationSrvc   services.IInvitationService
+	roleSrvc         services.IRoleService
+	mailSrvc         services.IMailService
+	auditSrvc        services.IAuditService
+	organizationSrvc services.IOrganizationService
+}
+
+// users, their certificates and audit events are only ever listed for the organization the admin is acting in
+const noOrganizationMessage = "you need to be a member of an organization to manage its users"
+
+var invitationDecoder = schema.NewDecoder()
+var userListDecoder = schema.NewDecoder()
+var auditQueryDecoder = schema.NewDecoder()
+var clientCertificateDecoder = schema.NewDecoder()
+var oauthClientDecoder = schema.NewDecoder()
+
+func init() {
+	// the list queries share the url with success and error messages
+	userListDecoder.IgnoreUnknownKeys(true)
+	auditQueryDecoder.IgnoreUnknownKeys(true)
+}
+
+func NewAdminHandler(userService services.IUserService, sessionService services.ISessionService, apiTokenService services.IApiTokenService, invitationService services.IInvitationService, roleService services.IRoleService, mailService services.IMailService, auditService services.IAuditService, clientCertificateService services.IClientCertificateService, oauthService services.IOAuthService, organizationService services.IOrganizationService) *AdminHandler {
+	return &AdminHandler{
+		config:           conf.Get(),
+		userSrvc:         userService,
+		sessionSrvc:      sessionService,
+		apiTokenSrvc:     apiTokenService,
+		clientCertSrvc:   clientCertificateService,
+		oauthSrvc:        oauthService,
+		invitationSrvc:   invitationService,
+		roleSrvc:         roleService,
+		mailSrvc:         mailService,
+		auditSrvc:        auditService,
+		organizationSrvc: organizationService,
+	}
+}
+
+func (h *AdminHandler) RegisterRoutes(router *mux.Router) {
+	r1 := router.PathPrefix("/admin/invitations").Subrouter()
+	r1.Use(
+		middlewares.NewAuthenticateMiddleware(h.userSrvc, h.sessionSrvc, h.apiTokenSrvc, h.clientCertSrvc, h.oauthSrvc).WithRedirectTarget(defaultErrorRedirectTarget()).Handler,
+		middlewares.NewPermissionMiddleware(h.roleSrvc, models.PermissionInvitationsManage).WithRedirectTarget(h.forbiddenRedirectTarget()).Handler,
+	)
+	r1.Path("").Methods(http.MethodGet).HandlerFunc(h.GetInvitations)
+	r1.Path("").Methods(http.MethodPost).HandlerFunc(h.PostCreateInvitation)
+	r1.Path("/delete").Methods(http.MethodPost).HandlerFunc(h.PostDeleteInvitation)
+
+	r2 := router.PathPrefix("/admin/users").Subrouter()
+	r2.Use(
+		middlewares.NewAuthenticateMiddleware(h.userSrvc, h.sessionSrvc, h.apiTokenSrvc, h.clientCertSrvc, h.oauthSrvc).WithRedirectTarget(defaultErrorRedirectTarget()).Handler,
+		middlewares.NewPermissionMiddleware(h.roleSrvc, models.PermissionUsersManage).WithRedirectTarget(h.forbiddenRedirectTarget()).Handler,
+		middlewares.NewOrganizationMiddleware(h.organizationSrvc).Handler,
+	)
+	r2.Path("").Methods(http.MethodGet).HandlerFunc(h.GetUsers)
+	r2.Path("/promote").Methods(http.MethodPost).HandlerFunc(h.PostPromoteUser)
+	r2.Path("/demote").Methods(http.MethodPost).HandlerFunc(h.PostDemoteUser)
+	r2.Path("/reset-password").Methods(http.MethodPost).HandlerFunc(h.PostResetUserPassword)
+	r2.Path("/reset-api-key").Methods(http.MethodPost).HandlerFunc(h.PostResetUserApiKey)
+	r2.Path("/delete").Methods(http.MethodPost).HandlerFunc(h.PostDeleteUser)
+
+	r3 := router.PathPrefix("/admin/audit").Subrouter()
+	r3.Use(
+		middlewares.NewAuthenticateMiddleware(h.userSrvc, h.sessionSrvc, h.apiTokenSrvc, h.clientCertSrvc, h.oauthSrvc).WithRedirectTarget(defaultErrorRedirectTarget()).Handler,
+		middlewares.NewPermissionMiddleware(h.roleSrvc, models.PermissionAuditView).WithRedirectTarget(h.forbiddenRedirectTarget()).Handler,
+		middlewares.NewOrganizationMiddleware(h.organizationSrvc).Handler,
+	)
+	r3.Path("").Methods(http.MethodGet).HandlerFunc(h.GetAudit)
+	r3.Path("/export").Methods(http.MethodGet).HandlerFunc(h.GetAuditExport)
+
+	r4 := router.PathPrefix("/admin/client-certificates").Subrouter()
+	r4.Use(
+		middlewares.NewAuthenticateMiddleware(h.userSrvc, h.sessionSrvc, h.apiTokenSrvc, h.clientCertSrvc, h.oauthSrvc).WithRedirectTarget(defaultErrorRedirectTarget()).Handler,
+		middlewares.NewPermissionMiddleware(h.roleSrvc, models.PermissionUsersManage).WithRedirectTarget(h.forbiddenRedirectTarget()).Handler,
+		middlewares.NewOrganizationMiddleware(h.organizationSrvc).Handler,
+	)
+	r4.Path("").Methods(http.MethodGet).HandlerFunc(h.GetClientCertificates)
+	r4.Path("").Methods(http.MethodPost).HandlerFunc(h.PostCreateClientCertificate)
+	r4.Path("/delete").Methods(http.MethodPost).HandlerFunc(h.PostDeleteClientCertificate)
+
+	r5 := router.PathPrefix("/admin/oauth-clients").Subrouter()
+	r5.Use(
+		middlewares.NewAuthenticateMiddleware(h.userSrvc, h.sessionSrvc, h.apiTokenSrvc, h.clientCertSrvc, h.oauthSrvc).WithRedirectTarget(defaultErrorRedirectTarget()).Handler,
+		middlewares.NewPermissionMiddleware(h.roleSrvc, models.PermissionSystemManage).WithRedirectTarget(h.forbiddenRedirectTarget()).Handler,
+	)
+	r5.Path("").Methods(http.MethodGet).HandlerFunc(h.GetOAuthClients)
+	r5.Path("").Methods(http.MethodPost).HandlerFunc(h.PostCreateOAuthClient)
+	r5.Path("/delete").Methods(http.MethodPost).HandlerFunc(h.PostDeleteOAuthClient)
+}
+
+func (h *AdminHandler) GetInvitations(w http.ResponseWriter, r *http.Request) {
+	if h.config.IsDev() {
+		loadTemplates()
+	}
+
+	user := middlewares.GetPrincipal(r)
+	templates[conf.AdminInvitationsTemplate].Execute(w, h.buildInvitationsViewModel(r, user))
+}
+
+func (h *AdminHandler) PostCreateInvitation(w http.ResponseWriter, r *http.Request) {
+	if h.config.IsDev() {
+		loadTemplates()
+	}
+
+	user := middlewares.GetPrincipal(r)
+
+	var createRequest models.InvitationCreateRequest
+	if err := r.ParseForm(); err != nil {
+		h.redirectInvitationsWithError(w, r, "missing parameters")
+		return
+	}
+	if err := invitationDecoder.Decode(&createRequest, r.PostForm); err != nil {
+		h.redirectInvitationsWithError(w, r, "missing parameters")
+		return
+	}
+	if !createRequest.IsValid() {
+		h.redirectInvitationsWithError(w, r, "invalid e-mail address")
+		return
+	}
+
+	_, link, err := h.invitationSrvc.Create(user, createRequest.Email)
+	if err != nil {
+		logbuch.Error("failed to create invitation – %v", err)
+		h.redirectInvitationsWithError(w, r, "failed to create invitation")
+		return
+	}
+
+	message := "invitation created successfully"
+	if h.config.Mail.Enabled {
+		message = fmt.Sprintf("invitation sent to %s", createRequest.Email)
+	}
+
+	vm := h.buildInvitationsViewModel(r, user).WithSuccess(message)
+	vm.NewLink = link
+	templates[conf.AdminInvitationsTemplate].Execute(w, vm)
+}
+
+func (h *AdminHandler) PostDeleteInvitation(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		h.redirectInvitationsWithError(w, r, "missing parameters")
+		return
+	}
+
+	if err := h.invitationSrvc.Delete(r.PostForm.Get("invitation_id")); err != nil {
+		h.redirectInvitationsWithError(w, r, "invitation not found")
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("%s/admin/invitations?success=%s", h.config.Server.BasePath, url.QueryEscape("invitation deleted successfully")), http.StatusFound)
+}
+
+func (h *AdminHandler) GetUsers(w http.ResponseWriter, r *http.Request) {
+	if h.config.IsDev() {
+		loadTemplates()
+	}
+
+	user := middlewares.GetPrincipal(r)
+	templates[conf.AdminUsersTemplate].Execute(w, h.buildUsersViewModel(r, user))
+}
+
+func (h *AdminHandler) PostPromoteUser(w http.ResponseWriter, r *http.Request) {
+	h.updateAdminRole(w, r, true)
+}
+
+func (h *AdminHandler) PostDemoteUser(w http.ResponseWriter, r *http.Request) {
+	h.updateAdminRole(w, r, false)
+}
+
+func (h *AdminHandler) PostResetUserPassword(w http.ResponseWriter, r *http.Request) {
+	user := middlewares.GetPrincipal(r)
+
+	if !h.config.Mail.Enabled {
+		h.redirectUsersWithError(w, r, "mailing is disabled on this server")
+		return
+	}
+
+	targetUser, ok := h.getTargetUser(w, r)
+	if !ok || !h.checkMayManage(w, r, user, targetUser) {
+		return
+	}
+	// same as for self-service resets, unconfirmed addresses might belong to someone else than the account owner
+	if targetUser.Email == "" || !targetUser.EmailVerified {
+		h.redirectUsersWithError(w, r, fmt.Sprintf("%s has no verified e-mail address", targetUser.ID))
+		return
+	}
+
+	token, err := h.userSrvc.GenerateResetToken(targetUser, middlewares.GetAuditOrigin(r))
+	if err != nil {
+		logbuch.Error("failed to generate password reset token for %s – %v", targetUser.ID, err)
+		h.redirectUsersWithError(w, r, "failed to generate password reset token")
+		return
+	}
+
+	conf.RunInBackground(func() {
+		link := fmt.Sprintf("%s/set-password?token=%s", h.config.Server.GetPublicUrl(), token)
+		if err := h.mailSrvc.SendPasswordReset(targetUser, link); err != nil {
+			logbuch.Error("failed to send password reset mail to %s – %v", targetUser.ID, err)
+		} else {
+			logbuch.Info("sent password reset mail to %s", targetUser.ID)
+		}
+	})
+
+	logbuch.Info("password reset for user %s requested by %s", targetUser.ID, user.ID)
+	h.redirectUsersWithSuccess(w, r, fmt.Sprintf("password reset mail sent to %s", targetUser.ID))
+}
+
+func (h *AdminHandler) PostResetUserApiKey(w http.ResponseWriter, r *http.Request) {
+	user := middlewares.GetPrincipal(r)
+
+	targetUser, ok := h.getTargetUser(w, r)
+	if !ok || !h.checkMayManage(w, r, user, targetUser) {
+		return
+	}
+
+	// the new key is deliberately not shown, the user has to generate another one themselves to learn it
+	if _, _, err := h.userSrvc.ResetApiKey(targetUser, middlewares.GetAuditOrigin(r)); err != nil {
+		logbuch.Error("failed to reset api key of user %s – %v", targetUser.ID, err)
+		h.redirectUsersWithError(w, r, "failed to reset api key")
+		return
+	}
+
+	logbuch.Info("api key of user %s reset by %s", targetUser.ID, user.ID)
+	h.redirectUsersWithSuccess(w, r, fmt.Sprintf("api key of %s reset successfully", targetUser.ID))
+}
+
+func (h *AdminHandler) PostDeleteUser(w http.ResponseWriter, r *http.Request) {
+	user := middlewares.GetPrincipal(r)
+
+	targetUser, ok := h.getTargetUser(w, r)
+	if !ok || !h.checkMayManage(w, r, user, targetUser) {
+		return
+	}
+	if targetUser.ID == user.ID {
+		h.redirectUsersWithError(w, r, "you can not delete your own account from here")
+		return
+	}
+	if targetUser.IsAdmin {
+		// keeps the last admin guard of the role service in effect
+		if err := h.roleSrvc.Unassign(targetUser, models.RoleAdmin); err != nil {
+			h.redirectUsersWithError(w, r, err.Error())
+			return
+		}
+	}
+
+	if err := h.userSrvc.Delete(targetUser, middlewares.GetAuditOrigin(r)); err != nil {
+		logbuch.Error("failed to delete user %s – %v", targetUser.ID, err)
+		h.redirectUsersWithError(w, r, "failed to delete user")
+		return
+	}
+
+	logbuch.Info("user %s deleted by %s", targetUser.ID, user.ID)
+	h.redirectUsersWithSuccess(w, r, fmt.Sprintf("user %s deleted successfully", targetUser.ID))
+}
+
+func (h *AdminHandler) GetAudit(w http.ResponseWriter, r *http.Request) {
+	if h.config.IsDev() {
+		loadTemplates()
+	}
+
+	user := middlewares.GetPrincipal(r)
+	templates[conf.AdminAuditTemplate].Execute(w, h.buildAuditViewModel(r, user))
+}
+
+// GetAuditExport hands out all audit events matching the current filters as a json file download
+func (h *AdminHandler) GetAuditExport(w http.ResponseWriter, r *http.Request) {
+	user := middlewares.GetPrincipal(r)
+
+	var query models.AuditEventQuery
+	if err := auditQueryDecoder.Decode(&query, r.URL.Query()); err != nil {
+		query = models.AuditEventQuery{}
+	}
+
+	events, err := h.auditSrvc.Export(middlewares.GetOrganizationId(r), &query)
+	if err != nil {
+		logbuch.Error("failed to export audit log – %v", err)
+		http.Redirect(w, r, fmt.Sprintf("%s/admin/audit?error=%s", h.config.Server.BasePath, url.QueryEscape("failed to export audit log")), http.StatusFound)
+		return
+	}
+
+	logbuch.Info("audit log exported by %s", user.ID)
+	filename := fmt.Sprintf("audit_%s.json", time.Now().Format("2006-01-02"))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
+	utils.RespondJSON(w, http.StatusOK, events)
+}
+
+func (h *AdminHandler) GetClientCertificates(w http.ResponseWriter, r *http.Request) {
+	if h.config.IsDev() {
+		loadTemplates()
+	}
+
+	user := middlewares.GetPrincipal(r)
+	templates[conf.AdminClientCertsTemplate].Execute(w, h.buildClientCertificatesViewModel(r, user))
+}
+
+func (h *AdminHandler) PostCreateClientCertificate(w http.ResponseWriter, r *http.Request) {
+	user := middlewares.GetPrincipal(r)
+
+	var createRequest models.ClientCertificateCreateRequest
+	if err := r.ParseForm(); err != nil {
+		h.redirectClientCertificatesWithError(w, r, "missing parameters")
+		return
+	}
+	if err := clientCertificateDecoder.Decode(&createRequest, r.PostForm); err != nil {
+		h.redirectClientCertificatesWithError(w, r, "missing parameters")
+		return
+	}
+	if !createRequest.IsValid() {
+		h.redirectClientCertificatesWithError(w, r, "invalid fingerprint, expected 64 hexadecimal characters")
+		return
+	}
+
+	targetUser, err := h.userSrvc.GetMemberById(middlewares.GetOrganizationId(r), createRequest.UserID)
+	if err != nil {
+		h.redirectClientCertificatesWithError(w, r, "user not found")
+		return
+	}
+	// a certificate lets its holder act as the user, which must not grant anyone permissions they don't already have
+	if !h.roleSrvc.HasAllPermissionsOf(user, targetUser) {
+		h.redirectClientCertificatesWithError(w, r, fmt.Sprintf("%s has permissions you lack, you can not register certificates for them", targetUser.ID))
+		return
+	}
+
+	if _, err := h.clientCertSrvc.Create(targetUser, createRequest.Name, createRequest.Fingerprint, middlewares.GetAuditOrigin(r)); err == services.ErrClientCertificateExists {
+		h.redirectClientCertificatesWithError(w, r, err.Error())
+		return
+	} else if err != nil {
+		logbuch.Error("failed to register client certificate for %s – %v", targetUser.ID, err)
+		h.redirectClientCertificatesWithError(w, r, "failed to register certificate")
+		return
+	}
+
+	logbuch.Info("client certificate for user %s registered by %s", targetUser.ID, user.ID)
+	http.Redirect(w, r, fmt.Sprintf("%s/admin/client-certificates?success=%s", h.config.Server.BasePath, url.QueryEscape(fmt.Sprintf("certificate registered for %s", targetUser.ID))), http.StatusFound)
+}
+
+func (h *AdminHandler) PostDeleteClientCertificate(w http.ResponseWriter, r *http.Request) {
+	user := middlewares.GetPrincipal(r)
+
+	if err := r.ParseForm(); err != nil {
+		h.redirectClientCertificatesWithError(w, r, "missing parameters")
+		return
+	}
+
+	fingerprint := r.PostForm.Get("fingerprint")
+	if err := h.clientCertSrvc.Delete(middlewares.GetOrganizationId(r), fingerprint, middlewares.GetAuditOrigin(r)); err != nil {
+		h.redirectClientCertificatesWithError(w, r, "certificate not found")
+		return
+	}
+
+	logbuch.Info("client certificate %s revoked by %s", fingerprint, user.ID)
+	http.Redirect(w, r, fmt.Sprintf("%s/admin/client-certificates?success=%s", h.config.Server.BasePath, url.QueryEscape("certificate revoked successfully")), http.StatusFound)
+}
+
+func (h *AdminHandler) GetOAuthClients(w http.ResponseWriter, r *http.Request) {
+	if h.config.IsDev() {
+		loadTemplates()
+	}
+
+	user := middlewares.GetPrincipal(r)
+	templates[conf.AdminOAuthClientsTemplate].Execute(w, h.buildOAuthClientsViewModel(r, user))
+}
+
+// PostCreateOAuthClient registers a third-party app and renders its secret right away, as it can not be shown again later on
+func (h *AdminHandler) PostCreateOAuthClient(w http.ResponseWriter, r *http.Request) {
+	if h.config.IsDev() {
+		loadTemplates()
+	}
+
+	user := middlewares.GetPrincipal(r)
+
+	var createRequest models.OAuthClientCreateRequest
+	if err := r.ParseForm(); err != nil {
+		h.redirectOAuthClientsWithError(w, r, "missing parameters")
+		return
+	}
+	if err := oauthClientDecoder.Decode(&createRequest, r.PostForm); err != nil {
+		h.redirectOAuthClientsWithError(w, r, "missing parameters")
+		return
+	}
+	if !createRequest.IsValid() {
+		h.redirectOAuthClientsWithError(w, r, "invalid parameters, redirect uris must be absolute and use https (or http on loopback addresses)")
+		return
+	}
+
+	client, secret, err := h.oauthSrvc.CreateClient(&createRequest, middlewares.GetAuditOrigin(r))
+	if err != nil {
+		logbuch.Error("failed to register oauth client '%s' – %v", createRequest.Name, err)
+		h.redirectOAuthClientsWithError(w, r, "failed to register app")
+		return
+	}
+
+	logbuch.Info("oauth client '%s' registered by %s", client.Name, user.ID)
+	vm := h.buildOAuthClientsViewModel(r, user).WithSuccess("app registered successfully")
+	vm.NewClient = client
+	vm.NewSecret = secret
+	templates[conf.AdminOAuthClientsTemplate].Execute(w, vm)
+}
+
+func (h *AdminHandler) PostDeleteOAuthClient(w http.ResponseWriter, r *http.Request) {
+	user := middlewares.GetPrincipal(r)
+
+	if err := r.ParseForm(); err != nil {
+		h.redirectOAuthClientsWithError(w, r, "missing parameters")
+		return
+	}
+
+	clientId := r.PostForm.Get("client_id")
+	if err := h.oauthSrvc.DeleteClient(clientId, middlewares.GetAuditOrigin(r)); err != nil {
+		h.redirectOAuthClientsWithError(w, r, "app not found")
+		return
+	}
+
+	logbuch.Info("oauth client %s deleted by %s", clientId, user.ID)
+	http.Redirect(w, r, fmt.Sprintf("%s/admin/oauth-clients?success=%s", h.config.Server.BasePath, url.QueryEscape("app deleted successfully")), http.StatusFound)
+}
+
+func (h *AdminHandler) updateAdminRole(w http.ResponseWriter, r *http.Request, promote bool) {
+	user := middlewares.GetPrincipal(r)
+
+	if !h.roleSrvc.HasPermission(user, models.PermissionRolesManage) {
+		h.redirectUsersWithError(w, r, "forbidden")
+		return
+	}
+
+	targetUser, ok := h.getTargetUser(w, r)
+	if !ok {
+		return
+	}
+
+	var err error
+	if promote {
+		err = h.roleSrvc.Assign(targetUser, models.RoleAdmin)
+	} else {
+		err = h.roleSrvc.Unassign(targetUser, models.RoleAdmin)
+	}
+	if err != nil {
+		if err == services.ErrLastAdmin {
+			h.redirectUsersWithError(w, r, err.Error())
+			return
+		}
+		logbuch.Error("failed to update admin role of user %s – %v", targetUser.ID, err)
+		h.redirectUsersWithError(w, r, "failed to update user")
+		return
+	}
+
+	if promote {
+		services.PublishAuditEvent(models.NewAuditEvent(models.AuditRoleAssign, middlewares.GetAuditOrigin(r), targetUser.ID, models.RoleAdmin))
+		logbuch.Info("user %s promoted to admin by %s", targetUser.ID, user.ID)
+		h.redirectUsersWithSuccess(w, r, fmt.Sprintf("%s is an admin now", targetUser.ID))
+	} else {
+		services.PublishAuditEvent(models.NewAuditEvent(models.AuditRoleUnassign, middlewares.GetAuditOrigin(r), targetUser.ID, models.RoleAdmin))
+		logbuch.Info("user %s demoted from admin by %s", targetUser.ID, user.ID)
+		h.redirectUsersWithSuccess(w, r, fmt.Sprintf("%s is no admin anymore", targetUser.ID))
+	}
+}
+
+// getTargetUser resolves the user referred to by the posted form and redirects with an error, if there is none
+func (h *AdminHandler) getTargetUser(w http.ResponseWriter, r *http.Request) (*models.User, bool) {
+	if err := r.ParseForm(); err != nil {
+		h.redirectUsersWithError(w, r, "missing parameters")
+		return nil, false
+	}
+	targetUser, err := h.userSrvc.GetMemberById(middlewares.GetOrganizationId(r), r.PostForm.Get("user_id"))
+	if err != nil {
+		h.redirectUsersWithError(w, r, "user not found")
+		return nil, false
+	}
+	return targetUser, true
+}
+
+// checkMayManage makes sure users are only touched by those having at least the same permissions, no matter by which roles they were granted
+func (h *AdminHandler) checkMayManage(w http.ResponseWriter, r *http.Request, user, targetUser *models.User) bool {
+	if !h.roleSrvc.HasAllPermissionsOf(user, targetUser) {
+		h.redirectUsersWithError(w, r, fmt.Sprintf("%s has permissions you lack, you can not manage them", targetUser.ID))
+		return false
+	}
+	return true
+}
+
+func (h *AdminHandler) forbiddenRedirectTarget() string {
+	return fmt.Sprintf("%s/dashboard?error=%s", h.config.Server.BasePath, url.QueryEscape("forbidden"))
+}
+
+func (h *AdminHandler) redirectInvitationsWithError(w http.ResponseWriter, r *http.Request, message string) {
+	http.Redirect(w, r, fmt.Sprintf("%s/admin/invitations?error=%s", h.config.Server.BasePath, url.QueryEscape(message)), http.StatusFound)
+}
+
+func (h *AdminHandler) redirectClientCertificatesWithError(w http.ResponseWriter, r *http.Request, message string) {
+	http.Redirect(w, r, fmt.Sprintf("%s/admin/client-certificates?error=%s", h.config.Server.BasePath, url.QueryEscape(message)), http.StatusFound)
+}
+
+func (h *AdminHandler) redirectOAuthClientsWithError(w http.ResponseWriter, r *http.Request, message string) {
+	http.Redirect(w, r, fmt.Sprintf("%s/admin/oauth-clients?error=%s", h.config.Server.BasePath, url.QueryEscape(message)), http.StatusFound)
+}
+
+func (h *AdminHandler) redirectUsersWithSuccess(w http.ResponseWriter, r *http.Request, message string) {
+	http.Redirect(w, r, fmt.Sprintf("%s/admin/users?success=%s", h.config.Server.BasePath, url.QueryEscape(message)), http.StatusFound)
+}
+
+func (h *AdminHandler) redirectUsersWithError(w http.ResponseWriter, r *http.Request, message string) {
+	http.Redirect(w, r, fmt.Sprintf("%s/admin/users?error=%s", h.config.Server.BasePath, url.QueryEscape(message)), http.StatusFound)
+}
+
+func (h *AdminHandler) buildUsersViewModel(r *http.Request, user *models.User) *view.AdminUsersViewModel {
+	var query models.UserListQuery
+	if err := userListDecoder.Decode(&query, r.URL.Query()); err != nil {
+		query = models.UserListQuery{}
+	}
+
+	vm := &view.AdminUsersViewModel{
+		User:           user,
+		Query:          &query,
+		CanManageRoles: h.roleSrvc.HasPermission(user, models.PermissionRolesManage),
+		MailEnabled:    h.config.Mail.Enabled,
+		Success:        r.URL.Query().Get("success"),
+		Error:          r.URL.Query().Get("error"),
+		CsrfToken:      middlewares.GetCsrfToken(r),
+	}
+
+	if orgId := middlewares.GetOrganizationId(r); orgId == "" {
+		vm.WithError(noOrganizationMessage)
+	} else if users, total, err := h.userSrvc.Search(orgId, &query); err == nil {
+		vm.Users = users
+		vm.Total = total
+	} else {
+		logbuch.Error("failed to fetch users – %v", err)
+		vm.WithError("failed to fetch users")
+	}
+
+	return vm
+}
+
+func (h *AdminHandler) buildAuditViewModel(r *http.Request, user *models.User) *view.AdminAuditViewModel {
+	var query models.AuditEventQuery
+	if err := auditQueryDecoder.Decode(&query, r.URL.Query()); err != nil {
+		query = models.AuditEventQuery{}
+	}
+
+	vm := &view.AdminAuditViewModel{
+		User:      user,
+		Query:     &query,
+		Actions:   models.AuditActions,
+		Success:   r.URL.Query().Get("success"),
+		Error:     r.URL.Query().Get("error"),
+		CsrfToken: middlewares.GetCsrfToken(r),
+	}
+
+	if orgId := middlewares.GetOrganizationId(r); orgId == "" {
+		vm.WithError(noOrganizationMessage)
+	} else if events, total, err := h.auditSrvc.Search(orgId, &query); err == nil {
+		vm.Events = events
+		vm.Total = total
+	} else {
+		logbuch.Error("failed to fetch audit events – %v", err)
+		vm.WithError("failed to fetch audit events")
+	}
+
+	// verification needs to go through the whole log, so it is only done on request
+	if r.URL.Query().Get("verify") == "true" {
+		if status, err := h.auditSrvc.Verify(); err == nil {
+			vm.Chain = status
+		} else {
+			logbuch.Error("failed to verify audit log – %v", err)
+			vm.WithError("failed to verify audit log")
+		}
+	}
+
+	return vm
+}
+
+func (h *AdminHandler) buildClientCertificatesViewModel(r *http.Request, user *models.User) *view.AdminClientCertificatesViewModel {
+	vm := &view.AdminClientCertificatesViewModel{
+		User:         user,
+		Enabled:      h.config.UseClientCerts(),
+		Mapping:      h.config.Server.ClientCertMapping,
+		PresetUserID: r.URL.Query().Get("user"),
+		Success:      r.URL.Query().Get("success"),
+		Error:        r.URL.Query().Get("error"),
+		CsrfToken:    middlewares.GetCsrfToken(r),
+	}
+
+	if orgId := middlewares.GetOrganizationId(r); orgId == "" {
+		vm.WithError(noOrganizationMessage)
+	} else if certificates, err := h.clientCertSrvc.GetByOrganization(orgId); err == nil {
+		vm.Certificates = certificates
+	} else {
+		logbuch.Error("failed to fetch client certificates – %v", err)
+		vm.WithError("failed to fetch client certificates")
+	}
+
+	return vm
+}
+
+func (h *AdminHandler) buildOAuthClientsViewModel(r *http.Request, user *models.User) *view.AdminOAuthClientsViewModel {
+	vm := &view.AdminOAuthClientsViewModel{
+		User:      user,
+		Scopes:    models.ApiTokenScopes,
+		Enabled:   h.config.Security.OAuthServer.Enabled,
+		Success:   r.URL.Query().Get("success"),
+		Error:     r.URL.Query().Get("error"),
+		CsrfToken: middlewares.GetCsrfToken(r),
+	}
+
+	if clients, err := h.oauthSrvc.GetClients(); err == nil {
+		vm.Clients = clients
+	} else {
+		logbuch.Error("failed to fetch oauth clients – %v", err)
+		vm.WithError("failed to fetch apps")
+	}
+
+	return vm
+}
+
+func (h *AdminHandler) buildInvitationsViewModel(r *http.Request, user *models.User) *view.InvitationsViewModel {
+	vm := &view.InvitationsViewModel{
+		User:        user,
+		MailEnabled: h.config.Mail.Enabled,
+		Success:     r.URL.Query().Get("success"),
+		Error:       r.URL.Query().Get("error"),
+		CsrfToken:   middlewares.GetCsrfToken(r),
+	}
+
+	if invitations, err := h.invitationSrvc.GetAll(); err == nil {
+		vm.Invitations = invitations
+	} else {
+		logbuch.Error("failed to fetch invitations – %v", err)
+		vm.WithError("failed to fetch invitations")
+	}
+
+	return vm
+}
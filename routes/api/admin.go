@@ -0,0 +1,394 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/emvi/logbuch"
+	"github.com/gorilla/mux"
+	conf "github.com/muety/broilerplate/config"
+	"github.com/muety/broilerplate/middlewares"
+	"github.com/muety/broilerplate/models"
+	"github.com/muety/broilerplate/services"
+	"github.com/muety/broilerplate/utils"
+	"net/http"
+)
+
+type AdminApiHandler struct {
+	config           *conf.Config
+	userSrvc         services.IUserService
+	sessionSrvc      services.ISessionService
+	apiTokenSrvc     services.IApiTokenService
+	clientCertSrvc   services.IClientCertificateService
+	oauthSrvc        services.IOAuthService
+	totpSrvc         services.ITotpService
+	cookieKeySrvc    services.ICookieKeyService
+	invitationSrvc   services.IInvitationService
+	roleSrvc         services.IRoleService
+	organizationSrvc services.IOrganizationService
+}
+
+func NewAdminApiHandler(userService services.IUserService, sessionService services.ISessionService, apiTokenService services.IApiTokenService, totpService services.ITotpService, cookieKeyService services.ICookieKeyService, invitationService services.IInvitationService, roleService services.IRoleService, clientCertificateService services.IClientCertificateService, oauthService services.IOAuthService, organizationService services.IOrganizationService) *AdminApiHandler {
+	return &AdminApiHandler{
+		config:           conf.Get(),
+		userSrvc:         userService,
+		sessionSrvc:      sessionService,
+		apiTokenSrvc:     apiTokenService,
+		clientCertSrvc:   clientCertificateService,
+		oauthSrvc:        oauthService,
+		totpSrvc:         totpService,
+		cookieKeySrvc:    cookieKeyService,
+		invitationSrvc:   invitationService,
+		roleSrvc:         roleService,
+		organizationSrvc: organizationService,
+	}
+}
+
+func (h *AdminApiHandler) RegisterRoutes(router *mux.Router) {
+	r1 := router.PathPrefix("/admin/cookie-keys").Subrouter()
+	r1.Use(
+		middlewares.NewAuthenticateMiddleware(h.userSrvc, h.sessionSrvc, h.apiTokenSrvc, h.clientCertSrvc, h.oauthSrvc).WithRequiredScopes(models.ScopeSystemAdmin).Handler,
+		middlewares.RequirePermission(h.roleSrvc, models.PermissionSystemManage),
+	)
+	r1.Path("/rotate").Methods(http.MethodPost).HandlerFunc(h.PostRotateCookieKeys)
+
+	r2 := router.PathPrefix("/admin/users").Subrouter()
+	r2.Use(
+		middlewares.NewAuthenticateMiddleware(h.userSrvc, h.sessionSrvc, h.apiTokenSrvc, h.clientCertSrvc, h.oauthSrvc).WithRequiredScopes(models.ScopeUsersAdmin).Handler,
+		middlewares.RequirePermission(h.roleSrvc, models.PermissionUsersManage),
+		middlewares.NewOrganizationMiddleware(h.organizationSrvc).Handler,
+	)
+	r2.Path("/{id}/2fa/reset").Methods(http.MethodPost).HandlerFunc(h.PostResetTotp)
+
+	r3 := router.PathPrefix("/admin/invitations").Subrouter()
+	r3.Use(
+		middlewares.NewAuthenticateMiddleware(h.userSrvc, h.sessionSrvc, h.apiTokenSrvc, h.clientCertSrvc, h.oauthSrvc).WithRequiredScopes(models.ScopeUsersAdmin).Handler,
+		middlewares.RequirePermission(h.roleSrvc, models.PermissionInvitationsManage),
+	)
+	r3.Methods(http.MethodGet).HandlerFunc(h.GetInvitations)
+	r3.Methods(http.MethodPost).HandlerFunc(h.PostCreateInvitation)
+	r3.Path("/{id}").Methods(http.MethodDelete).HandlerFunc(h.DeleteInvitation)
+
+	r4 := router.PathPrefix("/admin/roles").Subrouter()
+	r4.Use(
+		middlewares.NewAuthenticateMiddleware(h.userSrvc, h.sessionSrvc, h.apiTokenSrvc, h.clientCertSrvc, h.oauthSrvc).WithRequiredScopes(models.ScopeUsersAdmin).Handler,
+		middlewares.RequirePermission(h.roleSrvc, models.PermissionRolesManage),
+		middlewares.NewOrganizationMiddleware(h.organizationSrvc).Handler,
+	)
+	r4.Path("").Methods(http.MethodGet).HandlerFunc(h.GetRoles)
+	r4.Path("").Methods(http.MethodPost).HandlerFunc(h.PostSaveRole)
+	r4.Path("/permissions").Methods(http.MethodGet).HandlerFunc(h.GetPermissions)
+	r4.Path("/{name}").Methods(http.MethodDelete).HandlerFunc(h.DeleteRole)
+	r4.Path("/{name}/users/{id}").Methods(http.MethodPut).HandlerFunc(h.PutAssignRole)
+	r4.Path("/{name}/users/{id}").Methods(http.MethodDelete).HandlerFunc(h.DeleteAssignRole)
+}
+
+// @Summary Rotate the keys used to sign and encrypt authentication cookies
+// @Description Previous keys remain valid for decoding existing cookies during the configured grace period. Requires the system.manage permission.
+// @ID post-rotate-cookie-keys
+// @Tags admin
+// @Security ApiKeyAuth
+// @Success 204
+// @Failure 409 {string} string "if keys are statically configured"
+// @Router /admin/cookie-keys/rotate [post]
+func (h *AdminApiHandler) PostRotateCookieKeys(w http.ResponseWriter, r *http.Request) {
+	user := middlewares.GetPrincipal(r)
+
+	if err := h.cookieKeySrvc.Rotate(); err != nil {
+		if err == services.ErrStaticCookieKeys {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		logbuch.Error("failed to rotate cookie keys – %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(conf.ErrInternalServerError))
+		return
+	}
+
+	logbuch.Info("cookie keys rotated by %s", user.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// @Summary Reset a user's two-factor authentication
+// @Description Disables 2fa and deletes the user's totp secret and recovery codes, e.g. after the user lost their device. Requires the users.manage permission as well as all permissions the user has.
+// @ID post-reset-user-2fa
+// @Tags admin
+// @Security ApiKeyAuth
+// @Param id path string true "User ID"
+// @Success 204
+// @Failure 403 {string} string "if the user has permissions the caller lacks"
+// @Failure 404 {string} string "if the user is not a member of the caller's active organization"
+// @Router /admin/users/{id}/2fa/reset [post]
+func (h *AdminApiHandler) PostResetTotp(w http.ResponseWriter, r *http.Request) {
+	user := middlewares.GetPrincipal(r)
+
+	targetUser, err := h.userSrvc.GetMemberById(middlewares.GetOrganizationId(r), mux.Vars(r)["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(conf.ErrNotFound))
+		return
+	}
+
+	// otherwise, user managers could weaken the accounts of those more privileged than themselves
+	if !h.roleSrvc.HasAllPermissionsOf(user, targetUser) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(conf.ErrForbidden))
+		return
+	}
+
+	if err := h.totpSrvc.Disable(targetUser); err != nil {
+		logbuch.Error("failed to reset 2fa for user %s – %v", targetUser.ID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(conf.ErrInternalServerError))
+		return
+	}
+
+	services.PublishAuditEvent(models.NewAuditEvent(models.AuditTotpDisable, middlewares.GetAuditOrigin(r), targetUser.ID, ""))
+	logbuch.Info("two-factor authentication of user %s reset by %s", targetUser.ID, user.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// @Summary List all invitations
+// @Description Requires the invitations.manage permission.
+// @ID get-invitations
+// @Tags admin
+// @Produce json
+// @Security ApiKeyAuth
+// @Success 200 {array} models.Invitation
+// @Router /admin/invitations [get]
+func (h *AdminApiHandler) GetInvitations(w http.ResponseWriter, r *http.Request) {
+	invitations, err := h.invitationSrvc.GetAll()
+	if err != nil {
+		logbuch.Error("failed to fetch invitations – %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(conf.ErrInternalServerError))
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, invitations)
+}
+
+// @Summary Invite someone to sign up
+// @Description The invitation is mailed to the given address, if mailing is enabled. The returned signup link is only shown once. Requires the invitations.manage permission.
+// @ID post-invitation
+// @Tags admin
+// @Accept json
+// @Produce json
+// @Security ApiKeyAuth
+// @Param invitation body models.InvitationCreateRequest true "Invitee"
+// @Success 201 {object} models.InvitationCreateResponse
+// @Failure 400 {string} string
+// @Router /admin/invitations [post]
+func (h *AdminApiHandler) PostCreateInvitation(w http.ResponseWriter, r *http.Request) {
+	user := middlewares.GetPrincipal(r)
+
+	var createRequest models.InvitationCreateRequest
+	if err := json.NewDecoder(r.Body).Decode(&createRequest); err != nil || !createRequest.IsValid() {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(conf.ErrBadRequest))
+		return
+	}
+
+	invitation, link, err := h.invitationSrvc.Create(user, createRequest.Email)
+	if err != nil {
+		logbuch.Error("failed to create invitation – %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(conf.ErrInternalServerError))
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusCreated, &models.InvitationCreateResponse{Invitation: invitation, Link: link})
+}
+
+// @Summary Revoke or delete an invitation
+// @Description Requires the invitations.manage permission.
+// @ID delete-invitation
+// @Tags admin
+// @Security ApiKeyAuth
+// @Param id path string true "Invitation ID"
+// @Success 204
+// @Failure 404 {string} string
+// @Router /admin/invitations/{id} [delete]
+func (h *AdminApiHandler) DeleteInvitation(w http.ResponseWriter, r *http.Request) {
+	if err := h.invitationSrvc.Delete(mux.Vars(r)["id"]); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(conf.ErrNotFound))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// @Summary List all roles along with their permissions
+// @Description Requires the roles.manage permission.
+// @ID get-roles
+// @Tags admin
+// @Produce json
+// @Security ApiKeyAuth
+// @Success 200 {array} models.Role
+// @Router /admin/roles [get]
+func (h *AdminApiHandler) GetRoles(w http.ResponseWriter, r *http.Request) {
+	roles, err := h.roleSrvc.GetAll()
+	if err != nil {
+		logbuch.Error("failed to fetch roles – %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(conf.ErrInternalServerError))
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, roles)
+}
+
+// @Summary List all permissions available for roles
+// @Description Requires the roles.manage permission.
+// @ID get-permissions
+// @Tags admin
+// @Produce json
+// @Security ApiKeyAuth
+// @Success 200 {array} models.Permission
+// @Router /admin/roles/permissions [get]
+func (h *AdminApiHandler) GetPermissions(w http.ResponseWriter, r *http.Request) {
+	permissions, err := h.roleSrvc.GetPermissions()
+	if err != nil {
+		logbuch.Error("failed to fetch permissions – %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(conf.ErrInternalServerError))
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, permissions)
+}
+
+// @Summary Create a custom role or update an existing one
+// @Description The role's permissions are replaced by the given ones. The built-in admin role can not be modified. Requires the roles.manage permission.
+// @ID post-role
+// @Tags admin
+// @Accept json
+// @Produce json
+// @Security ApiKeyAuth
+// @Param role body models.RoleSaveRequest true "Role"
+// @Success 200 {object} models.Role
+// @Failure 400 {string} string
+// @Router /admin/roles [post]
+func (h *AdminApiHandler) PostSaveRole(w http.ResponseWriter, r *http.Request) {
+	var saveRequest models.RoleSaveRequest
+	if err := json.NewDecoder(r.Body).Decode(&saveRequest); err != nil || !saveRequest.IsValid() {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(conf.ErrBadRequest))
+		return
+	}
+
+	role, err := h.roleSrvc.Save(&saveRequest)
+	if err == services.ErrBuiltinRole {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err != nil {
+		logbuch.Error("failed to save role %s – %v", saveRequest.Name, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(conf.ErrInternalServerError))
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, role)
+}
+
+// @Summary Delete a custom role
+// @Description The role is revoked from all users holding it. Requires the roles.manage permission.
+// @ID delete-role
+// @Tags admin
+// @Security ApiKeyAuth
+// @Param name path string true "Role name"
+// @Success 204
+// @Failure 400 {string} string
+// @Failure 404 {string} string
+// @Router /admin/roles/{name} [delete]
+func (h *AdminApiHandler) DeleteRole(w http.ResponseWriter, r *http.Request) {
+	if err := h.roleSrvc.Delete(mux.Vars(r)["name"]); err != nil {
+		h.writeRoleError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// @Summary Assign a role to a user
+// @Description Requires the roles.manage permission.
+// @ID put-user-role
+// @Tags admin
+// @Security ApiKeyAuth
+// @Param name path string true "Role name"
+// @Param id path string true "User ID"
+// @Success 204
+// @Failure 404 {string} string "if the user is not a member of the caller's active organization"
+// @Router /admin/roles/{name}/users/{id} [put]
+func (h *AdminApiHandler) PutAssignRole(w http.ResponseWriter, r *http.Request) {
+	user := middlewares.GetPrincipal(r)
+
+	targetUser, err := h.userSrvc.GetMemberById(middlewares.GetOrganizationId(r), mux.Vars(r)["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(conf.ErrNotFound))
+		return
+	}
+
+	roleName := mux.Vars(r)["name"]
+	if err := h.roleSrvc.Assign(targetUser, roleName); err != nil {
+		h.writeRoleError(w, err)
+		return
+	}
+
+	services.PublishAuditEvent(models.NewAuditEvent(models.AuditRoleAssign, middlewares.GetAuditOrigin(r), targetUser.ID, roleName))
+	logbuch.Info("role %s assigned to user %s by %s", roleName, targetUser.ID, user.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// @Summary Revoke a role from a user
+// @Description The admin role can not be revoked from the last remaining admin. Requires the roles.manage permission.
+// @ID delete-user-role
+// @Tags admin
+// @Security ApiKeyAuth
+// @Param name path string true "Role name"
+// @Param id path string true "User ID"
+// @Success 204
+// @Failure 404 {string} string "if the user is not a member of the caller's active organization"
+// @Failure 409 {string} string
+// @Router /admin/roles/{name}/users/{id} [delete]
+func (h *AdminApiHandler) DeleteAssignRole(w http.ResponseWriter, r *http.Request) {
+	user := middlewares.GetPrincipal(r)
+
+	targetUser, err := h.userSrvc.GetMemberById(middlewares.GetOrganizationId(r), mux.Vars(r)["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(conf.ErrNotFound))
+		return
+	}
+
+	roleName := mux.Vars(r)["name"]
+	if err := h.roleSrvc.Unassign(targetUser, roleName); err != nil {
+		h.writeRoleError(w, err)
+		return
+	}
+
+	services.PublishAuditEvent(models.NewAuditEvent(models.AuditRoleUnassign, middlewares.GetAuditOrigin(r), targetUser.ID, roleName))
+	logbuch.Info("role %s revoked from user %s by %s", roleName, targetUser.ID, user.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *AdminApiHandler) writeRoleError(w http.ResponseWriter, err error) {
+	switch err {
+	case services.ErrRoleNotFound:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(conf.ErrNotFound))
+	case services.ErrBuiltinRole:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+	case services.ErrLastAdmin:
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(err.Error()))
+	default:
+		logbuch.Error("failed to modify roles – %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(conf.ErrInternalServerError))
+	}
+}
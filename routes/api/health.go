@@ -5,6 +5,7 @@ import (
 	"net/http"
 
 	"github.com/gorilla/mux"
+	conf "github.com/muety/broilerplate/config"
 	"gorm.io/gorm"
 )
 
@@ -19,6 +20,7 @@ func NewHealthApiHandler(db *gorm.DB) *HealthApiHandler {
 func (h *HealthApiHandler) RegisterRoutes(router *mux.Router) {
 	r := router.PathPrefix("/health").Subrouter()
 	r.Path("").Methods(http.MethodGet).HandlerFunc(h.Get)
+	r.Path("/ready").Methods(http.MethodGet).HandlerFunc(h.GetReady)
 }
 
 // @Summary Check the application's health status
@@ -35,6 +37,28 @@ func (h *HealthApiHandler) Get(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	var readyStatus int
+	if conf.IsReady() {
+		readyStatus = 1
+	}
+
 	w.Header().Set("Content-Type", "text/plain")
-	w.Write([]byte(fmt.Sprintf("app=1\ndb=%d", dbStatus)))
+	w.Write([]byte(fmt.Sprintf("app=1\ndb=%d\nready=%d", dbStatus, readyStatus)))
+}
+
+// @Summary Check whether the application accepts requests, which it stops to as soon as it is shutting down
+// @ID get-health-ready
+// @Tags misc
+// @Produce plain
+// @Success 200 {string} string
+// @Failure 503 {string} string
+// @Router /health/ready [get]
+func (h *HealthApiHandler) GetReady(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	if !conf.IsReady() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("ready=0"))
+		return
+	}
+	w.Write([]byte("ready=1"))
 }
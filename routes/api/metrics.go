@@ -24,16 +24,26 @@ const (
 )
 
 type MetricsHandler struct {
-	config       *conf.Config
-	userSrvc     services.IUserService
-	keyValueSrvc services.IKeyValueService
+	config         *conf.Config
+	userSrvc       services.IUserService
+	sessionSrvc    services.ISessionService
+	apiTokenSrvc   services.IApiTokenService
+	clientCertSrvc services.IClientCertificateService
+	oauthSrvc      services.IOAuthService
+	keyValueSrvc   services.IKeyValueService
+	roleSrvc       services.IRoleService
 }
 
-func NewMetricsHandler(userService services.IUserService, keyValueService services.IKeyValueService) *MetricsHandler {
+func NewMetricsHandler(userService services.IUserService, sessionService services.ISessionService, apiTokenService services.IApiTokenService, keyValueService services.IKeyValueService, roleService services.IRoleService, clientCertificateService services.IClientCertificateService, oauthService services.IOAuthService) *MetricsHandler {
 	return &MetricsHandler{
-		userSrvc:     userService,
-		keyValueSrvc: keyValueService,
-		config:       conf.Get(),
+		userSrvc:       userService,
+		sessionSrvc:    sessionService,
+		apiTokenSrvc:   apiTokenService,
+		clientCertSrvc: clientCertificateService,
+		oauthSrvc:      oauthService,
+		keyValueSrvc:   keyValueService,
+		roleSrvc:       roleService,
+		config:         conf.Get(),
 	}
 }
 
@@ -46,7 +56,7 @@ func (h *MetricsHandler) RegisterRoutes(router *mux.Router) {
 
 	r := router.PathPrefix("/metrics").Subrouter()
 	r.Use(
-		middlewares.NewAuthenticateMiddleware(h.userSrvc).Handler,
+		middlewares.NewAuthenticateMiddleware(h.userSrvc, h.sessionSrvc, h.apiTokenSrvc, h.clientCertSrvc, h.oauthSrvc).WithRequiredScopes(models.ScopeMetricsRead).Handler,
 	)
 	r.Path("").Methods(http.MethodGet).HandlerFunc(h.Get)
 }
@@ -63,7 +73,7 @@ func (h *MetricsHandler) Get(w http.ResponseWriter, r *http.Request) {
 
 	// TODO: user metrics
 
-	if reqUser.IsAdmin {
+	if h.roleSrvc.HasPermission(reqUser, models.PermissionMetricsView) {
 		if adminMetrics, err := h.getAdminMetrics(reqUser); err != nil {
 			logbuch.Error("%v", err)
 			w.WriteHeader(http.StatusInternalServerError)
@@ -85,7 +95,7 @@ func (h *MetricsHandler) Get(w http.ResponseWriter, r *http.Request) {
 func (h *MetricsHandler) getAdminMetrics(user *models.User) (*mm.Metrics, error) {
 	var metrics mm.Metrics
 
-	if !user.IsAdmin {
+	if !h.roleSrvc.HasPermission(user, models.PermissionMetricsView) {
 		return nil, errors.New("unauthorized")
 	}
 
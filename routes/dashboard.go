@@ -1,29 +1,70 @@
 package routes
 
 import (
+	"encoding/base64"
+	"fmt"
+	"github.com/emvi/logbuch"
 	"github.com/gorilla/mux"
+	"github.com/gorilla/schema"
 	conf "github.com/muety/broilerplate/config"
 	"github.com/muety/broilerplate/middlewares"
+	"github.com/muety/broilerplate/models"
 	"github.com/muety/broilerplate/models/view"
 	"github.com/muety/broilerplate/services"
+	"github.com/muety/broilerplate/utils"
+	"github.com/skip2/go-qrcode"
+	"html/template"
 	"net/http"
+	"net/url"
+	"time"
 )
 
 type DashboardHandler struct {
-	config   *conf.Config
-	userSrvc services.IUserService
+	config         *conf.Config
+	userSrvc       services.IUserService
+	sessionSrvc    services.ISessionService
+	totpSrvc       services.ITotpService
+	webauthnSrvc   services.IWebauthnService
+	apiTokenSrvc   services.IApiTokenService
+	clientCertSrvc services.IClientCertificateService
+	oauthSrvc      services.IOAuthService
+	roleSrvc       services.IRoleService
 }
 
-func NewDashboardHandler(userService services.IUserService) *DashboardHandler {
+var totpDecoder = schema.NewDecoder()
+var apiTokenDecoder = schema.NewDecoder()
+
+func NewDashboardHandler(userService services.IUserService, sessionService services.ISessionService, totpService services.ITotpService, webauthnService services.IWebauthnService, apiTokenService services.IApiTokenService, roleService services.IRoleService, clientCertificateService services.IClientCertificateService, oauthService services.IOAuthService) *DashboardHandler {
 	return &DashboardHandler{
-		userSrvc: userService,
-		config:   conf.Get(),
+		userSrvc:       userService,
+		sessionSrvc:    sessionService,
+		totpSrvc:       totpService,
+		webauthnSrvc:   webauthnService,
+		apiTokenSrvc:   apiTokenService,
+		clientCertSrvc: clientCertificateService,
+		oauthSrvc:      oauthService,
+		roleSrvc:       roleService,
+		config:         conf.Get(),
 	}
 }
 
 func (h *DashboardHandler) RegisterRoutes(router *mux.Router) {
 	r1 := router.PathPrefix("/dashboard").Subrouter()
-	r1.Use(middlewares.NewAuthenticateMiddleware(h.userSrvc).WithRedirectTarget(defaultErrorRedirectTarget()).Handler)
+	r1.Use(middlewares.NewAuthenticateMiddleware(h.userSrvc, h.sessionSrvc, h.apiTokenSrvc, h.clientCertSrvc, h.oauthSrvc).WithRedirectTarget(defaultErrorRedirectTarget()).Handler)
+	r1.Path("/sessions/revoke").Methods(http.MethodPost).HandlerFunc(h.PostRevokeSession)
+	r1.Path("/sessions/revoke-all").Methods(http.MethodPost).HandlerFunc(h.PostRevokeAllSessions)
+	r1.Path("/2fa").Methods(http.MethodGet).HandlerFunc(h.GetTotp)
+	r1.Path("/2fa/enable").Methods(http.MethodPost).HandlerFunc(h.PostEnableTotp)
+	r1.Path("/2fa/disable").Methods(http.MethodPost).HandlerFunc(h.PostDisableTotp)
+	r1.Path("/2fa/recovery-codes").Methods(http.MethodPost).HandlerFunc(h.PostRegenerateRecoveryCodes)
+	r1.Path("/tokens").Methods(http.MethodGet).HandlerFunc(h.GetApiTokens)
+	r1.Path("/tokens").Methods(http.MethodPost).HandlerFunc(h.PostCreateApiToken)
+	r1.Path("/tokens/revoke").Methods(http.MethodPost).HandlerFunc(h.PostRevokeApiToken)
+	r1.Path("/passkeys/delete").Methods(http.MethodPost).HandlerFunc(h.PostDeletePasskey)
+	if h.config.Security.OAuthServer.Enabled {
+		r1.Path("/apps").Methods(http.MethodGet).HandlerFunc(h.GetOAuthApps)
+		r1.Path("/apps/revoke").Methods(http.MethodPost).HandlerFunc(h.PostRevokeOAuthApp)
+	}
 	r1.Methods(http.MethodGet).HandlerFunc(h.GetIndex)
 }
 
@@ -39,16 +80,387 @@ func (h *DashboardHandler) GetIndex(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	vm := &view.DashboardViewModel{
-		User: user,
+	templates[conf.DashboardTemplate].Execute(w, h.buildIndexViewModel(r, user))
+}
+
+func (h *DashboardHandler) buildIndexViewModel(r *http.Request, user *models.User) *view.DashboardViewModel {
+	vm := h.buildViewModel(r)
+	vm.User = user
+
+	if sessions, err := h.sessionSrvc.GetByUser(user); err == nil {
+		vm.Sessions = sessions
+	} else {
+		logbuch.Error("failed to fetch sessions for user %s – %v", user.ID, err)
+		vm.WithError("failed to fetch sessions")
+	}
+	if passkeys, err := h.webauthnSrvc.GetByUser(user); err == nil {
+		vm.Passkeys = passkeys
+	} else {
+		logbuch.Error("failed to fetch passkeys for user %s – %v", user.ID, err)
+		vm.WithError("failed to fetch passkeys")
+	}
+	if sessionId, err := utils.ExtractCookieAuth(r, h.config); err == nil {
+		vm.CurrentSessionId = *sessionId
+	}
+
+	return vm
+}
+
+func (h *DashboardHandler) PostRevokeSession(w http.ResponseWriter, r *http.Request) {
+	user := middlewares.GetPrincipal(r)
+	if user == nil {
+		http.Redirect(w, r, defaultErrorRedirectTarget(), http.StatusFound)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		h.redirectWithError(w, r, "missing parameters")
+		return
+	}
+
+	sessions, err := h.sessionSrvc.GetByUser(user)
+	if err != nil {
+		h.redirectWithError(w, r, "failed to fetch sessions")
+		return
+	}
+
+	sessionId := r.PostForm.Get("session_id")
+	for _, s := range sessions {
+		if s.ID != sessionId {
+			continue
+		}
+		if err := h.sessionSrvc.Delete(s); err != nil {
+			h.redirectWithError(w, r, "failed to revoke session")
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("%s/dashboard?success=%s", h.config.Server.BasePath, url.QueryEscape("session revoked successfully")), http.StatusFound)
+		return
+	}
+
+	h.redirectWithError(w, r, "session not found")
+}
+
+func (h *DashboardHandler) PostRevokeAllSessions(w http.ResponseWriter, r *http.Request) {
+	user := middlewares.GetPrincipal(r)
+	if user == nil {
+		http.Redirect(w, r, defaultErrorRedirectTarget(), http.StatusFound)
+		return
+	}
+
+	if err := h.sessionSrvc.DeleteByUser(user); err != nil {
+		h.redirectWithError(w, r, "failed to revoke sessions")
+		return
+	}
+
+	http.SetCookie(w, h.config.GetClearCookie(models.AuthCookieKey, "/"))
+	http.Redirect(w, r, fmt.Sprintf("%s/login?success=%s", h.config.Server.BasePath, url.QueryEscape("you were logged out on all devices")), http.StatusFound)
+}
+
+func (h *DashboardHandler) PostDeletePasskey(w http.ResponseWriter, r *http.Request) {
+	user := middlewares.GetPrincipal(r)
+	if user == nil {
+		http.Redirect(w, r, defaultErrorRedirectTarget(), http.StatusFound)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		h.redirectWithError(w, r, "missing parameters")
+		return
+	}
+
+	if err := h.webauthnSrvc.Delete(user, r.PostForm.Get("credential_id")); err != nil {
+		h.redirectWithError(w, r, "passkey not found")
+		return
 	}
 
-	templates[conf.DashboardTemplate].Execute(w, vm)
+	http.Redirect(w, r, fmt.Sprintf("%s/dashboard?success=%s", h.config.Server.BasePath, url.QueryEscape("passkey removed successfully")), http.StatusFound)
+}
+
+func (h *DashboardHandler) GetTotp(w http.ResponseWriter, r *http.Request) {
+	if h.config.IsDev() {
+		loadTemplates()
+	}
+
+	user := middlewares.GetPrincipal(r)
+	vm := h.buildTotpViewModel(r, user)
+
+	if !user.TotpEnabled {
+		keyUri, err := h.totpSrvc.StartEnrollment(user)
+		if err != nil {
+			logbuch.Error("failed to start 2fa enrollment for user %s – %v", user.ID, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			templates[conf.TotpTemplate].Execute(w, vm.WithError("failed to set up two-factor authentication"))
+			return
+		}
+		qrCode, err := qrcode.Encode(keyUri, qrcode.Medium, 256)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			templates[conf.TotpTemplate].Execute(w, vm.WithError("failed to generate qr code"))
+			return
+		}
+		vm.KeyUri = keyUri
+		vm.QrCode = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(qrCode))
+	}
+
+	templates[conf.TotpTemplate].Execute(w, vm)
+}
+
+func (h *DashboardHandler) PostEnableTotp(w http.ResponseWriter, r *http.Request) {
+	if h.config.IsDev() {
+		loadTemplates()
+	}
+
+	user := middlewares.GetPrincipal(r)
+
+	var codeRequest models.TotpCodeRequest
+	if err := r.ParseForm(); err != nil {
+		h.redirectTotpWithError(w, r, "missing parameters")
+		return
+	}
+	if err := totpDecoder.Decode(&codeRequest, r.PostForm); err != nil {
+		h.redirectTotpWithError(w, r, "missing parameters")
+		return
+	}
+
+	recoveryCodes, err := h.totpSrvc.CompleteEnrollment(user, codeRequest.Code)
+	if err != nil {
+		// a new secret is generated when redirecting, so the qr code has to be scanned again
+		h.redirectTotpWithError(w, r, "invalid code, please scan the new qr code and try again")
+		return
+	}
+
+	vm := h.buildTotpViewModel(r, user).WithSuccess("two-factor authentication enabled successfully")
+	vm.RecoveryCodes = recoveryCodes
+	templates[conf.TotpTemplate].Execute(w, vm)
+}
+
+func (h *DashboardHandler) PostDisableTotp(w http.ResponseWriter, r *http.Request) {
+	user := middlewares.GetPrincipal(r)
+
+	var codeRequest models.TotpCodeRequest
+	if err := r.ParseForm(); err != nil {
+		h.redirectTotpWithError(w, r, "missing parameters")
+		return
+	}
+	if err := totpDecoder.Decode(&codeRequest, r.PostForm); err != nil {
+		h.redirectTotpWithError(w, r, "missing parameters")
+		return
+	}
+
+	if err := h.totpSrvc.Verify(user, codeRequest.Code); err != nil {
+		h.redirectTotpWithError(w, r, "invalid code")
+		return
+	}
+	if err := h.totpSrvc.Disable(user); err != nil {
+		h.redirectTotpWithError(w, r, "failed to disable two-factor authentication")
+		return
+	}
+	services.PublishAuditEvent(models.NewAuditEvent(models.AuditTotpDisable, middlewares.GetAuditOrigin(r), user.ID, ""))
+
+	http.Redirect(w, r, fmt.Sprintf("%s/dashboard?success=%s", h.config.Server.BasePath, url.QueryEscape("two-factor authentication disabled")), http.StatusFound)
+}
+
+func (h *DashboardHandler) PostRegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	if h.config.IsDev() {
+		loadTemplates()
+	}
+
+	user := middlewares.GetPrincipal(r)
+
+	var codeRequest models.TotpCodeRequest
+	if err := r.ParseForm(); err != nil {
+		h.redirectTotpWithError(w, r, "missing parameters")
+		return
+	}
+	if err := totpDecoder.Decode(&codeRequest, r.PostForm); err != nil {
+		h.redirectTotpWithError(w, r, "missing parameters")
+		return
+	}
+
+	if err := h.totpSrvc.Verify(user, codeRequest.Code); err != nil {
+		h.redirectTotpWithError(w, r, "invalid code")
+		return
+	}
+
+	recoveryCodes, err := h.totpSrvc.RegenerateRecoveryCodes(user)
+	if err != nil {
+		h.redirectTotpWithError(w, r, "failed to generate recovery codes")
+		return
+	}
+
+	vm := h.buildTotpViewModel(r, user).WithSuccess("new recovery codes generated, previous ones are no longer valid")
+	vm.RecoveryCodes = recoveryCodes
+	templates[conf.TotpTemplate].Execute(w, vm)
+}
+
+func (h *DashboardHandler) GetApiTokens(w http.ResponseWriter, r *http.Request) {
+	if h.config.IsDev() {
+		loadTemplates()
+	}
+
+	user := middlewares.GetPrincipal(r)
+	templates[conf.ApiTokensTemplate].Execute(w, h.buildApiTokensViewModel(r, user))
+}
+
+func (h *DashboardHandler) PostCreateApiToken(w http.ResponseWriter, r *http.Request) {
+	if h.config.IsDev() {
+		loadTemplates()
+	}
+
+	user := middlewares.GetPrincipal(r)
+
+	var createRequest models.ApiTokenCreateRequest
+	if err := r.ParseForm(); err != nil {
+		h.redirectApiTokensWithError(w, r, "missing parameters")
+		return
+	}
+	if err := apiTokenDecoder.Decode(&createRequest, r.PostForm); err != nil {
+		h.redirectApiTokensWithError(w, r, "missing parameters")
+		return
+	}
+	if !createRequest.IsValid() {
+		h.redirectApiTokensWithError(w, r, "invalid parameters")
+		return
+	}
+	for _, s := range createRequest.Scopes {
+		if p := models.ScopePermission(s); p != "" && !h.roleSrvc.HasPermission(user, p) {
+			h.redirectApiTokensWithError(w, r, fmt.Sprintf("you lack the permission to grant scope %s", s))
+			return
+		}
+	}
+
+	var expiresAt *time.Time
+	if createRequest.ExpiresInDays > 0 {
+		t := time.Now().AddDate(0, 0, createRequest.ExpiresInDays)
+		expiresAt = &t
+	}
+
+	plain, _, err := h.apiTokenSrvc.Create(user, createRequest.Name, createRequest.Scopes, expiresAt)
+	if err != nil {
+		logbuch.Error("failed to create api token for user %s – %v", user.ID, err)
+		h.redirectApiTokensWithError(w, r, "failed to create token")
+		return
+	}
+
+	vm := h.buildApiTokensViewModel(r, user).WithSuccess("token created successfully")
+	vm.NewToken = plain
+	templates[conf.ApiTokensTemplate].Execute(w, vm)
+}
+
+func (h *DashboardHandler) PostRevokeApiToken(w http.ResponseWriter, r *http.Request) {
+	user := middlewares.GetPrincipal(r)
+
+	if err := r.ParseForm(); err != nil {
+		h.redirectApiTokensWithError(w, r, "missing parameters")
+		return
+	}
+
+	if err := h.apiTokenSrvc.Delete(user, r.PostForm.Get("token_id")); err != nil {
+		h.redirectApiTokensWithError(w, r, "token not found")
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("%s/dashboard/tokens?success=%s", h.config.Server.BasePath, url.QueryEscape("token revoked successfully")), http.StatusFound)
+}
+
+func (h *DashboardHandler) GetOAuthApps(w http.ResponseWriter, r *http.Request) {
+	if h.config.IsDev() {
+		loadTemplates()
+	}
+
+	user := middlewares.GetPrincipal(r)
+	templates[conf.OAuthAppsTemplate].Execute(w, h.buildOAuthAppsViewModel(r, user))
+}
+
+// PostRevokeOAuthApp withdraws the user's authorization of a third-party app, which also invalidates all tokens issued to it
+func (h *DashboardHandler) PostRevokeOAuthApp(w http.ResponseWriter, r *http.Request) {
+	user := middlewares.GetPrincipal(r)
+
+	if err := r.ParseForm(); err != nil {
+		h.redirectOAuthAppsWithError(w, r, "missing parameters")
+		return
+	}
+
+	if err := h.oauthSrvc.RevokeGrant(user, r.PostForm.Get("grant_id"), middlewares.GetAuditOrigin(r)); err == services.ErrOAuthGrantUnknown {
+		h.redirectOAuthAppsWithError(w, r, err.Error())
+		return
+	} else if err != nil {
+		logbuch.Error("failed to revoke oauth grant of user %s – %v", user.ID, err)
+		h.redirectOAuthAppsWithError(w, r, "failed to revoke access")
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("%s/dashboard/apps?success=%s", h.config.Server.BasePath, url.QueryEscape("access revoked successfully")), http.StatusFound)
+}
+
+func (h *DashboardHandler) redirectOAuthAppsWithError(w http.ResponseWriter, r *http.Request, message string) {
+	http.Redirect(w, r, fmt.Sprintf("%s/dashboard/apps?error=%s", h.config.Server.BasePath, url.QueryEscape(message)), http.StatusFound)
+}
+
+func (h *DashboardHandler) redirectApiTokensWithError(w http.ResponseWriter, r *http.Request, message string) {
+	http.Redirect(w, r, fmt.Sprintf("%s/dashboard/tokens?error=%s", h.config.Server.BasePath, url.QueryEscape(message)), http.StatusFound)
+}
+
+func (h *DashboardHandler) redirectTotpWithError(w http.ResponseWriter, r *http.Request, message string) {
+	http.Redirect(w, r, fmt.Sprintf("%s/dashboard/2fa?error=%s", h.config.Server.BasePath, url.QueryEscape(message)), http.StatusFound)
+}
+
+func (h *DashboardHandler) redirectWithError(w http.ResponseWriter, r *http.Request, message string) {
+	http.Redirect(w, r, fmt.Sprintf("%s/dashboard?error=%s", h.config.Server.BasePath, url.QueryEscape(message)), http.StatusFound)
+}
+
+func (h *DashboardHandler) buildTotpViewModel(r *http.Request, user *models.User) *view.TotpViewModel {
+	return &view.TotpViewModel{
+		User:      user,
+		Success:   r.URL.Query().Get("success"),
+		Error:     r.URL.Query().Get("error"),
+		CsrfToken: middlewares.GetCsrfToken(r),
+	}
+}
+
+func (h *DashboardHandler) buildApiTokensViewModel(r *http.Request, user *models.User) *view.ApiTokensViewModel {
+	vm := &view.ApiTokensViewModel{
+		User:      user,
+		Scopes:    []string{},
+		Success:   r.URL.Query().Get("success"),
+		Error:     r.URL.Query().Get("error"),
+		CsrfToken: middlewares.GetCsrfToken(r),
+	}
+	for _, s := range models.ApiTokenScopes {
+		if p := models.ScopePermission(s); p == "" || h.roleSrvc.HasPermission(user, p) {
+			vm.Scopes = append(vm.Scopes, s)
+		}
+	}
+	if tokens, err := h.apiTokenSrvc.GetByUser(user); err == nil {
+		vm.Tokens = tokens
+	} else {
+		logbuch.Error("failed to fetch api tokens for user %s – %v", user.ID, err)
+		vm.WithError("failed to fetch tokens")
+	}
+	return vm
+}
+
+func (h *DashboardHandler) buildOAuthAppsViewModel(r *http.Request, user *models.User) *view.OAuthAppsViewModel {
+	vm := &view.OAuthAppsViewModel{
+		User:      user,
+		Success:   r.URL.Query().Get("success"),
+		Error:     r.URL.Query().Get("error"),
+		CsrfToken: middlewares.GetCsrfToken(r),
+	}
+	if grants, err := h.oauthSrvc.GetGrantsByUser(user); err == nil {
+		vm.Grants = grants
+	} else {
+		logbuch.Error("failed to fetch oauth grants for user %s – %v", user.ID, err)
+		vm.WithError("failed to fetch authorized apps")
+	}
+	return vm
 }
 
 func (h *DashboardHandler) buildViewModel(r *http.Request) *view.DashboardViewModel {
 	return &view.DashboardViewModel{
-		Success: r.URL.Query().Get("success"),
-		Error:   r.URL.Query().Get("error"),
+		OAuthEnabled: h.config.Security.OAuthServer.Enabled,
+		Success:      r.URL.Query().Get("success"),
+		Error:        r.URL.Query().Get("error"),
+		CsrfToken:    middlewares.GetCsrfToken(r),
 	}
 }
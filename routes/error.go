@@ -0,0 +1,27 @@
+package routes
+
+import (
+	"github.com/muety/broilerplate/config"
+	"github.com/muety/broilerplate/middlewares"
+	"github.com/muety/broilerplate/models/view"
+	"github.com/muety/broilerplate/utils"
+	"net/http"
+	"strings"
+)
+
+const csrfFailureMessage = "invalid or missing csrf token"
+
+// CsrfFailureHandler responds to requests rejected by the csrf middleware, either with a rendered error page or, for json requests, with a json error
+func CsrfFailureHandler(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		utils.RespondJSON(w, http.StatusForbidden, map[string]string{"error": csrfFailureMessage})
+		return
+	}
+
+	if config.Get().IsDev() {
+		loadTemplates()
+	}
+
+	w.WriteHeader(http.StatusForbidden)
+	templates[config.ErrorTemplate].Execute(w, (&view.ErrorViewModel{CsrfToken: middlewares.GetCsrfToken(r)}).WithError(csrfFailureMessage))
+}
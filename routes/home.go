@@ -5,6 +5,7 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/gorilla/schema"
 	conf "github.com/muety/broilerplate/config"
+	"github.com/muety/broilerplate/middlewares"
 	"github.com/muety/broilerplate/models"
 	"github.com/muety/broilerplate/models/view"
 	"github.com/muety/broilerplate/services"
@@ -19,6 +20,7 @@ type HomeHandler struct {
 var loginDecoder = schema.NewDecoder()
 var signupDecoder = schema.NewDecoder()
 var resetPasswordDecoder = schema.NewDecoder()
+var magicLinkDecoder = schema.NewDecoder()
 
 func NewHomeHandler(keyValueService services.IKeyValueService) *HomeHandler {
 	return &HomeHandler{
@@ -46,7 +48,8 @@ func (h *HomeHandler) GetIndex(w http.ResponseWriter, r *http.Request) {
 
 func (h *HomeHandler) buildViewModel(r *http.Request) *view.HomeViewModel {
 	return &view.HomeViewModel{
-		Success: r.URL.Query().Get("success"),
-		Error:   r.URL.Query().Get("error"),
+		Success:   r.URL.Query().Get("success"),
+		Error:     r.URL.Query().Get("error"),
+		CsrfToken: middlewares.GetCsrfToken(r),
 	}
 }
@@ -3,6 +3,7 @@ package routes
 import (
 	"github.com/gorilla/mux"
 	conf "github.com/muety/broilerplate/config"
+	"github.com/muety/broilerplate/middlewares"
 	"github.com/muety/broilerplate/models"
 	"github.com/muety/broilerplate/models/view"
 	"github.com/muety/broilerplate/services"
@@ -40,7 +41,8 @@ func (h *ImprintHandler) GetImprint(w http.ResponseWriter, r *http.Request) {
 
 func (h *ImprintHandler) buildViewModel(r *http.Request) *view.ImprintViewModel {
 	return &view.ImprintViewModel{
-		Success: r.URL.Query().Get("success"),
-		Error:   r.URL.Query().Get("error"),
+		Success:   r.URL.Query().Get("success"),
+		Error:     r.URL.Query().Get("error"),
+		CsrfToken: middlewares.GetCsrfToken(r),
 	}
 }
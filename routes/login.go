@@ -1,36 +1,89 @@
 package routes
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/emvi/logbuch"
 	"github.com/gorilla/mux"
 	conf "github.com/muety/broilerplate/config"
+	"github.com/muety/broilerplate/middlewares"
 	"github.com/muety/broilerplate/models"
 	"github.com/muety/broilerplate/models/view"
 	"github.com/muety/broilerplate/services"
 	"github.com/muety/broilerplate/utils"
+	"html/template"
+	"math"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// time within which the second factor has to be provided after successful password authentication
+const secondFactorTimeout = 5 * time.Minute
+
 type LoginHandler struct {
-	config   *conf.Config
-	userSrvc services.IUserService
-	mailSrvc services.IMailService
+	config         *conf.Config
+	userSrvc       services.IUserService
+	sessionSrvc    services.ISessionService
+	totpSrvc       services.ITotpService
+	webauthnSrvc   services.IWebauthnService
+	oidcSrvc       services.IOidcService
+	apiTokenSrvc   services.IApiTokenService
+	clientCertSrvc services.IClientCertificateService
+	oauthSrvc      services.IOAuthService
+	mailSrvc       services.IMailService
+	verifySrvc     services.IEmailVerificationService
+	invitationSrvc services.IInvitationService
+	throttleSrvc   services.IThrottleService
+	roleSrvc       services.IRoleService
+	magicLinkSrvc  services.IMagicLinkService
+	deviceSrvc     services.IKnownDeviceService
+	authenticator  services.IAuthenticator
 }
 
-func NewLoginHandler(userService services.IUserService, mailService services.IMailService) *LoginHandler {
+func NewLoginHandler(userService services.IUserService, sessionService services.ISessionService, totpService services.ITotpService, webauthnService services.IWebauthnService, oidcService services.IOidcService, apiTokenService services.IApiTokenService, mailService services.IMailService, emailVerificationService services.IEmailVerificationService, invitationService services.IInvitationService, throttleService services.IThrottleService, roleService services.IRoleService, magicLinkService services.IMagicLinkService, knownDeviceService services.IKnownDeviceService, authenticator services.IAuthenticator, clientCertificateService services.IClientCertificateService, oauthService services.IOAuthService) *LoginHandler {
 	return &LoginHandler{
-		config:   conf.Get(),
-		userSrvc: userService,
-		mailSrvc: mailService,
+		config:         conf.Get(),
+		userSrvc:       userService,
+		sessionSrvc:    sessionService,
+		totpSrvc:       totpService,
+		webauthnSrvc:   webauthnService,
+		oidcSrvc:       oidcService,
+		apiTokenSrvc:   apiTokenService,
+		clientCertSrvc: clientCertificateService,
+		oauthSrvc:      oauthService,
+		mailSrvc:       mailService,
+		verifySrvc:     emailVerificationService,
+		invitationSrvc: invitationService,
+		throttleSrvc:   throttleService,
+		roleSrvc:       roleService,
+		magicLinkSrvc:  magicLinkService,
+		deviceSrvc:     knownDeviceService,
+		authenticator:  authenticator,
 	}
 }
 
 func (h *LoginHandler) RegisterRoutes(router *mux.Router) {
 	router.Path("/login").Methods(http.MethodGet).HandlerFunc(h.GetIndex)
 	router.Path("/login").Methods(http.MethodPost).HandlerFunc(h.PostLogin)
+	router.Path("/login/magic").Methods(http.MethodGet).HandlerFunc(h.GetMagicLinkLogin)
+	router.Path("/login/magic").Methods(http.MethodPost).HandlerFunc(h.PostMagicLink)
+	router.Path("/login/magic/confirm").Methods(http.MethodPost).HandlerFunc(h.PostMagicLinkLogin)
+	router.Path("/login/2fa").Methods(http.MethodGet).HandlerFunc(h.GetLogin2fa)
+	router.Path("/login/2fa").Methods(http.MethodPost).HandlerFunc(h.PostLogin2fa)
+	router.Path("/login/oidc/{provider}").Methods(http.MethodGet).HandlerFunc(h.GetOidcLogin)
+	router.Path("/login/oidc/{provider}/callback").Methods(http.MethodGet).HandlerFunc(h.GetOidcCallback)
+	router.Path("/webauthn/login/begin").Methods(http.MethodPost).HandlerFunc(h.PostWebauthnLoginBegin)
+	router.Path("/webauthn/login/finish").Methods(http.MethodPost).HandlerFunc(h.PostWebauthnLoginFinish)
+
+	r1 := router.PathPrefix("/webauthn/register").Subrouter()
+	r1.Use(middlewares.NewAuthenticateMiddleware(h.userSrvc, h.sessionSrvc, h.apiTokenSrvc, h.clientCertSrvc, h.oauthSrvc).Handler)
+	r1.Path("/begin").Methods(http.MethodPost).HandlerFunc(h.PostWebauthnRegisterBegin)
+	r1.Path("/finish").Methods(http.MethodPost).HandlerFunc(h.PostWebauthnRegisterFinish)
+
 	router.Path("/logout").Methods(http.MethodPost).HandlerFunc(h.PostLogout)
 	router.Path("/signup").Methods(http.MethodGet).HandlerFunc(h.GetSignup)
 	router.Path("/signup").Methods(http.MethodPost).HandlerFunc(h.PostSignup)
@@ -38,6 +91,7 @@ func (h *LoginHandler) RegisterRoutes(router *mux.Router) {
 	router.Path("/set-password").Methods(http.MethodPost).HandlerFunc(h.PostSetPassword)
 	router.Path("/reset-password").Methods(http.MethodGet).HandlerFunc(h.GetResetPassword)
 	router.Path("/reset-password").Methods(http.MethodPost).HandlerFunc(h.PostResetPassword)
+	router.Path("/verify-email").Methods(http.MethodGet).HandlerFunc(h.GetVerifyEmail)
 }
 
 func (h *LoginHandler) GetIndex(w http.ResponseWriter, r *http.Request) {
@@ -46,7 +100,7 @@ func (h *LoginHandler) GetIndex(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if cookie, err := r.Cookie(models.AuthCookieKey); err == nil && cookie.Value != "" {
-		http.Redirect(w, r, fmt.Sprintf("%s/dashboard", h.config.Server.BasePath), http.StatusFound)
+		http.Redirect(w, r, h.loginTarget(w, r), http.StatusFound)
 		return
 	}
 
@@ -59,7 +113,7 @@ func (h *LoginHandler) PostLogin(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if cookie, err := r.Cookie(models.AuthCookieKey); err == nil && cookie.Value != "" {
-		http.Redirect(w, r, fmt.Sprintf("%s/dashboard", h.config.Server.BasePath), http.StatusFound)
+		http.Redirect(w, r, h.loginTarget(w, r), http.StatusFound)
 		return
 	}
 
@@ -75,31 +129,216 @@ func (h *LoginHandler) PostLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := h.userSrvc.GetUserById(login.Username)
-	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		templates[conf.LoginTemplate].Execute(w, h.buildViewModel(r).WithError("resource not found"))
+	ip := middlewares.ReadUserIP(r)
+	if wait := h.throttleSrvc.CheckLogin(ip, login.Username); wait > 0 {
+		writeTooManyRequests(w, wait)
+		templates[conf.LoginTemplate].Execute(w, h.buildViewModel(r).WithError(tooManyRequestsMessage(wait)))
 		return
 	}
 
-	if !utils.CompareBcrypt(user.Password, login.Password, h.config.Security.PasswordSalt) {
+	user, err := h.authenticator.Authenticate(login.Username, login.Password)
+	if err == services.ErrUnknownUser {
+		h.throttleSrvc.RegisterLoginFailure(ip, login.Username)
+		h.audit(r, models.AuditLoginFailure, login.Username, "unknown user")
+		w.WriteHeader(http.StatusNotFound)
+		templates[conf.LoginTemplate].Execute(w, h.buildViewModel(r).WithError("resource not found"))
+		return
+	} else if err == services.ErrInvalidCredentials {
+		h.throttleSrvc.RegisterLoginFailure(ip, login.Username)
+		h.audit(r, models.AuditLoginFailure, login.Username, "invalid password")
 		w.WriteHeader(http.StatusUnauthorized)
 		templates[conf.LoginTemplate].Execute(w, h.buildViewModel(r).WithError("invalid credentials"))
 		return
+	} else if err != nil {
+		logbuch.Error("failed to authenticate '%s' – %v", login.Username, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		templates[conf.LoginTemplate].Execute(w, h.buildViewModel(r).WithError("internal server error"))
+		return
 	}
 
-	encoded, err := h.config.Security.SecureCookie.Encode(models.AuthCookieKey, login.Username)
+	if !h.verifySrvc.IsLoginPermitted(user) {
+		if err := h.verifySrvc.Resend(user); err != nil {
+			logbuch.Error("failed to resend e-mail verification to %s – %v", user.ID, err)
+		}
+		w.WriteHeader(http.StatusForbidden)
+		templates[conf.LoginTemplate].Execute(w, h.buildViewModel(r).WithError(services.ErrEmailNotVerified.Error()))
+		return
+	}
+
+	h.loginWithSecondFactor(w, r, user)
+}
+
+func (h *LoginHandler) PostMagicLink(w http.ResponseWriter, r *http.Request) {
+	if h.config.IsDev() {
+		loadTemplates()
+	}
+
+	if !h.config.Security.MagicLinkLogin {
+		w.WriteHeader(http.StatusNotImplemented)
+		templates[conf.LoginTemplate].Execute(w, h.buildViewModel(r).WithError("login links are disabled on this server"))
+		return
+	}
+
+	var linkRequest models.MagicLinkRequest
+	if err := r.ParseForm(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		templates[conf.LoginTemplate].Execute(w, h.buildViewModel(r).WithError("missing parameters"))
+		return
+	}
+	if err := magicLinkDecoder.Decode(&linkRequest, r.PostForm); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		templates[conf.LoginTemplate].Execute(w, h.buildViewModel(r).WithError("missing parameters"))
+		return
+	}
+
+	// every request results in a mail being sent, just like password resets
+	ip := middlewares.ReadUserIP(r)
+	if wait := h.throttleSrvc.CheckPasswordReset(ip, linkRequest.Email); wait > 0 {
+		writeTooManyRequests(w, wait)
+		templates[conf.LoginTemplate].Execute(w, h.buildViewModel(r).WithError(tooManyRequestsMessage(wait)))
+		return
+	}
+	h.throttleSrvc.RegisterPasswordReset(ip, linkRequest.Email)
+
+	// unconfirmed addresses might belong to someone else than the account owner
+	if user, err := h.userSrvc.GetUserByEmail(linkRequest.Email); user != nil && err == nil && user.EmailVerified {
+		if err := h.magicLinkSrvc.Send(user); err == services.ErrMagicLinkLdapUser {
+			// not telling, just like for unregistered addresses
+			logbuch.Debug("login link requested for directory user")
+		} else if err != nil {
+			logbuch.Error("failed to issue login link for %s – %v", user.ID, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			templates[conf.LoginTemplate].Execute(w, h.buildViewModel(r).WithError("failed to send login link"))
+			return
+		}
+	} else {
+		logbuch.Debug("login link requested for unregistered or unconfirmed address")
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("%s/login?success=%s", h.config.Server.BasePath, url.QueryEscape("a login link was sent to you in case your e-mail address was registered")), http.StatusFound)
+}
+
+// GetMagicLinkLogin only asks for confirmation, as mail scanners and link previews follow links, which must neither use them up nor get logged in
+func (h *LoginHandler) GetMagicLinkLogin(w http.ResponseWriter, r *http.Request) {
+	if h.config.IsDev() {
+		loadTemplates()
+	}
+
+	if !h.config.Security.MagicLinkLogin {
+		http.Redirect(w, r, fmt.Sprintf("%s/login?error=%s", h.config.Server.BasePath, url.QueryEscape("login links are disabled on this server")), http.StatusFound)
+		return
+	}
+
+	vm := &view.MagicLinkLoginViewModel{
+		LoginViewModel: *h.buildViewModel(r),
+		Token:          r.URL.Query().Get("token"),
+	}
+
+	templates[conf.LoginMagicTemplate].Execute(w, vm)
+}
+
+func (h *LoginHandler) PostMagicLinkLogin(w http.ResponseWriter, r *http.Request) {
+	if h.config.IsDev() {
+		loadTemplates()
+	}
+
+	if !h.config.Security.MagicLinkLogin {
+		http.Redirect(w, r, fmt.Sprintf("%s/login?error=%s", h.config.Server.BasePath, url.QueryEscape("login links are disabled on this server")), http.StatusFound)
+		return
+	}
+
+	var linkLogin models.MagicLinkLogin
+	if err := r.ParseForm(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		templates[conf.LoginTemplate].Execute(w, h.buildViewModel(r).WithError("missing parameters"))
+		return
+	}
+	if err := magicLinkDecoder.Decode(&linkLogin, r.PostForm); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		templates[conf.LoginTemplate].Execute(w, h.buildViewModel(r).WithError("missing parameters"))
+		return
+	}
+
+	user, err := h.magicLinkSrvc.Consume(linkLogin.Token)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		templates[conf.LoginTemplate].Execute(w, h.buildViewModel(r).WithError("internal server error"))
+		if err != services.ErrMagicLinkInvalid {
+			logbuch.Error("failed to consume login link – %v", err)
+		}
+		http.Redirect(w, r, fmt.Sprintf("%s/login?error=%s", h.config.Server.BasePath, url.QueryEscape(services.ErrMagicLinkInvalid.Error())), http.StatusFound)
 		return
 	}
 
-	user.LastLoggedInAt = models.CustomTime(time.Now())
-	h.userSrvc.Update(user)
+	// the link only replaces the password, so a second factor is still required if set up
+	h.loginWithSecondFactor(w, r, user)
+}
 
-	http.SetCookie(w, h.config.CreateCookie(models.AuthCookieKey, encoded, "/"))
-	http.Redirect(w, r, fmt.Sprintf("%s/dashboard", h.config.Server.BasePath), http.StatusFound)
+func (h *LoginHandler) GetLogin2fa(w http.ResponseWriter, r *http.Request) {
+	if h.config.IsDev() {
+		loadTemplates()
+	}
+
+	pending, err := h.getPendingLogin(r)
+	if err != nil {
+		http.Redirect(w, r, fmt.Sprintf("%s/login?error=%s", h.config.Server.BasePath, url.QueryEscape(err.Error())), http.StatusFound)
+		return
+	}
+
+	user, err := h.userSrvc.GetUserById(pending.UserID)
+	if err != nil {
+		http.Redirect(w, r, fmt.Sprintf("%s/login?error=%s", h.config.Server.BasePath, url.QueryEscape("resource not found")), http.StatusFound)
+		return
+	}
+
+	templates[conf.Login2faTemplate].Execute(w, h.build2faViewModel(r, user))
+}
+
+func (h *LoginHandler) PostLogin2fa(w http.ResponseWriter, r *http.Request) {
+	if h.config.IsDev() {
+		loadTemplates()
+	}
+
+	pending, err := h.getPendingLogin(r)
+	if err != nil {
+		http.Redirect(w, r, fmt.Sprintf("%s/login?error=%s", h.config.Server.BasePath, url.QueryEscape(err.Error())), http.StatusFound)
+		return
+	}
+
+	user, err := h.userSrvc.GetUserById(pending.UserID)
+	if err != nil {
+		http.Redirect(w, r, fmt.Sprintf("%s/login?error=%s", h.config.Server.BasePath, url.QueryEscape("resource not found")), http.StatusFound)
+		return
+	}
+
+	var codeRequest models.TotpCodeRequest
+	if err := r.ParseForm(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		templates[conf.Login2faTemplate].Execute(w, h.build2faViewModel(r, user).WithError("missing parameters"))
+		return
+	}
+	if err := loginDecoder.Decode(&codeRequest, r.PostForm); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		templates[conf.Login2faTemplate].Execute(w, h.build2faViewModel(r, user).WithError("missing parameters"))
+		return
+	}
+
+	// second factor codes are short, so guessing them needs to be slowed down just like guessing passwords
+	ip := middlewares.ReadUserIP(r)
+	if wait := h.throttleSrvc.CheckLogin(ip, user.ID); wait > 0 {
+		writeTooManyRequests(w, wait)
+		templates[conf.Login2faTemplate].Execute(w, h.build2faViewModel(r, user).WithError(tooManyRequestsMessage(wait)))
+		return
+	}
+
+	if err := h.totpSrvc.Verify(user, codeRequest.Code); err != nil {
+		h.throttleSrvc.RegisterLoginFailure(ip, user.ID)
+		h.audit(r, models.AuditLoginFailure, user.ID, "invalid second factor code")
+		w.WriteHeader(http.StatusUnauthorized)
+		templates[conf.Login2faTemplate].Execute(w, h.build2faViewModel(r, user).WithError("invalid code"))
+		return
+	}
+
+	http.SetCookie(w, h.config.GetClearCookie(models.SecondFactorCookieKey, "/"))
+	h.login(w, r, user, conf.LoginTemplate)
 }
 
 func (h *LoginHandler) PostLogout(w http.ResponseWriter, r *http.Request) {
@@ -107,6 +346,13 @@ func (h *LoginHandler) PostLogout(w http.ResponseWriter, r *http.Request) {
 		loadTemplates()
 	}
 
+	if sessionId, err := utils.ExtractCookieAuth(r, h.config); err == nil {
+		if session, err := h.sessionSrvc.GetValidById(*sessionId); err == nil {
+			h.sessionSrvc.Delete(session)
+			h.audit(r, models.AuditLogout, session.UserID, "")
+		}
+	}
+
 	http.SetCookie(w, h.config.GetClearCookie(models.AuthCookieKey, "/"))
 	http.Redirect(w, r, fmt.Sprintf("%s/", h.config.Server.BasePath), http.StatusFound)
 }
@@ -121,7 +367,19 @@ func (h *LoginHandler) GetSignup(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	templates[conf.SignupTemplate].Execute(w, h.buildViewModel(r))
+	vm := h.buildViewModel(r)
+	if token := r.URL.Query().Get("invite"); token != "" {
+		invitation, err := h.invitationSrvc.GetValid(token)
+		if err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			templates[conf.SignupTemplate].Execute(w, vm.WithError(err.Error()))
+			return
+		}
+		vm.InviteToken = token
+		vm.InviteEmail = invitation.Email
+	}
+
+	templates[conf.SignupTemplate].Execute(w, vm)
 }
 
 func (h *LoginHandler) PostSignup(w http.ResponseWriter, r *http.Request) {
@@ -129,12 +387,6 @@ func (h *LoginHandler) PostSignup(w http.ResponseWriter, r *http.Request) {
 		loadTemplates()
 	}
 
-	if !h.config.IsDev() && !h.config.Security.AllowSignup {
-		w.WriteHeader(http.StatusForbidden)
-		templates[conf.SignupTemplate].Execute(w, h.buildViewModel(r).WithError("registration is disabled on this server"))
-		return
-	}
-
 	if cookie, err := r.Cookie(models.AuthCookieKey); err == nil && cookie.Value != "" {
 		http.Redirect(w, r, fmt.Sprintf("%s/dashboard", h.config.Server.BasePath), http.StatusFound)
 		return
@@ -152,27 +404,92 @@ func (h *LoginHandler) PostSignup(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// a valid invitation permits signing up even while open registration is disabled
+	var invitation *models.Invitation
+	if signup.InviteToken != "" {
+		var err error
+		if invitation, err = h.invitationSrvc.GetValid(signup.InviteToken); err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			templates[conf.SignupTemplate].Execute(w, h.buildViewModel(r).WithError(err.Error()))
+			return
+		}
+	}
+
+	if !h.config.IsDev() && !h.config.Security.AllowSignup && invitation == nil {
+		w.WriteHeader(http.StatusForbidden)
+		templates[conf.SignupTemplate].Execute(w, h.buildViewModel(r).WithError("registration is disabled on this server"))
+		return
+	}
+
+	vm := h.buildViewModel(r)
+	if invitation != nil {
+		vm.InviteToken = signup.InviteToken
+		vm.InviteEmail = invitation.Email
+	}
+
 	if !signup.IsValid() {
 		w.WriteHeader(http.StatusBadRequest)
-		templates[conf.SignupTemplate].Execute(w, h.buildViewModel(r).WithError("invalid parameters"))
+		templates[conf.SignupTemplate].Execute(w, vm.WithError("invalid parameters"))
+		return
+	}
+
+	if h.config.Security.RequireEmailVerification && signup.Email == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		templates[conf.SignupTemplate].Execute(w, vm.WithError("an e-mail address is required"))
 		return
 	}
 
 	numUsers, _ := h.userSrvc.Count()
 
-	_, created, err := h.userSrvc.CreateOrGet(&signup, numUsers == 0)
+	user, created, err := h.userSrvc.CreateOrGet(&signup)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		templates[conf.SignupTemplate].Execute(w, h.buildViewModel(r).WithError("failed to create new user"))
+		templates[conf.SignupTemplate].Execute(w, vm.WithError("failed to create new user"))
 		return
 	}
 	if !created {
 		w.WriteHeader(http.StatusConflict)
-		templates[conf.SignupTemplate].Execute(w, h.buildViewModel(r).WithError("user already existing"))
+		templates[conf.SignupTemplate].Execute(w, vm.WithError("user already existing"))
 		return
 	}
 
-	http.Redirect(w, r, fmt.Sprintf("%s/?success=%s", h.config.Server.BasePath, "account created successfully"), http.StatusFound)
+	// the very first user is granted full privileges to bootstrap the instance
+	if numUsers == 0 {
+		if err := h.roleSrvc.Assign(user, models.RoleAdmin); err != nil {
+			logbuch.Error("failed to assign admin role to first user %s – %v", user.ID, err)
+		}
+	}
+
+	if invitation != nil {
+		if err := h.invitationSrvc.Consume(invitation, user); err != nil {
+			// someone else was faster in using the same invitation
+			if err := h.userSrvc.Delete(user, nil); err != nil {
+				logbuch.Error("failed to roll back creation of user %s – %v", user.ID, err)
+			}
+			w.WriteHeader(http.StatusForbidden)
+			templates[conf.SignupTemplate].Execute(w, h.buildViewModel(r).WithError(err.Error()))
+			return
+		}
+
+		// the invitation was delivered to this very address, so it doesn't need to be confirmed again
+		if user.Email != "" && strings.EqualFold(user.Email, invitation.Email) {
+			user.EmailVerified = true
+			if user, err = h.userSrvc.Update(user); err != nil {
+				logbuch.Error("failed to mark e-mail address of user %s as verified – %v", signup.Username, err)
+			}
+		}
+	}
+
+	message := "account created successfully"
+	if h.config.Mail.Enabled && user != nil && user.Email != "" && !user.EmailVerified {
+		if err := h.verifySrvc.Send(user, user.Email); err != nil {
+			logbuch.Error("failed to send e-mail verification to %s – %v", user.ID, err)
+		} else {
+			message = "account created successfully, please confirm your e-mail address using the link we sent you"
+		}
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("%s/?success=%s", h.config.Server.BasePath, url.QueryEscape(message)), http.StatusFound)
 }
 
 func (h *LoginHandler) GetResetPassword(w http.ResponseWriter, r *http.Request) {
@@ -189,9 +506,9 @@ func (h *LoginHandler) GetSetPassword(w http.ResponseWriter, r *http.Request) {
 
 	values, _ := url.ParseQuery(r.URL.RawQuery)
 	token := values.Get("token")
-	if token == "" {
+	if _, err := h.userSrvc.GetUserByResetToken(token); err != nil {
 		w.WriteHeader(http.StatusUnauthorized)
-		templates[conf.SetPasswordTemplate].Execute(w, h.buildViewModel(r).WithError("invalid or missing token"))
+		templates[conf.SetPasswordTemplate].Execute(w, h.buildViewModel(r).WithError(err.Error()))
 		return
 	}
 
@@ -223,7 +540,7 @@ func (h *LoginHandler) PostSetPassword(w http.ResponseWriter, r *http.Request) {
 	user, err := h.userSrvc.GetUserByResetToken(setRequest.Token)
 	if err != nil {
 		w.WriteHeader(http.StatusUnauthorized)
-		templates[conf.SetPasswordTemplate].Execute(w, h.buildViewModel(r).WithError("invalid token"))
+		templates[conf.SetPasswordTemplate].Execute(w, h.buildViewModel(r).WithError(err.Error()))
 		return
 	}
 
@@ -235,6 +552,7 @@ func (h *LoginHandler) PostSetPassword(w http.ResponseWriter, r *http.Request) {
 
 	user.Password = setRequest.Password
 	user.ResetToken = ""
+	user.ResetTokenCreatedAt = nil
 	if hash, err := utils.HashBcrypt(user.Password, h.config.Security.PasswordSalt); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		templates[conf.SetPasswordTemplate].Execute(w, h.buildViewModel(r).WithError("failed to set new password"))
@@ -249,6 +567,13 @@ func (h *LoginHandler) PostSetPassword(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	h.audit(r, models.AuditPasswordChange, user.ID, "password reset link")
+
+	// log out everywhere, as the password might have been reset because of a compromised account
+	if err := h.sessionSrvc.DeleteByUser(user); err != nil {
+		logbuch.Error("failed to revoke sessions of user %s after password change – %v", user.ID, err)
+	}
+
 	http.Redirect(w, r, fmt.Sprintf("%s/login?success=%s", h.config.Server.BasePath, "password updated successfully"), http.StatusFound)
 }
 
@@ -275,34 +600,430 @@ func (h *LoginHandler) PostResetPassword(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	if user, err := h.userSrvc.GetUserByEmail(resetRequest.Email); user != nil && err == nil {
-		if u, err := h.userSrvc.GenerateResetToken(user); err != nil {
+	ip := middlewares.ReadUserIP(r)
+	if wait := h.throttleSrvc.CheckPasswordReset(ip, resetRequest.Email); wait > 0 {
+		writeTooManyRequests(w, wait)
+		templates[conf.ResetPasswordTemplate].Execute(w, h.buildViewModel(r).WithError(tooManyRequestsMessage(wait)))
+		return
+	}
+	h.throttleSrvc.RegisterPasswordReset(ip, resetRequest.Email)
+
+	// unconfirmed addresses might belong to someone else than the account owner
+	if user, err := h.userSrvc.GetUserByEmail(resetRequest.Email); user != nil && err == nil && user.EmailVerified {
+		if token, err := h.userSrvc.GenerateResetToken(user, middlewares.GetAuditOrigin(r)); err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			templates[conf.ResetPasswordTemplate].Execute(w, h.buildViewModel(r).WithError("failed to generate password reset token"))
 			return
 		} else {
-			go func(user *models.User) {
-				link := fmt.Sprintf("%s/set-password?token=%s", h.config.Server.GetPublicUrl(), user.ResetToken)
+			conf.RunInBackground(func() {
+				link := fmt.Sprintf("%s/set-password?token=%s", h.config.Server.GetPublicUrl(), token)
 				if err := h.mailSrvc.SendPasswordReset(user, link); err != nil {
 					logbuch.Error("failed to send password reset mail to %s – %v", user.ID, err)
 				} else {
 					logbuch.Info("sent password reset mail to %s", user.ID)
 				}
-			}(u)
+			})
 		}
 	} else {
-		logbuch.Warn("password reset requested for unregistered address '%s'", resetRequest.Email)
+		logbuch.Debug("password reset requested for unregistered or unconfirmed address")
 	}
 
 	http.Redirect(w, r, fmt.Sprintf("%s/?success=%s", h.config.Server.BasePath, "an e-mail was sent to you in case your e-mail address was registered"), http.StatusFound)
 }
 
+func (h *LoginHandler) GetVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	if _, err := h.verifySrvc.Verify(r.URL.Query().Get("token")); err != nil {
+		if err != services.ErrEmailVerificationFailed {
+			logbuch.Error("failed to verify e-mail address – %v", err)
+		}
+		http.Redirect(w, r, fmt.Sprintf("%s/?error=%s", h.config.Server.BasePath, url.QueryEscape(services.ErrEmailVerificationFailed.Error())), http.StatusFound)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("%s/?success=%s", h.config.Server.BasePath, url.QueryEscape("e-mail address confirmed successfully")), http.StatusFound)
+}
+
+func (h *LoginHandler) GetOidcLogin(w http.ResponseWriter, r *http.Request) {
+	authUrl, state, err := h.oidcSrvc.BeginLogin(r.Context(), mux.Vars(r)["provider"])
+	if err != nil {
+		http.Redirect(w, r, fmt.Sprintf("%s/login?error=%s", h.config.Server.BasePath, url.QueryEscape(err.Error())), http.StatusFound)
+		return
+	}
+
+	encoded, err := h.config.Security.SecureCookie.Encode(models.OidcCookieKey, state)
+	if err != nil {
+		http.Redirect(w, r, fmt.Sprintf("%s/login?error=%s", h.config.Server.BasePath, url.QueryEscape("internal server error")), http.StatusFound)
+		return
+	}
+
+	// must be lax, as the callback is a cross-site navigation coming from the identity provider
+	http.SetCookie(w, h.config.CreateLaxCookieWithMaxAge(models.OidcCookieKey, encoded, "/", int(time.Until(state.ExpiresAt).Seconds())))
+	http.Redirect(w, r, authUrl, http.StatusFound)
+}
+
+func (h *LoginHandler) GetOidcCallback(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, h.config.GetClearCookie(models.OidcCookieKey, "/"))
+
+	if idpError := r.URL.Query().Get("error"); idpError != "" {
+		logbuch.Warn("identity provider '%s' returned error '%s' (%s)", mux.Vars(r)["provider"], idpError, r.URL.Query().Get("error_description"))
+		http.Redirect(w, r, fmt.Sprintf("%s/login?error=%s", h.config.Server.BasePath, url.QueryEscape("single sign-on failed")), http.StatusFound)
+		return
+	}
+
+	var state models.OidcState
+	cookie, err := r.Cookie(models.OidcCookieKey)
+	if err == nil {
+		err = h.config.Security.SecureCookie.Decode(models.OidcCookieKey, cookie.Value, &state)
+	}
+	if err != nil || state.Provider != mux.Vars(r)["provider"] {
+		http.Redirect(w, r, fmt.Sprintf("%s/login?error=%s", h.config.Server.BasePath, url.QueryEscape("invalid authentication")), http.StatusFound)
+		return
+	}
+
+	user, err := h.oidcSrvc.FinishLogin(r.Context(), &state, r.URL.Query().Get("state"), r.URL.Query().Get("code"))
+	if err != nil {
+		message := "single sign-on failed"
+		if err == services.ErrOidcAccountExists || err == services.ErrOidcSignupDisabled {
+			message = err.Error()
+		}
+		logbuch.Warn("failed single sign-on with '%s': %v", state.Provider, err)
+		http.Redirect(w, r, fmt.Sprintf("%s/login?error=%s", h.config.Server.BasePath, url.QueryEscape(message)), http.StatusFound)
+		return
+	}
+
+	// single sign-on replaces the password only, a second factor set up locally is still required
+	var target string
+	if h.requiresSecondFactor(user) {
+		if err := h.setPendingLogin(w, user); err != nil {
+			http.Redirect(w, r, fmt.Sprintf("%s/login?error=%s", h.config.Server.BasePath, url.QueryEscape("internal server error")), http.StatusFound)
+			return
+		}
+		target = fmt.Sprintf("%s/login/2fa", h.config.Server.BasePath)
+	} else if err := h.createSession(w, r, user); err != nil {
+		message := "internal server error"
+		if err == services.ErrEmailNotVerified {
+			message = err.Error()
+		}
+		http.Redirect(w, r, fmt.Sprintf("%s/login?error=%s", h.config.Server.BasePath, url.QueryEscape(message)), http.StatusFound)
+		return
+	} else {
+		target = h.loginTarget(w, r)
+	}
+
+	// browsers don't send same-site strict cookies along with redirects that originate from another site,
+	// so we let the client navigate to the dashboard (or second factor prompt) by itself instead of responding with a redirect
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, `<!DOCTYPE html><html><head><meta http-equiv="refresh" content="0;url=%s"></head></html>`, template.HTMLEscapeString(target))
+}
+
+func (h *LoginHandler) PostWebauthnRegisterBegin(w http.ResponseWriter, r *http.Request) {
+	user := middlewares.GetPrincipal(r)
+
+	options, session, err := h.webauthnSrvc.BeginRegistration(user)
+	if err != nil {
+		utils.RespondJSON(w, http.StatusInternalServerError, map[string]string{"error": "internal server error"})
+		return
+	}
+	if err := h.setWebauthnSession(w, session); err != nil {
+		utils.RespondJSON(w, http.StatusInternalServerError, map[string]string{"error": "internal server error"})
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, options)
+}
+
+func (h *LoginHandler) PostWebauthnRegisterFinish(w http.ResponseWriter, r *http.Request) {
+	user := middlewares.GetPrincipal(r)
+
+	session, err := h.getWebauthnSession(r)
+	if err != nil {
+		utils.RespondJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	http.SetCookie(w, h.config.GetClearCookie(models.WebauthnCookieKey, "/"))
+
+	var registration models.WebauthnRegistration
+	if err := json.NewDecoder(r.Body).Decode(&registration); err != nil {
+		utils.RespondJSON(w, http.StatusBadRequest, map[string]string{"error": "missing parameters"})
+		return
+	}
+
+	credential, err := h.webauthnSrvc.FinishRegistration(user, session.ID, &registration)
+	if err != nil {
+		logbuch.Warn("failed to register passkey for user '%s': %v", user.ID, err)
+		utils.RespondJSON(w, http.StatusBadRequest, map[string]string{"error": "failed to register passkey"})
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusCreated, credential)
+}
+
+// PostWebauthnLoginBegin starts a passkey login, either passwordless or, with ?mode=2fa, as a second factor after password authentication
+func (h *LoginHandler) PostWebauthnLoginBegin(w http.ResponseWriter, r *http.Request) {
+	var user *models.User
+
+	if r.URL.Query().Get("mode") == models.WebauthnPurposeSecondFactor {
+		pending, err := h.getPendingLogin(r)
+		if err != nil {
+			utils.RespondJSON(w, http.StatusUnauthorized, map[string]string{"error": err.Error()})
+			return
+		}
+		if user, err = h.userSrvc.GetUserById(pending.UserID); err != nil {
+			utils.RespondJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid authentication"})
+			return
+		}
+	}
+
+	options, session, err := h.webauthnSrvc.BeginLogin(user)
+	if err != nil {
+		utils.RespondJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if err := h.setWebauthnSession(w, session); err != nil {
+		utils.RespondJSON(w, http.StatusInternalServerError, map[string]string{"error": "internal server error"})
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, options)
+}
+
+func (h *LoginHandler) PostWebauthnLoginFinish(w http.ResponseWriter, r *http.Request) {
+	session, err := h.getWebauthnSession(r)
+	if err != nil {
+		utils.RespondJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	http.SetCookie(w, h.config.GetClearCookie(models.WebauthnCookieKey, "/"))
+
+	if session.Purpose == models.WebauthnPurposeSecondFactor {
+		pending, err := h.getPendingLogin(r)
+		if err != nil || pending.UserID != session.UserID {
+			utils.RespondJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid authentication"})
+			return
+		}
+	}
+
+	var assertion models.WebauthnAssertion
+	if err := json.NewDecoder(r.Body).Decode(&assertion); err != nil {
+		utils.RespondJSON(w, http.StatusBadRequest, map[string]string{"error": "missing parameters"})
+		return
+	}
+
+	user, err := h.webauthnSrvc.FinishLogin(session.ID, &assertion)
+	if err != nil {
+		logbuch.Warn("failed passkey login: %v", err)
+		h.audit(r, models.AuditLoginFailure, session.UserID, "invalid passkey")
+		utils.RespondJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid credentials"})
+		return
+	}
+
+	if session.Purpose == models.WebauthnPurposeSecondFactor {
+		http.SetCookie(w, h.config.GetClearCookie(models.SecondFactorCookieKey, "/"))
+	}
+	if err := h.createSession(w, r, user); err == services.ErrEmailNotVerified {
+		utils.RespondJSON(w, http.StatusForbidden, map[string]string{"error": err.Error()})
+		return
+	} else if err != nil {
+		utils.RespondJSON(w, http.StatusInternalServerError, map[string]string{"error": "internal server error"})
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, map[string]string{"redirect": h.loginTarget(w, r)})
+}
+
+// loginWithSecondFactor asks for a second factor if the user has set one up, or logs them in right away otherwise
+func (h *LoginHandler) loginWithSecondFactor(w http.ResponseWriter, r *http.Request, user *models.User) {
+	if h.requiresSecondFactor(user) {
+		if err := h.setPendingLogin(w, user); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			templates[conf.LoginTemplate].Execute(w, h.buildViewModel(r).WithError("internal server error"))
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("%s/login/2fa", h.config.Server.BasePath), http.StatusFound)
+		return
+	}
+
+	h.login(w, r, user, conf.LoginTemplate)
+}
+
+func (h *LoginHandler) requiresSecondFactor(user *models.User) bool {
+	return user.TotpEnabled || h.webauthnSrvc.HasCredentials(user)
+}
+
+// setPendingLogin remembers the user as having passed the first factor, see getPendingLogin
+func (h *LoginHandler) setPendingLogin(w http.ResponseWriter, user *models.User) error {
+	pending := &models.PendingLogin{UserID: user.ID, ExpiresAt: time.Now().Add(secondFactorTimeout)}
+	encoded, err := h.config.Security.SecureCookie.Encode(models.SecondFactorCookieKey, pending)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, h.config.CreateCookieWithMaxAge(models.SecondFactorCookieKey, encoded, "/", int(secondFactorTimeout.Seconds())))
+	return nil
+}
+
+// login creates a new session for the (fully authenticated) user, sets the auth cookie and redirects to the dashboard
+func (h *LoginHandler) login(w http.ResponseWriter, r *http.Request, user *models.User, errorTemplate string) {
+	deletionCancelled := user.IsDeletionScheduled()
+	if err := h.createSession(w, r, user); err == services.ErrEmailNotVerified {
+		w.WriteHeader(http.StatusForbidden)
+		templates[errorTemplate].Execute(w, h.buildViewModel(r).WithError(err.Error()))
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		templates[errorTemplate].Execute(w, h.buildViewModel(r).WithError("internal server error"))
+		return
+	}
+	if deletionCancelled {
+		http.Redirect(w, r, fmt.Sprintf("%s/dashboard?success=%s", h.config.Server.BasePath, url.QueryEscape("welcome back, the deletion of your account was cancelled")), http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, h.loginTarget(w, r), http.StatusFound)
+}
+
+// loginTarget is where to go after logging in, i.e. back to where a login was required (e.g. to authorize an app), or to the dashboard otherwise
+func (h *LoginHandler) loginTarget(w http.ResponseWriter, r *http.Request) string {
+	dashboard := fmt.Sprintf("%s/dashboard", h.config.Server.BasePath)
+
+	cookie, err := r.Cookie(models.ReturnToCookieKey)
+	if err != nil || cookie.Value == "" {
+		return dashboard
+	}
+	http.SetCookie(w, h.config.GetClearCookie(models.ReturnToCookieKey, "/"))
+
+	var target string
+	if err := h.config.Security.SecureCookie.Decode(models.ReturnToCookieKey, cookie.Value, &target); err != nil {
+		return dashboard
+	}
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") {
+		return dashboard
+	}
+	return h.config.Server.BasePath + target
+}
+
+// createSession is the single place where every login method (password, login link, passkey, sso) ends up, so global login restrictions are enforced here
+func (h *LoginHandler) createSession(w http.ResponseWriter, r *http.Request, user *models.User) error {
+	if !h.verifySrvc.IsLoginPermitted(user) {
+		if err := h.verifySrvc.Resend(user); err != nil {
+			logbuch.Error("failed to resend e-mail verification to %s – %v", user.ID, err)
+		}
+		return services.ErrEmailNotVerified
+	}
+
+	h.throttleSrvc.RegisterLoginSuccess(middlewares.ReadUserIP(r), user.ID)
+
+	session, err := h.sessionSrvc.Create(user, middlewares.ReadUserIP(r), r.UserAgent())
+	if err != nil {
+		return err
+	}
+
+	encoded, err := h.config.Security.SecureCookie.Encode(models.AuthCookieKey, session.ID)
+	if err != nil {
+		return err
+	}
+
+	deletionCancelled := user.IsDeletionScheduled()
+	if deletionCancelled {
+		// logging in again is how users change their mind about deleting their account
+		user.DeletionScheduledAt = nil
+		logbuch.Info("deletion of user %s cancelled by logging in", user.ID)
+	}
+
+	user.LastLoggedInAt = models.CustomTime(time.Now())
+	if _, err := h.userSrvc.Update(user); err != nil {
+		logbuch.Error("failed to update last login of %s – %v", user.ID, err)
+	}
+
+	if err := h.deviceSrvc.Observe(user, middlewares.ReadUserIP(r), r.UserAgent()); err != nil {
+		logbuch.Error("failed to check for new device of %s – %v", user.ID, err)
+	}
+
+	h.audit(r, models.AuditLoginSuccess, user.ID, "")
+	if deletionCancelled {
+		h.audit(r, models.AuditUserDeletionCancelled, user.ID, "logged in again")
+	}
+
+	http.SetCookie(w, h.config.CreateCookie(models.AuthCookieKey, encoded, "/"))
+	return nil
+}
+
+// audit records an authentication related event, which is attributed to the user as its actor, unless it is a failed attempt by whoever
+func (h *LoginHandler) audit(r *http.Request, action, userId, details string) {
+	origin := middlewares.GetAuditOrigin(r)
+	if action != models.AuditLoginFailure {
+		origin.ActorID = userId
+	}
+	services.PublishAuditEvent(models.NewAuditEvent(action, origin, userId, details))
+}
+
+func (h *LoginHandler) getPendingLogin(r *http.Request) (*models.PendingLogin, error) {
+	cookie, err := r.Cookie(models.SecondFactorCookieKey)
+	if err != nil {
+		return nil, errors.New("missing authentication")
+	}
+
+	var pending models.PendingLogin
+	if err := h.config.Security.SecureCookie.Decode(models.SecondFactorCookieKey, cookie.Value, &pending); err != nil {
+		return nil, errors.New("invalid authentication")
+	}
+	if pending.IsExpired() {
+		return nil, errors.New("login timed out, please try again")
+	}
+	return &pending, nil
+}
+
+func (h *LoginHandler) setWebauthnSession(w http.ResponseWriter, session *models.WebauthnSession) error {
+	encoded, err := h.config.Security.SecureCookie.Encode(models.WebauthnCookieKey, session.ID)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, h.config.CreateCookieWithMaxAge(models.WebauthnCookieKey, encoded, "/", int(time.Until(session.ExpiresAt.T()).Seconds())))
+	return nil
+}
+
+func (h *LoginHandler) getWebauthnSession(r *http.Request) (*models.WebauthnSession, error) {
+	cookie, err := r.Cookie(models.WebauthnCookieKey)
+	if err != nil {
+		return nil, errors.New("missing ceremony state")
+	}
+
+	var sessionId string
+	if err := h.config.Security.SecureCookie.Decode(models.WebauthnCookieKey, cookie.Value, &sessionId); err != nil {
+		return nil, errors.New("invalid ceremony state")
+	}
+	session, err := h.webauthnSrvc.GetSession(sessionId)
+	if err != nil {
+		return nil, errors.New("ceremony expired or already completed")
+	}
+	return session, nil
+}
+
+func (h *LoginHandler) build2faViewModel(r *http.Request, user *models.User) *view.Login2faViewModel {
+	return &view.Login2faViewModel{
+		LoginViewModel: *h.buildViewModel(r),
+		TotpEnabled:    user.TotpEnabled,
+		HasPasskeys:    h.webauthnSrvc.HasCredentials(user),
+	}
+}
+
 func (h *LoginHandler) buildViewModel(r *http.Request) *view.LoginViewModel {
 	numUsers, _ := h.userSrvc.Count()
 
 	return &view.LoginViewModel{
-		Success:    r.URL.Query().Get("success"),
-		Error:      r.URL.Query().Get("error"),
-		TotalUsers: int(numUsers),
+		Success:       r.URL.Query().Get("success"),
+		Error:         r.URL.Query().Get("error"),
+		CsrfToken:     middlewares.GetCsrfToken(r),
+		TotalUsers:    int(numUsers),
+		OidcProviders: h.oidcSrvc.GetProviders(),
+		MagicLink:     h.config.Security.MagicLinkLogin,
 	}
 }
+
+// writeTooManyRequests responds with status 429 and tells the client when to retry, the response body is up to the caller
+func writeTooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	w.WriteHeader(http.StatusTooManyRequests)
+}
+
+func tooManyRequestsMessage(wait time.Duration) string {
+	return fmt.Sprintf("too many attempts, please try again in %s", wait.Round(time.Second).String())
+}
@@ -0,0 +1,322 @@
+package routes
+
+import (
+	"fmt"
+	"github.com/emvi/logbuch"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/schema"
+	conf "github.com/muety/broilerplate/config"
+	"github.com/muety/broilerplate/middlewares"
+	"github.com/muety/broilerplate/models"
+	"github.com/muety/broilerplate/models/view"
+	"github.com/muety/broilerplate/services"
+	"github.com/muety/broilerplate/utils"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// time within which users have to log in for an authorization request to be resumed afterwards
+const oauthLoginTimeout = 10 * time.Minute
+
+// OAuthHandler serves the endpoints of the oauth 2.0 authorization server, i.e. the consent screen for users and the token endpoints for apps
+type OAuthHandler struct {
+	config         *conf.Config
+	userSrvc       services.IUserService
+	sessionSrvc    services.ISessionService
+	apiTokenSrvc   services.IApiTokenService
+	clientCertSrvc services.IClientCertificateService
+	oauthSrvc      services.IOAuthService
+}
+
+var oauthAuthorizeDecoder = schema.NewDecoder()
+
+func NewOAuthHandler(userService services.IUserService, sessionService services.ISessionService, apiTokenService services.IApiTokenService, clientCertificateService services.IClientCertificateService, oauthService services.IOAuthService) *OAuthHandler {
+	// apps may send parameters of extensions we don't support
+	oauthAuthorizeDecoder.IgnoreUnknownKeys(true)
+
+	return &OAuthHandler{
+		config:         conf.Get(),
+		userSrvc:       userService,
+		sessionSrvc:    sessionService,
+		apiTokenSrvc:   apiTokenService,
+		clientCertSrvc: clientCertificateService,
+		oauthSrvc:      oauthService,
+	}
+}
+
+func (h *OAuthHandler) RegisterRoutes(router *mux.Router) {
+	if !h.config.Security.OAuthServer.Enabled {
+		return
+	}
+
+	r1 := router.PathPrefix("/oauth/authorize").Subrouter()
+	r1.Use(middlewares.NewAuthenticateMiddleware(h.userSrvc, h.sessionSrvc, h.apiTokenSrvc, h.clientCertSrvc, h.oauthSrvc).WithOptionalFor([]string{"/oauth/authorize"}).Handler)
+	r1.Path("").Methods(http.MethodGet).HandlerFunc(h.GetAuthorize)
+	r1.Path("").Methods(http.MethodPost).HandlerFunc(h.PostAuthorize)
+
+	router.Path("/oauth/token").Methods(http.MethodPost).HandlerFunc(h.PostToken)
+	router.Path("/oauth/introspect").Methods(http.MethodPost).HandlerFunc(h.PostIntrospect)
+}
+
+// GetAuthorize asks the user to consent to an app's authorization request, unless they have done so before
+func (h *OAuthHandler) GetAuthorize(w http.ResponseWriter, r *http.Request) {
+	if h.config.IsDev() {
+		loadTemplates()
+	}
+
+	var request models.OAuthAuthorizeRequest
+	if err := oauthAuthorizeDecoder.Decode(&request, r.URL.Query()); err != nil {
+		h.renderError(w, r, http.StatusBadRequest, "invalid authorization request")
+		return
+	}
+
+	// errors are only reported back to the app once it is known to be legit, otherwise this would be an open redirect
+	client, redirectUri, ok := h.resolveClient(&request)
+	if !ok {
+		h.renderError(w, r, http.StatusBadRequest, "unknown app or invalid redirect uri")
+		return
+	}
+
+	user := middlewares.GetPrincipal(r)
+	if user == nil {
+		h.redirectToLogin(w, r)
+		return
+	}
+
+	scopes, err := h.oauthSrvc.ValidateAuthorizeRequest(user, client, &request)
+	if err != nil {
+		h.redirectWithError(w, r, redirectUri, request.State, err)
+		return
+	}
+
+	if h.oauthSrvc.HasConsent(user, client, scopes) {
+		h.authorize(w, r, user, client, &request, redirectUri, scopes)
+		return
+	}
+
+	// the consent form eventually redirects back to the app
+	middlewares.AllowFormAction(w, redirectUri)
+	templates[conf.OAuthAuthorizeTemplate].Execute(w, &view.OAuthAuthorizeViewModel{
+		User:        user,
+		Client:      client,
+		Request:     &request,
+		Scopes:      scopes,
+		RedirectUri: redirectUri,
+		CsrfToken:   middlewares.GetCsrfToken(r),
+	})
+}
+
+// PostAuthorize handles the user's decision on the consent screen, the request is validated once again, as its parameters went through the browser
+func (h *OAuthHandler) PostAuthorize(w http.ResponseWriter, r *http.Request) {
+	if h.config.IsDev() {
+		loadTemplates()
+	}
+
+	user := middlewares.GetPrincipal(r)
+	if user == nil {
+		h.renderError(w, r, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	var request models.OAuthAuthorizeRequest
+	if err := r.ParseForm(); err != nil {
+		h.renderError(w, r, http.StatusBadRequest, "invalid authorization request")
+		return
+	}
+	if err := oauthAuthorizeDecoder.Decode(&request, r.PostForm); err != nil {
+		h.renderError(w, r, http.StatusBadRequest, "invalid authorization request")
+		return
+	}
+
+	client, redirectUri, ok := h.resolveClient(&request)
+	if !ok {
+		h.renderError(w, r, http.StatusBadRequest, "unknown app or invalid redirect uri")
+		return
+	}
+
+	scopes, err := h.oauthSrvc.ValidateAuthorizeRequest(user, client, &request)
+	if err != nil {
+		h.redirectWithError(w, r, redirectUri, request.State, err)
+		return
+	}
+
+	if r.PostForm.Get("decision") != "approve" {
+		h.redirectWithError(w, r, redirectUri, request.State, models.NewOAuthError(models.OAuthErrAccessDenied, "the user denied the request"))
+		return
+	}
+
+	h.authorize(w, r, user, client, &request, redirectUri, scopes)
+}
+
+// PostToken exchanges authorization codes and refresh tokens for access tokens
+func (h *OAuthHandler) PostToken(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	if err := r.ParseForm(); err != nil {
+		h.respondError(w, models.NewOAuthError(models.OAuthErrInvalidRequest, "malformed request body"))
+		return
+	}
+
+	client, err := h.authenticateClient(r)
+	if err != nil {
+		h.respondError(w, err)
+		return
+	}
+
+	var response *models.OAuthTokenResponse
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		response, err = h.oauthSrvc.ExchangeCode(client, r.PostForm.Get("code"), r.PostForm.Get("redirect_uri"), r.PostForm.Get("code_verifier"))
+	case "refresh_token":
+		response, err = h.oauthSrvc.Refresh(client, r.PostForm.Get("refresh_token"), strings.Fields(r.PostForm.Get("scope")))
+	default:
+		err = models.NewOAuthError(models.OAuthErrUnsupportedGrantType, "only authorization_code and refresh_token are supported")
+	}
+	if err != nil {
+		h.respondError(w, err)
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, response)
+}
+
+// PostIntrospect lets confidential apps check whether a token is (still) active and what it grants (rfc 7662)
+func (h *OAuthHandler) PostIntrospect(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	if err := r.ParseForm(); err != nil {
+		h.respondError(w, models.NewOAuthError(models.OAuthErrInvalidRequest, "malformed request body"))
+		return
+	}
+
+	client, err := h.authenticateClient(r)
+	if err != nil {
+		h.respondError(w, err)
+		return
+	}
+	if !client.IsConfidential() {
+		h.respondError(w, models.NewOAuthError(models.OAuthErrInvalidClient, "introspection requires client authentication"))
+		return
+	}
+
+	token := r.PostForm.Get("token")
+	if token == "" {
+		h.respondError(w, models.NewOAuthError(models.OAuthErrInvalidRequest, "missing token"))
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, h.oauthSrvc.Introspect(client, token))
+}
+
+func (h *OAuthHandler) authorize(w http.ResponseWriter, r *http.Request, user *models.User, client *models.OAuthClient, request *models.OAuthAuthorizeRequest, redirectUri string, scopes []string) {
+	code, err := h.oauthSrvc.Authorize(user, client, request, scopes, middlewares.GetAuditOrigin(r))
+	if err != nil {
+		h.redirectWithError(w, r, redirectUri, request.State, err)
+		return
+	}
+
+	params := url.Values{"code": []string{code}}
+	if request.State != "" {
+		params.Set("state", request.State)
+	}
+	http.Redirect(w, r, buildOAuthRedirect(redirectUri, params), http.StatusFound)
+}
+
+func (h *OAuthHandler) resolveClient(request *models.OAuthAuthorizeRequest) (*models.OAuthClient, string, bool) {
+	client, err := h.oauthSrvc.GetClient(request.ClientID)
+	if err != nil {
+		return nil, "", false
+	}
+	redirectUri, ok := client.ResolveRedirectUri(request.RedirectUri)
+	return client, redirectUri, ok
+}
+
+// authenticateClient reads the app's credentials from either the authorization header or the request body, as both are permitted by rfc 6749
+func (h *OAuthHandler) authenticateClient(r *http.Request) (*models.OAuthClient, error) {
+	clientId, secret, ok := r.BasicAuth()
+	if ok {
+		if r.PostForm.Get("client_secret") != "" {
+			return nil, models.NewOAuthError(models.OAuthErrInvalidRequest, "multiple client authentication methods used")
+		}
+		// credentials are form-encoded before being put into the header
+		var err1, err2 error
+		clientId, err1 = url.QueryUnescape(clientId)
+		secret, err2 = url.QueryUnescape(secret)
+		if err1 != nil || err2 != nil {
+			return nil, models.NewOAuthError(models.OAuthErrInvalidClient, "malformed client credentials")
+		}
+	} else {
+		clientId, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	return h.oauthSrvc.AuthenticateClient(clientId, secret)
+}
+
+// redirectToLogin asks the user to log in and resumes the authorization request afterwards
+func (h *OAuthHandler) redirectToLogin(w http.ResponseWriter, r *http.Request) {
+	encoded, err := h.config.Security.SecureCookie.Encode(models.ReturnToCookieKey, r.URL.RequestURI())
+	if err != nil {
+		h.renderError(w, r, http.StatusInternalServerError, "internal server error")
+		return
+	}
+	http.SetCookie(w, h.config.CreateLaxCookieWithMaxAge(models.ReturnToCookieKey, encoded, "/", int(oauthLoginTimeout.Seconds())))
+	if _, err := r.Cookie(models.AuthCookieKey); err == nil {
+		// the auth cookie was sent along, but is not valid anymore, so the login page must not consider the user logged in
+		http.SetCookie(w, h.config.GetClearCookie(models.AuthCookieKey, "/"))
+	}
+
+	// apps send users here from another site, so the (same-site strict) auth cookie might just have been withheld,
+	// which is why we let the client navigate to the login page by itself, from where logged in users are sent back right away
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, `<!DOCTYPE html><html><head><meta http-equiv="refresh" content="0;url=%s/login"></head></html>`, template.HTMLEscapeString(h.config.Server.BasePath))
+}
+
+func (h *OAuthHandler) redirectWithError(w http.ResponseWriter, r *http.Request, redirectUri, state string, err error) {
+	oauthErr, ok := err.(*models.OAuthError)
+	if !ok {
+		logbuch.Error("failed to process oauth authorization request – %v", err)
+		oauthErr = models.NewOAuthError(models.OAuthErrServerError, "")
+	}
+
+	params := url.Values{"error": []string{oauthErr.Code}}
+	if oauthErr.Description != "" {
+		params.Set("error_description", oauthErr.Description)
+	}
+	if state != "" {
+		params.Set("state", state)
+	}
+	http.Redirect(w, r, buildOAuthRedirect(redirectUri, params), http.StatusFound)
+}
+
+func (h *OAuthHandler) respondError(w http.ResponseWriter, err error) {
+	oauthErr, ok := err.(*models.OAuthError)
+	if !ok {
+		logbuch.Error("failed to process oauth token request – %v", err)
+		utils.RespondJSON(w, http.StatusInternalServerError, models.NewOAuthError(models.OAuthErrServerError, ""))
+		return
+	}
+	if oauthErr.Code == models.OAuthErrInvalidClient {
+		w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+		utils.RespondJSON(w, http.StatusUnauthorized, oauthErr)
+		return
+	}
+	utils.RespondJSON(w, http.StatusBadRequest, oauthErr)
+}
+
+func (h *OAuthHandler) renderError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	w.WriteHeader(status)
+	templates[conf.ErrorTemplate].Execute(w, (&view.ErrorViewModel{CsrfToken: middlewares.GetCsrfToken(r)}).WithError(message))
+}
+
+// buildOAuthRedirect adds parameters to a (registered, thus valid) redirect uri, keeping the query it might already have
+func buildOAuthRedirect(redirectUri string, params url.Values) string {
+	u, _ := url.Parse(redirectUri)
+	query := u.Query()
+	for k, v := range params {
+		query[k] = v
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
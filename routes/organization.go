@@ -0,0 +1,375 @@
+package routes
+
+import (
+	"fmt"
+	"github.com/emvi/logbuch"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/schema"
+	conf "github.com/muety/broilerplate/config"
+	"github.com/muety/broilerplate/middlewares"
+	"github.com/muety/broilerplate/models"
+	"github.com/muety/broilerplate/models/view"
+	"github.com/muety/broilerplate/services"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type OrganizationHandler struct {
+	config           *conf.Config
+	userSrvc         services.IUserService
+	sessionSrvc      services.ISessionService
+	apiTokenSrvc     services.IApiTokenService
+	clientCertSrvc   services.IClientCertificateService
+	oauthSrvc        services.IOAuthService
+	organizationSrvc services.IOrganizationService
+}
+
+var organizationDecoder = schema.NewDecoder()
+
+func NewOrganizationHandler(userService services.IUserService, sessionService services.ISessionService, apiTokenService services.IApiTokenService, organizationService services.IOrganizationService, clientCertificateService services.IClientCertificateService, oauthService services.IOAuthService) *OrganizationHandler {
+	return &OrganizationHandler{
+		config:           conf.Get(),
+		userSrvc:         userService,
+		sessionSrvc:      sessionService,
+		apiTokenSrvc:     apiTokenService,
+		clientCertSrvc:   clientCertificateService,
+		oauthSrvc:        oauthService,
+		organizationSrvc: organizationService,
+	}
+}
+
+func (h *OrganizationHandler) RegisterRoutes(router *mux.Router) {
+	r1 := router.PathPrefix("/organizations").Subrouter()
+	r1.Use(
+		middlewares.NewAuthenticateMiddleware(h.userSrvc, h.sessionSrvc, h.apiTokenSrvc, h.clientCertSrvc, h.oauthSrvc).WithRedirectTarget(defaultErrorRedirectTarget()).Handler,
+		middlewares.NewOrganizationMiddleware(h.organizationSrvc).Handler,
+	)
+	r1.Path("").Methods(http.MethodGet).HandlerFunc(h.GetIndex)
+	r1.Path("").Methods(http.MethodPost).HandlerFunc(h.PostCreate)
+	r1.Path("/switch").Methods(http.MethodPost).HandlerFunc(h.PostSwitch)
+	r1.Path("/rename").Methods(http.MethodPost).HandlerFunc(h.PostRename)
+	r1.Path("/delete").Methods(http.MethodPost).HandlerFunc(h.PostDelete)
+	r1.Path("/leave").Methods(http.MethodPost).HandlerFunc(h.PostLeave)
+	r1.Path("/members/role").Methods(http.MethodPost).HandlerFunc(h.PostUpdateMemberRole)
+	r1.Path("/members/remove").Methods(http.MethodPost).HandlerFunc(h.PostRemoveMember)
+	r1.Path("/invitations").Methods(http.MethodPost).HandlerFunc(h.PostInvite)
+	r1.Path("/invitations/delete").Methods(http.MethodPost).HandlerFunc(h.PostDeleteInvitation)
+	r1.Path("/join").Methods(http.MethodGet).HandlerFunc(h.GetJoin)
+	r1.Path("/join").Methods(http.MethodPost).HandlerFunc(h.PostJoin)
+}
+
+func (h *OrganizationHandler) GetIndex(w http.ResponseWriter, r *http.Request) {
+	if h.config.IsDev() {
+		loadTemplates()
+	}
+	templates[conf.OrganizationsTemplate].Execute(w, h.buildViewModel(r))
+}
+
+func (h *OrganizationHandler) PostCreate(w http.ResponseWriter, r *http.Request) {
+	user := middlewares.GetPrincipal(r)
+
+	var createRequest models.OrganizationCreateRequest
+	if err := r.ParseForm(); err != nil {
+		h.redirectWithError(w, r, "missing parameters")
+		return
+	}
+	if err := organizationDecoder.Decode(&createRequest, r.PostForm); err != nil {
+		h.redirectWithError(w, r, "missing parameters")
+		return
+	}
+	if !createRequest.IsValid() {
+		h.redirectWithError(w, r, "invalid name")
+		return
+	}
+
+	if _, err := h.organizationSrvc.Create(user, createRequest.Name); err != nil {
+		logbuch.Error("failed to create organization for user %s – %v", user.ID, err)
+		h.redirectWithError(w, r, "failed to create organization")
+		return
+	}
+
+	h.redirectWithSuccess(w, r, "organization created successfully")
+}
+
+func (h *OrganizationHandler) PostSwitch(w http.ResponseWriter, r *http.Request) {
+	user := middlewares.GetPrincipal(r)
+
+	if err := r.ParseForm(); err != nil {
+		h.redirectWithError(w, r, "missing parameters")
+		return
+	}
+
+	if err := h.organizationSrvc.Switch(user, r.PostForm.Get("organization_id")); err != nil {
+		h.redirectWithError(w, r, h.errorMessage(err, "failed to switch organization"))
+		return
+	}
+
+	// go back to the page the switch was triggered from, e.g. via the menu, while never redirecting to another host
+	target := fmt.Sprintf("%s/organizations", h.config.Server.BasePath)
+	if referer, err := url.Parse(r.Referer()); err == nil && strings.HasPrefix(referer.Path, "/") && !strings.HasPrefix(referer.Path, "//") {
+		target = (&url.URL{Path: referer.Path}).String()
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+func (h *OrganizationHandler) PostRename(w http.ResponseWriter, r *http.Request) {
+	membership := middlewares.GetMembership(r)
+	if membership == nil {
+		h.redirectWithError(w, r, services.ErrNotAMember.Error())
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		h.redirectWithError(w, r, "missing parameters")
+		return
+	}
+	name := r.PostForm.Get("name")
+	if !models.ValidateOrganizationName(name) {
+		h.redirectWithError(w, r, "invalid name")
+		return
+	}
+
+	if err := h.organizationSrvc.Rename(membership, name); err != nil {
+		h.redirectWithError(w, r, h.errorMessage(err, "failed to rename organization"))
+		return
+	}
+
+	h.redirectWithSuccess(w, r, "organization renamed successfully")
+}
+
+func (h *OrganizationHandler) PostDelete(w http.ResponseWriter, r *http.Request) {
+	membership := middlewares.GetMembership(r)
+	if membership == nil {
+		h.redirectWithError(w, r, services.ErrNotAMember.Error())
+		return
+	}
+
+	if err := h.organizationSrvc.Delete(membership); err != nil {
+		h.redirectWithError(w, r, h.errorMessage(err, "failed to delete organization"))
+		return
+	}
+
+	logbuch.Info("organization %s deleted by %s", membership.OrganizationID, membership.UserID)
+	h.redirectWithSuccess(w, r, "organization deleted successfully")
+}
+
+func (h *OrganizationHandler) PostLeave(w http.ResponseWriter, r *http.Request) {
+	membership := middlewares.GetMembership(r)
+	if membership == nil {
+		h.redirectWithError(w, r, services.ErrNotAMember.Error())
+		return
+	}
+
+	if err := h.organizationSrvc.Leave(membership); err != nil {
+		h.redirectWithError(w, r, h.errorMessage(err, "failed to leave organization"))
+		return
+	}
+
+	h.redirectWithSuccess(w, r, "you left the organization")
+}
+
+func (h *OrganizationHandler) PostUpdateMemberRole(w http.ResponseWriter, r *http.Request) {
+	membership := middlewares.GetMembership(r)
+	if membership == nil {
+		h.redirectWithError(w, r, services.ErrNotAMember.Error())
+		return
+	}
+
+	var updateRequest models.MembershipUpdateRequest
+	if err := r.ParseForm(); err != nil {
+		h.redirectWithError(w, r, "missing parameters")
+		return
+	}
+	if err := organizationDecoder.Decode(&updateRequest, r.PostForm); err != nil || !updateRequest.IsValid() {
+		h.redirectWithError(w, r, "invalid parameters")
+		return
+	}
+
+	if err := h.organizationSrvc.UpdateRole(membership, updateRequest.UserID, updateRequest.Role); err != nil {
+		h.redirectWithError(w, r, h.errorMessage(err, "failed to update role"))
+		return
+	}
+
+	h.redirectWithSuccess(w, r, "role updated successfully")
+}
+
+func (h *OrganizationHandler) PostRemoveMember(w http.ResponseWriter, r *http.Request) {
+	membership := middlewares.GetMembership(r)
+	if membership == nil {
+		h.redirectWithError(w, r, services.ErrNotAMember.Error())
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		h.redirectWithError(w, r, "missing parameters")
+		return
+	}
+
+	if err := h.organizationSrvc.RemoveMember(membership, r.PostForm.Get("user_id")); err != nil {
+		h.redirectWithError(w, r, h.errorMessage(err, "failed to remove member"))
+		return
+	}
+
+	h.redirectWithSuccess(w, r, "member removed successfully")
+}
+
+func (h *OrganizationHandler) PostInvite(w http.ResponseWriter, r *http.Request) {
+	if h.config.IsDev() {
+		loadTemplates()
+	}
+
+	user := middlewares.GetPrincipal(r)
+	membership := middlewares.GetMembership(r)
+	if membership == nil {
+		h.redirectWithError(w, r, services.ErrNotAMember.Error())
+		return
+	}
+
+	var inviteRequest models.OrganizationInviteRequest
+	if err := r.ParseForm(); err != nil {
+		h.redirectWithError(w, r, "missing parameters")
+		return
+	}
+	if err := organizationDecoder.Decode(&inviteRequest, r.PostForm); err != nil {
+		h.redirectWithError(w, r, "missing parameters")
+		return
+	}
+	if !inviteRequest.IsValid() {
+		h.redirectWithError(w, r, "invalid e-mail address or role")
+		return
+	}
+
+	_, link, err := h.organizationSrvc.Invite(membership, user, inviteRequest.Email, inviteRequest.Role)
+	if err != nil {
+		h.redirectWithError(w, r, h.errorMessage(err, "failed to create invitation"))
+		return
+	}
+
+	message := "invitation created successfully"
+	if h.config.Mail.Enabled {
+		message = fmt.Sprintf("invitation sent to %s", inviteRequest.Email)
+	}
+
+	vm := h.buildViewModel(r).WithSuccess(message)
+	vm.NewLink = link
+	templates[conf.OrganizationsTemplate].Execute(w, vm)
+}
+
+func (h *OrganizationHandler) PostDeleteInvitation(w http.ResponseWriter, r *http.Request) {
+	membership := middlewares.GetMembership(r)
+	if membership == nil {
+		h.redirectWithError(w, r, services.ErrNotAMember.Error())
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		h.redirectWithError(w, r, "missing parameters")
+		return
+	}
+
+	if err := h.organizationSrvc.DeleteInvitation(membership, r.PostForm.Get("invitation_id")); err != nil {
+		h.redirectWithError(w, r, h.errorMessage(err, "failed to delete invitation"))
+		return
+	}
+
+	h.redirectWithSuccess(w, r, "invitation deleted successfully")
+}
+
+// GetJoin asks the user to confirm joining the organization they were invited to
+func (h *OrganizationHandler) GetJoin(w http.ResponseWriter, r *http.Request) {
+	if h.config.IsDev() {
+		loadTemplates()
+	}
+
+	token := r.URL.Query().Get("token")
+	invitation, err := h.organizationSrvc.GetInvitation(token)
+	if err != nil {
+		h.redirectWithError(w, r, err.Error())
+		return
+	}
+
+	vm := h.buildViewModel(r)
+	vm.Join = invitation
+	vm.JoinToken = token
+	templates[conf.OrganizationsTemplate].Execute(w, vm)
+}
+
+func (h *OrganizationHandler) PostJoin(w http.ResponseWriter, r *http.Request) {
+	user := middlewares.GetPrincipal(r)
+
+	if err := r.ParseForm(); err != nil {
+		h.redirectWithError(w, r, "missing parameters")
+		return
+	}
+
+	membership, err := h.organizationSrvc.AcceptInvitation(user, r.PostForm.Get("token"))
+	if err != nil {
+		h.redirectWithError(w, r, h.errorMessage(err, "failed to join organization"))
+		return
+	}
+
+	h.redirectWithSuccess(w, r, fmt.Sprintf("you joined %s", membership.Organization.Name))
+}
+
+func (h *OrganizationHandler) redirectWithSuccess(w http.ResponseWriter, r *http.Request, message string) {
+	http.Redirect(w, r, fmt.Sprintf("%s/organizations?success=%s", h.config.Server.BasePath, url.QueryEscape(message)), http.StatusFound)
+}
+
+func (h *OrganizationHandler) redirectWithError(w http.ResponseWriter, r *http.Request, message string) {
+	http.Redirect(w, r, fmt.Sprintf("%s/organizations?error=%s", h.config.Server.BasePath, url.QueryEscape(message)), http.StatusFound)
+}
+
+// errorMessage passes the service's errors on to the user, while not leaking any unexpected ones
+func (h *OrganizationHandler) errorMessage(err error, fallback string) string {
+	switch err {
+	case services.ErrNotAMember, services.ErrAlreadyMember, services.ErrInsufficientOrgRole, services.ErrLastOwner, services.ErrOrgInvitationInvalid, services.ErrOrgInvitationExpired, services.ErrOrgInvitationEmail:
+		return err.Error()
+	}
+	logbuch.Error("%s – %v", fallback, err)
+	return fallback
+}
+
+func (h *OrganizationHandler) buildViewModel(r *http.Request) *view.OrganizationsViewModel {
+	user := middlewares.GetPrincipal(r)
+	membership := middlewares.GetMembership(r)
+
+	vm := &view.OrganizationsViewModel{
+		User:        user,
+		Active:      membership,
+		Roles:       models.OrgRoles,
+		MailEnabled: h.config.Mail.Enabled,
+		Success:     r.URL.Query().Get("success"),
+		Error:       r.URL.Query().Get("error"),
+		CsrfToken:   middlewares.GetCsrfToken(r),
+	}
+
+	if memberships, err := h.organizationSrvc.GetMemberships(user); err == nil {
+		vm.Memberships = memberships
+	} else {
+		logbuch.Error("failed to fetch memberships of user %s – %v", user.ID, err)
+		vm.WithError("failed to fetch organizations")
+	}
+
+	if membership == nil {
+		return vm
+	}
+
+	if members, err := h.organizationSrvc.GetMembers(membership); err == nil {
+		vm.Members = members
+	} else {
+		logbuch.Error("failed to fetch members of organization %s – %v", membership.OrganizationID, err)
+		vm.WithError("failed to fetch members")
+	}
+
+	if membership.CanManage() {
+		if invitations, err := h.organizationSrvc.GetInvitations(membership); err == nil {
+			vm.Invitations = invitations
+		} else {
+			logbuch.Error("failed to fetch invitations of organization %s – %v", membership.OrganizationID, err)
+			vm.WithError("failed to fetch invitations")
+		}
+	}
+
+	return vm
+}
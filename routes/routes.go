@@ -2,6 +2,9 @@ package routes
 
 import (
 	"fmt"
+	"github.com/muety/broilerplate/middlewares"
+	"github.com/muety/broilerplate/models"
+	"github.com/muety/broilerplate/services"
 	"github.com/muety/broilerplate/views"
 	"html/template"
 	"net/http"
@@ -15,7 +18,15 @@ type action func(w http.ResponseWriter, r *http.Request) (int, string, string)
 
 var templates map[string]*template.Template
 
-func Init() {
+// services backing template funcs, which are shared by all views
+var (
+	roleSrvc         services.IRoleService
+	organizationSrvc services.IOrganizationService
+)
+
+func Init(roleService services.IRoleService, organizationService services.IOrganizationService) {
+	roleSrvc = roleService
+	organizationSrvc = organizationService
 	loadTemplates()
 }
 
@@ -53,6 +64,26 @@ func DefaultTemplateFuncs() template.FuncMap {
 		"avatarUrlTemplate": func() string {
 			return config.Get().App.AvatarURLTemplate
 		},
+		"hasPermission": func(user *models.User, permission string) bool {
+			return roleSrvc != nil && roleSrvc.HasPermission(user, permission)
+		},
+		"memberships": func(user *models.User) []*models.Membership {
+			if organizationSrvc == nil || user == nil {
+				return []*models.Membership{}
+			}
+			memberships, _ := organizationSrvc.GetMemberships(user)
+			return memberships
+		},
+		"activeMembership": func(user *models.User) *models.Membership {
+			if organizationSrvc == nil || user == nil {
+				return nil
+			}
+			membership, _ := organizationSrvc.GetActive(user)
+			return membership
+		},
+		"csrfField": func(token string) template.HTML {
+			return template.HTML(fmt.Sprintf(`<input type="hidden" name="%s" value="%s">`, middlewares.CsrfFormField, template.HTMLEscapeString(token)))
+		},
 	}
 }
 
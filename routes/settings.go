@@ -0,0 +1,313 @@
+package routes
+
+import (
+	"fmt"
+	"github.com/emvi/logbuch"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/schema"
+	conf "github.com/muety/broilerplate/config"
+	"github.com/muety/broilerplate/middlewares"
+	"github.com/muety/broilerplate/models"
+	"github.com/muety/broilerplate/models/view"
+	"github.com/muety/broilerplate/services"
+	"github.com/muety/broilerplate/utils"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type SettingsHandler struct {
+	config         *conf.Config
+	userSrvc       services.IUserService
+	sessionSrvc    services.ISessionService
+	apiTokenSrvc   services.IApiTokenService
+	clientCertSrvc services.IClientCertificateService
+	oauthSrvc      services.IOAuthService
+	verifySrvc     services.IEmailVerificationService
+	orgSrvc        services.IOrganizationService
+	exportSrvc     services.IDataExportService
+}
+
+var userDataUpdateDecoder = schema.NewDecoder()
+var credentialsDecoder = schema.NewDecoder()
+var accountDeleteDecoder = schema.NewDecoder()
+
+func NewSettingsHandler(userService services.IUserService, sessionService services.ISessionService, apiTokenService services.IApiTokenService, emailVerificationService services.IEmailVerificationService, organizationService services.IOrganizationService, dataExportService services.IDataExportService, clientCertificateService services.IClientCertificateService, oauthService services.IOAuthService) *SettingsHandler {
+	return &SettingsHandler{
+		config:         conf.Get(),
+		userSrvc:       userService,
+		sessionSrvc:    sessionService,
+		apiTokenSrvc:   apiTokenService,
+		clientCertSrvc: clientCertificateService,
+		oauthSrvc:      oauthService,
+		verifySrvc:     emailVerificationService,
+		orgSrvc:        organizationService,
+		exportSrvc:     dataExportService,
+	}
+}
+
+func (h *SettingsHandler) RegisterRoutes(router *mux.Router) {
+	r1 := router.PathPrefix("/settings").Subrouter()
+	r1.Use(middlewares.NewAuthenticateMiddleware(h.userSrvc, h.sessionSrvc, h.apiTokenSrvc, h.clientCertSrvc, h.oauthSrvc).WithRedirectTarget(defaultErrorRedirectTarget()).Handler)
+	r1.Path("").Methods(http.MethodGet).HandlerFunc(h.GetIndex)
+	r1.Path("/account").Methods(http.MethodPost).HandlerFunc(h.PostUpdateAccount)
+	r1.Path("/email/resend").Methods(http.MethodPost).HandlerFunc(h.PostResendVerification)
+	r1.Path("/password").Methods(http.MethodPost).HandlerFunc(h.PostChangePassword)
+	r1.Path("/api-key/reset").Methods(http.MethodPost).HandlerFunc(h.PostResetApiKey)
+	r1.Path("/export").Methods(http.MethodGet).HandlerFunc(h.GetExport)
+	r1.Path("/delete").Methods(http.MethodPost).HandlerFunc(h.PostDeleteAccount)
+}
+
+func (h *SettingsHandler) GetIndex(w http.ResponseWriter, r *http.Request) {
+	if h.config.IsDev() {
+		loadTemplates()
+	}
+	templates[conf.SettingsTemplate].Execute(w, h.buildViewModel(r, middlewares.GetPrincipal(r)))
+}
+
+// PostUpdateAccount saves time zone and notification preferences right away, while a new e-mail address only becomes effective once confirmed
+func (h *SettingsHandler) PostUpdateAccount(w http.ResponseWriter, r *http.Request) {
+	user := middlewares.GetPrincipal(r)
+
+	var updateRequest models.UserDataUpdate
+	if err := r.ParseForm(); err != nil {
+		h.redirectWithError(w, r, "missing parameters")
+		return
+	}
+	if err := userDataUpdateDecoder.Decode(&updateRequest, r.PostForm); err != nil {
+		h.redirectWithError(w, r, "missing parameters")
+		return
+	}
+	updateRequest.Email = strings.TrimSpace(updateRequest.Email)
+	if !models.ValidateEmail(updateRequest.Email) {
+		h.redirectWithError(w, r, "invalid e-mail address")
+		return
+	}
+	if !updateRequest.IsValid() {
+		h.redirectWithError(w, r, "invalid time zone")
+		return
+	}
+	if updateRequest.Email == "" && user.Email != "" {
+		h.redirectWithError(w, r, "your e-mail address can not be removed")
+		return
+	}
+
+	emailChanged := updateRequest.Email != "" && !strings.EqualFold(updateRequest.Email, user.Email) && !strings.EqualFold(updateRequest.Email, user.PendingEmail)
+	if emailChanged {
+		if existing, err := h.userSrvc.GetUserByEmail(updateRequest.Email); err == nil && existing.ID != user.ID {
+			h.redirectWithError(w, r, "e-mail address already in use")
+			return
+		}
+	}
+
+	user.Location = updateRequest.Location
+	user.ReportsWeekly = updateRequest.ReportsWeekly
+	user.NotifyNewLogins = updateRequest.NotifyNewLogins
+
+	var err error
+	if emailChanged {
+		// also persists the remaining changes
+		err = h.verifySrvc.RequestChange(user, updateRequest.Email)
+	} else {
+		_, err = h.userSrvc.Update(user)
+	}
+	if err != nil {
+		logbuch.Error("failed to update account settings for user %s – %v", user.ID, err)
+		h.redirectWithError(w, r, "failed to save settings")
+		return
+	}
+
+	message := "settings saved successfully"
+	if emailChanged && h.config.Mail.Enabled {
+		message = "settings saved, please confirm your new e-mail address using the link we sent you"
+	}
+	h.redirectWithSuccess(w, r, message)
+}
+
+func (h *SettingsHandler) PostResendVerification(w http.ResponseWriter, r *http.Request) {
+	user := middlewares.GetPrincipal(r)
+
+	if !h.config.Mail.Enabled {
+		h.redirectWithError(w, r, "mailing is disabled on this server")
+		return
+	}
+	if user.EmailVerified && user.PendingEmail == "" {
+		h.redirectWithError(w, r, "your e-mail address is already confirmed")
+		return
+	}
+
+	if err := h.verifySrvc.Resend(user); err != nil {
+		logbuch.Error("failed to resend e-mail verification to %s – %v", user.ID, err)
+		h.redirectWithError(w, r, "failed to send confirmation mail")
+		return
+	}
+
+	h.redirectWithSuccess(w, r, "confirmation mail sent, unless one was sent just recently")
+}
+
+// PostChangePassword sets a new password after verifying the current one and logs the user out on all other devices
+func (h *SettingsHandler) PostChangePassword(w http.ResponseWriter, r *http.Request) {
+	user := middlewares.GetPrincipal(r)
+
+	var credentials models.CredentialsReset
+	if err := r.ParseForm(); err != nil {
+		h.redirectWithError(w, r, "missing parameters")
+		return
+	}
+	if err := credentialsDecoder.Decode(&credentials, r.PostForm); err != nil {
+		h.redirectWithError(w, r, "missing parameters")
+		return
+	}
+	if !utils.CompareBcrypt(user.Password, credentials.PasswordOld, h.config.Security.PasswordSalt) {
+		h.redirectWithError(w, r, "invalid current password")
+		return
+	}
+	if !credentials.IsValid() {
+		h.redirectWithError(w, r, "new password is too short or doesn't match")
+		return
+	}
+
+	hash, err := utils.HashBcrypt(credentials.PasswordNew, h.config.Security.PasswordSalt)
+	if err != nil {
+		h.redirectWithError(w, r, "failed to set new password")
+		return
+	}
+	user.Password = hash
+	if _, err := h.userSrvc.Update(user); err != nil {
+		logbuch.Error("failed to change password of user %s – %v", user.ID, err)
+		h.redirectWithError(w, r, "failed to save new password")
+		return
+	}
+	services.PublishAuditEvent(models.NewAuditEvent(models.AuditPasswordChange, middlewares.GetAuditOrigin(r), user.ID, ""))
+
+	h.revokeOtherSessions(r, user)
+	h.redirectWithSuccess(w, r, "password changed successfully, you were logged out on all other devices")
+}
+
+func (h *SettingsHandler) PostResetApiKey(w http.ResponseWriter, r *http.Request) {
+	if h.config.IsDev() {
+		loadTemplates()
+	}
+
+	user := middlewares.GetPrincipal(r)
+
+	key, _, err := h.userSrvc.ResetApiKey(user, middlewares.GetAuditOrigin(r))
+	if err != nil {
+		logbuch.Error("failed to reset api key for user %s – %v", user.ID, err)
+		h.redirectWithError(w, r, "failed to reset api key")
+		return
+	}
+
+	vm := h.buildViewModel(r, user).WithSuccess("api key reset successfully")
+	vm.NewApiKey = key
+	templates[conf.SettingsTemplate].Execute(w, vm)
+}
+
+// GetExport hands out all data stored about the user as a json file download
+func (h *SettingsHandler) GetExport(w http.ResponseWriter, r *http.Request) {
+	user := middlewares.GetPrincipal(r)
+
+	export, err := h.exportSrvc.Export(user)
+	if err != nil {
+		logbuch.Error("failed to export data of user %s – %v", user.ID, err)
+		h.redirectWithError(w, r, "failed to export your data")
+		return
+	}
+
+	filename := fmt.Sprintf("%s_%s.json", url.PathEscape(user.ID), time.Now().Format("2006-01-02"))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
+	utils.RespondJSON(w, http.StatusOK, export)
+}
+
+// PostDeleteAccount deletes the user's account after asking for their password again, either right away or after the configured grace period
+func (h *SettingsHandler) PostDeleteAccount(w http.ResponseWriter, r *http.Request) {
+	user := middlewares.GetPrincipal(r)
+
+	var deleteRequest models.AccountDeleteRequest
+	if err := r.ParseForm(); err != nil {
+		h.redirectWithError(w, r, "missing parameters")
+		return
+	}
+	if err := accountDeleteDecoder.Decode(&deleteRequest, r.PostForm); err != nil {
+		h.redirectWithError(w, r, "missing parameters")
+		return
+	}
+	if !utils.CompareBcrypt(user.Password, deleteRequest.Password, h.config.Security.PasswordSalt) {
+		h.redirectWithError(w, r, "invalid password")
+		return
+	}
+
+	if ownerships, err := h.orgSrvc.GetSoleOwnerships(user); err != nil {
+		logbuch.Error("failed to fetch organizations of user %s – %v", user.ID, err)
+		h.redirectWithError(w, r, "failed to delete account")
+		return
+	} else if len(ownerships) > 0 {
+		h.redirectWithError(w, r, fmt.Sprintf("please hand over ownership of %s to another member first", ownerships[0].Organization.Name))
+		return
+	}
+
+	if err := h.userSrvc.ScheduleDeletion(user, middlewares.GetAuditOrigin(r)); err != nil {
+		logbuch.Error("failed to delete user %s – %v", user.ID, err)
+		h.redirectWithError(w, r, "failed to delete account")
+		return
+	}
+
+	message := "your account was deleted"
+	if user.IsDeletionScheduled() {
+		if err := h.sessionSrvc.DeleteByUser(user); err != nil {
+			logbuch.Error("failed to revoke sessions of user %s – %v", user.ID, err)
+		}
+		message = fmt.Sprintf("your account will be deleted on %s, log in again until then to cancel the deletion", utils.FormatDateHuman(user.DeletionScheduledAt.T()))
+		logbuch.Info("user %s scheduled their account for deletion", user.ID)
+	} else {
+		logbuch.Info("user %s deleted their account", user.ID)
+	}
+
+	http.SetCookie(w, h.config.GetClearCookie(models.AuthCookieKey, "/"))
+	http.Redirect(w, r, fmt.Sprintf("%s/?success=%s", h.config.Server.BasePath, url.QueryEscape(message)), http.StatusFound)
+}
+
+func (h *SettingsHandler) revokeOtherSessions(r *http.Request, user *models.User) {
+	sessions, err := h.sessionSrvc.GetByUser(user)
+	if err != nil {
+		logbuch.Error("failed to fetch sessions of user %s – %v", user.ID, err)
+		return
+	}
+
+	var currentSessionId string
+	if sessionId, err := utils.ExtractCookieAuth(r, h.config); err == nil {
+		currentSessionId = *sessionId
+	}
+
+	for _, s := range sessions {
+		if s.ID == currentSessionId {
+			continue
+		}
+		if err := h.sessionSrvc.Delete(s); err != nil {
+			logbuch.Error("failed to revoke session of user %s – %v", user.ID, err)
+		}
+	}
+}
+
+func (h *SettingsHandler) redirectWithSuccess(w http.ResponseWriter, r *http.Request, message string) {
+	http.Redirect(w, r, fmt.Sprintf("%s/settings?success=%s", h.config.Server.BasePath, url.QueryEscape(message)), http.StatusFound)
+}
+
+func (h *SettingsHandler) redirectWithError(w http.ResponseWriter, r *http.Request, message string) {
+	http.Redirect(w, r, fmt.Sprintf("%s/settings?error=%s", h.config.Server.BasePath, url.QueryEscape(message)), http.StatusFound)
+}
+
+func (h *SettingsHandler) buildViewModel(r *http.Request, user *models.User) *view.SettingsViewModel {
+	vm := &view.SettingsViewModel{
+		User:        user,
+		MailEnabled: h.config.Mail.Enabled,
+		Success:     r.URL.Query().Get("success"),
+		Error:       r.URL.Query().Get("error"),
+		CsrfToken:   middlewares.GetCsrfToken(r),
+	}
+	if gracePeriod := h.config.Security.GetAccountDeletionGracePeriod(); gracePeriod > 0 {
+		vm.DeletionAt = time.Now().Add(gracePeriod)
+	}
+	return vm
+}
@@ -0,0 +1,99 @@
+package services
+
+import (
+	"errors"
+	"github.com/emvi/logbuch"
+	"github.com/muety/broilerplate/config"
+	"github.com/muety/broilerplate/models"
+	"github.com/muety/broilerplate/repositories"
+	"github.com/muety/broilerplate/utils"
+	uuid "github.com/satori/go.uuid"
+	"strings"
+	"time"
+)
+
+// minimum time between two updates of a token's last used timestamp, to not write to the database on every request
+const apiTokenTouchInterval = 1 * time.Minute
+
+var ErrApiTokenExpired = errors.New("api token expired")
+
+type ApiTokenService struct {
+	config     *config.Config
+	repository repositories.IApiTokenRepository
+}
+
+func NewApiTokenService(apiTokenRepo repositories.IApiTokenRepository) *ApiTokenService {
+	return &ApiTokenService{
+		config:     config.Get(),
+		repository: apiTokenRepo,
+	}
+}
+
+// Create generates a new token and returns its plain value, which is not stored anywhere and can thus only be shown once
+func (srv *ApiTokenService) Create(user *models.User, name string, scopes []string, expiresAt *time.Time) (string, *models.ApiToken, error) {
+	random, err := utils.RandomBytes(32)
+	if err != nil {
+		return "", nil, err
+	}
+	plain := models.ApiTokenPrefix + b64.EncodeToString(random)
+
+	token := &models.ApiToken{
+		ID:        uuid.NewV4().String(),
+		UserID:    user.ID,
+		Name:      name,
+		Prefix:    plain[:len(models.ApiTokenPrefix)+6],
+		TokenHash: utils.HashSha256(plain), // tokens are random and long enough, so a fast, unsalted hash is sufficient
+		Scopes:    strings.Join(scopes, ","),
+		CreatedAt: models.CustomTime(time.Now()),
+	}
+	if expiresAt != nil {
+		t := models.CustomTime(*expiresAt)
+		token.ExpiresAt = &t
+	}
+
+	if _, err := srv.repository.Insert(token); err != nil {
+		return "", nil, err
+	}
+	return plain, token, nil
+}
+
+// GetValidByToken resolves a plain token, unless it has expired, and updates its last used timestamp
+func (srv *ApiTokenService) GetValidByToken(plain string) (*models.ApiToken, error) {
+	if !strings.HasPrefix(plain, models.ApiTokenPrefix) {
+		return nil, errors.New("not an api token")
+	}
+
+	token, err := srv.repository.GetByHash(utils.HashSha256(plain))
+	if err != nil {
+		return nil, err
+	}
+	if token.IsExpired() {
+		return nil, ErrApiTokenExpired
+	}
+
+	if token.LastUsedAt == nil || time.Since(token.LastUsedAt.T()) > apiTokenTouchInterval {
+		now := models.CustomTime(time.Now())
+		token.LastUsedAt = &now
+		if _, err := srv.repository.UpdateLastUsed(token); err != nil {
+			logbuch.Warn("failed to update last used time of api token for user %s – %v", token.UserID, err)
+		}
+	}
+
+	return token, nil
+}
+
+func (srv *ApiTokenService) GetByUser(user *models.User) ([]*models.ApiToken, error) {
+	return srv.repository.GetByUser(user.ID)
+}
+
+func (srv *ApiTokenService) Delete(user *models.User, tokenId string) error {
+	token, err := srv.repository.GetById(tokenId)
+	if err != nil || token.UserID != user.ID {
+		return errors.New("token not found")
+	}
+	return srv.repository.Delete(token)
+}
+
+func (srv *ApiTokenService) DeleteByUser(user *models.User) error {
+	return srv.repository.DeleteByUser(user.ID)
+}
@@ -0,0 +1,164 @@
+package services
+
+import (
+	"context"
+	"github.com/emvi/logbuch"
+	"github.com/leandro-lugaresi/hub"
+	"github.com/muety/broilerplate/config"
+	"github.com/muety/broilerplate/models"
+	"github.com/muety/broilerplate/repositories"
+	"github.com/muety/broilerplate/utils"
+	"sync"
+	"time"
+)
+
+const (
+	auditVerifyBatchSize = 1000
+	auditAppendAttempts  = 5
+)
+
+type AuditService struct {
+	config       *config.Config
+	keyValueSrvc IKeyValueService
+	repository   repositories.IAuditEventRepository
+	hashKey      []byte
+	keyLock      sync.Mutex
+}
+
+func NewAuditService(keyValueService IKeyValueService, auditRepo repositories.IAuditEventRepository) *AuditService {
+	srv := &AuditService{
+		config:       config.Get(),
+		keyValueSrvc: keyValueService,
+		repository:   auditRepo,
+	}
+
+	// events are written one after another, as each of them references its predecessor's hash
+	config.HandleEvents(config.EventBus().Subscribe(0, config.EventAuditRecord), func(m hub.Message) {
+		event, ok := m.Fields[config.FieldPayload].(*models.AuditEvent)
+		if !ok {
+			return
+		}
+		if err := srv.record(event); err != nil {
+			logbuch.Error("failed to write audit event '%s' for %s – %v", event.Action, event.TargetID, err)
+		}
+	})
+
+	return srv
+}
+
+// PublishAuditEvent hands an event over to be written to the audit log asynchronously
+func PublishAuditEvent(event *models.AuditEvent) {
+	config.EventBus().Publish(hub.Message{
+		Name:   config.EventAuditRecord,
+		Fields: map[string]interface{}{config.FieldPayload: event},
+	})
+}
+
+// Search only covers events whose actor or target is a member of the given organization, the same goes for Export
+func (srv *AuditService) Search(orgId string, query *models.AuditEventQuery) ([]*models.AuditEvent, int64, error) {
+	return srv.repository.Search(orgId, query.Normalize())
+}
+
+func (srv *AuditService) Export(orgId string, query *models.AuditEventQuery) ([]*models.AuditEvent, error) {
+	return srv.repository.GetAllByQuery(orgId, query.Normalize())
+}
+
+func (srv *AuditService) GetByUser(user *models.User) ([]*models.AuditEvent, error) {
+	return srv.repository.GetByUser(user.ID)
+}
+
+// Verify recomputes the hash chain, starting from the oldest entry still retained
+func (srv *AuditService) Verify() (*models.AuditChainStatus, error) {
+	status := &models.AuditChainStatus{Intact: true}
+
+	var lastId uint
+	var prevHash *string
+	for {
+		events, err := srv.repository.GetAfter(lastId, auditVerifyBatchSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range events {
+			expected, err := srv.hash(e)
+			if err != nil {
+				return nil, err
+			}
+			if e.Hash != expected || (prevHash != nil && e.PrevHash != *prevHash) {
+				status.Intact = false
+				status.BrokenAt = e.ID
+				return status, nil
+			}
+			status.Checked++
+			prevHash = &e.Hash
+			lastId = e.ID
+		}
+		if len(events) < auditVerifyBatchSize {
+			return status, nil
+		}
+	}
+}
+
+// ScheduleCleanup periodically deletes audit events older than the configured retention period
+func (srv *AuditService) ScheduleCleanup(ctx context.Context, interval time.Duration) {
+	retention := srv.config.Security.GetAuditRetention()
+	if retention <= 0 {
+		return
+	}
+
+	config.RunPeriodically(ctx, interval, func() {
+		if n, err := srv.repository.DeleteByCreatedBefore(time.Now().Add(-retention)); err != nil {
+			logbuch.Error("failed to clean up audit events – %v", err)
+		} else if n > 0 {
+			logbuch.Info("cleaned up %d audit events older than %d days", n, srv.config.Security.AuditRetentionDays)
+		}
+	})
+}
+
+// record appends the event to the chain, whose head is always read from the database, as other instances write to it as well
+func (srv *AuditService) record(event *models.AuditEvent) error {
+	// loaded up front, as the key must not be created while appending holds a transaction
+	if _, err := srv.getHashKey(); err != nil {
+		return err
+	}
+
+	seal := func(e *models.AuditEvent) error {
+		hash, err := srv.hash(e)
+		e.Hash = hash
+		return err
+	}
+
+	for attempt := 1; ; attempt++ {
+		event.ID = 0
+		err := srv.repository.Append(event, seal)
+		if err == nil {
+			return nil
+		}
+		// unless another writer got ahead of us, retrying won't help
+		if latest, latestErr := srv.repository.GetLatest(); latestErr != nil || latest.Hash == event.PrevHash || attempt == auditAppendAttempts {
+			return err
+		}
+	}
+}
+
+// hash computes an entry's keyed hash, so the chain can't simply be recomputed after tampering with it
+func (srv *AuditService) hash(event *models.AuditEvent) (string, error) {
+	key, err := srv.getHashKey()
+	if err != nil {
+		return "", err
+	}
+	return utils.HashHmac(event.Payload(), string(key)), nil
+}
+
+func (srv *AuditService) getHashKey() ([]byte, error) {
+	srv.keyLock.Lock()
+	defer srv.keyLock.Unlock()
+
+	if srv.hashKey == nil {
+		key, err := srv.keyValueSrvc.GetOrCreateSecret(models.AuditKeyKey, 32)
+		if err != nil {
+			return nil, err
+		}
+		srv.hashKey = key
+	}
+	return srv.hashKey, nil
+}
@@ -0,0 +1,74 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/muety/broilerplate/models"
+	"github.com/muety/broilerplate/repositories"
+)
+
+func TestAuditService_SharesChainAcrossInstances(t *testing.T) {
+	setupTestConfig()
+	db := setupTestDb(t, &models.KeyStringValue{}, &models.AuditEvent{})
+	keyValueService := NewKeyValueService(repositories.NewKeyValueRepository(db))
+
+	// two instances writing to the same database, each of them having already seen the chain's head
+	instances := []*AuditService{
+		NewAuditService(keyValueService, repositories.NewAuditEventRepository(db)),
+		NewAuditService(keyValueService, repositories.NewAuditEventRepository(db)),
+	}
+
+	for i := 0; i < 6; i++ {
+		event := models.NewAuditEvent(models.AuditLoginSuccess, &models.AuditOrigin{ActorID: "alice"}, "alice", "")
+		if err := instances[i%2].record(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, srv := range instances {
+		status, err := srv.Verify()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !status.Intact || status.Checked != 6 {
+			t.Errorf("expected intact chain of 6 events, got %+v", status)
+		}
+	}
+
+	// predecessors are unique, so a stale writer can't fork the chain
+	latest, err := repositories.NewAuditEventRepository(db).GetLatest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fork := &models.AuditEvent{Action: models.AuditLoginSuccess, PrevHash: latest.PrevHash, Hash: "forged"}
+	if err := db.Create(fork).Error; err == nil {
+		t.Error("expected second event with the same predecessor to be rejected")
+	}
+}
+
+func TestAuditService_SearchesWithinOrganization(t *testing.T) {
+	setupTestConfig()
+	db := setupTestDb(t, &models.User{}, &models.Organization{}, &models.Membership{}, &models.KeyStringValue{}, &models.AuditEvent{})
+	setupOrganizations(t, db)
+	srv := NewAuditService(NewKeyValueService(repositories.NewKeyValueRepository(db)), repositories.NewAuditEventRepository(db))
+
+	for _, e := range [][2]string{{"alice", "bob"}, {"carol", "carol"}, {"carol", "bob"}, {"", "dave"}} {
+		if err := srv.record(models.NewAuditEvent(models.AuditLoginSuccess, &models.AuditOrigin{ActorID: e[0]}, e[1], "")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// events relating to a member are included, even if another organization's member was involved as well
+	if _, total, err := srv.Search("acme", &models.AuditEventQuery{}); err != nil || total != 2 {
+		t.Errorf("expected 2 events, got %d (%v)", total, err)
+	}
+	if events, err := srv.Export("globex", &models.AuditEventQuery{Action: models.AuditLoginSuccess}); err != nil || len(events) != 2 {
+		t.Errorf("expected 2 events, got %d (%v)", len(events), err)
+	}
+	if _, total, err := srv.Search("acme", &models.AuditEventQuery{UserID: "dave"}); err != nil || total != 0 {
+		t.Errorf("expected no events of non-members, got %d (%v)", total, err)
+	}
+	if _, _, err := srv.Search("", &models.AuditEventQuery{}); err != repositories.ErrMissingTenant {
+		t.Errorf("expected %v, got %v", repositories.ErrMissingTenant, err)
+	}
+}
@@ -0,0 +1,62 @@
+package services
+
+import (
+	"errors"
+	"github.com/muety/broilerplate/config"
+	"github.com/muety/broilerplate/models"
+	"github.com/muety/broilerplate/utils"
+)
+
+var (
+	ErrUnknownUser        = errors.New("unknown user")
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// LocalAuthenticator checks passwords against the bcrypt hashes stored with local accounts
+type LocalAuthenticator struct {
+	config      *config.Config
+	userService IUserService
+}
+
+func NewLocalAuthenticator(userService IUserService) *LocalAuthenticator {
+	return &LocalAuthenticator{
+		config:      config.Get(),
+		userService: userService,
+	}
+}
+
+func (a *LocalAuthenticator) Authenticate(username, password string) (*models.User, error) {
+	user, err := a.userService.GetUserById(username)
+	// directory users always have their passwords checked by the directory, e.g. to have them locked out once removed there
+	if err != nil || user.IsLdapUser() {
+		return nil, ErrUnknownUser
+	}
+	if !utils.CompareBcrypt(user.Password, password, a.config.Security.PasswordSalt) {
+		return nil, ErrInvalidCredentials
+	}
+	return user, nil
+}
+
+// AuthenticatorChain asks one authenticator after another until any of them knows the user and accepts the password
+type AuthenticatorChain struct {
+	authenticators []IAuthenticator
+}
+
+func NewAuthenticatorChain(authenticators ...IAuthenticator) *AuthenticatorChain {
+	return &AuthenticatorChain{authenticators: authenticators}
+}
+
+// Authenticate fails with the most telling error of all authenticators, i.e. rather reports a wrong password or an unavailable backend than an unknown user
+func (c *AuthenticatorChain) Authenticate(username, password string) (*models.User, error) {
+	err := ErrUnknownUser
+	for _, a := range c.authenticators {
+		user, authErr := a.Authenticate(username, password)
+		if authErr == nil {
+			return user, nil
+		}
+		if authErr != ErrUnknownUser && err != ErrInvalidCredentials {
+			err = authErr
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,112 @@
+package services
+
+import (
+	"crypto/x509"
+	"errors"
+	"github.com/emvi/logbuch"
+	"github.com/muety/broilerplate/config"
+	"github.com/muety/broilerplate/models"
+	"github.com/muety/broilerplate/repositories"
+	"time"
+)
+
+// minimum time between two updates of a certificate's last used timestamp, to not write to the database on every request
+const clientCertificateTouchInterval = 1 * time.Minute
+
+var (
+	ErrClientCertificateExists  = errors.New("this certificate is already registered")
+	ErrClientCertificateUnknown = errors.New("unknown client certificate")
+)
+
+type ClientCertificateService struct {
+	config      *config.Config
+	userService IUserService
+	repository  repositories.IClientCertificateRepository
+}
+
+func NewClientCertificateService(userService IUserService, clientCertificateRepo repositories.IClientCertificateRepository) *ClientCertificateService {
+	return &ClientCertificateService{
+		config:      config.Get(),
+		userService: userService,
+		repository:  clientCertificateRepo,
+	}
+}
+
+// GetUserByCertificate resolves the owner of a client certificate, which must have been verified against the client ca before
+func (srv *ClientCertificateService) GetUserByCertificate(cert *x509.Certificate) (*models.User, error) {
+	if registered, err := srv.repository.GetByFingerprint(models.CertificateFingerprint(cert)); err == nil {
+		srv.touch(registered)
+		return srv.userService.GetUserById(registered.UserID)
+	}
+
+	switch srv.config.Server.ClientCertMapping {
+	case config.ClientCertMappingSubject:
+		if user, err := srv.userService.GetUserById(cert.Subject.CommonName); err == nil {
+			return user, nil
+		}
+	case config.ClientCertMappingEmail:
+		for _, email := range cert.EmailAddresses {
+			if user, err := srv.userService.GetUserByEmail(email); err == nil && user.EmailVerified {
+				return user, nil
+			}
+		}
+	}
+
+	return nil, ErrClientCertificateUnknown
+}
+
+func (srv *ClientCertificateService) GetByOrganization(orgId string) ([]*models.ClientCertificate, error) {
+	return srv.repository.GetByOrganization(orgId)
+}
+
+func (srv *ClientCertificateService) GetByUser(user *models.User) ([]*models.ClientCertificate, error) {
+	return srv.repository.GetByUser(user.ID)
+}
+
+func (srv *ClientCertificateService) Create(user *models.User, name, fingerprint string, origin *models.AuditOrigin) (*models.ClientCertificate, error) {
+	fingerprint, ok := models.NormalizeFingerprint(fingerprint)
+	if !ok {
+		return nil, errors.New("invalid fingerprint")
+	}
+	if _, err := srv.repository.GetByFingerprint(fingerprint); err == nil {
+		return nil, ErrClientCertificateExists
+	}
+
+	certificate, err := srv.repository.Insert(&models.ClientCertificate{
+		Fingerprint: fingerprint,
+		UserID:      user.ID,
+		Name:        name,
+		CreatedAt:   models.CustomTime(time.Now()),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	PublishAuditEvent(models.NewAuditEvent(models.AuditClientCertRegister, origin, user.ID, fingerprint))
+	return certificate, nil
+}
+
+// Delete revokes a certificate of one of the given organization's members
+func (srv *ClientCertificateService) Delete(orgId, fingerprint string, origin *models.AuditOrigin) error {
+	certificate, err := srv.repository.GetByOrganizationAndFingerprint(orgId, fingerprint)
+	if err != nil {
+		return err
+	}
+	if err := srv.repository.Delete(certificate); err != nil {
+		return err
+	}
+
+	PublishAuditEvent(models.NewAuditEvent(models.AuditClientCertRevoke, origin, certificate.UserID, fingerprint))
+	return nil
+}
+
+func (srv *ClientCertificateService) touch(certificate *models.ClientCertificate) {
+	if certificate.LastUsedAt != nil && time.Since(certificate.LastUsedAt.T()) <= clientCertificateTouchInterval {
+		return
+	}
+	now := models.CustomTime(time.Now())
+	certificate.LastUsedAt = &now
+	if _, err := srv.repository.UpdateLastUsed(certificate); err != nil {
+		logbuch.Warn("failed to update last used time of client certificate for user %s – %v", certificate.UserID, err)
+	}
+}
@@ -0,0 +1,154 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/emvi/logbuch"
+	"github.com/muety/broilerplate/config"
+	"github.com/muety/broilerplate/models"
+	"gorm.io/gorm"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+var ErrStaticCookieKeys = errors.New("cookie keys are statically configured and can not be rotated")
+
+// CookieKeyService manages the key pairs used for secure cookies. Keys are either taken from the config (static, no rotation),
+// from a JSON file or from the key-value table in the database (default), so that logins survive restarts and are shared across replicas.
+type CookieKeyService struct {
+	config       *config.Config
+	keyValueSrvc IKeyValueService
+	mutex        sync.Mutex
+}
+
+func NewCookieKeyService(keyValueService IKeyValueService) *CookieKeyService {
+	return &CookieKeyService{
+		config:       config.Get(),
+		keyValueSrvc: keyValueService,
+	}
+}
+
+// Load reads the current key ring from its source, initializing it with a fresh key pair if empty, and applies it to the cookie codec
+func (srv *CookieKeyService) Load() error {
+	if srv.config.Security.HasStaticCookieKeys() {
+		return nil
+	}
+
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+
+	keys, err := srv.readKeys()
+	if err != nil {
+		return err
+	}
+
+	if len(keys) == 0 {
+		logbuch.Info("generating new cookie keys")
+		keys = []*models.CookieKey{config.GenerateCookieKey()}
+		if err := srv.writeKeys(keys); err != nil {
+			return err
+		}
+	}
+
+	srv.config.Security.SecureCookie.SetKeys(srv.prune(keys))
+	return nil
+}
+
+// Rotate generates a new key pair to sign cookies with from now on. Previous keys are retired, but remain valid for decoding during the configured grace period.
+func (srv *CookieKeyService) Rotate() error {
+	if srv.config.Security.HasStaticCookieKeys() {
+		return ErrStaticCookieKeys
+	}
+
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+
+	keys, err := srv.readKeys()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, k := range keys {
+		if !k.IsRetired() {
+			k.RetiredAt = &now
+		}
+	}
+
+	keys = srv.prune(append([]*models.CookieKey{config.GenerateCookieKey()}, keys...))
+	if err := srv.writeKeys(keys); err != nil {
+		return err
+	}
+
+	srv.config.Security.SecureCookie.SetKeys(keys)
+	logbuch.Info("rotated cookie keys, %d previous key(s) remain valid for decoding", len(keys)-1)
+	return nil
+}
+
+// ScheduleReload periodically re-reads the key ring to pick up rotations performed by other instances
+func (srv *CookieKeyService) ScheduleReload(ctx context.Context, interval time.Duration) {
+	if srv.config.Security.HasStaticCookieKeys() {
+		return
+	}
+
+	config.RunPeriodically(ctx, interval, func() {
+		if err := srv.Load(); err != nil {
+			logbuch.Error("failed to reload cookie keys – %v", err)
+		}
+	})
+}
+
+func (srv *CookieKeyService) prune(keys []*models.CookieKey) []*models.CookieKey {
+	gracePeriod := srv.config.Security.GetCookieKeyGracePeriod()
+	pruned := make([]*models.CookieKey, 0, len(keys))
+	for _, k := range keys {
+		if !k.IsExpired(gracePeriod) {
+			pruned = append(pruned, k)
+		}
+	}
+	return pruned
+}
+
+func (srv *CookieKeyService) readKeys() ([]*models.CookieKey, error) {
+	var data []byte
+
+	if file := srv.config.Security.CookieKeysFile; file != "" {
+		d, err := ioutil.ReadFile(file)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		data = d
+	} else if kv, err := srv.keyValueSrvc.GetString(models.CookieKeysKey); err == nil {
+		data = []byte(kv.Value)
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		// anything but a missing key ring must not make us generate a new one, which would log out everyone
+		return nil, err
+	}
+
+	var keys []*models.CookieKey
+	if len(data) == 0 {
+		return keys, nil
+	}
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (srv *CookieKeyService) writeKeys(keys []*models.CookieKey) error {
+	data, err := json.Marshal(keys)
+	if err != nil {
+		return err
+	}
+
+	if file := srv.config.Security.CookieKeysFile; file != "" {
+		return ioutil.WriteFile(file, data, 0600)
+	}
+	return srv.keyValueSrvc.PutString(&models.KeyStringValue{
+		Key:   models.CookieKeysKey,
+		Value: string(data),
+	})
+}
@@ -0,0 +1,83 @@
+package services
+
+import (
+	"github.com/muety/broilerplate/models"
+	"time"
+)
+
+// DataExportService collects all data tied to a user from the respective services, modules storing further personal data should be added here
+type DataExportService struct {
+	sessionService      ISessionService
+	apiTokenService     IApiTokenService
+	webauthnService     IWebauthnService
+	roleService         IRoleService
+	organizationService IOrganizationService
+	auditService        IAuditService
+	knownDeviceService  IKnownDeviceService
+	clientCertService   IClientCertificateService
+	oauthService        IOAuthService
+}
+
+func NewDataExportService(sessionService ISessionService, apiTokenService IApiTokenService, webauthnService IWebauthnService, roleService IRoleService, organizationService IOrganizationService, auditService IAuditService, knownDeviceService IKnownDeviceService, clientCertificateService IClientCertificateService, oauthService IOAuthService) *DataExportService {
+	return &DataExportService{
+		sessionService:      sessionService,
+		apiTokenService:     apiTokenService,
+		webauthnService:     webauthnService,
+		roleService:         roleService,
+		organizationService: organizationService,
+		auditService:        auditService,
+		knownDeviceService:  knownDeviceService,
+		clientCertService:   clientCertificateService,
+		oauthService:        oauthService,
+	}
+}
+
+func (srv *DataExportService) Export(user *models.User) (*models.UserDataExport, error) {
+	export := &models.UserDataExport{
+		ExportedAt: models.CustomTime(time.Now()),
+		User:       models.NewUserExport(user),
+		Roles:      []string{},
+	}
+
+	roles, err := srv.roleService.GetByUser(user)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range roles {
+		export.Roles = append(export.Roles, r.Name)
+	}
+
+	if export.Memberships, err = srv.organizationService.GetMemberships(user); err != nil {
+		return nil, err
+	}
+	if export.Sessions, err = srv.sessionService.GetByUser(user); err != nil {
+		return nil, err
+	}
+	if export.ApiTokens, err = srv.apiTokenService.GetByUser(user); err != nil {
+		return nil, err
+	}
+	if export.Passkeys, err = srv.webauthnService.GetByUser(user); err != nil {
+		return nil, err
+	}
+	if export.ClientCerts, err = srv.clientCertService.GetByUser(user); err != nil {
+		return nil, err
+	}
+	if export.OAuthGrants, err = srv.oauthService.GetGrantsByUser(user); err != nil {
+		return nil, err
+	}
+	if export.Devices, err = srv.knownDeviceService.GetByUser(user); err != nil {
+		return nil, err
+	}
+	if export.AuditEvents, err = srv.auditService.GetByUser(user); err != nil {
+		return nil, err
+	}
+	for _, e := range export.AuditEvents {
+		// where and from which device others acted on the user's account is not the user's data
+		if e.ActorID != user.ID {
+			e.IP = ""
+			e.UserAgent = ""
+		}
+	}
+
+	return export, nil
+}
@@ -0,0 +1,146 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/emvi/logbuch"
+	"github.com/muety/broilerplate/config"
+	"github.com/muety/broilerplate/models"
+	"github.com/muety/broilerplate/repositories"
+	"github.com/muety/broilerplate/utils"
+	"time"
+)
+
+const (
+	emailVerificationTtl = 48 * time.Hour
+	// minimum time between two verification mails to the same user, to not let anyone flood a mailbox
+	emailVerificationResendInterval = 5 * time.Minute
+)
+
+var (
+	ErrEmailNotVerified        = errors.New("please verify your e-mail address first, check your inbox for a confirmation link")
+	ErrEmailVerificationFailed = errors.New("invalid or expired confirmation link")
+)
+
+type EmailVerificationService struct {
+	config      *config.Config
+	userService IUserService
+	mailService IMailService
+	repository  repositories.IEmailVerificationRepository
+}
+
+func NewEmailVerificationService(userService IUserService, mailService IMailService, verificationRepo repositories.IEmailVerificationRepository) *EmailVerificationService {
+	return &EmailVerificationService{
+		config:      config.Get(),
+		userService: userService,
+		mailService: mailService,
+		repository:  verificationRepo,
+	}
+}
+
+// Send issues a new confirmation token for the given address (replacing previous ones) and mails it asynchronously
+func (srv *EmailVerificationService) Send(user *models.User, email string) error {
+	if err := srv.repository.DeleteByUser(user.ID); err != nil {
+		return err
+	}
+
+	random, err := utils.RandomBytes(32)
+	if err != nil {
+		return err
+	}
+	token := b64.EncodeToString(random)
+
+	if _, err := srv.repository.Insert(&models.EmailVerification{
+		TokenHash: utils.HashSha256(token),
+		UserID:    user.ID,
+		Email:     email,
+		CreatedAt: models.CustomTime(time.Now()),
+		ExpiresAt: models.CustomTime(time.Now().Add(emailVerificationTtl)),
+	}); err != nil {
+		return err
+	}
+
+	config.RunInBackground(func() {
+		link := fmt.Sprintf("%s/verify-email?token=%s", srv.config.Server.GetPublicUrl(), token)
+		if err := srv.mailService.SendEmailVerification(user, email, link); err != nil {
+			logbuch.Error("failed to send e-mail verification mail to %s – %v", user.ID, err)
+		} else {
+			logbuch.Info("sent e-mail verification mail to %s", user.ID)
+		}
+	})
+
+	return nil
+}
+
+// Resend sends a new confirmation link for the user's pending or current address, unless one was sent only recently
+func (srv *EmailVerificationService) Resend(user *models.User) error {
+	if latest, err := srv.repository.GetLatestByUser(user.ID); err == nil && time.Since(latest.CreatedAt.T()) < emailVerificationResendInterval {
+		return nil
+	}
+
+	email := user.PendingEmail
+	if email == "" {
+		email = user.Email
+	}
+	if email == "" {
+		return errors.New("no e-mail address to verify")
+	}
+	return srv.Send(user, email)
+}
+
+// RequestChange remembers the new address as pending and asks the user to confirm it, before it replaces the current one
+func (srv *EmailVerificationService) RequestChange(user *models.User, email string) error {
+	if !srv.config.Mail.Enabled {
+		// no way to verify the new address, so apply it right away
+		user.Email = email
+		user.EmailVerified = false
+		user.PendingEmail = ""
+		_, err := srv.userService.Update(user)
+		return err
+	}
+
+	user.PendingEmail = email
+	if _, err := srv.userService.Update(user); err != nil {
+		return err
+	}
+	return srv.Send(user, email)
+}
+
+// Verify consumes the given token and marks the corresponding address as the user's verified e-mail address
+func (srv *EmailVerificationService) Verify(token string) (*models.User, error) {
+	verification, err := srv.repository.GetByHash(utils.HashSha256(token))
+	if err != nil || verification.IsExpired() {
+		return nil, ErrEmailVerificationFailed
+	}
+
+	user, err := srv.userService.GetUserById(verification.UserID)
+	if err != nil {
+		return nil, ErrEmailVerificationFailed
+	}
+
+	if err := srv.repository.DeleteByUser(user.ID); err != nil {
+		return nil, err
+	}
+
+	user.Email = verification.Email
+	user.EmailVerified = true
+	user.PendingEmail = ""
+	return srv.userService.Update(user)
+}
+
+// IsLoginPermitted returns whether the user may log in with regard to the verification status of their e-mail address
+func (srv *EmailVerificationService) IsLoginPermitted(user *models.User) bool {
+	return !srv.config.Security.RequireEmailVerification || user.EmailVerified
+}
+
+// ScheduleCleanup periodically deletes expired verification tokens
+func (srv *EmailVerificationService) ScheduleCleanup(ctx context.Context, interval time.Duration) {
+	config.RunPeriodically(ctx, interval, func() {
+		if n, err := srv.repository.DeleteByExpiresBefore(time.Now()); err != nil {
+			logbuch.Error("failed to clean up expired e-mail verifications – %v", err)
+		} else if n > 0 {
+			logbuch.Info("cleaned up %d expired e-mail verifications", n)
+		}
+	})
+}
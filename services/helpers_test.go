@@ -0,0 +1,77 @@
+package services
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/muety/broilerplate/config"
+	"github.com/muety/broilerplate/models"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+const testPublicUrl = "https://app.example.org"
+
+// userServiceStub only implements what the services under test actually call, anything else panics
+type userServiceStub struct {
+	IUserService
+	users map[string]*models.User
+}
+
+func newUserServiceStub(users ...*models.User) *userServiceStub {
+	stub := &userServiceStub{users: map[string]*models.User{}}
+	for _, u := range users {
+		stub.users[u.ID] = u
+	}
+	return stub
+}
+
+func (s *userServiceStub) GetUserById(id string) (*models.User, error) {
+	if user, ok := s.users[id]; ok {
+		return user, nil
+	}
+	return nil, errors.New("record not found")
+}
+
+func (s *userServiceStub) CreateOrGet(signup *models.Signup) (*models.User, bool, error) {
+	if user, ok := s.users[signup.Username]; ok {
+		return user, false, nil
+	}
+	user := &models.User{ID: signup.Username, Email: signup.Email, Location: signup.Location}
+	s.users[user.ID] = user
+	return user, true, nil
+}
+
+func (s *userServiceStub) Update(user *models.User) (*models.User, error) {
+	s.users[user.ID] = user
+	return user, nil
+}
+
+func setupTestConfig() *config.Config {
+	cfg := &config.Config{}
+	cfg.App.Name = "Broilerplate"
+	cfg.Server.PublicUrl = testPublicUrl
+	cfg.Security.AllowSignup = true
+	config.Set(cfg)
+	return cfg
+}
+
+func setupTestDb(t *testing.T, dst ...interface{}) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every connection would get its own in-memory database otherwise
+	sqlDb, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDb.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqlDb.Close() })
+
+	if err := db.AutoMigrate(dst...); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
@@ -0,0 +1,107 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"github.com/emvi/logbuch"
+	"github.com/muety/broilerplate/config"
+	"github.com/muety/broilerplate/models"
+	"github.com/muety/broilerplate/repositories"
+	"github.com/muety/broilerplate/utils"
+	uuid "github.com/satori/go.uuid"
+	"net/url"
+	"time"
+)
+
+var (
+	ErrInvitationInvalid  = errors.New("invalid invitation")
+	ErrInvitationExpired  = errors.New("invitation has expired")
+	ErrInvitationConsumed = errors.New("invitation has already been used")
+)
+
+type InvitationService struct {
+	config      *config.Config
+	mailService IMailService
+	repository  repositories.IInvitationRepository
+}
+
+func NewInvitationService(mailService IMailService, invitationRepo repositories.IInvitationRepository) *InvitationService {
+	return &InvitationService{
+		config:      config.Get(),
+		mailService: mailService,
+		repository:  invitationRepo,
+	}
+}
+
+// Create issues a new invitation and mails the signup link to the invitee asynchronously, the link is also returned, as the plain token is not stored
+func (srv *InvitationService) Create(inviter *models.User, email string) (*models.Invitation, string, error) {
+	random, err := utils.RandomBytes(32)
+	if err != nil {
+		return nil, "", err
+	}
+	token := b64.EncodeToString(random)
+
+	invitation, err := srv.repository.Insert(&models.Invitation{
+		ID:        uuid.NewV4().String(),
+		TokenHash: utils.HashSha256(token),
+		Email:     email,
+		InviterID: inviter.ID,
+		CreatedAt: models.CustomTime(time.Now()),
+		ExpiresAt: models.CustomTime(time.Now().Add(srv.config.Security.GetInvitationTtl())),
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	link := fmt.Sprintf("%s/signup?invite=%s", srv.config.Server.GetPublicUrl(), url.QueryEscape(token))
+
+	if srv.config.Mail.Enabled {
+		config.RunInBackground(func() {
+			if err := srv.mailService.SendInvitation(inviter, email, link); err != nil {
+				logbuch.Error("failed to send invitation mail from %s – %v", inviter.ID, err)
+			} else {
+				logbuch.Info("sent invitation mail from %s", inviter.ID)
+			}
+		})
+	}
+
+	return invitation, link, nil
+}
+
+func (srv *InvitationService) GetAll() ([]*models.Invitation, error) {
+	return srv.repository.GetAll()
+}
+
+// GetValid resolves the invitation belonging to the given plain token, provided it is neither expired nor used yet
+func (srv *InvitationService) GetValid(token string) (*models.Invitation, error) {
+	invitation, err := srv.repository.GetByHash(utils.HashSha256(token))
+	if err != nil {
+		return nil, ErrInvitationInvalid
+	}
+	if invitation.IsConsumed() {
+		return nil, ErrInvitationConsumed
+	}
+	if invitation.IsExpired() {
+		return nil, ErrInvitationExpired
+	}
+	return invitation, nil
+}
+
+// Consume marks the invitation as used by the given user, which fails if someone else was faster
+func (srv *InvitationService) Consume(invitation *models.Invitation, user *models.User) error {
+	ok, err := srv.repository.MarkConsumed(invitation.ID, user.ID, time.Now())
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrInvitationConsumed
+	}
+	return nil
+}
+
+func (srv *InvitationService) Delete(id string) error {
+	if _, err := srv.repository.GetById(id); err != nil {
+		return err
+	}
+	return srv.repository.Delete(id)
+}
@@ -1,9 +1,14 @@
 package services
 
 import (
+	"encoding/base64"
+	"errors"
+	"github.com/emvi/logbuch"
 	"github.com/muety/broilerplate/config"
 	"github.com/muety/broilerplate/models"
 	"github.com/muety/broilerplate/repositories"
+	"github.com/muety/broilerplate/utils"
+	"gorm.io/gorm"
 )
 
 type KeyValueService struct {
@@ -40,3 +45,32 @@ func (srv *KeyValueService) PutString(kv *models.KeyStringValue) error {
 func (srv *KeyValueService) DeleteString(key string) error {
 	return srv.repository.DeleteString(key)
 }
+
+// GetOrCreateSecret returns the random secret of length n stored under the given key, generating and persisting a new one if not existing, yet.
+// When racing with another request or instance, whichever secret got stored first wins, so everyone ends up using the same one.
+func (srv *KeyValueService) GetOrCreateSecret(key string, n int) ([]byte, error) {
+	if kv, err := srv.repository.GetString(key); err == nil {
+		return base64.StdEncoding.DecodeString(kv.Value)
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		// overwriting the secret would render everything derived from it unusable
+		return nil, err
+	}
+
+	logbuch.Info("generating new secret '%s'", key)
+	secret, err := utils.RandomBytes(n)
+	if err != nil {
+		return nil, err
+	}
+	if err := srv.repository.InsertString(&models.KeyStringValue{
+		Key:   key,
+		Value: base64.StdEncoding.EncodeToString(secret),
+	}); err != nil {
+		return nil, err
+	}
+
+	kv, err := srv.repository.GetString(key)
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(kv.Value)
+}
@@ -0,0 +1,45 @@
+package services
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/muety/broilerplate/models"
+	"github.com/muety/broilerplate/repositories"
+	"gorm.io/gorm"
+)
+
+// staleKeyValueRepository misses the first read, as if another instance stored a value right after it
+type staleKeyValueRepository struct {
+	repositories.IKeyValueRepository
+	missed bool
+}
+
+func (r *staleKeyValueRepository) GetString(key string) (*models.KeyStringValue, error) {
+	if !r.missed {
+		r.missed = true
+		return nil, gorm.ErrRecordNotFound
+	}
+	return r.IKeyValueRepository.GetString(key)
+}
+
+func TestKeyValueService_GetOrCreateSecret(t *testing.T) {
+	setupTestConfig()
+	repo := repositories.NewKeyValueRepository(setupTestDb(t, &models.KeyStringValue{}))
+
+	first, err := NewKeyValueService(repo).GetOrCreateSecret("secret", 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first) != 32 {
+		t.Fatalf("expected secret of length 32, got %d", len(first))
+	}
+
+	second, err := NewKeyValueService(&staleKeyValueRepository{IKeyValueRepository: repo}).GetOrCreateSecret("secret", 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first, second) {
+		t.Error("expected the secret stored first to be kept")
+	}
+}
@@ -0,0 +1,92 @@
+package services
+
+import (
+	"context"
+	"github.com/emvi/logbuch"
+	"github.com/muety/broilerplate/config"
+	"github.com/muety/broilerplate/models"
+	"github.com/muety/broilerplate/repositories"
+	"github.com/muety/broilerplate/utils"
+	"time"
+)
+
+type KnownDeviceService struct {
+	config      *config.Config
+	mailService IMailService
+	repository  repositories.IKnownDeviceRepository
+}
+
+func NewKnownDeviceService(mailService IMailService, knownDeviceRepo repositories.IKnownDeviceRepository) *KnownDeviceService {
+	return &KnownDeviceService{
+		config:      config.Get(),
+		mailService: mailService,
+		repository:  knownDeviceRepo,
+	}
+}
+
+// Observe remembers the device a user just logged in from and notifies them if either its client or its ip address was not seen before
+func (srv *KnownDeviceService) Observe(user *models.User, ip, userAgent string) error {
+	devices, err := srv.repository.GetByUser(user.ID)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	client := utils.DescribeUserAgent(userAgent)
+
+	var knownClient, knownIp bool
+	for _, d := range devices {
+		if d.Client == client && d.IP == ip {
+			d.LastSeenAt = models.CustomTime(now)
+			return srv.repository.Touch(d)
+		}
+		knownClient = knownClient || d.Client == client
+		knownIp = knownIp || d.IP == ip
+	}
+
+	if _, err := srv.repository.Insert(&models.KnownDevice{
+		UserID:     user.ID,
+		Client:     client,
+		IP:         ip,
+		CreatedAt:  models.CustomTime(now),
+		LastSeenAt: models.CustomTime(now),
+	}); err != nil {
+		return err
+	}
+
+	// nothing to compare against on a user's very first login
+	if len(devices) > 0 && (!knownClient || !knownIp) {
+		srv.notify(user, now, client, ip)
+	}
+	return nil
+}
+
+func (srv *KnownDeviceService) GetByUser(user *models.User) ([]*models.KnownDevice, error) {
+	return srv.repository.GetByUser(user.ID)
+}
+
+// ScheduleCleanup periodically forgets devices that were not used to log in for a long time
+func (srv *KnownDeviceService) ScheduleCleanup(ctx context.Context, interval time.Duration) {
+	config.RunPeriodically(ctx, interval, func() {
+		if n, err := srv.repository.DeleteByLastSeenBefore(time.Now().Add(-models.KnownDeviceRetention)); err != nil {
+			logbuch.Error("failed to clean up known devices – %v", err)
+		} else if n > 0 {
+			logbuch.Info("forgot %d devices not seen for a long time", n)
+		}
+	})
+}
+
+func (srv *KnownDeviceService) notify(user *models.User, at time.Time, client, ip string) {
+	// only notify confirmed addresses, as unconfirmed ones might belong to someone else
+	if !user.NotifyNewLogins || user.Email == "" || !user.EmailVerified || !srv.config.Mail.Enabled {
+		return
+	}
+
+	config.RunInBackground(func() {
+		if err := srv.mailService.SendNewLogin(user, at, client, ip); err != nil {
+			logbuch.Error("failed to send new sign-in mail to %s – %v", user.ID, err)
+		} else {
+			logbuch.Info("sent new sign-in mail to %s", user.ID)
+		}
+	})
+}
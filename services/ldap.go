@@ -0,0 +1,190 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"github.com/emvi/logbuch"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/muety/broilerplate/config"
+	"github.com/muety/broilerplate/models"
+	"github.com/muety/broilerplate/utils"
+	"net"
+	"strings"
+)
+
+var ErrLdapAccountExists = errors.New("a local account with this username already exists")
+
+// LdapAuthenticator checks passwords by binding as the user's directory entry, which is looked up first, and provisions users on their first login
+type LdapAuthenticator struct {
+	config      *config.LdapConfig
+	allowSignup bool
+	userService IUserService
+	roleService IRoleService
+}
+
+func NewLdapAuthenticator(userService IUserService, roleService IRoleService) *LdapAuthenticator {
+	return &LdapAuthenticator{
+		config:      &config.Get().Security.Ldap,
+		allowSignup: config.Get().Security.AllowSignup,
+		userService: userService,
+		roleService: roleService,
+	}
+}
+
+func (a *LdapAuthenticator) Authenticate(username, password string) (*models.User, error) {
+	// most servers treat binds without password as anonymous ones, which succeed
+	if username == "" || password == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	conn, err := a.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	entry, err := a.findEntry(conn, username)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := conn.Bind(entry.DN, password); ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return nil, ErrInvalidCredentials
+	} else if err != nil {
+		return nil, err
+	}
+
+	user, err := a.resolveUser(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	if a.config.AdminGroup != "" {
+		if err := syncAdminRole(a.roleService, user, hasLdapGroup(entry.GetAttributeValues(a.config.GroupAttribute), a.config.AdminGroup)); err != nil {
+			return nil, err
+		}
+	}
+
+	return user, nil
+}
+
+func (a *LdapAuthenticator) dial() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(
+		a.config.Url,
+		ldap.DialWithDialer(&net.Dialer{Timeout: a.config.GetTimeout()}),
+		ldap.DialWithTLSConfig(a.config.GetTLSConfig()),
+	)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(a.config.GetTimeout())
+
+	if a.config.StartTls {
+		if err := conn.StartTLS(a.config.GetTLSConfig()); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// findEntry looks up the user's entry, as seen by the service account if configured
+func (a *LdapAuthenticator) findEntry(conn *ldap.Conn, username string) (*ldap.Entry, error) {
+	if a.config.BindDn != "" {
+		if err := conn.Bind(a.config.BindDn, a.config.BindPassword); err != nil {
+			logbuch.Error("failed to bind as ldap service account – %v", err)
+			return nil, err
+		}
+	}
+
+	result, err := conn.Search(ldap.NewSearchRequest(
+		a.config.BaseDn,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		2, int(a.config.GetTimeout().Seconds()), false,
+		strings.ReplaceAll(a.config.UserFilter, "{username}", ldap.EscapeFilter(username)),
+		[]string{a.config.UsernameAttribute, a.config.EmailAttribute, a.config.GroupAttribute},
+		nil,
+	))
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, err
+	}
+
+	if len(result.Entries) == 0 {
+		return nil, ErrUnknownUser
+	}
+	if len(result.Entries) > 1 {
+		logbuch.Warn("ldap user filter matches multiple entries for '%s', refusing to pick one", username)
+		return nil, ErrUnknownUser
+	}
+	return result.Entries[0], nil
+}
+
+func (a *LdapAuthenticator) resolveUser(entry *ldap.Entry) (*models.User, error) {
+	username := entry.GetAttributeValue(a.config.UsernameAttribute)
+	if !models.ValidateUsername(username) {
+		return nil, fmt.Errorf("missing or invalid attribute '%s' of '%s'", a.config.UsernameAttribute, entry.DN)
+	}
+
+	if user, err := a.userService.GetUserById(username); err == nil {
+		if !user.IsLdapUser() {
+			logbuch.Warn("not logging in directory user '%s', as a local account with the same name exists", username)
+			return nil, ErrLdapAccountExists
+		}
+		// entries move around within the directory
+		if user.LdapDn != entry.DN {
+			user.LdapDn = entry.DN
+			return a.userService.Update(user)
+		}
+		return user, nil
+	}
+
+	// on invitation-only servers, the directory only grants access to existing accounts, unless trusted to vouch for new users
+	if !a.allowSignup && !a.config.AutoProvision {
+		logbuch.Warn("not creating user for ldap entry '%s', as registration is disabled", entry.DN)
+		return nil, ErrUnknownUser
+	}
+
+	email := entry.GetAttributeValue(a.config.EmailAttribute)
+	if !models.ValidateEmail(email) {
+		email = ""
+	}
+
+	// the password is never used, as directory users are always authenticated against the directory
+	password, err := utils.RandomBytes(32)
+	if err != nil {
+		return nil, err
+	}
+
+	user, created, err := a.userService.CreateOrGet(&models.Signup{
+		Username: username,
+		Email:    email,
+		Password: b64.EncodeToString(password),
+		Location: "UTC",
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !created {
+		return nil, ErrLdapAccountExists
+	}
+
+	// addresses are maintained by the directory's administrators
+	user.LdapDn = entry.DN
+	user.EmailVerified = email != ""
+	if user, err = a.userService.Update(user); err != nil {
+		return nil, err
+	}
+
+	logbuch.Info("created user '%s' from ldap entry '%s'", user.ID, entry.DN)
+	return user, nil
+}
+
+// hasLdapGroup compares dns case-insensitively, as directories do
+func hasLdapGroup(groups []string, group string) bool {
+	for _, g := range groups {
+		if strings.EqualFold(g, group) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,528 @@
+package services
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/muety/broilerplate/config"
+	"github.com/muety/broilerplate/models"
+)
+
+const (
+	testLdapBaseDn     = "ou=people,dc=example,dc=org"
+	testLdapAdminGroup = "cn=admins,ou=groups,dc=example,dc=org"
+	testLdapServiceDn  = "cn=service,dc=example,dc=org"
+	ldapStartTlsOid    = "1.3.6.1.4.1.1466.20037"
+)
+
+// stubLdapServer is a minimal in-process directory, which understands simple binds, searches with and / or / not / equality / presence
+// filters and starttls, and optionally only accepts binds over tls (like servers enforcing confidentiality do)
+type stubLdapServer struct {
+	listener   net.Listener
+	tlsConfig  *tls.Config
+	requireTls bool
+	entries    []*stubLdapEntry
+	filters    []string // all search filters received, for inspection by tests
+	lock       sync.Mutex
+}
+
+type stubLdapEntry struct {
+	dn         string
+	password   string
+	attributes map[string][]string
+}
+
+type stubLdapConn struct {
+	conn  net.Conn
+	isTls bool
+	bound bool
+}
+
+func newStubLdapServer(t *testing.T, certificate tls.Certificate, ldaps bool) *stubLdapServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &stubLdapServer{tlsConfig: &tls.Config{Certificates: []tls.Certificate{certificate}}}
+	if ldaps {
+		listener = tls.NewListener(listener, srv.tlsConfig)
+	}
+	srv.listener = listener
+	t.Cleanup(func() { listener.Close() })
+
+	srv.entries = []*stubLdapEntry{
+		{testLdapServiceDn, "service-secret", map[string][]string{"objectClass": {"applicationProcess"}, "cn": {"service"}}},
+		{"uid=alice," + testLdapBaseDn, "alice-secret", map[string][]string{"objectClass": {"person"}, "uid": {"alice"}, "mail": {"alice@example.org"}, "memberOf": {strings.ToUpper(testLdapAdminGroup)}}},
+		{"uid=bob," + testLdapBaseDn, "bob-secret", map[string][]string{"objectClass": {"person"}, "uid": {"bob"}, "mail": {"not an address"}, "memberOf": {"cn=staff,ou=groups,dc=example,dc=org"}}},
+		{"uid=*)(uid=*," + testLdapBaseDn, "", map[string][]string{"objectClass": {"person"}, "uid": {"*)(uid=*"}}},
+		{"uid=twin,ou=a," + testLdapBaseDn, "twin-secret", map[string][]string{"objectClass": {"person"}, "uid": {"twin"}}},
+		{"uid=twin,ou=b," + testLdapBaseDn, "twin-secret", map[string][]string{"objectClass": {"person"}, "uid": {"twin"}}},
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			_, isTls := conn.(*tls.Conn)
+			go srv.serve(&stubLdapConn{conn: conn, isTls: isTls})
+		}
+	}()
+
+	return srv
+}
+
+func (srv *stubLdapServer) url(scheme, host string) string {
+	return fmt.Sprintf("%s://%s:%d", scheme, host, srv.listener.Addr().(*net.TCPAddr).Port)
+}
+
+func (srv *stubLdapServer) receivedFilters() []string {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	return append([]string{}, srv.filters...)
+}
+
+func (srv *stubLdapServer) serve(c *stubLdapConn) {
+	defer func() { c.conn.Close() }()
+
+	for {
+		packet, err := ber.ReadPacket(c.conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		messageId, _ := packet.Children[0].Value.(int64)
+		request := packet.Children[1]
+
+		switch request.Tag {
+		case ldap.ApplicationBindRequest:
+			srv.write(c, messageId, ldap.ApplicationBindResponse, srv.bind(c, request))
+		case ldap.ApplicationSearchRequest:
+			srv.search(c, messageId, request)
+		case ldap.ApplicationExtendedRequest:
+			if len(request.Children) == 0 || request.Children[0].Data.String() != ldapStartTlsOid || c.isTls {
+				srv.write(c, messageId, ldap.ApplicationExtendedResponse, ldap.LDAPResultProtocolError)
+				continue
+			}
+			srv.write(c, messageId, ldap.ApplicationExtendedResponse, ldap.LDAPResultSuccess)
+			tlsConn := tls.Server(c.conn, srv.tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			c.conn, c.isTls = tlsConn, true
+		default:
+			return
+		}
+	}
+}
+
+func (srv *stubLdapServer) bind(c *stubLdapConn, request *ber.Packet) uint16 {
+	if len(request.Children) < 3 {
+		return ldap.LDAPResultProtocolError
+	}
+	if srv.requireTls && !c.isTls {
+		return ldap.LDAPResultConfidentialityRequired
+	}
+
+	dn, password := request.Children[1].Data.String(), request.Children[2].Data.String()
+	c.bound = false
+	if dn == "" && password == "" {
+		return ldap.LDAPResultSuccess
+	}
+	for _, e := range srv.entries {
+		if strings.EqualFold(e.dn, dn) && e.password != "" && e.password == password {
+			c.bound = true
+			return ldap.LDAPResultSuccess
+		}
+	}
+	return ldap.LDAPResultInvalidCredentials
+}
+
+func (srv *stubLdapServer) search(c *stubLdapConn, messageId int64, request *ber.Packet) {
+	if len(request.Children) < 8 {
+		srv.write(c, messageId, ldap.ApplicationSearchResultDone, ldap.LDAPResultProtocolError)
+		return
+	}
+	if !c.bound {
+		srv.write(c, messageId, ldap.ApplicationSearchResultDone, ldap.LDAPResultInsufficientAccessRights)
+		return
+	}
+
+	baseDn := request.Children[0].Data.String()
+	sizeLimit, _ := request.Children[3].Value.(int64)
+	filter := request.Children[6]
+	if decompiled, err := ldap.DecompileFilter(filter); err == nil {
+		srv.lock.Lock()
+		srv.filters = append(srv.filters, decompiled)
+		srv.lock.Unlock()
+	}
+
+	var found int64
+	for _, e := range srv.entries {
+		if !strings.HasSuffix(strings.ToLower(e.dn), strings.ToLower(baseDn)) || !e.matches(filter) {
+			continue
+		}
+		if sizeLimit > 0 && found == sizeLimit {
+			srv.write(c, messageId, ldap.ApplicationSearchResultDone, ldap.LDAPResultSizeLimitExceeded)
+			return
+		}
+		found++
+		srv.writeEntry(c, messageId, e)
+	}
+	srv.write(c, messageId, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)
+}
+
+func (e *stubLdapEntry) matches(filter *ber.Packet) bool {
+	switch filter.Tag {
+	case ldap.FilterAnd:
+		for _, f := range filter.Children {
+			if !e.matches(f) {
+				return false
+			}
+		}
+		return true
+	case ldap.FilterOr:
+		for _, f := range filter.Children {
+			if e.matches(f) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterNot:
+		return len(filter.Children) == 1 && !e.matches(filter.Children[0])
+	case ldap.FilterEqualityMatch:
+		if len(filter.Children) != 2 {
+			return false
+		}
+		for _, v := range e.values(filter.Children[0].Data.String()) {
+			if strings.EqualFold(v, filter.Children[1].Data.String()) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterPresent:
+		return len(e.values(filter.Data.String())) > 0
+	default:
+		return false
+	}
+}
+
+func (e *stubLdapEntry) values(attribute string) []string {
+	for k, v := range e.attributes {
+		if strings.EqualFold(k, attribute) {
+			return v
+		}
+	}
+	return nil
+}
+
+func (srv *stubLdapServer) write(c *stubLdapConn, messageId int64, tag ber.Tag, resultCode uint16) {
+	response := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Response")
+	response.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(resultCode), "Result Code"))
+	response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+	srv.send(c, messageId, response)
+}
+
+func (srv *stubLdapServer) writeEntry(c *stubLdapConn, messageId int64, e *stubLdapEntry) {
+	entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+	entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.dn, "DN"))
+	attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+	for name, values := range e.attributes {
+		attribute := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+		attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "Type"))
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+		for _, v := range values {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, "Value"))
+		}
+		attribute.AppendChild(set)
+		attributes.AppendChild(attribute)
+	}
+	entry.AppendChild(attributes)
+	srv.send(c, messageId, entry)
+}
+
+func (srv *stubLdapServer) send(c *stubLdapConn, messageId int64, op *ber.Packet) {
+	message := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	message.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageId, "Message ID"))
+	message.AppendChild(op)
+	c.conn.Write(message.Bytes())
+}
+
+// roleServiceStub records admin role changes, anything else panics
+type roleServiceStub struct {
+	IRoleService
+}
+
+func (s *roleServiceStub) Assign(user *models.User, role string) error {
+	user.IsAdmin = user.IsAdmin || role == models.RoleAdmin
+	return nil
+}
+
+func (s *roleServiceStub) Unassign(user *models.User, role string) error {
+	user.IsAdmin = user.IsAdmin && role != models.RoleAdmin
+	return nil
+}
+
+// newTestCertificate issues a server certificate for the given host names by a freshly generated certificate authority
+func newTestCertificate(t *testing.T, hosts ...string) (tls.Certificate, *x509.CertPool) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: hosts[0]},
+		DNSNames:     hosts,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func setupLdapAuthenticator(t *testing.T, url string, users ...*models.User) (*LdapAuthenticator, *userServiceStub) {
+	cfg := setupTestConfig()
+	cfg.Security.Ldap = config.LdapConfig{
+		Enabled:           true,
+		Url:               url,
+		BindDn:            testLdapServiceDn,
+		BindPassword:      "service-secret",
+		BaseDn:            testLdapBaseDn,
+		UserFilter:        "(&(objectClass=person)(uid={username}))",
+		UsernameAttribute: "uid",
+		EmailAttribute:    "mail",
+		GroupAttribute:    "memberOf",
+		AdminGroup:        testLdapAdminGroup,
+		TimeoutSec:        5,
+	}
+
+	userService := newUserServiceStub(users...)
+	return NewLdapAuthenticator(userService, &roleServiceStub{}), userService
+}
+
+func TestLdapAuthenticator_Bind(t *testing.T) {
+	certificate, _ := newTestCertificate(t, "localhost")
+	server := newStubLdapServer(t, certificate, false)
+	authenticator, _ := setupLdapAuthenticator(t, server.url("ldap", "127.0.0.1"))
+
+	user, err := authenticator.Authenticate("alice", "alice-secret")
+	if err != nil {
+		t.Fatalf("login failed: %v", err)
+	}
+	if user.ID != "alice" || user.LdapDn != "uid=alice,"+testLdapBaseDn || user.Email != "alice@example.org" || !user.EmailVerified {
+		t.Errorf("unexpected user %+v", user)
+	}
+
+	// the user is recognized on subsequent logins
+	if user, err = authenticator.Authenticate("alice", "alice-secret"); err != nil || user.ID != "alice" {
+		t.Errorf("second login failed: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		expected error
+	}{
+		{"wrong password", "alice", "wrong", ErrInvalidCredentials},
+		{"empty password", "alice", "", ErrInvalidCredentials},
+		{"unknown user", "mallory", "secret", ErrUnknownUser},
+		{"ambiguous user", "twin", "twin-secret", ErrUnknownUser},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := authenticator.Authenticate(tt.username, tt.password); err != tt.expected {
+				t.Errorf("expected %v, got %v", tt.expected, err)
+			}
+		})
+	}
+}
+
+func TestLdapAuthenticator_DoesNotTakeOverLocalAccounts(t *testing.T) {
+	certificate, _ := newTestCertificate(t, "localhost")
+	server := newStubLdapServer(t, certificate, false)
+	authenticator, _ := setupLdapAuthenticator(t, server.url("ldap", "127.0.0.1"), &models.User{ID: "alice", Email: "alice@example.org"})
+
+	if _, err := authenticator.Authenticate("alice", "alice-secret"); err != ErrLdapAccountExists {
+		t.Errorf("expected %v, got %v", ErrLdapAccountExists, err)
+	}
+}
+
+func TestLdapAuthenticator_RespectsDisabledSignup(t *testing.T) {
+	certificate, _ := newTestCertificate(t, "localhost")
+	server := newStubLdapServer(t, certificate, false)
+	authenticator, userService := setupLdapAuthenticator(t, server.url("ldap", "127.0.0.1"))
+	authenticator.allowSignup = false
+
+	if _, err := authenticator.Authenticate("alice", "alice-secret"); err != ErrUnknownUser {
+		t.Errorf("expected %v, got %v", ErrUnknownUser, err)
+	}
+
+	// directory users, who already have an account, can still log in
+	userService.users["bob"] = &models.User{ID: "bob", LdapDn: "uid=bob," + testLdapBaseDn}
+	if _, err := authenticator.Authenticate("bob", "bob-secret"); err != nil {
+		t.Errorf("login failed: %v", err)
+	}
+
+	authenticator.config.AutoProvision = true
+	if _, err := authenticator.Authenticate("alice", "alice-secret"); err != nil {
+		t.Errorf("expected user to be created, got %v", err)
+	}
+}
+
+func TestLdapAuthenticator_EscapesUsername(t *testing.T) {
+	certificate, _ := newTestCertificate(t, "localhost")
+	server := newStubLdapServer(t, certificate, false)
+	authenticator, _ := setupLdapAuthenticator(t, server.url("ldap", "127.0.0.1"))
+
+	// unescaped, this would match every person and log in as whoever comes first
+	if _, err := authenticator.Authenticate("*)(uid=*", "alice-secret"); err == nil {
+		t.Fatal("expected login to fail")
+	}
+
+	filters := server.receivedFilters()
+	expected := `(&(objectClass=person)(uid=\2a\29\28uid=\2a))`
+	if len(filters) != 1 || filters[0] != expected {
+		t.Errorf("expected filter %s, got %v", expected, filters)
+	}
+}
+
+func TestLdapAuthenticator_MapsGroupToAdminRole(t *testing.T) {
+	certificate, _ := newTestCertificate(t, "localhost")
+	server := newStubLdapServer(t, certificate, false)
+	authenticator, userService := setupLdapAuthenticator(t, server.url("ldap", "127.0.0.1"))
+
+	// group dns are compared case-insensitively
+	alice, err := authenticator.Authenticate("alice", "alice-secret")
+	if err != nil {
+		t.Fatalf("login failed: %v", err)
+	}
+	if !alice.IsAdmin {
+		t.Error("expected member of admin group to be admin")
+	}
+
+	userService.users["bob"] = &models.User{ID: "bob", LdapDn: "uid=bob," + testLdapBaseDn, IsAdmin: true}
+	bob, err := authenticator.Authenticate("bob", "bob-secret")
+	if err != nil {
+		t.Fatalf("login failed: %v", err)
+	}
+	if bob.IsAdmin {
+		t.Error("expected admin role to be revoked from non-member")
+	}
+
+	// admin rights are left alone if not managed via ldap
+	authenticator.config.AdminGroup = ""
+	bob.IsAdmin = true
+	if bob, err = authenticator.Authenticate("bob", "bob-secret"); err != nil || !bob.IsAdmin {
+		t.Errorf("expected admin role to be kept, got %v", err)
+	}
+}
+
+func TestLdapAuthenticator_InvalidEmailIsNotAdopted(t *testing.T) {
+	certificate, _ := newTestCertificate(t, "localhost")
+	server := newStubLdapServer(t, certificate, false)
+	authenticator, _ := setupLdapAuthenticator(t, server.url("ldap", "127.0.0.1"))
+
+	bob, err := authenticator.Authenticate("bob", "bob-secret")
+	if err != nil {
+		t.Fatalf("login failed: %v", err)
+	}
+	if bob.Email != "" || bob.EmailVerified {
+		t.Errorf("expected no e-mail address, got '%s' (verified: %v)", bob.Email, bob.EmailVerified)
+	}
+}
+
+func TestLdapAuthenticator_Tls(t *testing.T) {
+	certificate, caPool := newTestCertificate(t, "localhost")
+	otherCertificate, _ := newTestCertificate(t, "ldap.example.org")
+
+	tests := []struct {
+		name               string
+		certificate        tls.Certificate
+		ldaps              bool
+		startTls           bool
+		requireTls         bool
+		caPool             *x509.CertPool
+		insecureSkipVerify bool
+		expectSuccess      bool
+	}{
+		{"ldaps", certificate, true, false, true, caPool, false, true},
+		{"ldaps with unknown authority", certificate, true, false, true, nil, false, false},
+		{"ldaps with wrong host name", otherCertificate, true, false, true, caPool, false, false},
+		{"ldaps without verification", otherCertificate, true, false, true, nil, true, true},
+		{"starttls", certificate, false, true, true, caPool, false, true},
+		{"starttls with unknown authority", certificate, false, true, true, nil, false, false},
+		{"plain ldap against server requiring tls", certificate, false, false, true, caPool, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newStubLdapServer(t, tt.certificate, tt.ldaps)
+			server.requireTls = tt.requireTls
+
+			scheme := "ldap"
+			if tt.ldaps {
+				scheme = "ldaps"
+			}
+			// the host name of the url is what the server's certificate is verified against
+			authenticator, _ := setupLdapAuthenticator(t, server.url(scheme, "localhost"))
+			authenticator.config.StartTls = tt.startTls
+			authenticator.config.CaCertPool = tt.caPool
+			authenticator.config.InsecureSkipVerify = tt.insecureSkipVerify
+
+			_, err := authenticator.Authenticate("alice", "alice-secret")
+			if tt.expectSuccess && err != nil {
+				t.Errorf("expected login to succeed, got %v", err)
+			}
+			if !tt.expectSuccess && err == nil {
+				t.Error("expected login to fail")
+			}
+		})
+	}
+}
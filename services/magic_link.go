@@ -0,0 +1,134 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/emvi/logbuch"
+	"github.com/muety/broilerplate/config"
+	"github.com/muety/broilerplate/models"
+	"github.com/muety/broilerplate/repositories"
+	"github.com/muety/broilerplate/utils"
+	"sync"
+	"time"
+)
+
+var (
+	ErrMagicLinkInvalid  = errors.New("invalid or expired login link")
+	ErrMagicLinkLdapUser = errors.New("directory users can not log in by login link")
+)
+
+type MagicLinkService struct {
+	config       *config.Config
+	userService  IUserService
+	mailService  IMailService
+	keyValueSrvc IKeyValueService
+	repository   repositories.IMagicLinkRepository
+	signingKey   []byte
+	keyLock      sync.Mutex
+}
+
+func NewMagicLinkService(userService IUserService, mailService IMailService, keyValueService IKeyValueService, magicLinkRepo repositories.IMagicLinkRepository) *MagicLinkService {
+	return &MagicLinkService{
+		config:       config.Get(),
+		userService:  userService,
+		mailService:  mailService,
+		keyValueSrvc: keyValueService,
+		repository:   magicLinkRepo,
+	}
+}
+
+// Send issues a new login link for the user (replacing previous ones) and mails it asynchronously
+func (srv *MagicLinkService) Send(user *models.User) error {
+	// directory users must be checked against the directory on every login, see LocalAuthenticator
+	if user.IsLdapUser() {
+		return ErrMagicLinkLdapUser
+	}
+
+	if err := srv.repository.DeleteByUser(user.ID); err != nil {
+		return err
+	}
+
+	random, err := utils.RandomBytes(32)
+	if err != nil {
+		return err
+	}
+	token := b64.EncodeToString(random)
+
+	signature, err := srv.sign(token)
+	if err != nil {
+		return err
+	}
+
+	if _, err := srv.repository.Insert(&models.MagicLink{
+		TokenHash: signature,
+		UserID:    user.ID,
+		CreatedAt: models.CustomTime(time.Now()),
+		ExpiresAt: models.CustomTime(time.Now().Add(srv.config.Security.GetMagicLinkTtl())),
+	}); err != nil {
+		return err
+	}
+
+	config.RunInBackground(func() {
+		link := fmt.Sprintf("%s/login/magic?token=%s", srv.config.Server.GetPublicUrl(), token)
+		if err := srv.mailService.SendMagicLink(user, link); err != nil {
+			logbuch.Error("failed to send login link to %s – %v", user.ID, err)
+		} else {
+			logbuch.Info("sent login link to %s", user.ID)
+		}
+	})
+
+	return nil
+}
+
+// Consume invalidates the given login link and returns the user it was issued for
+func (srv *MagicLinkService) Consume(token string) (*models.User, error) {
+	signature, err := srv.sign(token)
+	if err != nil {
+		return nil, err
+	}
+
+	link, err := srv.repository.GetByHash(signature)
+	if err != nil || link.IsExpired() {
+		return nil, ErrMagicLinkInvalid
+	}
+
+	// only whoever actually deletes the link gets to use it
+	if n, err := srv.repository.DeleteByHash(signature); err != nil {
+		return nil, err
+	} else if n != 1 {
+		return nil, ErrMagicLinkInvalid
+	}
+
+	user, err := srv.userService.GetUserById(link.UserID)
+	if err != nil || user.IsLdapUser() {
+		return nil, ErrMagicLinkInvalid
+	}
+	return user, nil
+}
+
+// ScheduleCleanup periodically deletes expired login links
+func (srv *MagicLinkService) ScheduleCleanup(ctx context.Context, interval time.Duration) {
+	config.RunPeriodically(ctx, interval, func() {
+		if n, err := srv.repository.DeleteByExpiresBefore(time.Now()); err != nil {
+			logbuch.Error("failed to clean up expired login links – %v", err)
+		} else if n > 0 {
+			logbuch.Info("cleaned up %d expired login links", n)
+		}
+	})
+}
+
+// sign computes the keyed hash under which a login link is stored, the plain token only ever ends up in the mail
+func (srv *MagicLinkService) sign(token string) (string, error) {
+	srv.keyLock.Lock()
+	defer srv.keyLock.Unlock()
+
+	if srv.signingKey == nil {
+		key, err := srv.keyValueSrvc.GetOrCreateSecret(models.MagicLinkKeyKey, 32)
+		if err != nil {
+			return "", err
+		}
+		srv.signingKey = key
+	}
+	return utils.HashHmac(token, string(srv.signingKey)), nil
+}
@@ -0,0 +1,93 @@
+package services
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/muety/broilerplate/config"
+	"github.com/muety/broilerplate/models"
+	"github.com/muety/broilerplate/repositories"
+)
+
+// mailServiceStub records the login links it was asked to send
+type mailServiceStub struct {
+	IMailService
+	links chan string
+}
+
+func (s *mailServiceStub) SendMagicLink(user *models.User, link string) error {
+	s.links <- link
+	return nil
+}
+
+func setupMagicLinkService(t *testing.T, users ...*models.User) (*MagicLinkService, *mailServiceStub) {
+	cfg := setupTestConfig()
+	cfg.Security.MagicLinkTtlSec = 900
+
+	db := setupTestDb(t, &models.KeyStringValue{}, &models.MagicLink{})
+	mailService := &mailServiceStub{links: make(chan string, 1)}
+	return NewMagicLinkService(newUserServiceStub(users...), mailService, NewKeyValueService(repositories.NewKeyValueRepository(db)), repositories.NewMagicLinkRepository(db)), mailService
+}
+
+func receiveMagicLinkToken(t *testing.T, mailService *mailServiceStub) string {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := config.WaitForBackgroundJobs(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case link := <-mailService.links:
+		u, err := url.Parse(link)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u.Query().Get("token")
+	default:
+		t.Fatal("expected login link to be sent")
+		return ""
+	}
+}
+
+func TestMagicLinkService_SendAndConsume(t *testing.T) {
+	alice := &models.User{ID: "alice", Email: "alice@example.org", EmailVerified: true}
+	srv, mailService := setupMagicLinkService(t, alice)
+
+	if err := srv.Send(alice); err != nil {
+		t.Fatal(err)
+	}
+	token := receiveMagicLinkToken(t, mailService)
+
+	user, err := srv.Consume(token)
+	if err != nil {
+		t.Fatalf("login failed: %v", err)
+	}
+	if user.ID != alice.ID {
+		t.Errorf("expected user '%s', got '%s'", alice.ID, user.ID)
+	}
+
+	if _, err := srv.Consume(token); err != ErrMagicLinkInvalid {
+		t.Errorf("expected link to be usable only once, got %v", err)
+	}
+}
+
+func TestMagicLinkService_RefusesDirectoryUsers(t *testing.T) {
+	alice := &models.User{ID: "alice", Email: "alice@example.org", EmailVerified: true}
+	srv, mailService := setupMagicLinkService(t, alice)
+
+	// users turned into directory users after their link was sent
+	if err := srv.Send(alice); err != nil {
+		t.Fatal(err)
+	}
+	token := receiveMagicLinkToken(t, mailService)
+	alice.LdapDn = "uid=alice,ou=people,dc=example,dc=org"
+
+	if _, err := srv.Consume(token); err != ErrMagicLinkInvalid {
+		t.Errorf("expected %v, got %v", ErrMagicLinkInvalid, err)
+	}
+	if err := srv.Send(alice); err != ErrMagicLinkLdapUser {
+		t.Errorf("expected %v, got %v", ErrMagicLinkLdapUser, err)
+	}
+}
@@ -9,11 +9,24 @@ import (
 	"github.com/muety/broilerplate/services"
 	"github.com/muety/broilerplate/utils"
 	"github.com/muety/broilerplate/views/mail"
+	"time"
 )
 
 const (
-	tplNamePasswordReset = "reset_password"
-	subjectPasswordReset = "Broilerplate - Password Reset"
+	tplNamePasswordReset     = "reset_password"
+	tplNameEmailVerification = "verify_email"
+	tplNameInvitation        = "invitation"
+	tplNameAccountLocked     = "account_locked"
+	tplNameOrgInvitation     = "organization_invitation"
+	tplNameMagicLink         = "magic_link"
+	tplNameNewLogin          = "new_login"
+	subjectPasswordReset     = "Broilerplate - Password Reset"
+	subjectEmailVerification = "Broilerplate - Confirm your E-Mail Address"
+	subjectInvitation        = "Broilerplate - You have been invited"
+	subjectAccountLocked     = "Broilerplate - Your account has been locked"
+	subjectOrgInvitation     = "Broilerplate - You have been invited to join an organization"
+	subjectMagicLink         = "Broilerplate - Your Login Link"
+	subjectNewLogin          = "Broilerplate - New sign-in to your account"
 )
 
 type SendingService interface {
@@ -64,6 +77,134 @@ func (m *MailService) SendPasswordReset(recipient *models.User, resetLink string
 	return m.sendingService.Send(mail)
 }
 
+func (m *MailService) SendMagicLink(recipient *models.User, loginLink string) error {
+	tpl, err := m.getMagicLinkTemplate(MagicLinkTplData{
+		LoginLink:    loginLink,
+		ValidMinutes: int(m.config.Security.GetMagicLinkTtl().Minutes()),
+	})
+	if err != nil {
+		return err
+	}
+	mail := &models.Mail{
+		From:    models.MailAddress(m.config.Mail.Sender),
+		To:      models.MailAddresses([]models.MailAddress{models.MailAddress(recipient.Email)}),
+		Subject: subjectMagicLink,
+	}
+	mail.WithHTML(tpl.String())
+	return m.sendingService.Send(mail)
+}
+
+func (m *MailService) SendEmailVerification(recipient *models.User, email, verifyLink string) error {
+	tpl, err := m.getEmailVerificationTemplate(EmailVerificationTplData{UserId: recipient.ID, VerifyLink: verifyLink})
+	if err != nil {
+		return err
+	}
+	mail := &models.Mail{
+		From:    models.MailAddress(m.config.Mail.Sender),
+		To:      models.MailAddresses([]models.MailAddress{models.MailAddress(email)}),
+		Subject: subjectEmailVerification,
+	}
+	mail.WithHTML(tpl.String())
+	return m.sendingService.Send(mail)
+}
+
+func (m *MailService) SendInvitation(inviter *models.User, email, signupLink string) error {
+	tpl, err := m.getInvitationTemplate(InvitationTplData{InviterId: inviter.ID, SignupLink: signupLink})
+	if err != nil {
+		return err
+	}
+	mail := &models.Mail{
+		From:    models.MailAddress(m.config.Mail.Sender),
+		To:      models.MailAddresses([]models.MailAddress{models.MailAddress(email)}),
+		Subject: subjectInvitation,
+	}
+	mail.WithHTML(tpl.String())
+	return m.sendingService.Send(mail)
+}
+
+func (m *MailService) SendOrganizationInvitation(inviter *models.User, org *models.Organization, email, joinLink string) error {
+	tpl, err := m.getOrganizationInvitationTemplate(OrganizationInvitationTplData{InviterId: inviter.ID, OrganizationName: org.Name, JoinLink: joinLink})
+	if err != nil {
+		return err
+	}
+	mail := &models.Mail{
+		From:    models.MailAddress(m.config.Mail.Sender),
+		To:      models.MailAddresses([]models.MailAddress{models.MailAddress(email)}),
+		Subject: subjectOrgInvitation,
+	}
+	mail.WithHTML(tpl.String())
+	return m.sendingService.Send(mail)
+}
+
+func (m *MailService) SendAccountLocked(recipient *models.User, ip string, until time.Time) error {
+	tpl, err := m.getAccountLockedTemplate(AccountLockedTplData{
+		UserId: recipient.ID,
+		Ip:     ip,
+		Until:  until.In(recipient.TZ()).Format(conf.SimpleDateTimeFormat) + " " + recipient.TZ().String(),
+	})
+	if err != nil {
+		return err
+	}
+	mail := &models.Mail{
+		From:    models.MailAddress(m.config.Mail.Sender),
+		To:      models.MailAddresses([]models.MailAddress{models.MailAddress(recipient.Email)}),
+		Subject: subjectAccountLocked,
+	}
+	mail.WithHTML(tpl.String())
+	return m.sendingService.Send(mail)
+}
+
+func (m *MailService) SendNewLogin(recipient *models.User, at time.Time, client, ip string) error {
+	tpl, err := m.getNewLoginTemplate(NewLoginTplData{
+		UserId: recipient.ID,
+		Time:   at.In(recipient.TZ()).Format(conf.SimpleDateTimeFormat) + " " + recipient.TZ().String(),
+		Client: client,
+		Ip:     ip,
+	})
+	if err != nil {
+		return err
+	}
+	mail := &models.Mail{
+		From:    models.MailAddress(m.config.Mail.Sender),
+		To:      models.MailAddresses([]models.MailAddress{models.MailAddress(recipient.Email)}),
+		Subject: subjectNewLogin,
+	}
+	mail.WithHTML(tpl.String())
+	return m.sendingService.Send(mail)
+}
+
+func (m *MailService) getAccountLockedTemplate(data AccountLockedTplData) (*bytes.Buffer, error) {
+	var rendered bytes.Buffer
+	if err := m.templates[m.fmtName(tplNameAccountLocked)].Execute(&rendered, data); err != nil {
+		return nil, err
+	}
+	return &rendered, nil
+}
+
+func (m *MailService) getInvitationTemplate(data InvitationTplData) (*bytes.Buffer, error) {
+	var rendered bytes.Buffer
+	if err := m.templates[m.fmtName(tplNameInvitation)].Execute(&rendered, data); err != nil {
+		return nil, err
+	}
+	return &rendered, nil
+}
+
+func (m *MailService) getOrganizationInvitationTemplate(data OrganizationInvitationTplData) (*bytes.Buffer, error) {
+	var rendered bytes.Buffer
+	if err := m.templates[m.fmtName(tplNameOrgInvitation)].Execute(&rendered, data); err != nil {
+		return nil, err
+	}
+	return &rendered, nil
+}
+
+func (m *MailService) getEmailVerificationTemplate(data EmailVerificationTplData) (*bytes.Buffer, error) {
+	var rendered bytes.Buffer
+	if err := m.templates[m.fmtName(tplNameEmailVerification)].Execute(&rendered, data); err != nil {
+		return nil, err
+	}
+	return &rendered, nil
+}
+
 func (m *MailService) getPasswordResetTemplate(data PasswordResetTplData) (*bytes.Buffer, error) {
 	var rendered bytes.Buffer
 	if err := m.templates[m.fmtName(tplNamePasswordReset)].Execute(&rendered, data); err != nil {
@@ -72,6 +213,22 @@ func (m *MailService) getPasswordResetTemplate(data PasswordResetTplData) (*byte
 	return &rendered, nil
 }
 
+func (m *MailService) getMagicLinkTemplate(data MagicLinkTplData) (*bytes.Buffer, error) {
+	var rendered bytes.Buffer
+	if err := m.templates[m.fmtName(tplNameMagicLink)].Execute(&rendered, data); err != nil {
+		return nil, err
+	}
+	return &rendered, nil
+}
+
+func (m *MailService) getNewLoginTemplate(data NewLoginTplData) (*bytes.Buffer, error) {
+	var rendered bytes.Buffer
+	if err := m.templates[m.fmtName(tplNameNewLogin)].Execute(&rendered, data); err != nil {
+		return nil, err
+	}
+	return &rendered, nil
+}
+
 func (m *MailService) fmtName(name string) string {
 	return fmt.Sprintf("%s.tpl.html", name)
 }
@@ -8,6 +8,6 @@ import (
 type NoopSendingService struct{}
 
 func (n *NoopSendingService) Send(mail *models.Mail) error {
-	logbuch.Info("noop mail service doing nothing instead of sending password reset mail to [%v]", mail.To.Strings())
+	logbuch.Info("noop mail service doing nothing instead of sending mail '%s' to [%v]", mail.Subject, mail.To.Strings())
 	return nil
 }
@@ -3,3 +3,37 @@ package mail
 type PasswordResetTplData struct {
 	ResetLink string
 }
+
+type MagicLinkTplData struct {
+	LoginLink    string
+	ValidMinutes int
+}
+
+type AccountLockedTplData struct {
+	UserId string
+	Ip     string
+	Until  string
+}
+
+type NewLoginTplData struct {
+	UserId string
+	Time   string
+	Client string
+	Ip     string
+}
+
+type InvitationTplData struct {
+	InviterId  string
+	SignupLink string
+}
+
+type OrganizationInvitationTplData struct {
+	InviterId        string
+	OrganizationName string
+	JoinLink         string
+}
+
+type EmailVerificationTplData struct {
+	UserId     string
+	VerifyLink string
+}
@@ -0,0 +1,426 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"github.com/emvi/logbuch"
+	"github.com/muety/broilerplate/config"
+	"github.com/muety/broilerplate/models"
+	"github.com/muety/broilerplate/repositories"
+	"github.com/muety/broilerplate/utils"
+	uuid "github.com/satori/go.uuid"
+	"strings"
+	"time"
+)
+
+// minimum time between two updates of a grant's last used timestamp, to not write to the database on every request
+const oauthGrantTouchInterval = 1 * time.Minute
+
+var (
+	ErrOAuthTokenExpired = errors.New("oauth access token expired")
+	ErrOAuthGrantUnknown = errors.New("authorization not found")
+)
+
+// OAuthService implements an oauth 2.0 authorization server (rfc 6749), which only supports the authorization code flow with pkce (rfc 7636)
+type OAuthService struct {
+	config      *config.Config
+	roleService IRoleService
+	clientRepo  repositories.IOAuthClientRepository
+	grantRepo   repositories.IOAuthGrantRepository
+	codeRepo    repositories.IOAuthAuthorizationCodeRepository
+	tokenRepo   repositories.IOAuthTokenRepository
+}
+
+func NewOAuthService(roleService IRoleService, clientRepo repositories.IOAuthClientRepository, grantRepo repositories.IOAuthGrantRepository, codeRepo repositories.IOAuthAuthorizationCodeRepository, tokenRepo repositories.IOAuthTokenRepository) *OAuthService {
+	return &OAuthService{
+		config:      config.Get(),
+		roleService: roleService,
+		clientRepo:  clientRepo,
+		grantRepo:   grantRepo,
+		codeRepo:    codeRepo,
+		tokenRepo:   tokenRepo,
+	}
+}
+
+func (srv *OAuthService) GetClients() ([]*models.OAuthClient, error) {
+	return srv.clientRepo.GetAll()
+}
+
+func (srv *OAuthService) GetClient(clientId string) (*models.OAuthClient, error) {
+	return srv.clientRepo.GetById(clientId)
+}
+
+// CreateClient registers a new app and returns its plain secret, which is empty for public clients and can only be shown once otherwise
+func (srv *OAuthService) CreateClient(request *models.OAuthClientCreateRequest, origin *models.AuditOrigin) (*models.OAuthClient, string, error) {
+	id, err := utils.RandomBytes(16)
+	if err != nil {
+		return nil, "", err
+	}
+
+	client := &models.OAuthClient{
+		ID:           hex.EncodeToString(id),
+		Name:         request.Name,
+		RedirectUris: strings.Join(request.GetRedirectUris(), "\n"),
+		Scopes:       strings.Join(request.Scopes, ","),
+		CreatedAt:    models.CustomTime(time.Now()),
+	}
+
+	var secret string
+	if request.Confidential {
+		random, err := utils.RandomBytes(32)
+		if err != nil {
+			return nil, "", err
+		}
+		secret = b64.EncodeToString(random)
+		client.SecretHash = utils.HashSha256(secret)
+	}
+
+	if _, err := srv.clientRepo.Insert(client); err != nil {
+		return nil, "", err
+	}
+
+	PublishAuditEvent(models.NewAuditEvent(models.AuditOAuthClientRegister, origin, client.ID, client.Name))
+	return client, secret, nil
+}
+
+// DeleteClient removes an app along with all authorizations users have given it
+func (srv *OAuthService) DeleteClient(clientId string, origin *models.AuditOrigin) error {
+	client, err := srv.clientRepo.GetById(clientId)
+	if err != nil {
+		return err
+	}
+	if err := srv.clientRepo.Delete(client); err != nil {
+		return err
+	}
+
+	PublishAuditEvent(models.NewAuditEvent(models.AuditOAuthClientDelete, origin, client.ID, client.Name))
+	return nil
+}
+
+// AuthenticateClient checks the credentials an app calls the token endpoints with, public clients must not send a secret
+func (srv *OAuthService) AuthenticateClient(clientId, secret string) (*models.OAuthClient, error) {
+	client, err := srv.clientRepo.GetById(clientId)
+	if err != nil {
+		return nil, models.NewOAuthError(models.OAuthErrInvalidClient, "unknown client")
+	}
+	if !client.IsConfidential() {
+		if secret != "" {
+			return nil, models.NewOAuthError(models.OAuthErrInvalidClient, "public clients must not use a secret")
+		}
+		return client, nil
+	}
+	if subtle.ConstantTimeCompare([]byte(utils.HashSha256(secret)), []byte(client.SecretHash)) != 1 {
+		return nil, models.NewOAuthError(models.OAuthErrInvalidClient, "invalid client credentials")
+	}
+	return client, nil
+}
+
+// ValidateAuthorizeRequest checks an authorization request of a client, whose redirect uri has already been verified, and returns the scopes to grant
+func (srv *OAuthService) ValidateAuthorizeRequest(user *models.User, client *models.OAuthClient, request *models.OAuthAuthorizeRequest) ([]string, error) {
+	if request.ResponseType != "code" {
+		return nil, models.NewOAuthError(models.OAuthErrUnsupportedResponseType, "only the authorization code flow is supported")
+	}
+	if request.CodeChallenge == "" || request.CodeChallengeMethod != models.OAuthCodeChallengeS256 {
+		return nil, models.NewOAuthError(models.OAuthErrInvalidRequest, "pkce with code_challenge_method S256 is required")
+	}
+	if len(request.CodeChallenge) != 43 {
+		return nil, models.NewOAuthError(models.OAuthErrInvalidRequest, "invalid code_challenge")
+	}
+
+	requested := request.GetScopes()
+	if len(requested) == 0 {
+		// default to whatever the app may ask for and the user may grant
+		scopes := []string{}
+		for _, s := range client.GetScopes() {
+			if srv.mayGrant(user, s) {
+				scopes = append(scopes, s)
+			}
+		}
+		if len(scopes) == 0 {
+			return nil, models.NewOAuthError(models.OAuthErrInvalidScope, "none of the app's scopes can be granted")
+		}
+		return scopes, nil
+	}
+
+	for _, s := range requested {
+		if !client.HasScope(s) {
+			return nil, models.NewOAuthError(models.OAuthErrInvalidScope, "scope "+s+" is not available to this app")
+		}
+		if !srv.mayGrant(user, s) {
+			return nil, models.NewOAuthError(models.OAuthErrInvalidScope, "user lacks the permission to grant scope "+s)
+		}
+	}
+	return requested, nil
+}
+
+// HasConsent returns whether the user has authorized the app for all of the given scopes before, so they don't need to be asked again
+func (srv *OAuthService) HasConsent(user *models.User, client *models.OAuthClient, scopes []string) bool {
+	grant, err := srv.grantRepo.GetByUserAndClient(user.ID, client.ID)
+	return err == nil && len(missingScopes(grant, scopes)) == 0
+}
+
+// Authorize records the user's consent and returns an authorization code for the app to exchange for tokens
+func (srv *OAuthService) Authorize(user *models.User, client *models.OAuthClient, request *models.OAuthAuthorizeRequest, scopes []string, origin *models.AuditOrigin) (string, error) {
+	grant, err := srv.grantRepo.GetByUserAndClient(user.ID, client.ID)
+	if err != nil {
+		grant, err = srv.grantRepo.Insert(&models.OAuthGrant{
+			ID:        uuid.NewV4().String(),
+			UserID:    user.ID,
+			ClientID:  client.ID,
+			Scopes:    strings.Join(scopes, ","),
+			CreatedAt: models.CustomTime(time.Now()),
+		})
+		if err != nil {
+			return "", err
+		}
+		PublishAuditEvent(models.NewAuditEvent(models.AuditOAuthAuthorize, origin, user.ID, client.Name))
+	} else if missing := missingScopes(grant, scopes); len(missing) > 0 {
+		grant.Scopes = strings.Join(append(grant.GetScopes(), missing...), ",")
+		if grant, err = srv.grantRepo.UpdateScopes(grant); err != nil {
+			return "", err
+		}
+		PublishAuditEvent(models.NewAuditEvent(models.AuditOAuthAuthorize, origin, user.ID, client.Name))
+	}
+
+	random, err := utils.RandomBytes(32)
+	if err != nil {
+		return "", err
+	}
+	code := b64.EncodeToString(random)
+
+	if _, err := srv.codeRepo.Insert(&models.OAuthAuthorizationCode{
+		CodeHash:      utils.HashSha256(code),
+		GrantID:       grant.ID,
+		RedirectUri:   request.RedirectUri,
+		Scopes:        strings.Join(scopes, ","),
+		CodeChallenge: request.CodeChallenge,
+		ExpiresAt:     models.CustomTime(time.Now().Add(models.OAuthCodeTtl)),
+	}); err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+// ExchangeCode redeems an authorization code, which only works once and only with the verifier matching the code challenge
+func (srv *OAuthService) ExchangeCode(client *models.OAuthClient, code, redirectUri, codeVerifier string) (*models.OAuthTokenResponse, error) {
+	authCode, err := srv.codeRepo.GetByHash(utils.HashSha256(code))
+	if err != nil {
+		return nil, models.NewOAuthError(models.OAuthErrInvalidGrant, "invalid authorization code")
+	}
+	if n, err := srv.codeRepo.Delete(authCode); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, models.NewOAuthError(models.OAuthErrInvalidGrant, "invalid authorization code")
+	}
+
+	if authCode.IsExpired() || authCode.Grant.ClientID != client.ID {
+		return nil, models.NewOAuthError(models.OAuthErrInvalidGrant, "invalid authorization code")
+	}
+	if authCode.RedirectUri != redirectUri {
+		return nil, models.NewOAuthError(models.OAuthErrInvalidGrant, "redirect_uri does not match the authorization request")
+	}
+	if !verifyCodeChallenge(authCode.CodeChallenge, codeVerifier) {
+		return nil, models.NewOAuthError(models.OAuthErrInvalidGrant, "invalid code_verifier")
+	}
+
+	return srv.issueToken(authCode.Grant, authCode.GetScopes())
+}
+
+// Refresh issues a new pair of tokens in exchange for a refresh token, which is invalidated thereby (refresh token rotation)
+func (srv *OAuthService) Refresh(client *models.OAuthClient, refreshToken string, scopes []string) (*models.OAuthTokenResponse, error) {
+	token, err := srv.tokenRepo.GetByRefreshHash(utils.HashSha256(refreshToken))
+	if err != nil || token.IsRefreshExpired() || token.Grant.ClientID != client.ID {
+		return nil, models.NewOAuthError(models.OAuthErrInvalidGrant, "invalid refresh token")
+	}
+
+	// apps may ask for fewer scopes than originally granted, but never for more
+	if len(scopes) == 0 {
+		scopes = token.GetScopes()
+	}
+	for _, s := range scopes {
+		if !token.HasScope(s) {
+			return nil, models.NewOAuthError(models.OAuthErrInvalidScope, "scope "+s+" was not granted")
+		}
+	}
+
+	if n, err := srv.tokenRepo.Delete(token); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, models.NewOAuthError(models.OAuthErrInvalidGrant, "invalid refresh token")
+	}
+
+	return srv.issueToken(token.Grant, scopes)
+}
+
+// Introspect describes an access or refresh token to the app it was issued to, tokens of other apps are reported as inactive
+func (srv *OAuthService) Introspect(client *models.OAuthClient, plain string) *models.OAuthIntrospection {
+	inactive := &models.OAuthIntrospection{Active: false}
+
+	var token *models.OAuthToken
+	var err error
+	var tokenType string
+	var expiresAt time.Time
+
+	if strings.HasPrefix(plain, models.OAuthAccessTokenPrefix) {
+		if token, err = srv.tokenRepo.GetByAccessHash(utils.HashSha256(plain)); err != nil || token.IsAccessExpired() {
+			return inactive
+		}
+		tokenType, expiresAt = "Bearer", token.AccessExpiresAt.T()
+	} else if strings.HasPrefix(plain, models.OAuthRefreshTokenPrefix) {
+		if token, err = srv.tokenRepo.GetByRefreshHash(utils.HashSha256(plain)); err != nil || token.IsRefreshExpired() {
+			return inactive
+		}
+		expiresAt = token.RefreshExpiresAt.T()
+	} else {
+		return inactive
+	}
+
+	if token.Grant.ClientID != client.ID {
+		return inactive
+	}
+
+	return &models.OAuthIntrospection{
+		Active:    true,
+		Scope:     strings.Join(token.GetScopes(), " "),
+		ClientID:  client.ID,
+		Username:  token.Grant.UserID,
+		Subject:   token.Grant.UserID,
+		TokenType: tokenType,
+		IssuedAt:  token.CreatedAt.T().Unix(),
+		ExpiresAt: expiresAt.Unix(),
+	}
+}
+
+// GetValidByAccessToken resolves a plain access token, unless it has expired, and updates its grant's last used timestamp
+func (srv *OAuthService) GetValidByAccessToken(plain string) (*models.OAuthToken, error) {
+	if !strings.HasPrefix(plain, models.OAuthAccessTokenPrefix) {
+		return nil, errors.New("not an oauth access token")
+	}
+	if !srv.config.Security.OAuthServer.Enabled {
+		return nil, errors.New("oauth server disabled")
+	}
+
+	token, err := srv.tokenRepo.GetByAccessHash(utils.HashSha256(plain))
+	if err != nil {
+		return nil, err
+	}
+	if token.IsAccessExpired() {
+		return nil, ErrOAuthTokenExpired
+	}
+
+	srv.touch(token.Grant)
+	return token, nil
+}
+
+func (srv *OAuthService) GetGrantsByUser(user *models.User) ([]*models.OAuthGrant, error) {
+	return srv.grantRepo.GetByUser(user.ID)
+}
+
+// RevokeGrant withdraws the user's authorization of an app, which invalidates all tokens issued to it on behalf of the user
+func (srv *OAuthService) RevokeGrant(user *models.User, grantId string, origin *models.AuditOrigin) error {
+	grant, err := srv.grantRepo.GetById(grantId)
+	if err != nil || grant.UserID != user.ID {
+		return ErrOAuthGrantUnknown
+	}
+	if err := srv.grantRepo.Delete(grant); err != nil {
+		return err
+	}
+
+	PublishAuditEvent(models.NewAuditEvent(models.AuditOAuthRevoke, origin, user.ID, grant.Client.Name))
+	return nil
+}
+
+// ScheduleCleanup periodically deletes expired authorization codes and tokens
+func (srv *OAuthService) ScheduleCleanup(ctx context.Context, interval time.Duration) {
+	config.RunPeriodically(ctx, interval, func() {
+		if n, err := srv.codeRepo.DeleteByExpiresBefore(time.Now()); err != nil {
+			logbuch.Error("failed to clean up expired oauth authorization codes – %v", err)
+		} else if n > 0 {
+			logbuch.Info("cleaned up %d expired oauth authorization codes", n)
+		}
+		if n, err := srv.tokenRepo.DeleteByRefreshExpiresBefore(time.Now()); err != nil {
+			logbuch.Error("failed to clean up expired oauth tokens – %v", err)
+		} else if n > 0 {
+			logbuch.Info("cleaned up %d expired oauth tokens", n)
+		}
+	})
+}
+
+func (srv *OAuthService) issueToken(grant *models.OAuthGrant, scopes []string) (*models.OAuthTokenResponse, error) {
+	accessRandom, err := utils.RandomBytes(32)
+	if err != nil {
+		return nil, err
+	}
+	refreshRandom, err := utils.RandomBytes(32)
+	if err != nil {
+		return nil, err
+	}
+	accessToken := models.OAuthAccessTokenPrefix + b64.EncodeToString(accessRandom)
+	refreshToken := models.OAuthRefreshTokenPrefix + b64.EncodeToString(refreshRandom)
+
+	now := time.Now()
+	accessTtl, refreshTtl := srv.config.Security.OAuthServer.GetAccessTokenTtl(), srv.config.Security.OAuthServer.GetRefreshTokenTtl()
+
+	// tokens are random and long enough, so a fast, unsalted hash is sufficient
+	if _, err := srv.tokenRepo.Insert(&models.OAuthToken{
+		ID:               uuid.NewV4().String(),
+		GrantID:          grant.ID,
+		AccessTokenHash:  utils.HashSha256(accessToken),
+		RefreshTokenHash: utils.HashSha256(refreshToken),
+		Scopes:           strings.Join(scopes, ","),
+		CreatedAt:        models.CustomTime(now),
+		AccessExpiresAt:  models.CustomTime(now.Add(accessTtl)),
+		RefreshExpiresAt: models.CustomTime(now.Add(refreshTtl)),
+	}); err != nil {
+		return nil, err
+	}
+
+	srv.touch(grant)
+
+	return &models.OAuthTokenResponse{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(accessTtl.Seconds()),
+		RefreshToken: refreshToken,
+		Scope:        strings.Join(scopes, " "),
+	}, nil
+}
+
+func (srv *OAuthService) mayGrant(user *models.User, scope string) bool {
+	p := models.ScopePermission(scope)
+	return p == "" || srv.roleService.HasPermission(user, p)
+}
+
+func (srv *OAuthService) touch(grant *models.OAuthGrant) {
+	if grant.LastUsedAt != nil && time.Since(grant.LastUsedAt.T()) <= oauthGrantTouchInterval {
+		return
+	}
+	now := models.CustomTime(time.Now())
+	grant.LastUsedAt = &now
+	if _, err := srv.grantRepo.UpdateLastUsed(grant); err != nil {
+		logbuch.Warn("failed to update last used time of oauth grant for user %s – %v", grant.UserID, err)
+	}
+}
+
+// verifyCodeChallenge checks a pkce code verifier against the S256 challenge sent along with the authorization request
+func verifyCodeChallenge(challenge, verifier string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	hash := sha256.Sum256([]byte(verifier))
+	return subtle.ConstantTimeCompare([]byte(b64.EncodeToString(hash[:])), []byte(challenge)) == 1
+}
+
+// missingScopes returns those of the given scopes, which the grant doesn't cover yet
+func missingScopes(grant *models.OAuthGrant, scopes []string) []string {
+	missing := []string{}
+	for _, s := range scopes {
+		if !grant.HasScope(s) {
+			missing = append(missing, s)
+		}
+	}
+	return missing
+}
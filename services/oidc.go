@@ -0,0 +1,256 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/emvi/logbuch"
+	"github.com/muety/broilerplate/config"
+	"github.com/muety/broilerplate/models"
+	"github.com/muety/broilerplate/repositories"
+	"github.com/muety/broilerplate/utils"
+	"golang.org/x/oauth2"
+	"strings"
+	"sync"
+	"time"
+)
+
+// time within which the user has to complete the login at the identity provider
+const oidcLoginTimeout = 10 * time.Minute
+
+var (
+	ErrOidcAccountExists  = errors.New("an account with this username already exists")
+	ErrOidcSignupDisabled = errors.New("registration is disabled on this server, please ask an admin for an invitation")
+)
+
+type OidcService struct {
+	config      *config.Config
+	userService IUserService
+	roleService IRoleService
+	repository  repositories.IOidcIdentityRepository
+	providers   map[string]*oidcProvider
+	lock        sync.Mutex
+}
+
+type oidcProvider struct {
+	config   *config.OidcProviderConfig
+	oauth2   *oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+func NewOidcService(userService IUserService, roleService IRoleService, identityRepo repositories.IOidcIdentityRepository) *OidcService {
+	return &OidcService{
+		config:      config.Get(),
+		userService: userService,
+		roleService: roleService,
+		repository:  identityRepo,
+		providers:   map[string]*oidcProvider{},
+	}
+}
+
+func (srv *OidcService) GetProviders() []*config.OidcProviderConfig {
+	providers := make([]*config.OidcProviderConfig, len(srv.config.Security.Oidc))
+	for i := range srv.config.Security.Oidc {
+		providers[i] = &srv.config.Security.Oidc[i]
+	}
+	return providers
+}
+
+// BeginLogin returns the identity provider's authorization url to redirect the user to, along with the state to be checked upon callback
+func (srv *OidcService) BeginLogin(ctx context.Context, providerName string) (string, *models.OidcState, error) {
+	provider, err := srv.getProvider(ctx, providerName)
+	if err != nil {
+		return "", nil, err
+	}
+
+	state := &models.OidcState{Provider: providerName, ExpiresAt: time.Now().Add(oidcLoginTimeout)}
+	for _, v := range []*string{&state.State, &state.Nonce, &state.CodeVerifier} {
+		random, err := utils.RandomBytes(32)
+		if err != nil {
+			return "", nil, err
+		}
+		*v = b64.EncodeToString(random)
+	}
+
+	challenge := sha256.Sum256([]byte(state.CodeVerifier))
+	authUrl := provider.oauth2.AuthCodeURL(
+		state.State,
+		oidc.Nonce(state.Nonce),
+		oauth2.SetAuthURLParam("code_challenge", b64.EncodeToString(challenge[:])),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+	)
+
+	return authUrl, state, nil
+}
+
+// FinishLogin exchanges the authorization code, verifies the id token and returns the linked user, who is created on first login
+func (srv *OidcService) FinishLogin(ctx context.Context, state *models.OidcState, stateParam, code string) (*models.User, error) {
+	if state == nil || state.IsExpired() {
+		return nil, errors.New("login timed out, please try again")
+	}
+	if stateParam == "" || stateParam != state.State {
+		return nil, errors.New("invalid state")
+	}
+
+	provider, err := srv.getProvider(ctx, state.Provider)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := provider.oauth2.Exchange(ctx, code, oauth2.SetAuthURLParam("code_verifier", state.CodeVerifier))
+	if err != nil {
+		return nil, fmt.Errorf("failed to exchange code: %v", err)
+	}
+
+	rawIdToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, errors.New("missing id token")
+	}
+	idToken, err := provider.verifier.Verify(ctx, rawIdToken)
+	if err != nil {
+		return nil, fmt.Errorf("invalid id token: %v", err)
+	}
+	if idToken.Nonce != state.Nonce {
+		return nil, errors.New("nonce mismatch")
+	}
+
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, err
+	}
+
+	user, err := srv.resolveUser(provider.config, idToken.Subject, claims)
+	if err != nil {
+		return nil, err
+	}
+
+	if provider.config.AdminGroup != "" {
+		if err := syncAdminRole(srv.roleService, user, hasGroup(claims[provider.config.GroupsClaim], provider.config.AdminGroup)); err != nil {
+			return nil, err
+		}
+	}
+
+	return user, nil
+}
+
+func (srv *OidcService) resolveUser(providerConfig *config.OidcProviderConfig, subject string, claims map[string]interface{}) (*models.User, error) {
+	if identity, err := srv.repository.GetBySubject(providerConfig.Name, subject); err == nil {
+		return srv.userService.GetUserById(identity.UserID)
+	}
+
+	username, _ := claims[providerConfig.UsernameClaim].(string)
+	email, _ := claims[providerConfig.EmailClaim].(string)
+	emailVerified, _ := claims["email_verified"].(bool)
+	if !models.ValidateUsername(username) {
+		return nil, fmt.Errorf("missing or invalid claim '%s'", providerConfig.UsernameClaim)
+	}
+	if !models.ValidateEmail(email) {
+		email = ""
+	}
+
+	// on invitation-only servers, single sign-on is only available to existing accounts, unless the identity provider is trusted to vouch for new users
+	if !srv.config.Security.AllowSignup && !providerConfig.AutoProvision {
+		if _, err := srv.userService.GetUserById(username); err != nil {
+			return nil, ErrOidcSignupDisabled
+		}
+	}
+
+	// sso users get a random password, which they can reset later on to also log in locally
+	password, err := utils.RandomBytes(32)
+	if err != nil {
+		return nil, err
+	}
+
+	user, created, err := srv.userService.CreateOrGet(&models.Signup{
+		Username: username,
+		Email:    email,
+		Password: b64.EncodeToString(password),
+		Location: "UTC",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// only link pre-existing local accounts if both the identity provider and we ourselves have verified that the e-mail address belongs to the user,
+	// otherwise anyone could sign up with somebody else's address (either locally or at the identity provider) to take over their account
+	if !created && (!emailVerified || email == "" || !user.EmailVerified || !strings.EqualFold(user.Email, email)) {
+		return nil, ErrOidcAccountExists
+	}
+
+	if created && emailVerified && email != "" {
+		user.EmailVerified = true
+		if user, err = srv.userService.Update(user); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := srv.repository.Insert(&models.OidcIdentity{
+		ProviderName: providerConfig.Name,
+		Subject:      subject,
+		UserID:       user.ID,
+		CreatedAt:    models.CustomTime(time.Now()),
+	}); err != nil {
+		return nil, err
+	}
+
+	if created {
+		logbuch.Info("created user '%s' via single sign-on with '%s'", user.ID, providerConfig.Name)
+	} else {
+		logbuch.Info("linked user '%s' to single sign-on with '%s'", user.ID, providerConfig.Name)
+	}
+
+	return user, nil
+}
+
+// getProvider lazily performs discovery, so that unreachable identity providers don't prevent the application from starting
+func (srv *OidcService) getProvider(ctx context.Context, name string) (*oidcProvider, error) {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+
+	if p, ok := srv.providers[name]; ok {
+		return p, nil
+	}
+
+	providerConfig := srv.config.Security.GetOidcProvider(name)
+	if providerConfig == nil {
+		return nil, errors.New("unknown identity provider")
+	}
+
+	// discovery and key retrieval must not be bound to the (short-lived) request context
+	provider, err := oidc.NewProvider(context.Background(), providerConfig.Issuer)
+	if err != nil {
+		logbuch.Error("failed to discover identity provider '%s': %v", name, err)
+		return nil, errors.New("identity provider unavailable")
+	}
+
+	p := &oidcProvider{
+		config: providerConfig,
+		oauth2: &oauth2.Config{
+			ClientID:     providerConfig.ClientId,
+			ClientSecret: providerConfig.ClientSecret,
+			Endpoint:     provider.Endpoint(),
+			RedirectURL:  fmt.Sprintf("%s/login/oidc/%s/callback", srv.config.Server.GetPublicUrl(), name),
+			Scopes:       providerConfig.GetScopes(),
+		},
+		verifier: provider.Verifier(&oidc.Config{ClientID: providerConfig.ClientId}),
+	}
+	srv.providers[name] = p
+
+	return p, nil
+}
+
+func hasGroup(groupsClaim interface{}, group string) bool {
+	switch groups := groupsClaim.(type) {
+	case string:
+		return groups == group
+	case []interface{}:
+		for _, g := range groups {
+			if s, ok := g.(string); ok && s == group {
+				return true
+			}
+		}
+	}
+	return false
+}
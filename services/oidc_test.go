@@ -0,0 +1,340 @@
+package services
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/muety/broilerplate/config"
+	"github.com/muety/broilerplate/models"
+	"github.com/muety/broilerplate/repositories"
+)
+
+const (
+	testOidcProvider = "idp"
+	testOidcClientId = "broilerplate"
+)
+
+// stubIdp is a minimal openid connect provider, serving discovery, keys and the token endpoint (with pkce), while the user's
+// interaction at the authorization endpoint is simulated by authorize()
+type stubIdp struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	codes  map[string]*stubAuthorization
+	lock   sync.Mutex
+}
+
+type stubAuthorization struct {
+	challenge string
+	nonce     string
+	claims    map[string]interface{}
+}
+
+func newStubIdp(t *testing.T) *stubIdp {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idp := &stubIdp{key: key, codes: map[string]*stubAuthorization{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", idp.handleDiscovery)
+	mux.HandleFunc("/keys", idp.handleKeys)
+	mux.HandleFunc("/token", idp.handleToken)
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+
+	return idp
+}
+
+func (idp *stubIdp) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	issuer := idp.server.URL
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"issuer":                                issuer,
+		"authorization_endpoint":                issuer + "/authorize",
+		"token_endpoint":                        issuer + "/token",
+		"jwks_uri":                              issuer + "/keys",
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (idp *stubIdp) handleKeys(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test",
+			"alg": "RS256",
+			"use": "sig",
+			"n":   b64.EncodeToString(idp.key.N.Bytes()),
+			"e":   b64.EncodeToString(big.NewInt(int64(idp.key.E)).Bytes()),
+		}},
+	})
+}
+
+func (idp *stubIdp) handleToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("grant_type") != "authorization_code" {
+		idp.tokenError(w, "invalid_request")
+		return
+	}
+
+	// codes can only be redeemed once
+	idp.lock.Lock()
+	authorization, ok := idp.codes[r.PostForm.Get("code")]
+	delete(idp.codes, r.PostForm.Get("code"))
+	idp.lock.Unlock()
+	if !ok {
+		idp.tokenError(w, "invalid_grant")
+		return
+	}
+
+	verifierHash := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if b64.EncodeToString(verifierHash[:]) != authorization.challenge {
+		idp.tokenError(w, "invalid_grant")
+		return
+	}
+
+	claims := map[string]interface{}{
+		"iss":   idp.server.URL,
+		"aud":   testOidcClientId,
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": authorization.nonce,
+	}
+	for k, v := range authorization.claims {
+		claims[k] = v
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": "access-token",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idp.sign(claims),
+	})
+}
+
+func (idp *stubIdp) tokenError(w http.ResponseWriter, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{"error": code})
+}
+
+func (idp *stubIdp) sign(claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signingInput := b64.EncodeToString(header) + "." + b64.EncodeToString(payload)
+
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, _ := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, digest[:])
+	return signingInput + "." + b64.EncodeToString(signature)
+}
+
+// authorize simulates the user logging in at the identity provider, who then redirects back with an authorization code
+func (idp *stubIdp) authorize(t *testing.T, authUrl string, claims map[string]interface{}) (string, string) {
+	u, err := url.Parse(authUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+	if query.Get("client_id") != testOidcClientId || query.Get("code_challenge_method") != "S256" {
+		t.Fatalf("unexpected authorization request %s", authUrl)
+	}
+
+	code := fmt.Sprintf("code-%d", time.Now().UnixNano())
+	idp.lock.Lock()
+	idp.codes[code] = &stubAuthorization{challenge: query.Get("code_challenge"), nonce: query.Get("nonce"), claims: claims}
+	idp.lock.Unlock()
+
+	return query.Get("state"), code
+}
+
+func setupOidcService(t *testing.T, users ...*models.User) (*OidcService, *stubIdp) {
+	idp := newStubIdp(t)
+
+	cfg := setupTestConfig()
+	cfg.Security.Oidc = []config.OidcProviderConfig{{
+		Name:          testOidcProvider,
+		Issuer:        idp.server.URL,
+		ClientId:      testOidcClientId,
+		ClientSecret:  "secret",
+		UsernameClaim: "preferred_username",
+		EmailClaim:    "email",
+	}}
+
+	db := setupTestDb(t, &models.User{}, &models.OidcIdentity{})
+	return NewOidcService(newUserServiceStub(users...), nil, repositories.NewOidcIdentityRepository(db)), idp
+}
+
+func userClaims(subject, username, email string, emailVerified bool) map[string]interface{} {
+	return map[string]interface{}{
+		"sub":                subject,
+		"preferred_username": username,
+		"email":              email,
+		"email_verified":     emailVerified,
+	}
+}
+
+func loginWithStubIdp(t *testing.T, srv *OidcService, idp *stubIdp, claims map[string]interface{}) (*models.User, error) {
+	authUrl, state, err := srv.BeginLogin(context.Background(), testOidcProvider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateParam, code := idp.authorize(t, authUrl, claims)
+	return srv.FinishLogin(context.Background(), state, stateParam, code)
+}
+
+func TestOidcService_CreatesAndRecognizesUsers(t *testing.T) {
+	srv, idp := setupOidcService(t)
+
+	user, err := loginWithStubIdp(t, srv, idp, userClaims("sub-1", "alice", "alice@example.org", true))
+	if err != nil {
+		t.Fatalf("login failed: %v", err)
+	}
+	if user.ID != "alice" || user.Email != "alice@example.org" || !user.EmailVerified {
+		t.Errorf("unexpected user %+v", user)
+	}
+
+	// users are recognized by their subject, even if their username changed at the identity provider
+	user, err = loginWithStubIdp(t, srv, idp, userClaims("sub-1", "alice2", "alice@example.org", true))
+	if err != nil {
+		t.Fatalf("login failed: %v", err)
+	}
+	if user.ID != "alice" {
+		t.Errorf("expected user 'alice', got '%s'", user.ID)
+	}
+}
+
+func TestOidcService_DoesNotTrustUnverifiedEmail(t *testing.T) {
+	srv, idp := setupOidcService(t)
+
+	user, err := loginWithStubIdp(t, srv, idp, userClaims("sub-1", "alice", "alice@example.org", false))
+	if err != nil {
+		t.Fatalf("login failed: %v", err)
+	}
+	if user.EmailVerified {
+		t.Error("expected e-mail address to not be verified")
+	}
+}
+
+func TestOidcService_RespectsDisabledSignup(t *testing.T) {
+	carol := &models.User{ID: "carol", Email: "carol@example.org", EmailVerified: true}
+
+	srv, idp := setupOidcService(t, carol)
+	srv.config.Security.AllowSignup = false
+
+	if _, err := loginWithStubIdp(t, srv, idp, userClaims("sub-1", "alice", "alice@example.org", true)); err != ErrOidcSignupDisabled {
+		t.Errorf("expected %v, got %v", ErrOidcSignupDisabled, err)
+	}
+	if user, err := loginWithStubIdp(t, srv, idp, userClaims("sub-2", "carol", "carol@example.org", true)); err != nil || user.ID != carol.ID {
+		t.Errorf("expected existing account to be linked, got %v", err)
+	}
+
+	srv, idp = setupOidcService(t)
+	srv.config.Security.AllowSignup = false
+	srv.config.Security.Oidc[0].AutoProvision = true
+
+	if user, err := loginWithStubIdp(t, srv, idp, userClaims("sub-1", "alice", "alice@example.org", true)); err != nil || user.ID != "alice" {
+		t.Errorf("expected user to be created, got %v", err)
+	}
+}
+
+func TestOidcService_RejectsInvalidCallbacks(t *testing.T) {
+	srv, idp := setupOidcService(t)
+	claims := userClaims("sub-1", "alice", "alice@example.org", true)
+
+	tests := []struct {
+		name   string
+		tamper func(state *models.OidcState, stateParam, code *string)
+	}{
+		{"state mismatch", func(_ *models.OidcState, stateParam, _ *string) { *stateParam = "forged" }},
+		{"missing state", func(_ *models.OidcState, stateParam, _ *string) { *stateParam = "" }},
+		{"expired state", func(state *models.OidcState, _, _ *string) { state.ExpiresAt = time.Now().Add(-time.Second) }},
+		{"nonce mismatch", func(state *models.OidcState, _, _ *string) { state.Nonce = "forged" }},
+		{"pkce mismatch", func(state *models.OidcState, _, _ *string) { state.CodeVerifier = "forged" }},
+		{"unknown code", func(_ *models.OidcState, _, code *string) { *code = "forged" }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authUrl, state, err := srv.BeginLogin(context.Background(), testOidcProvider)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stateParam, code := idp.authorize(t, authUrl, claims)
+			tt.tamper(state, &stateParam, &code)
+			if _, err := srv.FinishLogin(context.Background(), state, stateParam, code); err == nil {
+				t.Error("expected login to fail")
+			}
+		})
+	}
+
+	t.Run("code replay", func(t *testing.T) {
+		authUrl, state, err := srv.BeginLogin(context.Background(), testOidcProvider)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stateParam, code := idp.authorize(t, authUrl, claims)
+		if _, err := srv.FinishLogin(context.Background(), state, stateParam, code); err != nil {
+			t.Fatalf("login failed: %v", err)
+		}
+		if _, err := srv.FinishLogin(context.Background(), state, stateParam, code); err == nil {
+			t.Error("expected login to fail")
+		}
+	})
+}
+
+func TestOidcService_LinksExistingAccounts(t *testing.T) {
+	tests := []struct {
+		name          string
+		localEmail    string
+		localVerified bool
+		claims        map[string]interface{}
+		expectLinked  bool
+	}{
+		{"both verified", "carol@example.org", true, userClaims("sub-1", "carol", "Carol@example.org", true), true},
+		{"unverified at identity provider", "carol@example.org", true, userClaims("sub-1", "carol", "carol@example.org", false), false},
+		{"unverified locally", "carol@example.org", false, userClaims("sub-1", "carol", "carol@example.org", true), false},
+		{"different address", "carol@example.org", true, userClaims("sub-1", "carol", "mallory@example.org", true), false},
+		{"no address", "carol@example.org", true, userClaims("sub-1", "carol", "", true), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			local := &models.User{ID: "carol", Email: tt.localEmail, EmailVerified: tt.localVerified}
+			srv, idp := setupOidcService(t, local)
+
+			user, err := loginWithStubIdp(t, srv, idp, tt.claims)
+			if !tt.expectLinked {
+				if err != ErrOidcAccountExists {
+					t.Errorf("expected %v, got %v", ErrOidcAccountExists, err)
+				}
+				if _, err := srv.repository.GetBySubject(testOidcProvider, "sub-1"); err == nil {
+					t.Error("expected identity to not be linked")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("login failed: %v", err)
+			}
+			if user.ID != local.ID {
+				t.Errorf("expected user '%s', got '%s'", local.ID, user.ID)
+			}
+			if identity, err := srv.repository.GetBySubject(testOidcProvider, "sub-1"); err != nil || identity.UserID != local.ID {
+				t.Errorf("expected identity to be linked to '%s'", local.ID)
+			}
+		})
+	}
+}
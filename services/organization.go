@@ -0,0 +1,355 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/emvi/logbuch"
+	"github.com/leandro-lugaresi/hub"
+	"github.com/muety/broilerplate/config"
+	"github.com/muety/broilerplate/models"
+	"github.com/muety/broilerplate/repositories"
+	"github.com/muety/broilerplate/utils"
+	uuid "github.com/satori/go.uuid"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNotAMember           = errors.New("not a member of this organization")
+	ErrAlreadyMember        = errors.New("already a member of this organization")
+	ErrInsufficientOrgRole  = errors.New("your role within this organization doesn't allow this")
+	ErrLastOwner            = errors.New("an organization needs at least one owner")
+	ErrOrgInvitationInvalid = errors.New("invalid invitation")
+	ErrOrgInvitationExpired = errors.New("invitation has expired")
+	ErrOrgInvitationEmail   = errors.New("this invitation was sent to a different e-mail address than your confirmed one")
+)
+
+// OrganizationService handles organizations and their members. Operations within an organization are always performed
+// on behalf of the acting user's membership, which determines both the tenant and whether the action is permitted.
+type OrganizationService struct {
+	config      *config.Config
+	userService IUserService
+	mailService IMailService
+	repository  repositories.IOrganizationRepository
+	memberships repositories.IMembershipRepository
+	invitations repositories.IOrganizationInvitationRepository
+}
+
+func NewOrganizationService(userService IUserService, mailService IMailService, organizationRepo repositories.IOrganizationRepository, membershipRepo repositories.IMembershipRepository, invitationRepo repositories.IOrganizationInvitationRepository) *OrganizationService {
+	srv := &OrganizationService{
+		config:      config.Get(),
+		userService: userService,
+		mailService: mailService,
+		repository:  organizationRepo,
+		memberships: membershipRepo,
+		invitations: invitationRepo,
+	}
+
+	// memberships are deleted along with the user, but organizations left without any member have to be cleaned up
+	config.HandleEvents(config.EventBus().Subscribe(0, config.EventUserDelete), func(hub.Message) {
+		if n, err := srv.repository.DeleteOrphaned(); err != nil {
+			logbuch.Error("failed to delete organizations without members – %v", err)
+		} else if n > 0 {
+			logbuch.Info("deleted %d organization(s) left without members", n)
+		}
+	})
+
+	return srv
+}
+
+// Create sets up a new organization owned by the given user and switches to it
+func (srv *OrganizationService) Create(user *models.User, name string) (*models.Membership, error) {
+	membership := &models.Membership{
+		UserID:    user.ID,
+		Role:      models.OrgRoleOwner,
+		CreatedAt: models.CustomTime(time.Now()),
+	}
+	org, err := srv.repository.Insert(&models.Organization{
+		ID:        uuid.NewV4().String(),
+		Name:      strings.TrimSpace(name),
+		CreatedAt: models.CustomTime(time.Now()),
+	}, membership)
+	if err != nil {
+		return nil, err
+	}
+	membership.Organization = org
+
+	if err := srv.Switch(user, org.ID); err != nil {
+		return nil, err
+	}
+	return membership, nil
+}
+
+func (srv *OrganizationService) GetMemberships(user *models.User) ([]*models.Membership, error) {
+	return srv.memberships.GetByUser(user.ID)
+}
+
+// GetActive resolves the membership of the organization the user is currently working in, falling back to their oldest
+// membership, if they never switched or left the organization in the meantime, and nil if they don't belong to any
+func (srv *OrganizationService) GetActive(user *models.User) (*models.Membership, error) {
+	if user.ActiveOrganizationID != "" {
+		if membership, err := srv.memberships.Get(user.ActiveOrganizationID, user.ID); err == nil {
+			return membership, nil
+		}
+	}
+
+	memberships, err := srv.memberships.GetByUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if len(memberships) == 0 {
+		return nil, nil
+	}
+	return memberships[0], nil
+}
+
+// GetSoleOwnerships returns the memberships of organizations the user is the only owner of, while there are other members, who would be left without an owner if the user was gone
+func (srv *OrganizationService) GetSoleOwnerships(user *models.User) ([]*models.Membership, error) {
+	memberships, err := srv.memberships.GetByUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*models.Membership, 0)
+	for _, m := range memberships {
+		if !m.IsOwner() {
+			continue
+		}
+		if err := srv.checkNotLastOwner(m.OrganizationID); err != ErrLastOwner {
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		members, err := srv.memberships.GetByOrganization(m.OrganizationID)
+		if err != nil {
+			return nil, err
+		}
+		if len(members) > 1 {
+			result = append(result, m)
+		}
+	}
+	return result, nil
+}
+
+func (srv *OrganizationService) Switch(user *models.User, orgId string) error {
+	if _, err := srv.memberships.Get(orgId, user.ID); err != nil {
+		return ErrNotAMember
+	}
+	if user.ActiveOrganizationID == orgId {
+		return nil
+	}
+	user.ActiveOrganizationID = orgId
+	_, err := srv.userService.Update(user)
+	return err
+}
+
+func (srv *OrganizationService) GetMembers(actor *models.Membership) ([]*models.Membership, error) {
+	return srv.memberships.GetByOrganization(actor.OrganizationID)
+}
+
+func (srv *OrganizationService) Rename(actor *models.Membership, name string) error {
+	if !actor.IsOwner() {
+		return ErrInsufficientOrgRole
+	}
+	_, err := srv.repository.Update(&models.Organization{ID: actor.OrganizationID, Name: strings.TrimSpace(name)})
+	return err
+}
+
+// Delete removes the organization along with all memberships and pending invitations
+func (srv *OrganizationService) Delete(actor *models.Membership) error {
+	if !actor.IsOwner() {
+		return ErrInsufficientOrgRole
+	}
+	return srv.repository.Delete(actor.OrganizationID)
+}
+
+// UpdateRole changes another member's role, while only owners may hand out or take away ownership
+func (srv *OrganizationService) UpdateRole(actor *models.Membership, userId, role string) error {
+	target, err := srv.getManageableMember(actor, userId)
+	if err != nil {
+		return err
+	}
+	if role == models.OrgRoleOwner && !actor.IsOwner() {
+		return ErrInsufficientOrgRole
+	}
+	if target.IsOwner() && role != models.OrgRoleOwner {
+		if err := srv.checkNotLastOwner(actor.OrganizationID); err != nil {
+			return err
+		}
+	}
+	return srv.memberships.UpdateRole(actor.OrganizationID, userId, role)
+}
+
+func (srv *OrganizationService) RemoveMember(actor *models.Membership, userId string) error {
+	target, err := srv.getManageableMember(actor, userId)
+	if err != nil {
+		return err
+	}
+	if target.IsOwner() {
+		if err := srv.checkNotLastOwner(actor.OrganizationID); err != nil {
+			return err
+		}
+	}
+	return srv.memberships.Delete(actor.OrganizationID, userId)
+}
+
+func (srv *OrganizationService) Leave(actor *models.Membership) error {
+	if actor.IsOwner() {
+		if err := srv.checkNotLastOwner(actor.OrganizationID); err != nil {
+			return err
+		}
+	}
+	return srv.memberships.Delete(actor.OrganizationID, actor.UserID)
+}
+
+// Invite creates an invitation to the actor's organization and mails the link asynchronously, the link is also returned, as the plain token is not stored
+func (srv *OrganizationService) Invite(actor *models.Membership, inviter *models.User, email, role string) (*models.OrganizationInvitation, string, error) {
+	if !actor.CanManage() || (role == models.OrgRoleOwner && !actor.IsOwner()) {
+		return nil, "", ErrInsufficientOrgRole
+	}
+
+	random, err := utils.RandomBytes(32)
+	if err != nil {
+		return nil, "", err
+	}
+	token := b64.EncodeToString(random)
+
+	invitation, err := srv.invitations.Insert(&models.OrganizationInvitation{
+		ID:             uuid.NewV4().String(),
+		OrganizationID: actor.OrganizationID,
+		TokenHash:      utils.HashSha256(token),
+		Email:          email,
+		Role:           role,
+		InviterID:      inviter.ID,
+		CreatedAt:      models.CustomTime(time.Now()),
+		ExpiresAt:      models.CustomTime(time.Now().Add(srv.config.Security.GetInvitationTtl())),
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	link := fmt.Sprintf("%s/organizations/join?token=%s", srv.config.Server.GetPublicUrl(), url.QueryEscape(token))
+
+	if srv.config.Mail.Enabled {
+		config.RunInBackground(func() {
+			if err := srv.mailService.SendOrganizationInvitation(inviter, actor.Organization, email, link); err != nil {
+				logbuch.Error("failed to send organization invitation mail from %s – %v", inviter.ID, err)
+			} else {
+				logbuch.Info("sent organization invitation mail from %s", inviter.ID)
+			}
+		})
+	}
+
+	return invitation, link, nil
+}
+
+func (srv *OrganizationService) GetInvitations(actor *models.Membership) ([]*models.OrganizationInvitation, error) {
+	if !actor.CanManage() {
+		return nil, ErrInsufficientOrgRole
+	}
+	return srv.invitations.GetByOrganization(actor.OrganizationID)
+}
+
+func (srv *OrganizationService) DeleteInvitation(actor *models.Membership, id string) error {
+	if !actor.CanManage() {
+		return ErrInsufficientOrgRole
+	}
+	ok, err := srv.invitations.Delete(actor.OrganizationID, id)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrOrgInvitationInvalid
+	}
+	return nil
+}
+
+// GetInvitation resolves the (not yet expired) invitation belonging to the given plain token
+func (srv *OrganizationService) GetInvitation(token string) (*models.OrganizationInvitation, error) {
+	invitation, err := srv.invitations.GetByHash(utils.HashSha256(token))
+	if err != nil {
+		return nil, ErrOrgInvitationInvalid
+	}
+	if invitation.IsExpired() {
+		return nil, ErrOrgInvitationExpired
+	}
+	return invitation, nil
+}
+
+// AcceptInvitation makes the user a member with the invited role and consumes the invitation
+func (srv *OrganizationService) AcceptInvitation(user *models.User, token string) (*models.Membership, error) {
+	invitation, err := srv.GetInvitation(token)
+	if err != nil {
+		return nil, err
+	}
+	// links get forwarded or leak, so only the one the invitation was addressed to may accept it
+	if !user.EmailVerified || !strings.EqualFold(strings.TrimSpace(user.Email), strings.TrimSpace(invitation.Email)) {
+		return nil, ErrOrgInvitationEmail
+	}
+	if _, err := srv.memberships.Get(invitation.OrganizationID, user.ID); err == nil {
+		return nil, ErrAlreadyMember
+	}
+
+	// deleting first makes sure the invitation can only be used once, even under concurrent requests
+	if ok, err := srv.invitations.Delete(invitation.OrganizationID, invitation.ID); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, ErrOrgInvitationInvalid
+	}
+
+	membership, err := srv.memberships.Insert(&models.Membership{
+		OrganizationID: invitation.OrganizationID,
+		UserID:         user.ID,
+		Role:           invitation.Role,
+		CreatedAt:      models.CustomTime(time.Now()),
+	})
+	if err != nil {
+		return nil, err
+	}
+	membership.Organization = invitation.Organization
+
+	if err := srv.Switch(user, invitation.OrganizationID); err != nil {
+		return nil, err
+	}
+	return membership, nil
+}
+
+// ScheduleCleanup periodically deletes expired organization invitations
+func (srv *OrganizationService) ScheduleCleanup(ctx context.Context, interval time.Duration) {
+	config.RunPeriodically(ctx, interval, func() {
+		if n, err := srv.invitations.DeleteByExpiresBefore(time.Now()); err != nil {
+			logbuch.Error("failed to clean up expired organization invitations – %v", err)
+		} else if n > 0 {
+			logbuch.Info("cleaned up %d expired organization invitations", n)
+		}
+	})
+}
+
+// getManageableMember returns another member of the actor's organization, provided the actor may manage them
+func (srv *OrganizationService) getManageableMember(actor *models.Membership, userId string) (*models.Membership, error) {
+	if !actor.CanManage() {
+		return nil, ErrInsufficientOrgRole
+	}
+	target, err := srv.memberships.Get(actor.OrganizationID, userId)
+	if err != nil {
+		return nil, ErrNotAMember
+	}
+	if target.IsOwner() && !actor.IsOwner() {
+		return nil, ErrInsufficientOrgRole
+	}
+	return target, nil
+}
+
+func (srv *OrganizationService) checkNotLastOwner(orgId string) error {
+	count, err := srv.memberships.CountByRole(orgId, models.OrgRoleOwner)
+	if err != nil {
+		return err
+	}
+	if count <= 1 {
+		return ErrLastOwner
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+package services
+
+import (
+	"errors"
+	"github.com/emvi/logbuch"
+	"github.com/muety/broilerplate/models"
+	"github.com/muety/broilerplate/repositories"
+	"github.com/patrickmn/go-cache"
+	"time"
+)
+
+var (
+	ErrRoleNotFound = errors.New("role not found")
+	ErrBuiltinRole  = errors.New("built-in roles can not be modified")
+	ErrLastAdmin    = errors.New("can not remove the last admin")
+)
+
+type RoleService struct {
+	cache       *cache.Cache
+	userService IUserService
+	repository  repositories.IRoleRepository
+}
+
+func NewRoleService(userService IUserService, roleRepo repositories.IRoleRepository) *RoleService {
+	return &RoleService{
+		// short expiry, as roles might be changed by another instance
+		cache:       cache.New(1*time.Minute, 2*time.Minute),
+		userService: userService,
+		repository:  roleRepo,
+	}
+}
+
+// EnsureDefaults seeds all known permissions and makes sure the built-in admin role holds every one of them
+func (srv *RoleService) EnsureDefaults() error {
+	permissions := make([]*models.Permission, 0, len(models.Permissions))
+	for name, description := range models.Permissions {
+		p := &models.Permission{Name: name, Description: description}
+		if err := srv.repository.UpsertPermission(p); err != nil {
+			return err
+		}
+		permissions = append(permissions, p)
+	}
+
+	_, err := srv.repository.Upsert(&models.Role{
+		Name:        models.RoleAdmin,
+		Description: "Full access to all administrative functions",
+		Permissions: permissions,
+	})
+	srv.cache.Flush()
+	return err
+}
+
+func (srv *RoleService) GetAll() ([]*models.Role, error) {
+	return srv.repository.GetAll()
+}
+
+func (srv *RoleService) GetByName(name string) (*models.Role, error) {
+	role, err := srv.repository.GetByName(name)
+	if err != nil {
+		return nil, ErrRoleNotFound
+	}
+	return role, nil
+}
+
+func (srv *RoleService) GetByUser(user *models.User) ([]*models.Role, error) {
+	return srv.repository.GetByUser(user.ID)
+}
+
+func (srv *RoleService) GetPermissions() ([]*models.Permission, error) {
+	return srv.repository.GetPermissions()
+}
+
+func (srv *RoleService) HasPermission(user *models.User, permission string) bool {
+	if user == nil {
+		return false
+	}
+	permissions, err := srv.getUserPermissions(user)
+	if err != nil {
+		logbuch.Error("failed to fetch permissions of user %s – %v", user.ID, err)
+		return false
+	}
+	_, ok := permissions[permission]
+	return ok
+}
+
+// HasAllPermissionsOf tells whether the user holds every permission of the other one, i.e. whether acting as them would not grant anything more
+func (srv *RoleService) HasAllPermissionsOf(user, other *models.User) bool {
+	if user == nil || other == nil {
+		return false
+	}
+	permissions, err := srv.getUserPermissions(user)
+	if err != nil {
+		logbuch.Error("failed to fetch permissions of user %s – %v", user.ID, err)
+		return false
+	}
+	otherPermissions, err := srv.getUserPermissions(other)
+	if err != nil {
+		logbuch.Error("failed to fetch permissions of user %s – %v", other.ID, err)
+		return false
+	}
+	for p := range otherPermissions {
+		if !permissions[p] {
+			return false
+		}
+	}
+	return true
+}
+
+// Save creates a custom role or updates an existing one, replacing its permissions
+func (srv *RoleService) Save(request *models.RoleSaveRequest) (*models.Role, error) {
+	if request.Name == models.RoleAdmin {
+		return nil, ErrBuiltinRole
+	}
+
+	role := &models.Role{
+		Name:        request.Name,
+		Description: request.Description,
+		Permissions: make([]*models.Permission, 0, len(request.Permissions)),
+	}
+	for _, p := range request.Permissions {
+		role.Permissions = append(role.Permissions, &models.Permission{Name: p})
+	}
+
+	defer srv.cache.Flush()
+	if _, err := srv.repository.Upsert(role); err != nil {
+		return nil, err
+	}
+	return srv.repository.GetByName(role.Name)
+}
+
+func (srv *RoleService) Delete(name string) error {
+	if name == models.RoleAdmin {
+		return ErrBuiltinRole
+	}
+	if _, err := srv.GetByName(name); err != nil {
+		return err
+	}
+
+	defer srv.cache.Flush()
+	return srv.repository.Delete(name)
+}
+
+// Assign grants the role to the user, the admin role is additionally mirrored to the user's IsAdmin flag
+func (srv *RoleService) Assign(user *models.User, roleName string) error {
+	if _, err := srv.GetByName(roleName); err != nil {
+		return err
+	}
+	if err := srv.repository.Assign(user.ID, roleName); err != nil {
+		return err
+	}
+	srv.cache.Delete(user.ID)
+
+	if roleName == models.RoleAdmin && !user.IsAdmin {
+		user.IsAdmin = true
+		if _, err := srv.userService.Update(user); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (srv *RoleService) Unassign(user *models.User, roleName string) error {
+	if roleName == models.RoleAdmin {
+		count, err := srv.repository.CountUsers(models.RoleAdmin)
+		if err != nil {
+			return err
+		}
+		if count <= 1 && srv.hasRole(user, models.RoleAdmin) {
+			return ErrLastAdmin
+		}
+	}
+
+	if err := srv.repository.Unassign(user.ID, roleName); err != nil {
+		return err
+	}
+	srv.cache.Delete(user.ID)
+
+	if roleName == models.RoleAdmin && user.IsAdmin {
+		user.IsAdmin = false
+		if _, err := srv.userService.Update(user); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncAdminRole grants or revokes admin rights according to an external identity source, like group memberships at an identity provider
+func syncAdminRole(roleService IRoleService, user *models.User, isAdmin bool) error {
+	if isAdmin && !user.IsAdmin {
+		return roleService.Assign(user, models.RoleAdmin)
+	}
+	if !isAdmin && user.IsAdmin {
+		if err := roleService.Unassign(user, models.RoleAdmin); err == ErrLastAdmin {
+			logbuch.Warn("not revoking admin role from %s, as they are the last admin", user.ID)
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (srv *RoleService) hasRole(user *models.User, roleName string) bool {
+	roles, err := srv.repository.GetByUser(user.ID)
+	if err != nil {
+		return false
+	}
+	for _, r := range roles {
+		if r.Name == roleName {
+			return true
+		}
+	}
+	return false
+}
+
+func (srv *RoleService) getUserPermissions(user *models.User) (map[string]bool, error) {
+	if permissions, ok := srv.cache.Get(user.ID); ok {
+		return permissions.(map[string]bool), nil
+	}
+
+	roles, err := srv.repository.GetByUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	permissions := map[string]bool{}
+	for _, r := range roles {
+		for _, p := range r.Permissions {
+			permissions[p.Name] = true
+		}
+	}
+
+	srv.cache.SetDefault(user.ID, permissions)
+	return permissions, nil
+}
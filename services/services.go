@@ -1,7 +1,11 @@
 package services
 
 import (
+	"context"
+	"crypto/x509"
+	"github.com/muety/broilerplate/config"
 	"github.com/muety/broilerplate/models"
+	"time"
 )
 
 type IKeyValueService interface {
@@ -9,23 +13,200 @@ type IKeyValueService interface {
 	MustGetString(string) *models.KeyStringValue
 	PutString(*models.KeyStringValue) error
 	DeleteString(string) error
+	GetOrCreateSecret(string, int) ([]byte, error)
+}
+
+type ICookieKeyService interface {
+	Load() error
+	Rotate() error
+	ScheduleReload(context.Context, time.Duration)
 }
 
 type IMailService interface {
 	SendPasswordReset(*models.User, string) error
+	SendEmailVerification(*models.User, string, string) error
+	SendInvitation(*models.User, string, string) error
+	SendOrganizationInvitation(*models.User, *models.Organization, string, string) error
+	SendAccountLocked(*models.User, string, time.Time) error
+	SendMagicLink(*models.User, string) error
+	SendNewLogin(*models.User, time.Time, string, string) error
+}
+
+type ISessionService interface {
+	Create(*models.User, string, string) (*models.Session, error)
+	GetValidById(string) (*models.Session, error)
+	GetByUser(*models.User) ([]*models.Session, error)
+	Delete(*models.Session) error
+	DeleteByUser(*models.User) error
+	ScheduleCleanup(context.Context, time.Duration)
+}
+
+type ITotpService interface {
+	StartEnrollment(*models.User) (string, error)
+	CompleteEnrollment(*models.User, string) ([]string, error)
+	Verify(*models.User, string) error
+	RegenerateRecoveryCodes(*models.User) ([]string, error)
+	Disable(*models.User) error
+}
+
+type IWebauthnService interface {
+	BeginRegistration(*models.User) (*models.WebauthnOptions, *models.WebauthnSession, error)
+	FinishRegistration(*models.User, string, *models.WebauthnRegistration) (*models.WebauthnCredential, error)
+	BeginLogin(*models.User) (*models.WebauthnOptions, *models.WebauthnSession, error)
+	FinishLogin(string, *models.WebauthnAssertion) (*models.User, error)
+	GetSession(string) (*models.WebauthnSession, error)
+	GetByUser(*models.User) ([]*models.WebauthnCredential, error)
+	HasCredentials(*models.User) bool
+	Delete(*models.User, string) error
+	ScheduleCleanup(context.Context, time.Duration)
+}
+
+type IApiTokenService interface {
+	Create(*models.User, string, []string, *time.Time) (string, *models.ApiToken, error)
+	GetValidByToken(string) (*models.ApiToken, error)
+	GetByUser(*models.User) ([]*models.ApiToken, error)
+	Delete(*models.User, string) error
+	DeleteByUser(*models.User) error
+}
+
+type IEmailVerificationService interface {
+	Send(*models.User, string) error
+	Resend(*models.User) error
+	RequestChange(*models.User, string) error
+	Verify(string) (*models.User, error)
+	IsLoginPermitted(*models.User) bool
+	ScheduleCleanup(context.Context, time.Duration)
+}
+
+type IAuditService interface {
+	Search(string, *models.AuditEventQuery) ([]*models.AuditEvent, int64, error)
+	Export(string, *models.AuditEventQuery) ([]*models.AuditEvent, error)
+	GetByUser(*models.User) ([]*models.AuditEvent, error)
+	Verify() (*models.AuditChainStatus, error)
+	ScheduleCleanup(context.Context, time.Duration)
+}
+
+// IAuthenticator checks a username and password, failing with ErrUnknownUser or ErrInvalidCredentials
+type IAuthenticator interface {
+	Authenticate(string, string) (*models.User, error)
+}
+
+type IMagicLinkService interface {
+	Send(*models.User) error
+	Consume(string) (*models.User, error)
+	ScheduleCleanup(context.Context, time.Duration)
+}
+
+type IKnownDeviceService interface {
+	Observe(*models.User, string, string) error
+	GetByUser(*models.User) ([]*models.KnownDevice, error)
+	ScheduleCleanup(context.Context, time.Duration)
+}
+
+type IClientCertificateService interface {
+	GetUserByCertificate(*x509.Certificate) (*models.User, error)
+	GetByOrganization(string) ([]*models.ClientCertificate, error)
+	GetByUser(*models.User) ([]*models.ClientCertificate, error)
+	Create(*models.User, string, string, *models.AuditOrigin) (*models.ClientCertificate, error)
+	Delete(string, string, *models.AuditOrigin) error
+}
+
+type IOAuthService interface {
+	GetClients() ([]*models.OAuthClient, error)
+	GetClient(string) (*models.OAuthClient, error)
+	CreateClient(*models.OAuthClientCreateRequest, *models.AuditOrigin) (*models.OAuthClient, string, error)
+	DeleteClient(string, *models.AuditOrigin) error
+	AuthenticateClient(string, string) (*models.OAuthClient, error)
+	ValidateAuthorizeRequest(*models.User, *models.OAuthClient, *models.OAuthAuthorizeRequest) ([]string, error)
+	HasConsent(*models.User, *models.OAuthClient, []string) bool
+	Authorize(*models.User, *models.OAuthClient, *models.OAuthAuthorizeRequest, []string, *models.AuditOrigin) (string, error)
+	ExchangeCode(*models.OAuthClient, string, string, string) (*models.OAuthTokenResponse, error)
+	Refresh(*models.OAuthClient, string, []string) (*models.OAuthTokenResponse, error)
+	Introspect(*models.OAuthClient, string) *models.OAuthIntrospection
+	GetValidByAccessToken(string) (*models.OAuthToken, error)
+	GetGrantsByUser(*models.User) ([]*models.OAuthGrant, error)
+	RevokeGrant(*models.User, string, *models.AuditOrigin) error
+	ScheduleCleanup(context.Context, time.Duration)
+}
+
+type IInvitationService interface {
+	Create(*models.User, string) (*models.Invitation, string, error)
+	GetAll() ([]*models.Invitation, error)
+	GetValid(string) (*models.Invitation, error)
+	Consume(*models.Invitation, *models.User) error
+	Delete(string) error
+}
+
+type IThrottleService interface {
+	CheckLogin(string, string) time.Duration
+	RegisterLoginFailure(string, string)
+	RegisterLoginSuccess(string, string)
+	CheckPasswordReset(string, string) time.Duration
+	RegisterPasswordReset(string, string)
+	ScheduleCleanup(context.Context, time.Duration)
+}
+
+type IOidcService interface {
+	GetProviders() []*config.OidcProviderConfig
+	BeginLogin(context.Context, string) (string, *models.OidcState, error)
+	FinishLogin(context.Context, *models.OidcState, string, string) (*models.User, error)
+}
+
+type IRoleService interface {
+	EnsureDefaults() error
+	GetAll() ([]*models.Role, error)
+	GetByName(string) (*models.Role, error)
+	GetByUser(*models.User) ([]*models.Role, error)
+	GetPermissions() ([]*models.Permission, error)
+	HasPermission(*models.User, string) bool
+	HasAllPermissionsOf(*models.User, *models.User) bool
+	Save(*models.RoleSaveRequest) (*models.Role, error)
+	Delete(string) error
+	Assign(*models.User, string) error
+	Unassign(*models.User, string) error
+}
+
+type IOrganizationService interface {
+	Create(*models.User, string) (*models.Membership, error)
+	GetMemberships(*models.User) ([]*models.Membership, error)
+	GetActive(*models.User) (*models.Membership, error)
+	GetSoleOwnerships(*models.User) ([]*models.Membership, error)
+	Switch(*models.User, string) error
+	GetMembers(*models.Membership) ([]*models.Membership, error)
+	Rename(*models.Membership, string) error
+	Delete(*models.Membership) error
+	UpdateRole(*models.Membership, string, string) error
+	RemoveMember(*models.Membership, string) error
+	Leave(*models.Membership) error
+	Invite(*models.Membership, *models.User, string, string) (*models.OrganizationInvitation, string, error)
+	GetInvitations(*models.Membership) ([]*models.OrganizationInvitation, error)
+	DeleteInvitation(*models.Membership, string) error
+	GetInvitation(string) (*models.OrganizationInvitation, error)
+	AcceptInvitation(*models.User, string) (*models.Membership, error)
+	ScheduleCleanup(context.Context, time.Duration)
+}
+
+type IDataExportService interface {
+	Export(*models.User) (*models.UserDataExport, error)
 }
 
 type IUserService interface {
 	GetUserById(string) (*models.User, error)
+	GetMemberById(string, string) (*models.User, error)
 	GetUserByKey(string) (*models.User, error)
 	GetUserByEmail(string) (*models.User, error)
 	GetUserByResetToken(string) (*models.User, error)
 	GetAll() ([]*models.User, error)
+	Search(string, *models.UserListQuery) ([]*models.User, int64, error)
 	Count() (int64, error)
-	CreateOrGet(*models.Signup, bool) (*models.User, bool, error)
+	CreateOrGet(*models.Signup) (*models.User, bool, error)
 	Update(*models.User) (*models.User, error)
-	Delete(*models.User) error
-	ResetApiKey(*models.User) (*models.User, error)
-	GenerateResetToken(*models.User) (*models.User, error)
+	AdvanceTotpCounter(*models.User, int64) (bool, error)
+	Delete(*models.User, *models.AuditOrigin) error
+	ScheduleDeletion(*models.User, *models.AuditOrigin) error
+	CancelDeletion(*models.User, *models.AuditOrigin) (*models.User, error)
+	ScheduleCleanup(context.Context, time.Duration)
+	ResetApiKey(*models.User, *models.AuditOrigin) (string, *models.User, error)
+	GenerateResetToken(*models.User, *models.AuditOrigin) (string, error)
 	FlushCache()
 }
@@ -0,0 +1,98 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"github.com/emvi/logbuch"
+	"github.com/muety/broilerplate/config"
+	"github.com/muety/broilerplate/models"
+	"github.com/muety/broilerplate/repositories"
+	uuid "github.com/satori/go.uuid"
+	"time"
+)
+
+// minimum time between two updates of a session's last seen timestamp, to not write to the database on every request
+const sessionTouchInterval = 1 * time.Minute
+
+var ErrSessionExpired = errors.New("session expired")
+
+type SessionService struct {
+	config     *config.Config
+	repository repositories.ISessionRepository
+}
+
+func NewSessionService(sessionRepo repositories.ISessionRepository) *SessionService {
+	return &SessionService{
+		config:     config.Get(),
+		repository: sessionRepo,
+	}
+}
+
+func (srv *SessionService) Create(user *models.User, ipAddress, userAgent string) (*models.Session, error) {
+	if len(userAgent) > 255 {
+		userAgent = userAgent[:255]
+	}
+
+	now := models.CustomTime(time.Now())
+	return srv.repository.Insert(&models.Session{
+		ID:         uuid.NewV4().String(),
+		UserID:     user.ID,
+		CreatedAt:  now,
+		LastSeenAt: now,
+		IpAddress:  ipAddress,
+		UserAgent:  userAgent,
+	})
+}
+
+// GetValidById returns the session with the given id, unless it has expired, and updates its last seen timestamp
+func (srv *SessionService) GetValidById(sessionId string) (*models.Session, error) {
+	session, err := srv.repository.GetById(sessionId)
+	if err != nil {
+		return nil, err
+	}
+
+	if session.IsExpired(srv.maxAge()) {
+		srv.repository.Delete(session)
+		return nil, ErrSessionExpired
+	}
+
+	if time.Since(session.LastSeenAt.T()) > sessionTouchInterval {
+		session.LastSeenAt = models.CustomTime(time.Now())
+		if _, err := srv.repository.UpdateLastSeen(session); err != nil {
+			logbuch.Warn("failed to update last seen time of session for user %s – %v", session.UserID, err)
+		}
+	}
+
+	return session, nil
+}
+
+func (srv *SessionService) GetByUser(user *models.User) ([]*models.Session, error) {
+	return srv.repository.GetByUser(user.ID)
+}
+
+func (srv *SessionService) Delete(session *models.Session) error {
+	return srv.repository.Delete(session)
+}
+
+func (srv *SessionService) DeleteByUser(user *models.User) error {
+	return srv.repository.DeleteByUser(user.ID)
+}
+
+// ScheduleCleanup periodically deletes sessions that have not been used for longer than the cookie max age
+func (srv *SessionService) ScheduleCleanup(ctx context.Context, interval time.Duration) {
+	if srv.maxAge() == 0 {
+		return
+	}
+
+	config.RunPeriodically(ctx, interval, func() {
+		if n, err := srv.repository.DeleteByLastSeenBefore(time.Now().Add(-srv.maxAge())); err != nil {
+			logbuch.Error("failed to clean up expired sessions – %v", err)
+		} else if n > 0 {
+			logbuch.Info("cleaned up %d expired sessions", n)
+		}
+	})
+}
+
+func (srv *SessionService) maxAge() time.Duration {
+	return time.Duration(srv.config.Security.CookieMaxAgeSec) * time.Second
+}
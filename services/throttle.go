@@ -0,0 +1,154 @@
+package services
+
+import (
+	"context"
+	"github.com/emvi/logbuch"
+	"github.com/muety/broilerplate/config"
+	"github.com/muety/broilerplate/models"
+	"github.com/muety/broilerplate/repositories"
+	"sync"
+	"time"
+)
+
+// maximum exponent for the backoff calculation, to not overflow
+const maxBackoffExponent = 20
+
+// ThrottleService slows down repeated failed logins and password reset requests per client ip and per account
+type ThrottleService struct {
+	config      *config.Config
+	userService IUserService
+	mailService IMailService
+	repository  repositories.IThrottleRepository
+	lock        sync.Mutex
+}
+
+func NewThrottleService(userService IUserService, mailService IMailService, throttleRepo repositories.IThrottleRepository) *ThrottleService {
+	return &ThrottleService{
+		config:      config.Get(),
+		userService: userService,
+		mailService: mailService,
+		repository:  throttleRepo,
+	}
+}
+
+// CheckLogin returns for how long login attempts from the given ip or for the given username are currently rejected
+func (srv *ThrottleService) CheckLogin(ip, username string) time.Duration {
+	return srv.retryAfter(models.ThrottleKey(models.ThrottleKeyLoginIp, ip), models.ThrottleKey(models.ThrottleKeyLoginUser, username))
+}
+
+func (srv *ThrottleService) RegisterLoginFailure(ip, username string) {
+	if !srv.config.Security.Throttle.Enabled {
+		return
+	}
+
+	srv.registerFailure(models.ThrottleKey(models.ThrottleKeyLoginIp, ip), false)
+	if entry := srv.registerFailure(models.ThrottleKey(models.ThrottleKeyLoginUser, username), true); entry != nil && entry.Failures == srv.config.Security.Throttle.LockoutThreshold {
+		logbuch.Warn("locked account '%s' after %d failed logins, last one from %s", username, entry.Failures, ip)
+		srv.notifyLocked(username, ip, entry.BlockedUntil.T())
+	}
+}
+
+// RegisterLoginSuccess resets the account's failure count, while the client ip's count remains, to not let an attacker with a valid account reset it
+func (srv *ThrottleService) RegisterLoginSuccess(ip, username string) {
+	if !srv.config.Security.Throttle.Enabled {
+		return
+	}
+	if err := srv.repository.Delete(models.ThrottleKey(models.ThrottleKeyLoginUser, username)); err != nil {
+		logbuch.Error("failed to reset login throttle for '%s' – %v", username, err)
+	}
+}
+
+// CheckPasswordReset returns for how long password reset requests from the given ip or for the given address are currently rejected
+func (srv *ThrottleService) CheckPasswordReset(ip, email string) time.Duration {
+	return srv.retryAfter(models.ThrottleKey(models.ThrottleKeyResetIp, ip), models.ThrottleKey(models.ThrottleKeyResetEmail, email))
+}
+
+// RegisterPasswordReset counts every reset request like a failure, as each of them results in a mail being sent
+func (srv *ThrottleService) RegisterPasswordReset(ip, email string) {
+	if !srv.config.Security.Throttle.Enabled {
+		return
+	}
+	srv.registerFailure(models.ThrottleKey(models.ThrottleKeyResetIp, ip), false)
+	srv.registerFailure(models.ThrottleKey(models.ThrottleKeyResetEmail, email), false)
+}
+
+// ScheduleCleanup periodically deletes throttle entries without any recent failures
+func (srv *ThrottleService) ScheduleCleanup(ctx context.Context, interval time.Duration) {
+	config.RunPeriodically(ctx, interval, func() {
+		if n, err := srv.repository.DeleteByLastFailureBefore(time.Now().Add(-srv.config.Security.Throttle.GetWindow())); err != nil {
+			logbuch.Error("failed to clean up throttle entries – %v", err)
+		} else if n > 0 {
+			logbuch.Info("cleaned up %d throttle entries", n)
+		}
+	})
+}
+
+func (srv *ThrottleService) retryAfter(keys ...string) time.Duration {
+	if !srv.config.Security.Throttle.Enabled {
+		return 0
+	}
+
+	var wait time.Duration
+	for _, key := range keys {
+		if entry, err := srv.repository.Get(key); err == nil && entry.IsBlocked() && entry.RetryAfter() > wait {
+			wait = entry.RetryAfter()
+		}
+	}
+	return wait
+}
+
+func (srv *ThrottleService) registerFailure(key string, lockout bool) *models.ThrottleEntry {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+
+	cfg := srv.config.Security.Throttle
+	now := time.Now()
+
+	entry, err := srv.repository.Get(key)
+	if err != nil || (now.Sub(entry.LastFailureAt.T()) > cfg.GetWindow() && !entry.IsBlocked()) {
+		entry = &models.ThrottleEntry{Key: key}
+	}
+
+	entry.Failures++
+	entry.LastFailureAt = models.CustomTime(now)
+
+	if lockout && cfg.LockoutThreshold > 0 && entry.Failures == cfg.LockoutThreshold {
+		entry.BlockedUntil = models.CustomTime(now.Add(cfg.GetLockoutDuration()))
+	} else if excess := entry.Failures - cfg.FreeAttempts; excess > 0 {
+		entry.BlockedUntil = models.CustomTime(now.Add(backoff(excess, cfg.GetBaseDelay(), cfg.GetMaxDelay())))
+	}
+
+	if err := srv.repository.Upsert(entry); err != nil {
+		logbuch.Error("failed to update throttle entry – %v", err)
+		return nil
+	}
+	return entry
+}
+
+func (srv *ThrottleService) notifyLocked(username, ip string, until time.Time) {
+	user, err := srv.userService.GetUserById(username)
+	// only notify confirmed addresses, as unconfirmed ones might belong to someone else
+	if err != nil || user.Email == "" || !user.EmailVerified || !srv.config.Mail.Enabled {
+		return
+	}
+
+	config.RunInBackground(func() {
+		if err := srv.mailService.SendAccountLocked(user, ip, until); err != nil {
+			logbuch.Error("failed to send account lockout mail to %s – %v", user.ID, err)
+		} else {
+			logbuch.Info("sent account lockout mail to %s", user.ID)
+		}
+	})
+}
+
+// backoff returns the base delay, doubled for every failure beyond the first excess one, but at most the given maximum
+func backoff(excess int, base, max time.Duration) time.Duration {
+	exp := excess - 1
+	if exp > maxBackoffExponent {
+		exp = maxBackoffExponent
+	}
+	if delay := base * time.Duration(1<<uint(exp)); delay < max {
+		return delay
+	}
+	return max
+}
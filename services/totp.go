@@ -0,0 +1,208 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"github.com/muety/broilerplate/config"
+	"github.com/muety/broilerplate/models"
+	"github.com/muety/broilerplate/repositories"
+	"github.com/muety/broilerplate/utils"
+	"strings"
+	"sync"
+	"time"
+)
+
+const numRecoveryCodes = 10
+
+var ErrInvalidTotpCode = errors.New("invalid code")
+
+type TotpService struct {
+	config        *config.Config
+	userService   IUserService
+	keyValueSrvc  IKeyValueService
+	recoveryRepo  repositories.IRecoveryCodeRepository
+	encryptionKey []byte
+	recoveryKey   []byte
+	keyLock       sync.Mutex
+}
+
+func NewTotpService(userService IUserService, keyValueService IKeyValueService, recoveryCodeRepo repositories.IRecoveryCodeRepository) *TotpService {
+	return &TotpService{
+		config:       config.Get(),
+		userService:  userService,
+		keyValueSrvc: keyValueService,
+		recoveryRepo: recoveryCodeRepo,
+	}
+}
+
+// StartEnrollment generates and stores a new (not yet enabled) secret for the user and returns the corresponding key uri
+func (srv *TotpService) StartEnrollment(user *models.User) (string, error) {
+	if user.TotpEnabled {
+		return "", errors.New("two-factor authentication is already enabled")
+	}
+
+	secret, err := utils.GenerateTotpSecret()
+	if err != nil {
+		return "", err
+	}
+
+	key, err := srv.getEncryptionKey()
+	if err != nil {
+		return "", err
+	}
+	encrypted, err := utils.EncryptAES(key, secret)
+	if err != nil {
+		return "", err
+	}
+
+	user.TotpSecret = encrypted
+	user.TotpLastCounter = 0
+	if _, err := srv.userService.Update(user); err != nil {
+		return "", err
+	}
+
+	return utils.TotpUri(srv.config.Security.TotpIssuer, user.ID, secret), nil
+}
+
+// CompleteEnrollment enables 2fa for the user if the given code matches the pending secret and returns a fresh set of recovery codes
+func (srv *TotpService) CompleteEnrollment(user *models.User, code string) ([]string, error) {
+	if user.TotpEnabled || user.TotpSecret == "" {
+		return nil, errors.New("no pending two-factor enrollment")
+	}
+	if err := srv.verifyTotp(user, code); err != nil {
+		return nil, err
+	}
+
+	user.TotpEnabled = true
+	if _, err := srv.userService.Update(user); err != nil {
+		return nil, err
+	}
+
+	return srv.RegenerateRecoveryCodes(user)
+}
+
+// Verify checks the given code, either a totp code or one of the user's recovery codes, which is consumed then
+func (srv *TotpService) Verify(user *models.User, code string) error {
+	if !user.TotpEnabled {
+		return errors.New("two-factor authentication is not enabled")
+	}
+	if err := srv.verifyTotp(user, code); err == nil {
+		return nil
+	}
+	return srv.consumeRecoveryCode(user, code)
+}
+
+func (srv *TotpService) RegenerateRecoveryCodes(user *models.User) ([]string, error) {
+	if err := srv.recoveryRepo.DeleteByUser(user.ID); err != nil {
+		return nil, err
+	}
+
+	plainCodes := make([]string, numRecoveryCodes)
+	codes := make([]*models.RecoveryCode, numRecoveryCodes)
+	for i := range plainCodes {
+		b, err := utils.RandomBytes(5)
+		if err != nil {
+			return nil, err
+		}
+		h := fmt.Sprintf("%x", b)
+		plainCodes[i] = fmt.Sprintf("%s-%s", h[:5], h[5:])
+		hash, err := srv.hashRecoveryCode(plainCodes[i])
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = &models.RecoveryCode{
+			UserID:   user.ID,
+			CodeHash: hash,
+		}
+	}
+
+	if err := srv.recoveryRepo.InsertBatch(codes); err != nil {
+		return nil, err
+	}
+	return plainCodes, nil
+}
+
+// Disable turns off 2fa for the user and removes secret and recovery codes, e.g. when requested by the user or reset by an admin
+func (srv *TotpService) Disable(user *models.User) error {
+	user.TotpEnabled = false
+	user.TotpSecret = ""
+	user.TotpLastCounter = 0
+	if _, err := srv.userService.Update(user); err != nil {
+		return err
+	}
+	return srv.recoveryRepo.DeleteByUser(user.ID)
+}
+
+func (srv *TotpService) verifyTotp(user *models.User, code string) error {
+	key, err := srv.getEncryptionKey()
+	if err != nil {
+		return err
+	}
+	secret, err := utils.DecryptAES(key, user.TotpSecret)
+	if err != nil {
+		return err
+	}
+
+	counter, ok := utils.ValidateTotp(secret, code, time.Now())
+	if !ok || counter <= user.TotpLastCounter {
+		return ErrInvalidTotpCode
+	}
+
+	// remember last used time step to prevent replay, the check above only saves the database round trip
+	if ok, err := srv.userService.AdvanceTotpCounter(user, counter); err != nil {
+		return err
+	} else if !ok {
+		return ErrInvalidTotpCode
+	}
+	return nil
+}
+
+// consumeRecoveryCode deletes the matching code in a single statement, so that concurrent requests can't both use it
+func (srv *TotpService) consumeRecoveryCode(user *models.User, code string) error {
+	hash, err := srv.hashRecoveryCode(code)
+	if err != nil {
+		return err
+	}
+
+	n, err := srv.recoveryRepo.DeleteByUserAndHash(user.ID, hash)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrInvalidTotpCode
+	}
+	return nil
+}
+
+// hashRecoveryCode keys the hash with a random secret, as the codes themselves are too short to withstand brute-forcing otherwise
+func (srv *TotpService) hashRecoveryCode(code string) (string, error) {
+	srv.keyLock.Lock()
+	defer srv.keyLock.Unlock()
+
+	if srv.recoveryKey == nil {
+		key, err := srv.keyValueSrvc.GetOrCreateSecret(models.RecoveryCodeKeyKey, 32)
+		if err != nil {
+			return "", err
+		}
+		srv.recoveryKey = key
+	}
+	return utils.HashHmac(strings.ToLower(strings.TrimSpace(code)), string(srv.recoveryKey)), nil
+}
+
+func (srv *TotpService) getEncryptionKey() ([]byte, error) {
+	if len(srv.config.Security.EncryptionKeyBytes) > 0 {
+		return srv.config.Security.EncryptionKeyBytes, nil
+	}
+
+	srv.keyLock.Lock()
+	defer srv.keyLock.Unlock()
+
+	if srv.encryptionKey == nil {
+		key, err := srv.keyValueSrvc.GetOrCreateSecret(models.EncryptionKeyKey, 32)
+		if err != nil {
+			return nil, err
+		}
+		srv.encryptionKey = key
+	}
+	return srv.encryptionKey, nil
+}
@@ -0,0 +1,54 @@
+package services
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/muety/broilerplate/models"
+	"github.com/muety/broilerplate/repositories"
+	"github.com/muety/broilerplate/utils"
+)
+
+func TestTotpService_RejectsReplayAcrossInstances(t *testing.T) {
+	setupTestConfig()
+	db := setupTestDb(t, &models.User{}, &models.KeyStringValue{}, &models.RecoveryCode{})
+	keyValueService := NewKeyValueService(repositories.NewKeyValueRepository(db))
+	userService := NewUserService(nil, keyValueService, repositories.NewUserRepository(db))
+	srv := NewTotpService(userService, keyValueService, repositories.NewRecoveryCodeRepository(db))
+
+	user := &models.User{ID: "alice", Email: "alice@example.org"}
+	if err := db.Create(user).Error; err != nil {
+		t.Fatal(err)
+	}
+	uri, err := srv.StartEnrollment(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := u.Query().Get("secret")
+	user.TotpEnabled = true
+	if _, err := userService.Update(user); err != nil {
+		t.Fatal(err)
+	}
+
+	code, err := utils.TotpCode(secret, time.Now().Unix()/30)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// two requests (or instances) holding their own copy of the user, neither of which knows about the other's login
+	first, second := *user, *user
+	if err := srv.Verify(&first, code); err != nil {
+		t.Fatalf("verification failed: %v", err)
+	}
+	if err := srv.Verify(&second, code); err == nil {
+		t.Error("expected replayed code to be rejected")
+	}
+	if err := srv.Verify(&first, code); err == nil {
+		t.Error("expected reused code to be rejected")
+	}
+}
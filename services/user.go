@@ -1,6 +1,9 @@
 package services
 
 import (
+	"context"
+	"errors"
+	"github.com/emvi/logbuch"
 	"github.com/leandro-lugaresi/hub"
 	"github.com/muety/broilerplate/config"
 	"github.com/muety/broilerplate/models"
@@ -8,24 +11,37 @@ import (
 	"github.com/muety/broilerplate/utils"
 	"github.com/patrickmn/go-cache"
 	uuid "github.com/satori/go.uuid"
+	"sync"
 	"time"
 )
 
+// number of leading characters of an api key that are stored in plain text to help users identify their key
+const apiKeyPrefixLength = 8
+
+var (
+	ErrResetTokenInvalid = errors.New("invalid password reset link")
+	ErrResetTokenExpired = errors.New("password reset link has expired, please request a new one")
+)
+
 type UserService struct {
-	config      *config.Config
-	cache       *cache.Cache
-	eventBus    *hub.Hub
-	mailService IMailService
-	repository  repositories.IUserRepository
+	config        *config.Config
+	cache         *cache.Cache
+	eventBus      *hub.Hub
+	mailService   IMailService
+	keyValueSrvc  IKeyValueService
+	repository    repositories.IUserRepository
+	apiKeyHashKey []byte
+	keyLock       sync.Mutex
 }
 
-func NewUserService(mailService IMailService, userRepo repositories.IUserRepository) *UserService {
+func NewUserService(mailService IMailService, keyValueService IKeyValueService, userRepo repositories.IUserRepository) *UserService {
 	srv := &UserService{
-		config:      config.Get(),
-		eventBus:    config.EventBus(),
-		cache:       cache.New(1*time.Hour, 2*time.Hour),
-		mailService: mailService,
-		repository:  userRepo,
+		config:       config.Get(),
+		eventBus:     config.EventBus(),
+		cache:        cache.New(1*time.Hour, 2*time.Hour),
+		mailService:  mailService,
+		keyValueSrvc: keyValueService,
+		repository:   userRepo,
 	}
 
 	return srv
@@ -45,17 +61,29 @@ func (srv *UserService) GetUserById(userId string) (*models.User, error) {
 	return u, nil
 }
 
+// GetMemberById looks up a user on behalf of someone acting in the given organization, who must not reach beyond its members.
+// Memberships change independently of users, so the cache is bypassed.
+func (srv *UserService) GetMemberById(orgId, userId string) (*models.User, error) {
+	return srv.repository.GetByOrganizationAndId(orgId, userId)
+}
+
 func (srv *UserService) GetUserByKey(key string) (*models.User, error) {
-	if u, ok := srv.cache.Get(key); ok {
+	hash, err := srv.hashApiKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	cacheKey := "apikey:" + hash
+	if u, ok := srv.cache.Get(cacheKey); ok {
 		return u.(*models.User), nil
 	}
 
-	u, err := srv.repository.GetByApiKey(key)
+	u, err := srv.repository.GetByApiKey(hash)
 	if err != nil {
 		return nil, err
 	}
 
-	srv.cache.SetDefault(u.ID, u)
+	srv.cache.SetDefault(cacheKey, u)
 	return u, nil
 }
 
@@ -63,26 +91,44 @@ func (srv *UserService) GetUserByEmail(email string) (*models.User, error) {
 	return srv.repository.GetByEmail(email)
 }
 
+// GetUserByResetToken resolves the plain reset token from a password reset link, telling expired tokens apart from unknown ones
 func (srv *UserService) GetUserByResetToken(resetToken string) (*models.User, error) {
-	return srv.repository.GetByResetToken(resetToken)
+	if resetToken == "" {
+		return nil, ErrResetTokenInvalid
+	}
+
+	u, err := srv.repository.GetByResetToken(utils.HashSha256(resetToken))
+	if err != nil {
+		return nil, ErrResetTokenInvalid
+	}
+
+	if u.ResetTokenCreatedAt == nil || time.Since(u.ResetTokenCreatedAt.T()) > srv.config.Security.GetPasswordResetTtl() {
+		return nil, ErrResetTokenExpired
+	}
+
+	return u, nil
 }
 
 func (srv *UserService) GetAll() ([]*models.User, error) {
 	return srv.repository.GetAll()
 }
 
+// Search lists the given organization's members only
+func (srv *UserService) Search(orgId string, query *models.UserListQuery) ([]*models.User, int64, error) {
+	return srv.repository.Search(orgId, query.Normalize())
+}
+
 func (srv *UserService) Count() (int64, error) {
 	return srv.repository.Count()
 }
 
-func (srv *UserService) CreateOrGet(signup *models.Signup, isAdmin bool) (*models.User, bool, error) {
+// CreateOrGet creates a new user without any roles, see IRoleService for granting privileges
+func (srv *UserService) CreateOrGet(signup *models.Signup) (*models.User, bool, error) {
 	u := &models.User{
 		ID:       signup.Username,
-		ApiKey:   uuid.NewV4().String(),
 		Email:    signup.Email,
 		Location: signup.Location,
 		Password: signup.Password,
-		IsAdmin:  isAdmin,
 	}
 
 	if hash, err := utils.HashBcrypt(u.Password, srv.config.Security.PasswordSalt); err != nil {
@@ -91,6 +137,10 @@ func (srv *UserService) CreateOrGet(signup *models.Signup, isAdmin bool) (*model
 		u.Password = hash
 	}
 
+	if _, err := srv.setNewApiKey(u); err != nil {
+		return nil, false, err
+	}
+
 	return srv.repository.InsertOrGet(u)
 }
 
@@ -100,31 +150,151 @@ func (srv *UserService) Update(user *models.User) (*models.User, error) {
 	return srv.repository.Update(user)
 }
 
-func (srv *UserService) ResetApiKey(user *models.User) (*models.User, error) {
+// AdvanceTotpCounter records the time step of a just used code and tells whether it had not been used before, even by a concurrent request or another instance
+func (srv *UserService) AdvanceTotpCounter(user *models.User, counter int64) (bool, error) {
 	srv.cache.Flush()
-	user.ApiKey = uuid.NewV4().String()
-	return srv.Update(user)
+	n, err := srv.repository.AdvanceTotpCounter(user.ID, counter)
+	if err != nil || n == 0 {
+		return false, err
+	}
+	user.TotpLastCounter = counter
+	return true, nil
 }
 
-func (srv *UserService) GenerateResetToken(user *models.User) (*models.User, error) {
-	return srv.repository.UpdateField(user, "reset_token", uuid.NewV4())
+// ResetApiKey generates a new api key and returns it in plain text, as only its hash is persisted
+func (srv *UserService) ResetApiKey(user *models.User, origin *models.AuditOrigin) (string, *models.User, error) {
+	srv.cache.Flush()
+	key, err := srv.setNewApiKey(user)
+	if err != nil {
+		return "", nil, err
+	}
+	if user, err = srv.Update(user); err != nil {
+		return "", nil, err
+	}
+	PublishAuditEvent(models.NewAuditEvent(models.AuditApiKeyReset, origin, user.ID, ""))
+	return key, user, nil
 }
 
-func (srv *UserService) Delete(user *models.User) error {
+// GenerateResetToken issues a new password reset token, replacing any previous one, and returns it in plain text, as only its hash is persisted
+func (srv *UserService) GenerateResetToken(user *models.User, origin *models.AuditOrigin) (string, error) {
+	random, err := utils.RandomBytes(32)
+	if err != nil {
+		return "", err
+	}
+	token := b64.EncodeToString(random)
+
+	createdAt := models.CustomTime(time.Now())
+	user.ResetToken = utils.HashSha256(token)
+	user.ResetTokenCreatedAt = &createdAt
+	if _, err := srv.Update(user); err != nil {
+		return "", err
+	}
+	PublishAuditEvent(models.NewAuditEvent(models.AuditPasswordResetRequest, origin, user.ID, ""))
+	return token, nil
+}
+
+// Delete removes the user along with all their data and publishes a deletion event for modules to purge anything not cascaded by the database
+func (srv *UserService) Delete(user *models.User, origin *models.AuditOrigin) error {
 	srv.cache.Flush()
 
-	srv.notifyUpdate(user)
+	if err := srv.repository.Delete(user); err != nil {
+		return err
+	}
+
+	srv.notifyDelete(user)
+	PublishAuditEvent(models.NewAuditEvent(models.AuditUserDelete, origin, user.ID, ""))
+	return nil
+}
+
+// ScheduleDeletion marks the user for deletion after the configured grace period, or deletes them right away if there is none
+func (srv *UserService) ScheduleDeletion(user *models.User, origin *models.AuditOrigin) error {
+	gracePeriod := srv.config.Security.GetAccountDeletionGracePeriod()
+	if gracePeriod <= 0 {
+		return srv.Delete(user, origin)
+	}
+
+	deleteAt := models.CustomTime(time.Now().Add(gracePeriod))
+	user.DeletionScheduledAt = &deleteAt
+	if _, err := srv.Update(user); err != nil {
+		return err
+	}
+	PublishAuditEvent(models.NewAuditEvent(models.AuditUserDeletionScheduled, origin, user.ID, ""))
+	return nil
+}
+
+func (srv *UserService) CancelDeletion(user *models.User, origin *models.AuditOrigin) (*models.User, error) {
+	user.DeletionScheduledAt = nil
+	if _, err := srv.Update(user); err != nil {
+		return nil, err
+	}
+	PublishAuditEvent(models.NewAuditEvent(models.AuditUserDeletionCancelled, origin, user.ID, ""))
+	return user, nil
+}
 
-	return srv.repository.Delete(user)
+// ScheduleCleanup periodically deletes users whose deletion grace period has passed and purges expired password reset tokens
+func (srv *UserService) ScheduleCleanup(ctx context.Context, interval time.Duration) {
+	config.RunPeriodically(ctx, interval, func() {
+		if n, err := srv.repository.ClearResetTokensCreatedBefore(time.Now().Add(-srv.config.Security.GetPasswordResetTtl())); err != nil {
+			logbuch.Error("failed to purge expired password reset tokens – %v", err)
+		} else if n > 0 {
+			srv.cache.Flush()
+			logbuch.Info("purged %d expired password reset tokens", n)
+		}
+
+		users, err := srv.repository.GetByDeletionScheduledBefore(time.Now())
+		if err != nil {
+			logbuch.Error("failed to fetch users scheduled for deletion – %v", err)
+			return
+		}
+		for _, u := range users {
+			if err := srv.Delete(u, nil); err != nil {
+				logbuch.Error("failed to delete user %s – %v", u.ID, err)
+			} else {
+				logbuch.Info("deleted user %s after deletion grace period", u.ID)
+			}
+		}
+	})
 }
 
 func (srv *UserService) FlushCache() {
 	srv.cache.Flush()
 }
 
+func (srv *UserService) setNewApiKey(user *models.User) (string, error) {
+	key := uuid.NewV4().String()
+	hash, err := srv.hashApiKey(key)
+	if err != nil {
+		return "", err
+	}
+	user.ApiKey = hash
+	user.ApiKeyPrefix = key[:apiKeyPrefixLength]
+	return key, nil
+}
+
+func (srv *UserService) hashApiKey(key string) (string, error) {
+	srv.keyLock.Lock()
+	defer srv.keyLock.Unlock()
+
+	if srv.apiKeyHashKey == nil {
+		hashKey, err := srv.keyValueSrvc.GetOrCreateSecret(models.ApiKeyHashKeyKey, 32)
+		if err != nil {
+			return "", err
+		}
+		srv.apiKeyHashKey = hashKey
+	}
+	return utils.HashHmac(key, string(srv.apiKeyHashKey)), nil
+}
+
 func (srv *UserService) notifyUpdate(user *models.User) {
 	srv.eventBus.Publish(hub.Message{
 		Name:   config.EventUserUpdate,
 		Fields: map[string]interface{}{config.FieldPayload: user},
 	})
 }
+
+func (srv *UserService) notifyDelete(user *models.User) {
+	srv.eventBus.Publish(hub.Message{
+		Name:   config.EventUserDelete,
+		Fields: map[string]interface{}{config.FieldPayload: user},
+	})
+}
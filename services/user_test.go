@@ -0,0 +1,100 @@
+package services
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/muety/broilerplate/models"
+	"github.com/muety/broilerplate/repositories"
+	"gorm.io/gorm"
+)
+
+// setupOrganizations makes alice and bob members of acme, carol of globex and dave of none at all
+func setupOrganizations(t *testing.T, db *gorm.DB) {
+	for _, org := range []*models.Organization{{ID: "acme"}, {ID: "globex"}} {
+		if err := db.Create(org).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, id := range []string{"alice", "bob", "carol", "dave"} {
+		if err := db.Create(&models.User{ID: id, ApiKey: id, Email: id + "@example.org"}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, m := range []*models.Membership{
+		{OrganizationID: "acme", UserID: "alice", Role: models.OrgRoleOwner},
+		{OrganizationID: "acme", UserID: "bob", Role: models.OrgRoleMember},
+		{OrganizationID: "globex", UserID: "carol", Role: models.OrgRoleOwner},
+	} {
+		if err := db.Omit("Organization", "User").Create(m).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestUserService_ScopesAdminQueriesByOrganization(t *testing.T) {
+	setupTestConfig()
+	db := setupTestDb(t, &models.User{}, &models.Organization{}, &models.Membership{}, &models.KeyStringValue{})
+	setupOrganizations(t, db)
+	srv := NewUserService(nil, NewKeyValueService(repositories.NewKeyValueRepository(db)), repositories.NewUserRepository(db))
+
+	users, total, err := srv.Search("acme", &models.UserListQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 2 || len(users) != 2 || users[0].ID != "alice" || users[1].ID != "bob" {
+		t.Errorf("expected acme's members only, got %d users", total)
+	}
+	if _, total, err := srv.Search("acme", &models.UserListQuery{Search: "carol"}); err != nil || total != 0 {
+		t.Errorf("expected search not to reach into other organizations, got %d users (%v)", total, err)
+	}
+
+	if _, err := srv.GetMemberById("acme", "bob"); err != nil {
+		t.Errorf("expected member to be found, got %v", err)
+	}
+	if _, err := srv.GetMemberById("acme", "carol"); err == nil {
+		t.Error("expected member of another organization not to be found")
+	}
+	if _, err := srv.GetMemberById("acme", "dave"); err == nil {
+		t.Error("expected user without organization not to be found")
+	}
+
+	// without an organization, queries fail rather than spanning all of them
+	if _, _, err := srv.Search("", &models.UserListQuery{}); err != repositories.ErrMissingTenant {
+		t.Errorf("expected %v, got %v", repositories.ErrMissingTenant, err)
+	}
+	if _, err := srv.GetMemberById("", "bob"); err != repositories.ErrMissingTenant {
+		t.Errorf("expected %v, got %v", repositories.ErrMissingTenant, err)
+	}
+}
+
+func TestClientCertificateService_ScopesAdminQueriesByOrganization(t *testing.T) {
+	setupTestConfig()
+	db := setupTestDb(t, &models.User{}, &models.Organization{}, &models.Membership{}, &models.ClientCertificate{})
+	setupOrganizations(t, db)
+	srv := NewClientCertificateService(newUserServiceStub(), repositories.NewClientCertificateRepository(db))
+
+	fingerprints := map[string]string{}
+	for i, id := range []string{"bob", "carol"} {
+		certificate, err := srv.Create(&models.User{ID: id}, id, fmt.Sprintf("%064x", i+1), &models.AuditOrigin{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		fingerprints[id] = certificate.Fingerprint
+	}
+
+	certificates, err := srv.GetByOrganization("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certificates) != 1 || certificates[0].UserID != "bob" {
+		t.Errorf("expected bob's certificate only, got %d certificates", len(certificates))
+	}
+
+	if err := srv.Delete("acme", fingerprints["carol"], &models.AuditOrigin{}); err == nil {
+		t.Error("expected certificate of another organization's member not to be revoked")
+	}
+	if err := srv.Delete("acme", fingerprints["bob"], &models.AuditOrigin{}); err != nil {
+		t.Errorf("expected certificate to be revoked, got %v", err)
+	}
+}
@@ -0,0 +1,446 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/emvi/logbuch"
+	"github.com/muety/broilerplate/config"
+	"github.com/muety/broilerplate/models"
+	"github.com/muety/broilerplate/repositories"
+	"github.com/muety/broilerplate/utils"
+	"strings"
+	"time"
+)
+
+// Minimal implementation of the webauthn relying party ceremonies (https://www.w3.org/TR/webauthn-2/#sctn-rp-operations).
+// Only "none" attestation is supported. To not depend on a cbor parser, clients are expected to send the public key as
+// returned by AuthenticatorAttestationResponse.getPublicKey(), which is supported by all current browsers.
+
+const (
+	webauthnTimeout = 5 * time.Minute
+
+	// authenticator data flags
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttestedData = 0x40
+)
+
+var b64 = base64.RawURLEncoding
+
+var errWebauthnSessionInvalid = errors.New("invalid session")
+
+type WebauthnService struct {
+	config      *config.Config
+	userService IUserService
+	repository  repositories.IWebauthnCredentialRepository
+	sessions    repositories.IWebauthnSessionRepository // ongoing ceremonies, each challenge can only be answered once
+}
+
+func NewWebauthnService(userService IUserService, credentialRepo repositories.IWebauthnCredentialRepository, sessionRepo repositories.IWebauthnSessionRepository) *WebauthnService {
+	return &WebauthnService{
+		config:      config.Get(),
+		userService: userService,
+		repository:  credentialRepo,
+		sessions:    sessionRepo,
+	}
+}
+
+func (srv *WebauthnService) BeginRegistration(user *models.User) (*models.WebauthnOptions, *models.WebauthnSession, error) {
+	session, err := srv.newSession(user, models.WebauthnPurposeRegister)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	credentials, err := srv.repository.GetByUser(user.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	options := &models.WebauthnOptions{
+		Challenge: session.Challenge,
+		Timeout:   int(webauthnTimeout.Milliseconds()),
+		Rp: &models.WebauthnRpEntity{
+			ID:   srv.config.Server.GetHostname(),
+			Name: srv.config.App.Name,
+		},
+		User: &models.WebauthnUserEntity{
+			ID:          b64.EncodeToString([]byte(user.ID)),
+			Name:        user.ID,
+			DisplayName: user.ID,
+		},
+		PubKeyCredParams: []models.WebauthnCredentialParameters{
+			{Type: "public-key", Alg: models.CoseAlgES256},
+			{Type: "public-key", Alg: models.CoseAlgRS256},
+		},
+		ExcludeCredentials: srv.descriptors(credentials),
+		AuthenticatorSelection: &models.WebauthnAuthenticatorSelection{
+			ResidentKey:      "preferred",
+			UserVerification: "preferred",
+		},
+		Attestation: "none",
+	}
+
+	return options, session, nil
+}
+
+func (srv *WebauthnService) FinishRegistration(user *models.User, sessionId string, registration *models.WebauthnRegistration) (*models.WebauthnCredential, error) {
+	session := srv.takeSession(sessionId)
+	if err := srv.checkSession(session, models.WebauthnPurposeRegister); err != nil {
+		return nil, err
+	}
+	if session.UserID != user.ID {
+		return nil, errors.New("session user mismatch")
+	}
+
+	if err := srv.verifyClientData(registration.ClientDataJSON, "webauthn.create", session.Challenge); err != nil {
+		return nil, err
+	}
+
+	authData, err := b64.DecodeString(registration.AuthenticatorData)
+	if err != nil {
+		return nil, err
+	}
+	flags, signCount, err := srv.verifyAuthenticatorData(authData, false)
+	if err != nil {
+		return nil, err
+	}
+	if flags&flagAttestedData == 0 {
+		return nil, errors.New("missing attested credential data")
+	}
+
+	// attested credential data: aaguid (16 bytes), credential id length (2 bytes), credential id, credential public key
+	if len(authData) < 37+18 {
+		return nil, errors.New("authenticator data too short")
+	}
+	idLen := int(binary.BigEndian.Uint16(authData[53:55]))
+	if len(authData) < 55+idLen {
+		return nil, errors.New("authenticator data too short")
+	}
+	credentialId := b64.EncodeToString(authData[55 : 55+idLen])
+	if credentialId != strings.TrimRight(registration.ID, "=") {
+		return nil, errors.New("credential id mismatch")
+	}
+
+	publicKey, err := b64.DecodeString(registration.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := srv.checkPublicKey(publicKey, registration.PublicKeyAlgorithm); err != nil {
+		return nil, err
+	}
+
+	if _, err := srv.repository.GetById(credentialId); err == nil {
+		return nil, errors.New("credential already registered")
+	}
+
+	name := strings.TrimSpace(registration.Name)
+	if name == "" {
+		name = "Passkey"
+	}
+	if len(name) > 64 {
+		name = name[:64]
+	}
+
+	now := models.CustomTime(time.Now())
+	return srv.repository.Insert(&models.WebauthnCredential{
+		ID:         credentialId,
+		UserID:     user.ID,
+		Name:       name,
+		PublicKey:  publicKey,
+		Algorithm:  registration.PublicKeyAlgorithm,
+		SignCount:  signCount,
+		CreatedAt:  now,
+		LastUsedAt: now,
+	})
+}
+
+// BeginLogin starts an authentication ceremony, either as a second factor for the given user or, if user is nil, for passwordless login using discoverable credentials
+func (srv *WebauthnService) BeginLogin(user *models.User) (*models.WebauthnOptions, *models.WebauthnSession, error) {
+	purpose := models.WebauthnPurposeLogin
+	userVerification := "required"
+	var allowCredentials []models.WebauthnCredentialDescriptor
+
+	if user != nil {
+		credentials, err := srv.repository.GetByUser(user.ID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(credentials) == 0 {
+			return nil, nil, errors.New("no passkeys registered")
+		}
+		purpose = models.WebauthnPurposeSecondFactor
+		userVerification = "discouraged"
+		allowCredentials = srv.descriptors(credentials)
+	}
+
+	session, err := srv.newSession(user, purpose)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	options := &models.WebauthnOptions{
+		Challenge:        session.Challenge,
+		Timeout:          int(webauthnTimeout.Milliseconds()),
+		RpId:             srv.config.Server.GetHostname(),
+		AllowCredentials: allowCredentials,
+		UserVerification: userVerification,
+	}
+
+	return options, session, nil
+}
+
+// FinishLogin verifies the assertion and returns the user it belongs to
+func (srv *WebauthnService) FinishLogin(sessionId string, assertion *models.WebauthnAssertion) (*models.User, error) {
+	session := srv.takeSession(sessionId)
+	if session == nil || (session.Purpose != models.WebauthnPurposeLogin && session.Purpose != models.WebauthnPurposeSecondFactor) {
+		return nil, errWebauthnSessionInvalid
+	}
+	if err := srv.checkSession(session, session.Purpose); err != nil {
+		return nil, err
+	}
+
+	credential, err := srv.repository.GetById(strings.TrimRight(assertion.ID, "="))
+	if err != nil {
+		return nil, errors.New("unknown credential")
+	}
+
+	if session.Purpose == models.WebauthnPurposeSecondFactor && credential.UserID != session.UserID {
+		return nil, errors.New("credential does not belong to user")
+	}
+	if session.Purpose == models.WebauthnPurposeLogin && assertion.UserHandle != "" {
+		if userHandle, err := b64.DecodeString(assertion.UserHandle); err != nil || string(userHandle) != credential.UserID {
+			return nil, errors.New("user handle mismatch")
+		}
+	}
+
+	if err := srv.verifyClientData(assertion.ClientDataJSON, "webauthn.get", session.Challenge); err != nil {
+		return nil, err
+	}
+
+	authData, err := b64.DecodeString(assertion.AuthenticatorData)
+	if err != nil {
+		return nil, err
+	}
+	// passwordless login requires user verification (e.g. pin or biometrics), as the passkey is the only factor then
+	_, signCount, err := srv.verifyAuthenticatorData(authData, session.Purpose == models.WebauthnPurposeLogin)
+	if err != nil {
+		return nil, err
+	}
+
+	clientData, err := b64.DecodeString(assertion.ClientDataJSON)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := b64.DecodeString(assertion.Signature)
+	if err != nil {
+		return nil, err
+	}
+	clientDataHash := sha256.Sum256(clientData)
+	if err := srv.verifySignature(credential, append(authData, clientDataHash[:]...), signature); err != nil {
+		return nil, err
+	}
+
+	// a non-increasing signature counter indicates a cloned authenticator (counter is always zero for some authenticators, though)
+	if signCount != 0 || credential.SignCount != 0 {
+		if signCount <= credential.SignCount {
+			return nil, errors.New("signature counter did not increase")
+		}
+	}
+
+	credential.SignCount = signCount
+	credential.LastUsedAt = models.CustomTime(time.Now())
+	if _, err := srv.repository.UpdateUsage(credential); err != nil {
+		return nil, err
+	}
+
+	return srv.userService.GetUserById(credential.UserID)
+}
+
+func (srv *WebauthnService) GetByUser(user *models.User) ([]*models.WebauthnCredential, error) {
+	return srv.repository.GetByUser(user.ID)
+}
+
+func (srv *WebauthnService) HasCredentials(user *models.User) bool {
+	count, err := srv.repository.CountByUser(user.ID)
+	return err == nil && count > 0
+}
+
+func (srv *WebauthnService) Delete(user *models.User, credentialId string) error {
+	credential, err := srv.repository.GetById(credentialId)
+	if err != nil || credential.UserID != user.ID {
+		return errors.New("credential not found")
+	}
+	return srv.repository.Delete(credential)
+}
+
+// GetSession returns the ongoing ceremony with the given id without ending it
+func (srv *WebauthnService) GetSession(id string) (*models.WebauthnSession, error) {
+	session, err := srv.sessions.GetById(id)
+	if err != nil || session.IsExpired() {
+		return nil, errWebauthnSessionInvalid
+	}
+	return session, nil
+}
+
+// ScheduleCleanup periodically deletes ceremonies, which were never finished
+func (srv *WebauthnService) ScheduleCleanup(ctx context.Context, interval time.Duration) {
+	config.RunPeriodically(ctx, interval, func() {
+		if n, err := srv.sessions.DeleteByExpiresBefore(time.Now()); err != nil {
+			logbuch.Error("failed to clean up expired webauthn sessions – %v", err)
+		} else if n > 0 {
+			logbuch.Info("cleaned up %d expired webauthn sessions", n)
+		}
+	})
+}
+
+func (srv *WebauthnService) newSession(user *models.User, purpose string) (*models.WebauthnSession, error) {
+	id, err := utils.RandomBytes(32)
+	if err != nil {
+		return nil, err
+	}
+	challenge, err := utils.RandomBytes(32)
+	if err != nil {
+		return nil, err
+	}
+	session := &models.WebauthnSession{
+		ID:        b64.EncodeToString(id),
+		Challenge: b64.EncodeToString(challenge),
+		Purpose:   purpose,
+		ExpiresAt: models.CustomTime(time.Now().Add(webauthnTimeout)),
+	}
+	if user != nil {
+		session.UserID = user.ID
+	}
+	return srv.sessions.Insert(session)
+}
+
+// takeSession removes the ceremony from the database before it is finished, so that any response, valid or not, can only be submitted once.
+// Only the one request (on whichever instance) that actually deleted it gets to finish it.
+func (srv *WebauthnService) takeSession(id string) *models.WebauthnSession {
+	session, err := srv.sessions.GetById(id)
+	if err != nil {
+		return nil
+	}
+	if n, err := srv.sessions.Delete(id); err != nil || n != 1 {
+		return nil
+	}
+	return session
+}
+
+func (srv *WebauthnService) checkSession(session *models.WebauthnSession, purpose string) error {
+	if session == nil || session.Purpose != purpose || session.Challenge == "" {
+		return errWebauthnSessionInvalid
+	}
+	if session.IsExpired() {
+		return errors.New("session expired")
+	}
+	return nil
+}
+
+func (srv *WebauthnService) verifyClientData(clientDataJSON, expectedType, expectedChallenge string) error {
+	raw, err := b64.DecodeString(clientDataJSON)
+	if err != nil {
+		return err
+	}
+
+	var clientData models.WebauthnClientData
+	if err := json.Unmarshal(raw, &clientData); err != nil {
+		return err
+	}
+
+	if clientData.Type != expectedType {
+		return errors.New("unexpected client data type")
+	}
+	if subtle.ConstantTimeCompare([]byte(strings.TrimRight(clientData.Challenge, "=")), []byte(expectedChallenge)) != 1 {
+		return errors.New("challenge mismatch")
+	}
+	if clientData.Origin != srv.config.Server.GetOrigin() {
+		return errors.New("origin mismatch")
+	}
+	return nil
+}
+
+func (srv *WebauthnService) verifyAuthenticatorData(authData []byte, requireUserVerification bool) (byte, uint32, error) {
+	// rp id hash (32 bytes), flags (1 byte), signature counter (4 bytes), ...
+	if len(authData) < 37 {
+		return 0, 0, errors.New("authenticator data too short")
+	}
+
+	rpIdHash := sha256.Sum256([]byte(srv.config.Server.GetHostname()))
+	if !bytes.Equal(authData[:32], rpIdHash[:]) {
+		return 0, 0, errors.New("relying party id mismatch")
+	}
+
+	flags := authData[32]
+	if flags&flagUserPresent == 0 {
+		return 0, 0, errors.New("user not present")
+	}
+	if requireUserVerification && flags&flagUserVerified == 0 {
+		return 0, 0, errors.New("user not verified")
+	}
+
+	return flags, binary.BigEndian.Uint32(authData[33:37]), nil
+}
+
+func (srv *WebauthnService) checkPublicKey(der []byte, alg int) error {
+	publicKey, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return err
+	}
+
+	switch key := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		if alg != models.CoseAlgES256 || key.Curve != elliptic.P256() {
+			return errors.New("unsupported key type")
+		}
+	case *rsa.PublicKey:
+		if alg != models.CoseAlgRS256 {
+			return errors.New("unsupported key type")
+		}
+	default:
+		return errors.New("unsupported key type")
+	}
+	return nil
+}
+
+func (srv *WebauthnService) verifySignature(credential *models.WebauthnCredential, data, signature []byte) error {
+	publicKey, err := x509.ParsePKIXPublicKey(credential.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	digest := sha256.Sum256(data)
+
+	switch key := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(key, digest[:], signature) {
+			return errors.New("invalid signature")
+		}
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+			return errors.New("invalid signature")
+		}
+	default:
+		return errors.New("unsupported key type")
+	}
+	return nil
+}
+
+func (srv *WebauthnService) descriptors(credentials []*models.WebauthnCredential) []models.WebauthnCredentialDescriptor {
+	descriptors := make([]models.WebauthnCredentialDescriptor, len(credentials))
+	for i, c := range credentials {
+		descriptors[i] = models.WebauthnCredentialDescriptor{Type: "public-key", ID: c.ID}
+	}
+	return descriptors
+}
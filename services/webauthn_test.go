@@ -0,0 +1,368 @@
+package services
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/muety/broilerplate/models"
+	"github.com/muety/broilerplate/repositories"
+)
+
+// softAuthenticator plays the part of the browser and a (non-resident) es256 security key
+type softAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialId []byte
+	signCount    uint32
+	origin       string
+	rpId         string
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentialId := make([]byte, 16)
+	rand.Read(credentialId)
+	return &softAuthenticator{key: key, credentialId: credentialId, origin: testPublicUrl, rpId: "app.example.org"}
+}
+
+func (a *softAuthenticator) clientData(t *testing.T, ceremonyType, challenge string) []byte {
+	clientData, err := json.Marshal(&models.WebauthnClientData{Type: ceremonyType, Challenge: challenge, Origin: a.origin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return clientData
+}
+
+func (a *softAuthenticator) authenticatorData(flags byte) []byte {
+	rpIdHash := sha256.Sum256([]byte(a.rpId))
+	authData := append(rpIdHash[:], flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(authData[33:37], a.signCount)
+	return authData
+}
+
+func (a *softAuthenticator) register(t *testing.T, options *models.WebauthnOptions) *models.WebauthnRegistration {
+	publicKey, err := x509.MarshalPKIXPublicKey(&a.key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// attested credential data with a zero aaguid, the cose key is not looked at by the relying party
+	authData := a.authenticatorData(flagUserPresent | flagUserVerified | flagAttestedData)
+	authData = append(authData, make([]byte, 16)...)
+	authData = append(authData, byte(len(a.credentialId)>>8), byte(len(a.credentialId)))
+	authData = append(authData, a.credentialId...)
+
+	return &models.WebauthnRegistration{
+		ID:                 b64.EncodeToString(a.credentialId),
+		ClientDataJSON:     b64.EncodeToString(a.clientData(t, "webauthn.create", options.Challenge)),
+		AuthenticatorData:  b64.EncodeToString(authData),
+		PublicKey:          b64.EncodeToString(publicKey),
+		PublicKeyAlgorithm: models.CoseAlgES256,
+		Name:               "Test Key",
+	}
+}
+
+func (a *softAuthenticator) assert(t *testing.T, options *models.WebauthnOptions, userId string) *models.WebauthnAssertion {
+	a.signCount++
+	authData := a.authenticatorData(flagUserPresent | flagUserVerified)
+	clientData := a.clientData(t, "webauthn.get", options.Challenge)
+
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(authData, clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &models.WebauthnAssertion{
+		ID:                b64.EncodeToString(a.credentialId),
+		ClientDataJSON:    b64.EncodeToString(clientData),
+		AuthenticatorData: b64.EncodeToString(authData),
+		Signature:         b64.EncodeToString(signature),
+		UserHandle:        b64.EncodeToString([]byte(userId)),
+	}
+}
+
+func setupWebauthnService(t *testing.T) (*WebauthnService, *models.User) {
+	setupTestConfig()
+	db := setupTestDb(t, &models.User{}, &models.WebauthnCredential{}, &models.WebauthnSession{})
+
+	user := &models.User{ID: "alice", Email: "alice@example.org"}
+	if err := db.Create(user).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	userService := newUserServiceStub(user)
+	return NewWebauthnService(userService, repositories.NewWebauthnCredentialRepository(db), repositories.NewWebauthnSessionRepository(db)), user
+}
+
+func registerSoftAuthenticator(t *testing.T, srv *WebauthnService, user *models.User) *softAuthenticator {
+	authenticator := newSoftAuthenticator(t)
+	options, session, err := srv.BeginRegistration(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.FinishRegistration(user, session.ID, authenticator.register(t, options)); err != nil {
+		t.Fatalf("registration failed: %v", err)
+	}
+	return authenticator
+}
+
+func TestWebauthnService_Registration(t *testing.T) {
+	srv, user := setupWebauthnService(t)
+	authenticator := registerSoftAuthenticator(t, srv, user)
+
+	credentials, err := srv.GetByUser(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(credentials) != 1 || credentials[0].ID != b64.EncodeToString(authenticator.credentialId) {
+		t.Fatalf("expected the registered credential to be stored, got %v", credentials)
+	}
+	if !srv.HasCredentials(user) {
+		t.Error("expected user to have credentials")
+	}
+}
+
+func TestWebauthnService_RegistrationRejectsInvalidResponses(t *testing.T) {
+	srv, user := setupWebauthnService(t)
+
+	tests := []struct {
+		name   string
+		tamper func(*softAuthenticator, *models.WebauthnOptions)
+	}{
+		{"bad origin", func(a *softAuthenticator, _ *models.WebauthnOptions) { a.origin = "https://evil.example.org" }},
+		{"bad relying party", func(a *softAuthenticator, _ *models.WebauthnOptions) { a.rpId = "evil.example.org" }},
+		{"bad challenge", func(_ *softAuthenticator, o *models.WebauthnOptions) {
+			o.Challenge = b64.EncodeToString([]byte("guessed"))
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authenticator := newSoftAuthenticator(t)
+			options, session, err := srv.BeginRegistration(user)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.tamper(authenticator, options)
+			if _, err := srv.FinishRegistration(user, session.ID, authenticator.register(t, options)); err == nil {
+				t.Error("expected registration to fail")
+			}
+		})
+	}
+
+	if srv.HasCredentials(user) {
+		t.Error("expected no credentials to be stored")
+	}
+}
+
+func TestWebauthnService_Login(t *testing.T) {
+	srv, user := setupWebauthnService(t)
+	authenticator := registerSoftAuthenticator(t, srv, user)
+
+	for i := 0; i < 2; i++ {
+		options, session, err := srv.BeginLogin(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		loggedIn, err := srv.FinishLogin(session.ID, authenticator.assert(t, options, user.ID))
+		if err != nil {
+			t.Fatalf("login failed: %v", err)
+		}
+		if loggedIn.ID != user.ID {
+			t.Errorf("expected user '%s', got '%s'", user.ID, loggedIn.ID)
+		}
+	}
+}
+
+func TestWebauthnService_LoginRejectsInvalidAssertions(t *testing.T) {
+	srv, user := setupWebauthnService(t)
+	authenticator := registerSoftAuthenticator(t, srv, user)
+
+	// log in once, so that the stored signature counter is non-zero
+	options, session, err := srv.BeginLogin(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.FinishLogin(session.ID, authenticator.assert(t, options, user.ID)); err != nil {
+		t.Fatalf("login failed: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		tamper func(*softAuthenticator, *models.WebauthnOptions)
+	}{
+		{"bad origin", func(a *softAuthenticator, _ *models.WebauthnOptions) { a.origin = "https://evil.example.org" }},
+		{"bad challenge", func(_ *softAuthenticator, o *models.WebauthnOptions) {
+			o.Challenge = b64.EncodeToString([]byte("guessed"))
+		}},
+		{"sign count regression", func(a *softAuthenticator, _ *models.WebauthnOptions) { a.signCount = 0 }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options, session, err := srv.BeginLogin(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tampered := *options
+			tt.tamper(authenticator, &tampered)
+			if _, err := srv.FinishLogin(session.ID, authenticator.assert(t, &tampered, user.ID)); err == nil {
+				t.Error("expected login to fail")
+			}
+			authenticator.origin = testPublicUrl
+		})
+	}
+
+	t.Run("bad signature", func(t *testing.T) {
+		options, session, err := srv.BeginLogin(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertion := authenticator.assert(t, options, user.ID)
+		assertion.Signature = authenticator.assert(t, options, user.ID).Signature
+		if _, err := srv.FinishLogin(session.ID, assertion); err == nil {
+			t.Error("expected login to fail")
+		}
+	})
+}
+
+func TestWebauthnService_LoginRejectsReplay(t *testing.T) {
+	srv, user := setupWebauthnService(t)
+	authenticator := registerSoftAuthenticator(t, srv, user)
+
+	options, session, err := srv.BeginLogin(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertion := authenticator.assert(t, options, user.ID)
+	if _, err := srv.FinishLogin(session.ID, assertion); err != nil {
+		t.Fatalf("login failed: %v", err)
+	}
+
+	// the very same response must neither be accepted for the completed ceremony, nor for a new one
+	if _, err := srv.GetSession(session.ID); err == nil {
+		t.Error("expected session to be gone after login")
+	}
+	if _, err := srv.FinishLogin(session.ID, assertion); err == nil {
+		t.Error("expected replayed assertion to be rejected")
+	}
+	_, nextSession, err := srv.BeginLogin(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.FinishLogin(nextSession.ID, assertion); err == nil {
+		t.Error("expected replayed assertion to be rejected for a new challenge")
+	}
+}
+
+func TestWebauthnService_SharesCeremoniesAcrossInstances(t *testing.T) {
+	srv, user := setupWebauthnService(t)
+	authenticator := registerSoftAuthenticator(t, srv, user)
+
+	// another instance behind the same load balancer, which only shares the database with the first one
+	other := NewWebauthnService(srv.userService, srv.repository, srv.sessions)
+
+	options, session, err := srv.BeginLogin(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.GetSession(session.ID); err != nil {
+		t.Fatalf("expected ceremony to be known to the other instance, got %v", err)
+	}
+	assertion := authenticator.assert(t, options, user.ID)
+	if _, err := other.FinishLogin(session.ID, assertion); err != nil {
+		t.Fatalf("login failed: %v", err)
+	}
+	if _, err := srv.FinishLogin(session.ID, assertion); err == nil {
+		t.Error("expected ceremony finished on the other instance to be gone")
+	}
+}
+
+func TestWebauthnService_ExpiredCeremoniesAreRejected(t *testing.T) {
+	srv, user := setupWebauthnService(t)
+	authenticator := registerSoftAuthenticator(t, srv, user)
+
+	options, _, err := srv.BeginLogin(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired := &models.WebauthnSession{
+		ID:        "expired",
+		Challenge: options.Challenge,
+		Purpose:   models.WebauthnPurposeLogin,
+		ExpiresAt: models.CustomTime(time.Now().Add(-time.Second)),
+	}
+	if _, err := srv.sessions.Insert(expired); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := srv.GetSession(expired.ID); err == nil {
+		t.Error("expected expired ceremony to be rejected")
+	}
+	if _, err := srv.FinishLogin(expired.ID, authenticator.assert(t, options, user.ID)); err == nil {
+		t.Error("expected expired ceremony to be rejected")
+	}
+
+	// abandoned ceremonies are cleaned up, ongoing ones are kept
+	expired.ID = "abandoned"
+	if _, err := srv.sessions.Insert(expired); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := srv.sessions.DeleteByExpiresBefore(time.Now()); err != nil || n != 1 {
+		t.Errorf("expected 1 session to be cleaned up, got %d (%v)", n, err)
+	}
+}
+
+func TestWebauthnService_FailedAttemptEndsCeremony(t *testing.T) {
+	srv, user := setupWebauthnService(t)
+	authenticator := registerSoftAuthenticator(t, srv, user)
+
+	options, session, err := srv.BeginLogin(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticator.origin = "https://evil.example.org"
+	if _, err := srv.FinishLogin(session.ID, authenticator.assert(t, options, user.ID)); err == nil {
+		t.Fatal("expected login to fail")
+	}
+
+	authenticator.origin = testPublicUrl
+	if _, err := srv.FinishLogin(session.ID, authenticator.assert(t, options, user.ID)); err == nil {
+		t.Error("expected challenge to be usable only once")
+	}
+}
+
+func TestWebauthnService_SecondFactorRequiresOwnCredential(t *testing.T) {
+	srv, user := setupWebauthnService(t)
+	authenticator := registerSoftAuthenticator(t, srv, user)
+
+	other := &models.User{ID: "bob"}
+	srv.userService.(*userServiceStub).users[other.ID] = other
+
+	// users without passkeys can't even start a second factor ceremony
+	if _, _, err := srv.BeginLogin(other); err == nil {
+		t.Error("expected second factor ceremony to fail without credentials")
+	}
+
+	options, session, err := srv.BeginLogin(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.Purpose != models.WebauthnPurposeSecondFactor || session.UserID != user.ID {
+		t.Fatalf("unexpected session %+v", session)
+	}
+	if _, err := srv.FinishLogin(session.ID, authenticator.assert(t, options, user.ID)); err != nil {
+		t.Errorf("second factor failed: %v", err)
+	}
+}
@@ -5,4 +5,35 @@ function findParentAttribute(el, attrName) {
     if (el.attributes[attrName]) return el.attributes[attrName]
     if (!el.parentNode || !el.parentNode.attributes) return null
     return findParentAttribute(el.parentNode, attrName)
-}
\ No newline at end of file
+}
+
+function bufferToBase64Url(buffer) {
+    const bytes = new Uint8Array(buffer)
+    let str = ''
+    bytes.forEach(b => str += String.fromCharCode(b))
+    return btoa(str).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '')
+}
+
+function base64UrlToBuffer(value) {
+    const str = atob(value.replace(/-/g, '+').replace(/_/g, '/'))
+    return Uint8Array.from(str, c => c.charCodeAt(0)).buffer
+}
+
+function isWebauthnSupported() {
+    return !!(window.PublicKeyCredential && navigator.credentials)
+}
+
+async function postJson(url, body) {
+    const res = await fetch(url, {
+        method: 'POST',
+        headers: {
+            'Content-Type': 'application/json',
+            'X-CSRF-Token': document.querySelector('meta[name="csrf-token"]').content,
+        },
+        credentials: 'same-origin',
+        body: body ? JSON.stringify(body) : undefined,
+    })
+    const data = await res.json().catch(() => ({}))
+    if (!res.ok) throw new Error(data.error || `request failed with status ${res.status}`)
+    return data
+}
@@ -2,6 +2,7 @@ PetiteVue.createApp({
     $delimiters: ['${', '}'],
     state: {
         showDropdownUser: false,
+        showDropdownOrg: false,
     },
     mounted() {
         window.addEventListener('click', (e) => {
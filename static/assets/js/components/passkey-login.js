@@ -0,0 +1,34 @@
+PetiteVue.createApp({
+    $delimiters: ['${', '}'],
+    supported: isWebauthnSupported(),
+    loading: false,
+    error: '',
+    async login(mode) {
+        this.error = ''
+        this.loading = true
+        try {
+            const options = await postJson(`webauthn/login/begin${mode ? '?mode=' + mode : ''}`)
+            const credential = await navigator.credentials.get({
+                publicKey: {
+                    challenge: base64UrlToBuffer(options.challenge),
+                    timeout: options.timeout,
+                    rpId: options.rpId,
+                    userVerification: options.userVerification,
+                    allowCredentials: (options.allowCredentials || []).map(c => ({ type: c.type, id: base64UrlToBuffer(c.id) })),
+                }
+            })
+            const result = await postJson('webauthn/login/finish', {
+                id: credential.id,
+                client_data_json: bufferToBase64Url(credential.response.clientDataJSON),
+                authenticator_data: bufferToBase64Url(credential.response.authenticatorData),
+                signature: bufferToBase64Url(credential.response.signature),
+                user_handle: credential.response.userHandle ? bufferToBase64Url(credential.response.userHandle) : '',
+            })
+            window.location.href = result.redirect
+        } catch (e) {
+            this.error = e.message
+        } finally {
+            this.loading = false
+        }
+    }
+}).mount('#passkey-login')
@@ -0,0 +1,43 @@
+PetiteVue.createApp({
+    $delimiters: ['${', '}'],
+    supported: isWebauthnSupported(),
+    loading: false,
+    name: '',
+    error: '',
+    async register() {
+        this.error = ''
+        this.loading = true
+        try {
+            const options = await postJson('webauthn/register/begin')
+            const credential = await navigator.credentials.create({
+                publicKey: {
+                    challenge: base64UrlToBuffer(options.challenge),
+                    timeout: options.timeout,
+                    rp: options.rp,
+                    user: {
+                        id: base64UrlToBuffer(options.user.id),
+                        name: options.user.name,
+                        displayName: options.user.displayName,
+                    },
+                    pubKeyCredParams: options.pubKeyCredParams,
+                    excludeCredentials: (options.excludeCredentials || []).map(c => ({ type: c.type, id: base64UrlToBuffer(c.id) })),
+                    authenticatorSelection: options.authenticatorSelection,
+                    attestation: options.attestation,
+                }
+            })
+            await postJson('webauthn/register/finish', {
+                id: credential.id,
+                client_data_json: bufferToBase64Url(credential.response.clientDataJSON),
+                authenticator_data: bufferToBase64Url(credential.response.getAuthenticatorData()),
+                public_key: bufferToBase64Url(credential.response.getPublicKey()),
+                public_key_algorithm: credential.response.getPublicKeyAlgorithm(),
+                name: this.name,
+            })
+            window.location.href = `dashboard?success=${encodeURIComponent('passkey added successfully')}`
+        } catch (e) {
+            this.error = e.message
+        } finally {
+            this.loading = false
+        }
+    }
+}).mount('#passkeys')
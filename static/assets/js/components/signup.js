@@ -3,7 +3,7 @@ let debounceTimeout
 PetiteVue.createApp({
     timezone: guessTimezone(),
     username: '',
-    email: '',
+    email: inviteEmail,
     avatarUrl: defaultAvatarUrl,
     updateAvatar() {
         if (!avatarUrlTemplate) return
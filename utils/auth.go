@@ -20,17 +20,17 @@ func ExtractBearerAuth(r *http.Request) (key string, err error) {
 	return string(keyBytes), err
 }
 
-func ExtractCookieAuth(r *http.Request, config *config.Config) (username *string, err error) {
+func ExtractCookieAuth(r *http.Request, config *config.Config) (sessionId *string, err error) {
 	cookie, err := r.Cookie(models.AuthCookieKey)
 	if err != nil {
 		return nil, errors.New("missing authentication")
 	}
 
-	if err := config.Security.SecureCookie.Decode(models.AuthCookieKey, cookie.Value, &username); err != nil {
+	if err := config.Security.SecureCookie.Decode(models.AuthCookieKey, cookie.Value, &sessionId); err != nil {
 		return nil, errors.New("cookie is invalid")
 	}
 
-	return username, nil
+	return sessionId, nil
 }
 
 func CompareBcrypt(wanted, actual, pepper string) bool {
@@ -0,0 +1,71 @@
+package utils
+
+import (
+	"encoding/json"
+	"github.com/emvi/logbuch"
+	"net/http"
+	"strings"
+)
+
+func RespondJSON(w http.ResponseWriter, status int, object interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(object); err != nil {
+		logbuch.Error("error while writing json response: %v", err)
+	}
+}
+
+type userAgentPattern struct {
+	token string
+	name  string
+}
+
+// order matters, as many user agents claim to be others as well, e.g. edge and opera both include chrome and safari
+var (
+	uaBrowsers = []userAgentPattern{
+		{"Edg/", "Edge"},
+		{"OPR/", "Opera"},
+		{"SamsungBrowser/", "Samsung Internet"},
+		{"Firefox/", "Firefox"},
+		{"FxiOS/", "Firefox"},
+		{"CriOS/", "Chrome"},
+		{"Chrome/", "Chrome"},
+		{"Safari/", "Safari"},
+		{"curl/", "curl"},
+		{"Wget/", "Wget"},
+	}
+	uaSystems = []userAgentPattern{
+		{"Android", "Android"},
+		{"iPhone", "iOS"},
+		{"iPad", "iPadOS"},
+		{"CrOS", "ChromeOS"},
+		{"Windows", "Windows"},
+		{"Mac OS X", "macOS"},
+		{"Macintosh", "macOS"},
+		{"Linux", "Linux"},
+	}
+)
+
+// DescribeUserAgent roughly describes the client behind a user agent string, e.g. "Firefox on Linux", or returns "unknown client"
+func DescribeUserAgent(userAgent string) string {
+	browser, system := matchUserAgent(userAgent, uaBrowsers), matchUserAgent(userAgent, uaSystems)
+	if browser != "" && system != "" {
+		return browser + " on " + system
+	}
+	if browser != "" {
+		return browser
+	}
+	if system != "" {
+		return "Unknown browser on " + system
+	}
+	return "unknown client"
+}
+
+func matchUserAgent(userAgent string, patterns []userAgentPattern) string {
+	for _, p := range patterns {
+		if strings.Contains(userAgent, p.token) {
+			return p.name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,158 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// see https://www.haproxy.org/download/2.6/doc/proxy-protocol.txt
+var (
+	proxyProtocolV1Prefix    = []byte("PROXY ")
+	proxyProtocolV2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+)
+
+const proxyProtocolV1MaxLength = 107
+
+var errProxyProtocolHeader = errors.New("missing or invalid proxy protocol header")
+
+type proxyProtocolListener struct {
+	net.Listener
+	isTrusted func(net.Addr) bool
+	timeout   time.Duration
+}
+
+// NewProxyProtocolListener wraps a listener to take the client address from proxy protocol (v1 or v2) headers, which connections from trusted peers are required to start with
+func NewProxyProtocolListener(listener net.Listener, isTrusted func(net.Addr) bool, timeout time.Duration) net.Listener {
+	return &proxyProtocolListener{
+		Listener:  listener,
+		isTrusted: isTrusted,
+		timeout:   timeout,
+	}
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	// headers sent by anyone else are not interpreted, which makes the request fail to parse
+	if !l.isTrusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	return &proxyProtocolConn{
+		Conn:    conn,
+		reader:  bufio.NewReader(conn),
+		timeout: l.timeout,
+	}, nil
+}
+
+// proxyProtocolConn reads the header on first use instead of in Accept(), so slow peers can't block the accept loop
+type proxyProtocolConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	timeout    time.Duration
+	once       sync.Once
+	remoteAddr net.Addr
+	err        error
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtocolConn) readHeader() {
+	c.once.Do(func() {
+		if c.timeout > 0 {
+			c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+			defer c.Conn.SetReadDeadline(time.Time{})
+		}
+
+		if prefix, err := c.reader.Peek(len(proxyProtocolV1Prefix)); err == nil && bytes.Equal(prefix, proxyProtocolV1Prefix) {
+			c.remoteAddr, c.err = readProxyProtocolV1(c.reader)
+		} else if signature, err := c.reader.Peek(len(proxyProtocolV2Signature)); err == nil && bytes.Equal(signature, proxyProtocolV2Signature) {
+			c.remoteAddr, c.err = readProxyProtocolV2(c.reader)
+		} else {
+			c.err = errProxyProtocolHeader
+		}
+	})
+}
+
+// readProxyProtocolV1 parses a human-readable header like "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", returning a nil address for "PROXY UNKNOWN" (e.g. health checks)
+func readProxyProtocolV1(reader *bufio.Reader) (net.Addr, error) {
+	line, err := reader.ReadSlice('\n')
+	if err != nil || len(line) > proxyProtocolV1MaxLength || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errProxyProtocolHeader
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errProxyProtocolHeader
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, errProxyProtocolHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyProtocolV2 parses a binary header, returning a nil address for local connections (e.g. health checks) or address families other than tcp
+func readProxyProtocolV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, errProxyProtocolHeader
+	}
+
+	version, command, family := header[12]>>4, header[12]&0x0F, header[13]
+	if version != 2 || command > 1 {
+		return nil, errProxyProtocolHeader
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, errProxyProtocolHeader
+	}
+
+	if command == 0 {
+		return nil, nil
+	}
+
+	switch family {
+	case 0x11: // tcp over ipv4
+		if len(payload) < 12 {
+			return nil, errProxyProtocolHeader
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x21: // tcp over ipv6
+		if len(payload) < 36 {
+			return nil, errProxyProtocolHeader
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	default:
+		return nil, nil
+	}
+}